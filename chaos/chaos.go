@@ -0,0 +1,51 @@
+// Package chaos injects faults for resilience testing. Nothing happens
+// unless CHAOS_ENABLED is true; each fault then fires at the rate (0 to 1)
+// set in its CHAOS_*_RATE variable.
+package chaos
+
+import (
+	"errors"
+	"log"
+	"math/rand"
+	"time"
+
+	"github.com/thejsj/veenco/config"
+)
+
+var ErrInjected = errors.New("chaos: injected database error")
+
+func enabled() bool {
+	return config.Bool("CHAOS_ENABLED", false)
+}
+
+func fire(rateVariable string) bool {
+	return enabled() && rand.Float64() < config.Float(rateVariable, 0)
+}
+
+// S3Latency sleeps for CHAOS_S3_LATENCY (default 2s) at CHAOS_S3_LATENCY_RATE
+func S3Latency() {
+	if fire("CHAOS_S3_LATENCY_RATE") {
+		latency := config.Duration("CHAOS_S3_LATENCY", 2*time.Second)
+		log.Printf("chaos: delaying S3 request by %s", latency)
+		time.Sleep(latency)
+	}
+}
+
+// DBError returns ErrInjected at CHAOS_DB_ERROR_RATE
+func DBError() error {
+	if fire("CHAOS_DB_ERROR_RATE") {
+		log.Printf("chaos: failing database query")
+		return ErrInjected
+	}
+	return nil
+}
+
+// Redeliver reports whether a queue message should be requeued instead of
+// processed, at CHAOS_REDELIVERY_RATE
+func Redeliver() bool {
+	if fire("CHAOS_REDELIVERY_RATE") {
+		log.Printf("chaos: requeueing message")
+		return true
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/thejsj/veenco/config"
+	"github.com/thejsj/veenco/replay"
+	"github.com/thejsj/veenco/server"
+	"github.com/thejsj/veenco/worker"
+)
+
+const usage = `usage: enco <command>
+
+Commands:
+  serve       run the HTTP API
+  work        consume and run conversion jobs
+  all-in-one  run the HTTP API and a worker in one process
+  schedule    run the periodic sweeps; set SERVE_SCHEDULE=false on serve
+  check       validate configuration and connectivity without writing anything
+  replay      replay <log> <base url>: re-send captured requests to another deployment
+`
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	log.Printf("Loading ENV Variables...")
+	err := config.Load()
+	if err != nil {
+		log.Fatal("Error loading .env file")
+	}
+	config.ReloadOnHangup()
+
+	switch os.Args[1] {
+	case "serve":
+		server.Serve()
+	case "work":
+		worker.Work()
+	case "all-in-one":
+		go worker.Work()
+		server.Serve()
+	case "schedule":
+		server.Schedule()
+	case "check":
+		if !server.RunCheck() {
+			os.Exit(1)
+		}
+	case "replay":
+		if len(os.Args) != 4 {
+			fmt.Fprint(os.Stderr, usage)
+			os.Exit(2)
+		}
+		header := http.Header{}
+		if apiKey := os.Getenv("REPLAY_API_KEY"); apiKey != "" {
+			header.Set("X-Api-Key", apiKey)
+		}
+		err = replay.Run(os.Args[2], os.Args[3], header)
+		if err != nil {
+			log.Fatal(err)
+		}
+	default:
+		fmt.Fprintf(os.Stderr, "enco: unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,161 @@
+package config
+
+import (
+	"log"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/joho/godotenv"
+)
+
+var version int64 = 1
+
+var (
+	dotenvMutex sync.Mutex
+	// Variables whose value came from .env, so a reload can drop them once
+	// they are removed from it
+	dotenvKeys = map[string]bool{}
+	// Values from the environment that a reload overrode, put back when
+	// .env stops setting them
+	overridden = map[string]string{}
+)
+
+// Load reads .env into the environment. Variables that are already set in
+// the environment take precedence.
+func Load() error {
+	values, err := godotenv.Read()
+	if err != nil {
+		return err
+	}
+	dotenvMutex.Lock()
+	defer dotenvMutex.Unlock()
+	for key, value := range values {
+		if _, set := os.LookupEnv(key); set {
+			continue
+		}
+		os.Setenv(key, value)
+		dotenvKeys[key] = true
+	}
+	return nil
+}
+
+// Version starts at 1 and goes up every time the configuration is reloaded
+func Version() int64 {
+	return atomic.LoadInt64(&version)
+}
+
+// Reload re-reads .env, this time overriding the environment. Variables
+// removed from .env since it was last read go back to their value from the
+// environment, or are unset. Settings read per request (admin token,
+// limits, signing keys...) take effect right away; connection settings only
+// apply after a restart.
+func Reload() error {
+	values, err := godotenv.Read()
+	if err != nil {
+		return err
+	}
+	dotenvMutex.Lock()
+	defer dotenvMutex.Unlock()
+	for key := range dotenvKeys {
+		if _, ok := values[key]; ok {
+			continue
+		}
+		if value, ok := overridden[key]; ok {
+			os.Setenv(key, value)
+			delete(overridden, key)
+		} else {
+			os.Unsetenv(key)
+		}
+		delete(dotenvKeys, key)
+	}
+	for key, value := range values {
+		if !dotenvKeys[key] {
+			if previous, set := os.LookupEnv(key); set {
+				overridden[key] = previous
+			}
+			dotenvKeys[key] = true
+		}
+		os.Setenv(key, value)
+	}
+	atomic.AddInt64(&version, 1)
+	return nil
+}
+
+// ReloadOnHangup calls Reload every time the process receives SIGHUP
+func ReloadOnHangup() {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go func() {
+		for range hangup {
+			err := Reload()
+			if err != nil {
+				log.Printf("Error reloading configuration: %s", err)
+				continue
+			}
+			log.Printf("Reloaded configuration, now at version %v", Version())
+		}
+	}()
+}
+
+// String returns the variable or fallback when it isn't set
+func String(name string, fallback string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// Int returns the variable or fallback when it isn't set or isn't a number
+func Int(name string, fallback int) int {
+	value, err := strconv.Atoi(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// Float returns the variable or fallback when it isn't set or isn't a number
+func Float(name string, fallback float64) float64 {
+	value, err := strconv.ParseFloat(os.Getenv(name), 64)
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// Duration parses values like 500ms or 2m, returning fallback when the
+// variable isn't set or can't be parsed
+func Duration(name string, fallback time.Duration) time.Duration {
+	value, err := time.ParseDuration(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// Bool accepts true/false (and the other forms strconv.ParseBool does)
+func Bool(name string, fallback bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(name))
+	if err != nil {
+		return fallback
+	}
+	return value
+}
+
+// List splits a comma separated variable, dropping empty items
+func List(name string) []string {
+	var list []string
+	for _, item := range strings.Split(os.Getenv(name), ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
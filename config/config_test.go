@@ -0,0 +1,66 @@
+package config
+
+import (
+	"os"
+	"testing"
+)
+
+func TestReloadDropsRemovedVariables(t *testing.T) {
+	dir := t.TempDir()
+	previousDir, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(previousDir)
+
+	t.Setenv("CONFIG_TEST_KEPT", "environment")
+	t.Setenv("CONFIG_TEST_OVERRIDDEN", "environment")
+	os.Unsetenv("CONFIG_TEST_REMOVED")
+	defer os.Unsetenv("CONFIG_TEST_REMOVED")
+
+	err = os.WriteFile(".env", []byte("CONFIG_TEST_KEPT=dotenv\nCONFIG_TEST_REMOVED=dotenv\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := os.Getenv("CONFIG_TEST_KEPT"); value != "environment" {
+		t.Errorf("Expected the environment to take precedence on load, got %q", value)
+	}
+
+	err = os.WriteFile(".env", []byte("CONFIG_TEST_OVERRIDDEN=dotenv\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, set := os.LookupEnv("CONFIG_TEST_REMOVED"); set {
+		t.Errorf("Expected a variable removed from .env to be unset")
+	}
+	if value := os.Getenv("CONFIG_TEST_OVERRIDDEN"); value != "dotenv" {
+		t.Errorf("Expected .env to override the environment on reload, got %q", value)
+	}
+
+	err = os.WriteFile(".env", []byte(""), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = Reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if value := os.Getenv("CONFIG_TEST_OVERRIDDEN"); value != "environment" {
+		t.Errorf("Expected the environment's value back once .env drops it, got %q", value)
+	}
+	if value := os.Getenv("CONFIG_TEST_KEPT"); value != "environment" {
+		t.Errorf("Expected a variable .env never set to be left alone, got %q", value)
+	}
+}
@@ -0,0 +1,87 @@
+package database
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/thejsj/veenco/config"
+)
+
+// ConnectOpts builds the gorethink connection options from the
+// environment. RETHINKDB_ADDRESSES takes a comma separated list of seed
+// hosts for clustered deployments and falls back to RETHINKDB_HOST and
+// RETHINKDB_PORT when it is not set.
+func ConnectOpts() (r.ConnectOpts, error) {
+	opts := r.ConnectOpts{
+		Database:      os.Getenv("DB_NAME"),
+		AuthKey:       os.Getenv("RETHINKDB_AUTH_KEY"),
+		Username:      os.Getenv("RETHINKDB_USERNAME"),
+		Password:      os.Getenv("RETHINKDB_PASSWORD"),
+		DiscoverHosts: config.Bool("RETHINKDB_DISCOVER_HOSTS", false),
+	}
+
+	addresses := config.List("RETHINKDB_ADDRESSES")
+	if len(addresses) > 0 {
+		opts.Addresses = addresses
+	} else {
+		opts.Address = os.Getenv("RETHINKDB_HOST") + ":" + os.Getenv("RETHINKDB_PORT")
+	}
+
+	tlsConfig, err := rethinkDBTLSConfig()
+	if err != nil {
+		return opts, err
+	}
+	opts.TLSConfig = tlsConfig
+	return opts, nil
+}
+
+// rethinkDBTLSConfig returns nil when TLS has not been enabled
+func rethinkDBTLSConfig() (*tls.Config, error) {
+	if !config.Bool("RETHINKDB_TLS", false) {
+		return nil, nil
+	}
+
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: config.Bool("RETHINKDB_TLS_SKIP_VERIFY", false),
+	}
+
+	caFile := os.Getenv("RETHINKDB_TLS_CA_FILE")
+	if caFile != "" {
+		caCert, err := ioutil.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading RethinkDB CA file: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCert) {
+			return nil, fmt.Errorf("No certificates found in RethinkDB CA file: %s", caFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	certFile := os.Getenv("RETHINKDB_TLS_CERT_FILE")
+	keyFile := os.Getenv("RETHINKDB_TLS_KEY_FILE")
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading RethinkDB client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// Connect opens a session using ConnectOpts
+func Connect() (*r.Session, error) {
+	connectOpts, err := ConnectOpts()
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("Connecting to RethinkDB (%s) ...", strings.Join(append(connectOpts.Addresses, connectOpts.Address), " "))
+	return r.Connect(connectOpts)
+}
@@ -0,0 +1,105 @@
+// Package errcode lists the error codes shared by the server and worker.
+// The server answers failed requests with one, failed jobs store one, and
+// clients should branch on the code rather than on messages or statuses.
+// Codes are part of the API: add new ones, but never rename or reuse one.
+package errcode
+
+import "errors"
+
+type Code string
+
+const (
+	// Anything not covered by a more specific code
+	Internal       Code = "INTERNAL"
+	InvalidRequest Code = "INVALID_REQUEST"
+	NotFound       Code = "NOT_FOUND"
+	Unauthorized   Code = "UNAUTHORIZED"
+	Forbidden      Code = "FORBIDDEN"
+	Conflict       Code = "CONFLICT"
+	ReadOnly       Code = "READ_ONLY"
+	// The bucket or database couldn't be reached or refused the request
+	StorageUnavailable Code = "STORAGE_UNAVAILABLE"
+	// The job queue didn't accept the task, retry after the Retry-After header
+	QueueUnavailable Code = "QUEUE_UNAVAILABLE"
+	// An external image's source URL couldn't be fetched
+	SourceUnavailable Code = "SOURCE_UNAVAILABLE"
+	// The content doesn't decode as what it claims to be
+	InvalidImage      Code = "INVALID_IMAGE"
+	UnsupportedFormat Code = "UNSUPPORTED_FORMAT"
+	PayloadTooLarge   Code = "PAYLOAD_TOO_LARGE"
+	QuotaExceeded     Code = "QUOTA_EXCEEDED"
+	// Too many requests in a short time; retry after the Retry-After header
+	RateLimited Code = "RATE_LIMITED"
+	// A transformation request is over the pipeline limits
+	PipelineTooLarge Code = "PIPELINE_TOO_LARGE"
+	// The client sent the upload too slowly
+	UploadTimeout Code = "UPLOAD_TIMEOUT"
+	// The job wasn't run before it expired
+	JobTimeout Code = "JOB_TIMEOUT"
+	// This build of the service leaves out what the request needs
+	NotImplemented Code = "NOT_IMPLEMENTED"
+)
+
+// All lists every code, for clients that want to enumerate them
+var All = []Code{
+	Internal,
+	InvalidRequest,
+	NotFound,
+	Unauthorized,
+	Forbidden,
+	Conflict,
+	ReadOnly,
+	StorageUnavailable,
+	QueueUnavailable,
+	SourceUnavailable,
+	InvalidImage,
+	UnsupportedFormat,
+	PayloadTooLarge,
+	QuotaExceeded,
+	RateLimited,
+	PipelineTooLarge,
+	UploadTimeout,
+	JobTimeout,
+	NotImplemented,
+}
+
+// Retryable reports whether work that failed with the code may succeed when
+// tried again unchanged. Bad input fails the same way every time.
+func Retryable(code Code) bool {
+	switch code {
+	case InvalidRequest, NotFound, InvalidImage, UnsupportedFormat, PayloadTooLarge, PipelineTooLarge, JobTimeout:
+		return false
+	}
+	return true
+}
+
+// Error attaches a code to an error
+type Error struct {
+	Code Code
+	Err  error
+}
+
+func (err *Error) Error() string {
+	return err.Err.Error()
+}
+
+func (err *Error) Unwrap() error {
+	return err.Err
+}
+
+// Wrap returns nil for a nil err so it can wrap return values directly
+func Wrap(code Code, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Code: code, Err: err}
+}
+
+// Of returns the code attached to err, or Internal when there is none
+func Of(err error) Code {
+	var coded *Error
+	if errors.As(err, &coded) {
+		return coded.Code
+	}
+	return Internal
+}
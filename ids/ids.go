@@ -0,0 +1,134 @@
+// Package ids generates the ids of images, jobs and other records. The
+// format is picked with ID_FORMAT: uuidv7 (the default) and ulid both start
+// with the creation time, so ids sort in the order records were created and
+// new rows land next to each other in the primary index. uuidv4 gives the
+// fully random ids used before. More formats can be added with Register.
+package ids
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/thejsj/veenco/config"
+)
+
+const (
+	FormatUUIDv7 = "uuidv7"
+	FormatULID   = "ulid"
+	FormatUUIDv4 = "uuidv4"
+)
+
+// Generator returns a new unique id
+type Generator func() string
+
+var (
+	generatorsMutex sync.RWMutex
+	generators      = map[string]Generator{
+		FormatUUIDv7: NewUUIDv7,
+		FormatULID:   NewULID,
+		FormatUUIDv4: NewUUIDv4,
+	}
+)
+
+// Register adds a format that ID_FORMAT can select
+func Register(format string, generator Generator) {
+	generatorsMutex.Lock()
+	defer generatorsMutex.Unlock()
+	generators[format] = generator
+}
+
+// New returns an id in the configured format
+func New() string {
+	format := config.String("ID_FORMAT", FormatUUIDv7)
+	generatorsMutex.RLock()
+	generator, ok := generators[format]
+	generatorsMutex.RUnlock()
+	if !ok {
+		log.Printf("Unknown ID_FORMAT %s, using %s", format, FormatUUIDv7)
+		generator = NewUUIDv7
+	}
+	return generator()
+}
+
+var (
+	uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	ulidPattern = regexp.MustCompile(`^[0-7][0-9A-HJKMNP-TV-Za-hjkmnp-tv-z]{25}$`)
+)
+
+// LooksLikeId reports whether s has the shape of an id in any of the
+// built-in formats, whichever one is configured now
+func LooksLikeId(s string) bool {
+	return uuidPattern.MatchString(s) || ulidPattern.MatchString(s)
+}
+
+func randomBytes(buffer []byte) {
+	_, err := rand.Read(buffer)
+	if err != nil {
+		panic("ids: reading random bytes failed: " + err.Error())
+	}
+}
+
+// putMillis writes the time in milliseconds as a 48 bit big endian number
+func putMillis(buffer []byte, now time.Time) {
+	millis := uint64(now.UnixMilli())
+	for i := 0; i < 6; i++ {
+		buffer[i] = byte(millis >> (8 * (5 - i)))
+	}
+}
+
+func formatUUID(buffer [16]byte) string {
+	encoded := hex.EncodeToString(buffer[:])
+	return encoded[0:8] + "-" + encoded[8:12] + "-" + encoded[12:16] + "-" + encoded[16:20] + "-" + encoded[20:32]
+}
+
+// NewUUIDv4 returns a random RFC 9562 version 4 UUID
+func NewUUIDv4() string {
+	var buffer [16]byte
+	randomBytes(buffer[:])
+	buffer[6] = buffer[6]&0x0f | 0x40
+	buffer[8] = buffer[8]&0x3f | 0x80
+	return formatUUID(buffer)
+}
+
+// NewUUIDv7 returns an RFC 9562 version 7 UUID: a millisecond timestamp
+// followed by random bits
+func NewUUIDv7() string {
+	var buffer [16]byte
+	randomBytes(buffer[6:])
+	putMillis(buffer[:6], time.Now())
+	buffer[6] = buffer[6]&0x0f | 0x70
+	buffer[8] = buffer[8]&0x3f | 0x80
+	return formatUUID(buffer)
+}
+
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// NewULID returns a ULID: a millisecond timestamp followed by 80 random
+// bits, as 26 Crockford base32 characters
+func NewULID() string {
+	var buffer [16]byte
+	randomBytes(buffer[6:])
+	putMillis(buffer[:6], time.Now())
+
+	// 128 bits in 26 characters of 5 bits, with the first holding only 3
+	encoded := make([]byte, 26)
+	var bits uint
+	var value uint32
+	index := 25
+	for i := 15; i >= 0; i-- {
+		value |= uint32(buffer[i]) << bits
+		bits += 8
+		for bits >= 5 {
+			encoded[index] = crockford[value&0x1f]
+			index--
+			value >>= 5
+			bits -= 5
+		}
+	}
+	encoded[0] = crockford[value&0x1f]
+	return string(encoded)
+}
@@ -0,0 +1,220 @@
+package queue
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+	"github.com/thejsj/veenco/config"
+)
+
+var (
+	// ErrBlocked is returned while the broker is flow controlling publishers,
+	// e.g. because it is low on memory or disk. Callers should retry later.
+	ErrBlocked = errors.New("The broker isn't accepting messages right now")
+	// ErrUnroutable is returned when no queue was bound to receive the task
+	ErrUnroutable = errors.New("No queue accepted the task")
+	// ErrNacked is returned when the broker couldn't store the task
+	ErrNacked = errors.New("The broker refused the task")
+	// ErrConfirmTimeout is returned when the broker didn't confirm the task
+	// in time. The task may still have been queued.
+	ErrConfirmTimeout = errors.New("The broker didn't confirm the task in time")
+)
+
+// Publisher sends tasks on a channel in confirm mode, so a task only counts
+// as published once the broker has taken responsibility for it. Tasks are
+// published as mandatory and come back when nothing can route them. The
+// immediate flag isn't used: RabbitMQ doesn't support it.
+type Publisher struct {
+	channel *amqp.Channel
+	// Held while publishing so delivery tags follow the order of publishes
+	publishMutex sync.Mutex
+	deliveryTag  uint64
+	// Tasks waiting for their confirmation, by delivery tag
+	pendingMutex sync.Mutex
+	pending      map[uint64]*pendingTask
+
+	blockedMutex sync.Mutex
+	blocked      bool
+	unblocked    chan struct{}
+}
+
+type pendingTask struct {
+	confirmed chan amqp.Confirmation
+	returned  bool
+}
+
+// NewPublisher puts the channel in confirm mode and starts tracking
+// confirmations and the connection's flow control
+func NewPublisher(conn *amqp.Connection, channel *amqp.Channel) (*Publisher, error) {
+	err := channel.Confirm(false)
+	if err != nil {
+		return nil, err
+	}
+	publisher := &Publisher{
+		channel:   channel,
+		pending:   map[uint64]*pendingTask{},
+		unblocked: make(chan struct{}),
+	}
+	// Unbuffered, so a return is always handled before the ack that
+	// follows it
+	go publisher.dispatch(channel.NotifyPublish(make(chan amqp.Confirmation)), channel.NotifyReturn(make(chan amqp.Return)))
+	go publisher.trackFlow(conn.NotifyBlocked(make(chan amqp.Blocking, 1)), channel.NotifyFlow(make(chan bool, 1)))
+	return publisher, nil
+}
+
+// dispatch hands confirmations and returns to the tasks waiting for them.
+// The broker's notifications have to be read even when nothing waits for
+// them anymore, or the connection stalls.
+func (publisher *Publisher) dispatch(confirms chan amqp.Confirmation, returns chan amqp.Return) {
+	for confirms != nil {
+		select {
+		case returning, ok := <-returns:
+			if !ok {
+				returns = nil
+				continue
+			}
+			deliveryTag, _ := strconv.ParseUint(returning.MessageId, 10, 64)
+			publisher.pendingMutex.Lock()
+			if task, ok := publisher.pending[deliveryTag]; ok {
+				task.returned = true
+			}
+			publisher.pendingMutex.Unlock()
+		case confirmation, ok := <-confirms:
+			if !ok {
+				confirms = nil
+				continue
+			}
+			publisher.pendingMutex.Lock()
+			if task, ok := publisher.pending[confirmation.DeliveryTag]; ok {
+				task.confirmed <- confirmation
+			}
+			publisher.pendingMutex.Unlock()
+		}
+	}
+	// The channel closed, fail every task still waiting
+	publisher.pendingMutex.Lock()
+	for _, task := range publisher.pending {
+		close(task.confirmed)
+	}
+	publisher.pending = map[uint64]*pendingTask{}
+	publisher.pendingMutex.Unlock()
+}
+
+// trackFlow follows connection.blocked notifications, which RabbitMQ sends
+// on resource alarms, and channel.flow ones, which older brokers send
+func (publisher *Publisher) trackFlow(blockings chan amqp.Blocking, flows chan bool) {
+	for blockings != nil || flows != nil {
+		select {
+		case blocking, ok := <-blockings:
+			if !ok {
+				blockings = nil
+				continue
+			}
+			publisher.setBlocked(blocking.Active)
+		case active, ok := <-flows:
+			if !ok {
+				flows = nil
+				continue
+			}
+			publisher.setBlocked(!active)
+		}
+	}
+}
+
+func (publisher *Publisher) setBlocked(blocked bool) {
+	publisher.blockedMutex.Lock()
+	defer publisher.blockedMutex.Unlock()
+	if blocked == publisher.blocked {
+		return
+	}
+	publisher.blocked = blocked
+	if blocked {
+		publisher.unblocked = make(chan struct{})
+	} else {
+		close(publisher.unblocked)
+	}
+}
+
+// Blocked reports whether the broker is currently flow controlling us
+func (publisher *Publisher) Blocked() bool {
+	publisher.blockedMutex.Lock()
+	defer publisher.blockedMutex.Unlock()
+	return publisher.blocked
+}
+
+// waitUntilUnblocked waits up to PUBLISH_BLOCKED_WAIT (5s by default) for
+// the broker to lift flow control
+func (publisher *Publisher) waitUntilUnblocked() error {
+	publisher.blockedMutex.Lock()
+	blocked, unblocked := publisher.blocked, publisher.unblocked
+	publisher.blockedMutex.Unlock()
+	if !blocked {
+		return nil
+	}
+	select {
+	case <-unblocked:
+		return nil
+	case <-time.After(config.Duration("PUBLISH_BLOCKED_WAIT", 5*time.Second)):
+		return ErrBlocked
+	}
+}
+
+// PublishTask sends a persistent job for imageId, whose source is in
+// format, to workers at or above minWorkerVersion, like the PublishTask
+// function, and waits up to PUBLISH_CONFIRM_TIMEOUT (10s by default) for the
+// broker to confirm it
+func (publisher *Publisher) PublishTask(imageId string, format string, body []byte, minWorkerVersion int) error {
+	err := publisher.waitUntilUnblocked()
+	if err != nil {
+		return err
+	}
+
+	task := &pendingTask{confirmed: make(chan amqp.Confirmation, 1)}
+	publisher.publishMutex.Lock()
+	deliveryTag := publisher.deliveryTag + 1
+	publisher.pendingMutex.Lock()
+	publisher.pending[deliveryTag] = task
+	publisher.pendingMutex.Unlock()
+	publishing := taskPublishing(body, minWorkerVersion)
+	publishing.MessageId = strconv.FormatUint(deliveryTag, 10)
+	exchange, routingKey := taskRoute(imageId, format)
+	err = publisher.channel.Publish(
+		exchange,   // exchange
+		routingKey, // routing key
+		true,       // mandatory
+		false,      // immediate
+		publishing)
+	if err == nil {
+		publisher.deliveryTag = deliveryTag
+	}
+	publisher.publishMutex.Unlock()
+	defer func() {
+		publisher.pendingMutex.Lock()
+		delete(publisher.pending, deliveryTag)
+		publisher.pendingMutex.Unlock()
+	}()
+	if err != nil {
+		return err
+	}
+
+	select {
+	case confirmation, ok := <-task.confirmed:
+		if !ok {
+			return amqp.ErrClosed
+		}
+		if !confirmation.Ack {
+			return ErrNacked
+		}
+		publisher.pendingMutex.Lock()
+		defer publisher.pendingMutex.Unlock()
+		if task.returned {
+			return ErrUnroutable
+		}
+		return nil
+	case <-time.After(config.Duration("PUBLISH_CONFIRM_TIMEOUT", 10*time.Second)):
+		return ErrConfirmTimeout
+	}
+}
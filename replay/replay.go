@@ -0,0 +1,110 @@
+// Package replay records API requests to a JSON lines log and re-executes
+// them against another deployment
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Headers that are never written to the log
+var sensitiveHeaders = []string{"Authorization", "Cookie", "X-Admin-Token", "X-Api-Key", "X-Forwarded-For"}
+
+type Record struct {
+	RecordedAt time.Time           `json:"recordedAt"`
+	Method     string              `json:"method"`
+	Path       string              `json:"path"`
+	Header     map[string][]string `json:"header"`
+	Body       string              `json:"body"`
+	Status     int                 `json:"status"`
+	Response   string              `json:"response"`
+}
+
+// SanitizeHeader copies header without credentials or client addresses
+func SanitizeHeader(header http.Header) map[string][]string {
+	sanitized := map[string][]string{}
+	for name, values := range header {
+		sanitized[name] = values
+	}
+	for _, name := range sensitiveHeaders {
+		delete(sanitized, name)
+	}
+	return sanitized
+}
+
+var appendMutex sync.Mutex
+
+// Append writes the record to the log file as a single line of JSON
+func Append(filename string, record Record) error {
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	appendMutex.Lock()
+	defer appendMutex.Unlock()
+	file, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = file.Write(append(line, '\n'))
+	return err
+}
+
+// Run re-sends every request in the log to baseUrl and prints the recorded
+// and new status side by side. Credentials were stripped when recording, so
+// headers like X-Api-Key can be supplied through extraHeader.
+func Run(filename string, baseUrl string, extraHeader http.Header) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 1<<20), 64<<20)
+	mismatches := 0
+	for scanner.Scan() {
+		var record Record
+		err = json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			return err
+		}
+		req, err := http.NewRequest(record.Method, strings.TrimSuffix(baseUrl, "/")+record.Path, bytes.NewBufferString(record.Body))
+		if err != nil {
+			return err
+		}
+		for name, values := range record.Header {
+			req.Header[name] = values
+		}
+		for name, values := range extraHeader {
+			req.Header[name] = values
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			fmt.Printf("%s %s: recorded %v, got error %s\n", record.Method, record.Path, record.Status, err)
+			mismatches++
+			continue
+		}
+		res.Body.Close()
+		if res.StatusCode != record.Status {
+			mismatches++
+		}
+		fmt.Printf("%s %s: recorded %v, got %v\n", record.Method, record.Path, record.Status, res.StatusCode)
+	}
+	if err = scanner.Err(); err != nil {
+		return err
+	}
+	if mismatches > 0 {
+		return fmt.Errorf("%v requests did not match their recorded status", mismatches)
+	}
+	return nil
+}
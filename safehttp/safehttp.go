@@ -0,0 +1,161 @@
+// Package safehttp fetches URLs that API callers hand us, such as the
+// sources of registered images and job callbacks. Those requests run inside
+// our network, so they must not be able to reach it: connections to
+// loopback, private, link-local and other internal addresses are refused
+// after DNS resolution, which also covers names and redirects that point at
+// internal hosts.
+package safehttp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/thejsj/veenco/config"
+)
+
+var (
+	// ErrInternalAddress is returned when a URL resolves to an address
+	// callers aren't allowed to reach
+	ErrInternalAddress = errors.New("Refusing to connect to an internal address")
+	// ErrTooLarge is returned when a response is over SAFE_HTTP_MAX_BYTES
+	ErrTooLarge = errors.New("Response is too large")
+)
+
+// Addresses that aren't covered by the net.IP predicates
+var internalNetworks = mustParseCIDRs(
+	"100.64.0.0/10", // carrier-grade NAT
+	"192.0.0.0/24",  // IETF protocol assignments
+	"198.18.0.0/15", // benchmarking
+	"64:ff9b::/96",  // NAT64, which can reach IPv4 internals
+)
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// internal reports whether ip is somewhere callers shouldn't reach
+func internal(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, network := range internalNetworks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// refuseInternal runs after the address is resolved and before connecting.
+// SAFE_HTTP_ALLOW_INTERNAL turns the check off for local development.
+func refuseInternal(network string, address string, _ syscall.RawConn) error {
+	if config.Bool("SAFE_HTTP_ALLOW_INTERNAL", false) {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || internal(ip) {
+		return fmt.Errorf("%w: %s", ErrInternalAddress, host)
+	}
+	return nil
+}
+
+var (
+	clientOnce sync.Once
+	client     *http.Client
+)
+
+// Client is shared by every request to a caller supplied URL. Requests time
+// out after SAFE_HTTP_TIMEOUT (30s by default), including reading the body.
+func Client() *http.Client {
+	clientOnce.Do(func() {
+		dialer := &net.Dialer{
+			Timeout: 10 * time.Second,
+			Control: refuseInternal,
+		}
+		client = &http.Client{
+			Timeout: config.Duration("SAFE_HTTP_TIMEOUT", 30*time.Second),
+			Transport: &http.Transport{
+				// Proxies would make the check apply to the proxy instead
+				Proxy:                 nil,
+				DialContext:           dialer.DialContext,
+				TLSHandshakeTimeout:   10 * time.Second,
+				ResponseHeaderTimeout: 15 * time.Second,
+				MaxIdleConns:          100,
+				IdleConnTimeout:       90 * time.Second,
+			},
+		}
+	})
+	return client
+}
+
+// maxBytes bounds a response body, from SAFE_HTTP_MAX_BYTES (512MB by
+// default, the same as uploads)
+func maxBytes() int64 {
+	return int64(config.Int("SAFE_HTTP_MAX_BYTES", 512<<20))
+}
+
+// Do sends the request with Client and caps the response body at
+// SAFE_HTTP_MAX_BYTES. Reading past the cap fails with ErrTooLarge.
+func Do(req *http.Request) (*http.Response, error) {
+	res, err := Client().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	limit := maxBytes()
+	if res.ContentLength > limit {
+		res.Body.Close()
+		return nil, ErrTooLarge
+	}
+	res.Body = &limitedBody{ReadCloser: res.Body, remaining: limit}
+	return res, nil
+}
+
+// Get is Do for a plain GET
+func Get(url string) (*http.Response, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	return Do(req)
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	remaining int64
+}
+
+func (body *limitedBody) Read(buffer []byte) (int, error) {
+	if body.remaining <= 0 {
+		// Only an error if there is more to read
+		n, err := body.ReadCloser.Read(make([]byte, 1))
+		if n > 0 {
+			return 0, ErrTooLarge
+		}
+		return 0, err
+	}
+	if int64(len(buffer)) > body.remaining {
+		buffer = buffer[:body.remaining]
+	}
+	n, err := body.ReadCloser.Read(buffer)
+	body.remaining -= int64(n)
+	return n, err
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"crypto/subtle"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/thejsj/veenco/config"
+	"github.com/thejsj/veenco/errcode"
+)
+
+// AdminOnly wraps a handler so it can only be called with the token set in
+// ADMIN_TOKEN. Admin routes are disabled entirely when no token is set.
+func AdminOnly(handle httprouter.Handle) httprouter.Handle {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		adminToken := os.Getenv("ADMIN_TOKEN")
+		if adminToken == "" {
+			WriteError(writer, http.StatusForbidden, errcode.Forbidden, "Admin API is disabled")
+			return
+		}
+		token := req.Header.Get("X-Admin-Token")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) != 1 {
+			WriteError(writer, http.StatusUnauthorized, errcode.Unauthorized, "Invalid admin token")
+			return
+		}
+		handle(writer, req, params)
+	}
+}
+
+// validAdminToken reports whether the request carries the admin token
+func validAdminToken(req *http.Request) bool {
+	adminToken := os.Getenv("ADMIN_TOKEN")
+	token := req.Header.Get("X-Admin-Token")
+	return adminToken != "" && subtle.ConstantTimeCompare([]byte(token), []byte(adminToken)) == 1
+}
+
+// ClientIp returns the address of the caller. X-Forwarded-For is only
+// believed when the connection comes from one of TRUSTED_PROXIES (addresses
+// or CIDR ranges), and then the right-most hop that isn't a trusted proxy is
+// the caller, as anything left of it could have been sent by the client.
+func ClientIp(req *http.Request) string {
+	remoteIp, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		remoteIp = req.RemoteAddr
+	}
+	trusted := trustedProxies()
+	if !trustedProxy(trusted, remoteIp) {
+		return remoteIp
+	}
+	var hops []string
+	for _, header := range req.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				hops = append(hops, hop)
+			}
+		}
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		if !trustedProxy(trusted, hops[i]) {
+			return hops[i]
+		}
+	}
+	if len(hops) > 0 {
+		return hops[0]
+	}
+	return remoteIp
+}
+
+// trustedProxies parses TRUSTED_PROXIES, where a plain address stands for
+// just itself
+func trustedProxies() []*net.IPNet {
+	var networks []*net.IPNet
+	for _, entry := range config.List("TRUSTED_PROXIES") {
+		if !strings.Contains(entry, "/") {
+			if ip := net.ParseIP(entry); ip != nil && ip.To4() != nil {
+				entry += "/32"
+			} else {
+				entry += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			log.Printf("Ignoring invalid TRUSTED_PROXIES entry `%s`", entry)
+			continue
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+func trustedProxy(networks []*net.IPNet, address string) bool {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,235 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/julienschmidt/httprouter"
+	"github.com/thejsj/veenco/config"
+	"github.com/thejsj/veenco/errcode"
+	"github.com/thejsj/veenco/ids"
+)
+
+// ApiKey is a client credential. Only the SHA-256 of the key is stored;
+// the key itself is returned once, when it is created.
+type ApiKey struct {
+	Id   string `gorethink:"id" json:"id"`
+	Name string `gorethink:"name" json:"name"`
+	// Images and jobs created with the key belong to this tenant. Keys
+	// created without one are a tenant of their own.
+	TenantId  string    `gorethink:"tenantId,omitempty" json:"tenantId,omitempty"`
+	KeyHash   string    `gorethink:"keyHash" json:"-"`
+	CreatedAt time.Time `gorethink:"createdAt" json:"createdAt"`
+	RevokedAt time.Time `gorethink:"revokedAt,omitempty" json:"revokedAt,omitempty"`
+	// Overrides DefaultPipelineLimits for requests made with this key
+	Limits *PipelineLimits `gorethink:"limits,omitempty" json:"limits,omitempty"`
+	// Overrides QUALITY_MIN and QUALITY_MAX for requests made with this key
+	Quality *QualityPolicy `gorethink:"quality,omitempty" json:"quality,omitempty"`
+}
+
+type apiKeyContextKey struct{}
+
+// hashApiKey is what keys are looked up by
+func hashApiKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// requestApiKey reads the key from the X-Api-Key header, falling back to the
+// `apiKey` query parameter
+func requestApiKey(req *http.Request) string {
+	key := req.Header.Get("X-Api-Key")
+	if key == "" {
+		key = req.URL.Query().Get("apiKey")
+	}
+	return key
+}
+
+// FindApiKey returns the unrevoked key matching the given secret
+func FindApiKey(session *r.Session, key string) (ApiKey, error) {
+	var apiKey ApiKey
+	cursor, err := r.Table("apiKeys").GetAllByIndex("keyHash", hashApiKey(key)).Run(session)
+	if err != nil {
+		return apiKey, err
+	}
+	defer cursor.Close()
+	err = cursor.One(&apiKey)
+	if err == nil && !apiKey.RevokedAt.IsZero() {
+		return apiKey, r.ErrEmptyResult
+	}
+	return apiKey, err
+}
+
+// Tenant is the id owning everything created with the key
+func (apiKey ApiKey) Tenant() string {
+	if apiKey.TenantId != "" {
+		return apiKey.TenantId
+	}
+	return apiKey.Id
+}
+
+// RequestApiKey returns the key a request was authenticated with, if any
+func RequestApiKey(req *http.Request) (ApiKey, bool) {
+	apiKey, ok := req.Context().Value(apiKeyContextKey{}).(ApiKey)
+	return apiKey, ok
+}
+
+// RequireApiKey answers every request that could change something with 401
+// unless it carries a valid API key. Requests with the admin token are let
+// through so admin routes keep working, and so keys can be created in the
+// first place. Set API_KEY_REQUIRED=false to turn the check off. Reads
+// don't need a key, but one is checked when given so the caller can see
+// their tenant's images.
+func RequireApiKey(session *r.Session, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		if validAdminToken(req) {
+			handler.ServeHTTP(writer, req)
+			return
+		}
+		key := requestApiKey(req)
+		if key == "" {
+			switch req.Method {
+			case "GET", "HEAD", "OPTIONS":
+				handler.ServeHTTP(writer, req)
+				return
+			}
+			if !config.Bool("API_KEY_REQUIRED", true) {
+				handler.ServeHTTP(writer, req)
+				return
+			}
+			WriteError(writer, http.StatusUnauthorized, errcode.Unauthorized, "An API key is required")
+			return
+		}
+		apiKey, err := FindApiKey(session, key)
+		if err == r.ErrEmptyResult {
+			WriteError(writer, http.StatusUnauthorized, errcode.Unauthorized, "Invalid API key")
+			return
+		}
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		handler.ServeHTTP(writer, req.WithContext(context.WithValue(req.Context(), apiKeyContextKey{}, apiKey)))
+	})
+}
+
+type ApiKeyRequest struct {
+	Name     string          `json:"name"`
+	TenantId string          `json:"tenantId"`
+	Limits   *PipelineLimits `json:"limits"`
+	Quality  *QualityPolicy  `json:"quality"`
+}
+
+type ApiKeyResponse struct {
+	ApiKey
+	Key string `json:"key"`
+}
+
+// ApiKeyPostHandler creates a key. The response is the only place the key
+// is ever shown.
+func ApiKeyPostHandler(session *r.Session) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		var apiKeyRequest ApiKeyRequest
+		err := json.NewDecoder(req.Body).Decode(&apiKeyRequest)
+		if err != nil {
+			http.Error(writer, "Error unmarshalling API key request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		if apiKeyRequest.Name == "" {
+			http.Error(writer, "`name` is required", http.StatusBadRequest)
+			return
+		}
+		if apiKeyRequest.Quality != nil {
+			if reason := apiKeyRequest.Quality.Check(); reason != "" {
+				http.Error(writer, reason, http.StatusBadRequest)
+				return
+			}
+		}
+
+		secret := make([]byte, 32)
+		_, err = rand.Read(secret)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		key := hex.EncodeToString(secret)
+		apiKey := ApiKey{
+			Id:        ids.New(),
+			Name:      apiKeyRequest.Name,
+			TenantId:  apiKeyRequest.TenantId,
+			KeyHash:   hashApiKey(key),
+			CreatedAt: time.Now(),
+			Limits:    apiKeyRequest.Limits,
+			Quality:   apiKeyRequest.Quality,
+		}
+		err = r.Table("apiKeys").Insert(apiKey).Exec(session)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Created API key %s (%s)", apiKey.Id, apiKey.Name)
+
+		jsonResponse, err := json.Marshal(ApiKeyResponse{ApiKey: apiKey, Key: key})
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.WriteHeader(http.StatusCreated)
+		writer.Write(jsonResponse)
+	}
+}
+
+// ApiKeyIndexHandler lists all keys, revoked ones included
+func ApiKeyIndexHandler(session *r.Session) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		cursor, err := r.Table("apiKeys").OrderBy(r.Desc("createdAt")).Run(session)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		apiKeys := []ApiKey{}
+		err = cursor.All(&apiKeys)
+		cursor.Close()
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		jsonResponse, err := json.Marshal(apiKeys)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(jsonResponse)
+	}
+}
+
+// ApiKeyDeleteHandler revokes a key. The record is kept so it still shows up
+// in the index.
+func ApiKeyDeleteHandler(session *r.Session) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		id := params.ByName("id")
+		result, err := r.Table("apiKeys").Get(id).Update(map[string]interface{}{
+			"revokedAt": time.Now(),
+		}).RunWrite(session)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if result.Skipped > 0 {
+			http.Error(writer, fmt.Sprintf("No API key with id `%s` could be found", id), http.StatusNotFound)
+			return
+		}
+		log.Printf("Revoked API key %s", id)
+		writer.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,208 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/julienschmidt/httprouter"
+	"github.com/thejsj/veenco/config"
+	"github.com/thejsj/veenco/errcode"
+	"github.com/thejsj/veenco/ids"
+	"github.com/thejsj/veenco/queue"
+)
+
+// BatchTransformationRequest runs the same transformations on every image
+type BatchTransformationRequest struct {
+	ImageIds []string `json:"imageIds"`
+	TransformationJobCollection
+}
+
+// TransformationBatch records a batch so its progress can be polled
+type TransformationBatch struct {
+	Id        string    `gorethink:"id" json:"id"`
+	OwnerId   string    `gorethink:"ownerId,omitempty" json:"ownerId,omitempty"`
+	CreatedAt time.Time `gorethink:"createdAt" json:"createdAt"`
+	ImageIds  []string  `gorethink:"imageIds" json:"imageIds"`
+	// Images whose jobs couldn't be submitted, with the reason
+	Failed map[string]string `gorethink:"failed,omitempty" json:"failed,omitempty"`
+}
+
+type BatchTransformationResponse struct {
+	BatchId string `json:"batchId"`
+	// The jobs submitted for each image, as POST /image/:id/transformation
+	// returns them
+	Images map[string]map[string][]interface{} `json:"images"`
+	Failed map[string]string                   `json:"failed,omitempty"`
+}
+
+type BatchStatus struct {
+	TransformationBatch
+	// pending, running, completed, failed, or partial when some of the
+	// jobs failed
+	Status string `json:"status"`
+	// Number of jobs in each state
+	Jobs map[string]int `json:"jobs"`
+	// Status of each image's jobs, in the same terms as the batch's
+	Images map[string]string `json:"images"`
+}
+
+// aggregateJobStatus sums up the states of a set of jobs
+func aggregateJobStatus(statuses []string) string {
+	counts := map[string]int{}
+	for _, status := range statuses {
+		counts[status]++
+	}
+	switch {
+	case len(statuses) == 0:
+		return JobStatusFailed
+	case counts[JobStatusPending] == len(statuses):
+		return JobStatusPending
+	case counts[JobStatusPending]+counts[JobStatusRunning] > 0:
+		return JobStatusRunning
+	case counts[JobStatusCompleted] == len(statuses):
+		return JobStatusCompleted
+	case counts[JobStatusCompleted] == 0:
+		return JobStatusFailed
+	}
+	return "partial"
+}
+
+// BatchTransformationPostHandler submits the same transformations for up to
+// BATCH_MAX_IMAGES (100 by default) images, each getting its own job chain.
+// Images that can't be found or whose jobs can't be queued are listed under
+// `failed` rather than failing the whole batch.
+func BatchTransformationPostHandler(session *r.Session, publisher *queue.Publisher) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		log.Printf("POST BatchTransformationPostHandler")
+		var batchRequest BatchTransformationRequest
+		err := json.NewDecoder(req.Body).Decode(&batchRequest)
+		if err != nil {
+			WriteError(writer, http.StatusBadRequest, errcode.InvalidRequest, "Error unmarshalling batch request: "+err.Error())
+			return
+		}
+		maxImages := config.Int("BATCH_MAX_IMAGES", 100)
+		if len(batchRequest.ImageIds) == 0 || len(batchRequest.ImageIds) > maxImages {
+			WriteError(writer, http.StatusBadRequest, errcode.InvalidRequest, fmt.Sprintf("`imageIds` must list between 1 and %d images", maxImages))
+			return
+		}
+		expiresAt, err := batchRequest.prepare(session, req)
+		if handleError(writer, err, "") {
+			return
+		}
+
+		batch := TransformationBatch{
+			Id:        ids.New(),
+			OwnerId:   RequestTenant(req),
+			CreatedAt: time.Now(),
+			ImageIds:  batchRequest.ImageIds,
+			Failed:    map[string]string{},
+		}
+		response := BatchTransformationResponse{BatchId: batch.Id, Images: map[string]map[string][]interface{}{}}
+		var queueErr error
+		for _, imageId := range batchRequest.ImageIds {
+			if _, ok := response.Images[imageId]; ok {
+				continue
+			}
+			// Once the broker is blocking, the remaining images would only
+			// wait for it in turn
+			if queueErr != nil {
+				batch.Failed[imageId] = queueErr.Error()
+				continue
+			}
+			imageEntry, err := LookupImageEntry(session, imageId, RequestTenant(req))
+			if err == nil && !CanAccess(req, imageEntry.OwnerId) {
+				err = r.ErrEmptyResult
+			}
+			if err == r.ErrEmptyResult {
+				batch.Failed[imageId] = fmt.Sprintf("No image with id or slug `%s` could be found", imageId)
+				continue
+			}
+			if err == nil && !CanChange(req, imageEntry.OwnerId) {
+				batch.Failed[imageId] = fmt.Sprintf("Image `%s` has no owner and can only be changed once an admin assigns it one", imageId)
+				continue
+			}
+			if err == nil {
+				response.Images[imageId], err = queueTransformations(session, publisher, req, imageEntry, batchRequest.TransformationJobCollection, expiresAt, batch.Id)
+			}
+			if err != nil {
+				batch.Failed[imageId] = err.Error()
+				if errors.Is(err, queue.ErrBlocked) {
+					queueErr = err
+				}
+			}
+		}
+		response.Failed = batch.Failed
+
+		err = r.Table("batches").Insert(batch).Exec(session)
+		if handleError(writer, err, "Error inserting batch into database") {
+			return
+		}
+		jsonResponse, err := json.Marshal(response)
+		if handleError(writer, err, "Error Marshalling JSON") {
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Header().Set("Location", apiPath(req, "/transformation/batch/"+batch.Id))
+		writer.Write(jsonResponse)
+	}
+}
+
+// BatchGetHandler returns a batch with the combined status of its jobs
+func BatchGetHandler(session *r.Session) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		log.Printf("GET BatchGetHandler")
+		id := params.ByName("id")
+		var batch TransformationBatch
+		cursor, err := r.Table("batches").Get(id).Run(session)
+		if err == nil {
+			err = cursor.One(&batch)
+			cursor.Close()
+		}
+		if err == nil && !CanAccess(req, batch.OwnerId) {
+			err = r.ErrEmptyResult
+		}
+		if err == r.ErrEmptyResult {
+			WriteError(writer, http.StatusNotFound, errcode.NotFound, fmt.Sprintf("No batch with id `%s` could be found", id))
+			return
+		}
+		if handleError(writer, err, "") {
+			return
+		}
+
+		var jobs []map[string]interface{}
+		err = chainRecords(r.Table("jobs").GetAllByIndex("batchId", id).Pluck("imageId", "status"), session, &jobs)
+		if handleError(writer, err, "") {
+			return
+		}
+		status := BatchStatus{TransformationBatch: batch, Jobs: map[string]int{}, Images: map[string]string{}}
+		var statuses []string
+		imageStatuses := map[string][]string{}
+		for _, job := range jobs {
+			defaultJobStatus(job)
+			jobStatus := jobString(job, "status")
+			status.Jobs[jobStatus]++
+			statuses = append(statuses, jobStatus)
+			imageId := jobString(job, "imageId")
+			imageStatuses[imageId] = append(imageStatuses[imageId], jobStatus)
+		}
+		for _, imageId := range batch.ImageIds {
+			status.Images[imageId] = aggregateJobStatus(imageStatuses[imageId])
+		}
+		status.Status = aggregateJobStatus(statuses)
+		if len(batch.Failed) > 0 && status.Status == JobStatusCompleted {
+			status.Status = "partial"
+		}
+
+		jsonResponse, err := json.Marshal(status)
+		if handleError(writer, err, "") {
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(jsonResponse)
+	}
+}
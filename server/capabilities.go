@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/julienschmidt/httprouter"
+)
+
+// JobParameter describes one field of a transformation's `data`
+type JobParameter struct {
+	Type        string  `json:"type"`
+	Required    bool    `json:"required,omitempty"`
+	Minimum     float64 `json:"minimum,omitempty"`
+	Maximum     float64 `json:"maximum,omitempty"`
+	Description string  `json:"description,omitempty"`
+}
+
+type JobTypeCapability struct {
+	Description string                  `json:"description"`
+	Parameters  map[string]JobParameter `json:"parameters"`
+}
+
+type LimitsCapability struct {
+	// Largest body of a POST or PUT /image
+	MaxUploadBytes int64 `json:"maxUploadBytes"`
+	// Largest file a resumable upload can create
+	MaxResumableUploadBytes int64          `json:"maxResumableUploadBytes"`
+	MaxResumableChunkBytes  int64          `json:"maxResumableChunkBytes"`
+	MinResumableChunkBytes  int64          `json:"minResumableChunkBytes"`
+	MaxCaptionBytes         int64          `json:"maxCaptionBytes"`
+	MaxMetadataBytes        int            `json:"maxMetadataBytes"`
+	Pipeline                PipelineLimits `json:"pipeline"`
+}
+
+// Capabilities lets clients discover what this deployment supports instead
+// of hardcoding it
+type Capabilities struct {
+	JobTypes map[string]JobTypeCapability `json:"jobTypes"`
+	// Content types that are checked to decode on upload. Anything else is
+	// stored as is, and video/* uploads are probed for their streams.
+	InputFormats   []string         `json:"inputFormats"`
+	CaptionFormats []string         `json:"captionFormats"`
+	Presets        []string         `json:"presets"`
+	Limits         LimitsCapability `json:"limits"`
+}
+
+// CurrentCapabilities reflects the configuration at the time of the call,
+// with the caller's API key limits applied and the names of the presets
+// that exist
+func CurrentCapabilities(req *http.Request, presets []string) Capabilities {
+	quality := RequestQualityPolicy(req)
+	return Capabilities{
+		JobTypes: map[string]JobTypeCapability{
+			JobTypeResizeToWidthPx: {
+				Description: "Resize to a width in pixels, keeping the aspect ratio",
+				Parameters: map[string]JobParameter{
+					"width": {Type: "number", Required: true, Minimum: 1},
+					"quality": {
+						Type:        "number",
+						Minimum:     quality.Min,
+						Maximum:     quality.Max,
+						Description: "Output quality; values outside the range are clamped",
+					},
+				},
+			},
+			JobTypeOperations: {
+				Description: "Run an ops string such as `resize:h=200,fit=crop;format:webp,q=80`, with a single output",
+				Parameters: map[string]JobParameter{
+					"ops": {
+						Type:        "string",
+						Required:    true,
+						Description: "`q` values outside the quality range are clamped",
+					},
+				},
+			},
+		},
+		InputFormats:   decodableContentTypes,
+		CaptionFormats: []string{"text/vtt", "application/x-subrip"},
+		Presets:        presets,
+		Limits: LimitsCapability{
+			MaxUploadBytes:          maxUploadBytes(),
+			MaxResumableUploadBytes: maxResumableSize(),
+			MaxResumableChunkBytes:  maxResumableChunk(),
+			MinResumableChunkBytes:  minResumableChunk,
+			MaxCaptionBytes:         maxCaptionBytes,
+			MaxMetadataBytes:        maxMetadataBytes(),
+			Pipeline:                RequestPipelineLimits(req),
+		},
+	}
+}
+
+func CapabilitiesGetHandler(session *r.Session) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		presets := []string{}
+		err := chainRecords(r.Table("presets").OrderBy("id").Field("id"), session, &presets)
+		if handleError(writer, err, "") {
+			return
+		}
+		jsonResponse, err := json.Marshal(CurrentCapabilities(req, presets))
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(jsonResponse)
+	}
+}
@@ -0,0 +1,212 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/thejsj/veenco/errcode"
+)
+
+// Caption is a subtitle track stored alongside a video, always as WebVTT
+type Caption struct {
+	Language   string `gorethink:"language" json:"language"`
+	Label      string `gorethink:"label,omitempty" json:"label,omitempty"`
+	S3Filename string `gorethink:"s3Filename" json:"s3Filename"`
+}
+
+const maxCaptionBytes = 2 << 20
+
+var (
+	captionLanguage = regexp.MustCompile(`^[a-zA-Z]{2,3}(-[a-zA-Z0-9]{2,8})*$`)
+	srtTiming       = regexp.MustCompile(`^(\d{2,}:\d{2}:\d{2}),(\d{3}) --> (\d{2,}:\d{2}:\d{2}),(\d{3})`)
+	vttTiming       = regexp.MustCompile(`^(\d{2,}:)?\d{2}:\d{2}\.\d{3} --> (\d{2,}:)?\d{2}:\d{2}\.\d{3}`)
+)
+
+// ParseCaptions validates a WebVTT or SRT file, returning it as WebVTT
+func ParseCaptions(contentType string, body []byte) ([]byte, error) {
+	body = bytes.TrimPrefix(body, []byte("\xef\xbb\xbf"))
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+	switch mediaType {
+	case "text/vtt":
+		return body, validateWebVTT(body)
+	case "application/x-subrip", "text/srt":
+		return srtToWebVTT(body)
+	}
+	return nil, fmt.Errorf("Captions must be text/vtt or application/x-subrip")
+}
+
+func validateWebVTT(body []byte) error {
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	if !scanner.Scan() || !strings.HasPrefix(scanner.Text(), "WEBVTT") {
+		return fmt.Errorf("WebVTT files must start with `WEBVTT`")
+	}
+	cues := 0
+	for scanner.Scan() {
+		if strings.Contains(scanner.Text(), "-->") {
+			if !vttTiming.MatchString(scanner.Text()) {
+				return fmt.Errorf("Invalid WebVTT cue timing: %s", scanner.Text())
+			}
+			cues++
+		}
+	}
+	if cues == 0 {
+		return fmt.Errorf("Captions have no cues")
+	}
+	return scanner.Err()
+}
+
+// srtToWebVTT rewrites the cue timings and drops the cue numbers
+func srtToWebVTT(body []byte) ([]byte, error) {
+	var vtt bytes.Buffer
+	vtt.WriteString("WEBVTT\n")
+	blocks := strings.Split(strings.ReplaceAll(string(body), "\r\n", "\n"), "\n\n")
+	cues := 0
+	for _, block := range blocks {
+		lines := strings.Split(strings.Trim(block, "\n"), "\n")
+		if len(lines) == 1 && lines[0] == "" {
+			continue
+		}
+		// The cue number is optional in practice
+		if len(lines) > 1 && !strings.Contains(lines[0], "-->") {
+			lines = lines[1:]
+		}
+		timing := srtTiming.FindStringSubmatch(lines[0])
+		if timing == nil {
+			return nil, fmt.Errorf("Invalid SRT cue timing: %s", lines[0])
+		}
+		fmt.Fprintf(&vtt, "\n%s.%s --> %s.%s\n", timing[1], timing[2], timing[3], timing[4])
+		for _, line := range lines[1:] {
+			vtt.WriteString(line + "\n")
+		}
+		cues++
+	}
+	if cues == 0 {
+		return nil, fmt.Errorf("Captions have no cues")
+	}
+	return vtt.Bytes(), nil
+}
+
+// CaptionsPutHandler stores the body as the video's caption track for the
+// `language` param, replacing any existing one. `label` is optional.
+func CaptionsPutHandler(session *r.Session, s3bucket *s3.Bucket) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		log.Printf("PUT CaptionsPutHandler")
+		imageEntry, ok := FindImageEntryToChange(session, writer, req, params.ByName("id"))
+		if !ok {
+			return
+		}
+		if !strings.HasPrefix(imageEntry.ContentType, "video/") {
+			WriteError(writer, http.StatusConflict, errcode.UnsupportedFormat, "Captions can only be attached to videos")
+			return
+		}
+		language := params.ByName("language")
+		if !captionLanguage.MatchString(language) {
+			http.Error(writer, "`language` must be a BCP 47 language tag such as `en` or `pt-BR`", http.StatusBadRequest)
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(writer, req.Body, maxCaptionBytes))
+		if err != nil {
+			WriteError(writer, http.StatusRequestEntityTooLarge, errcode.PayloadTooLarge, "Error reading body of request: "+err.Error())
+			return
+		}
+		vtt, err := ParseCaptions(req.Header.Get("Content-Type"), body)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		caption := Caption{
+			Language:   language,
+			Label:      req.URL.Query().Get("label"),
+			S3Filename: "captions/" + imageEntry.Id + "/" + language + ".vtt",
+		}
+		err = s3bucket.Put(caption.S3Filename, vtt, "text/vtt", s3.Private)
+		if err != nil {
+			RecordS3Error("put")
+			WriteError(writer, http.StatusInternalServerError, errcode.StorageUnavailable, "Error uploading captions to S3 bucket: "+err.Error())
+			return
+		}
+		captions := []Caption{caption}
+		for _, existing := range imageEntry.Captions {
+			if existing.Language != language {
+				captions = append(captions, existing)
+			}
+		}
+		err = r.Table("images").Get(imageEntry.Id).Update(map[string]interface{}{
+			"captions": captions,
+		}).Exec(session)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		jsonResponse, err := json.Marshal(caption)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(jsonResponse)
+	}
+}
+
+func CaptionsDeleteHandler(session *r.Session, s3bucket *s3.Bucket) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		log.Printf("DELETE CaptionsDeleteHandler")
+		imageEntry, ok := FindImageEntryToChange(session, writer, req, params.ByName("id"))
+		if !ok {
+			return
+		}
+		language := params.ByName("language")
+		captions := []Caption{}
+		var removed *Caption
+		for i, caption := range imageEntry.Captions {
+			if caption.Language == language {
+				removed = &imageEntry.Captions[i]
+				continue
+			}
+			captions = append(captions, caption)
+		}
+		if removed == nil {
+			http.Error(writer, fmt.Sprintf("No `%s` captions could be found", language), http.StatusNotFound)
+			return
+		}
+
+		err := s3bucket.Del(removed.S3Filename)
+		if err != nil {
+			http.Error(writer, "Error deleting captions from S3 bucket: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		err = r.Table("images").Get(imageEntry.Id).Update(map[string]interface{}{
+			"captions": captions,
+		}).Exec(session)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// deleteCaptions removes every caption file of an image
+func deleteCaptions(s3bucket *s3.Bucket, imageEntry ImageEntry) error {
+	for _, caption := range imageEntry.Captions {
+		err := s3bucket.Del(caption.S3Filename)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
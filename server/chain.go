@@ -0,0 +1,87 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/julienschmidt/httprouter"
+	"github.com/thejsj/veenco/ids"
+)
+
+// Request ids we accept from clients and proxies as chain ids
+var chainIdPattern = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+// RequestChainId returns the request's X-Request-ID, or a new id when there
+// is none. The chain id of an upload is kept on the image and copied to its
+// jobs, their outputs and webhook calls, so one id finds everything that
+// happened to an asset.
+func RequestChainId(req *http.Request) string {
+	requestId := req.Header.Get("X-Request-ID")
+	if chainIdPattern.MatchString(requestId) {
+		return requestId
+	}
+	return ids.New()
+}
+
+// chainIdFor is the chain id for work on an existing image. Images uploaded
+// before chain ids existed get the request's.
+func chainIdFor(req *http.Request, imageEntry ImageEntry) string {
+	if imageEntry.ChainId != "" {
+		return imageEntry.ChainId
+	}
+	return RequestChainId(req)
+}
+
+// ChainGetHandler returns every image, job and quarantined upload recorded
+// with the chain id
+func ChainGetHandler(session *r.Session) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		log.Printf("GET ChainGetHandler")
+		chainId := params.ByName("id")
+
+		images := []ImageEntry{}
+		jobs := []map[string]interface{}{}
+		quarantined := []QuarantineEntry{}
+		err := chainRecords(r.Table("images").GetAllByIndex("chainId", chainId), session, &images)
+		if err == nil {
+			err = chainRecords(r.Table("jobs").GetAllByIndex("chainId", chainId).OrderBy("createdAt"), session, &jobs)
+		}
+		if err == nil {
+			err = chainRecords(r.Table("quarantine").Filter(map[string]interface{}{
+				"image": map[string]interface{}{"chainId": chainId},
+			}), session, &quarantined)
+		}
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, job := range jobs {
+			defaultJobStatus(job)
+		}
+
+		jsonResponse, err := json.Marshal(map[string]interface{}{
+			"chainId":    chainId,
+			"images":     images,
+			"jobs":       jobs,
+			"quarantine": quarantined,
+		})
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(jsonResponse)
+	}
+}
+
+func chainRecords(query r.Term, session *r.Session, result interface{}) error {
+	cursor, err := query.Run(session)
+	if err != nil {
+		return err
+	}
+	defer cursor.Close()
+	return cursor.All(result)
+}
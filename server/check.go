@@ -0,0 +1,156 @@
+package server
+
+import (
+	"fmt"
+	"os"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/streadway/amqp"
+	"github.com/thejsj/veenco/database"
+	"github.com/thejsj/veenco/queue"
+	"github.com/thejsj/veenco/storage"
+)
+
+type checkResult struct {
+	name string
+	err  error
+	hint string
+}
+
+// RunCheck validates the configuration and makes read-only connections to
+// RethinkDB, S3 and RabbitMQ, printing a diagnostic for every step. It
+// returns false if anything failed.
+func RunCheck() bool {
+	var results []checkResult
+	report := func(name string, err error, hint string) {
+		results = append(results, checkResult{name, err, hint})
+		if err != nil {
+			fmt.Printf("[fail] %s: %s\n       %s\n", name, err, hint)
+		} else {
+			fmt.Printf("[ok]   %s\n", name)
+		}
+	}
+
+	for _, variable := range []string{"DB_NAME", "S3_BUCKET_NAME", "AWS_ACCESS_KEY", "AWS_SECRET_KEY", "HTTP_PORT"} {
+		var err error
+		if os.Getenv(variable) == "" {
+			err = fmt.Errorf("not set")
+		}
+		report("Environment variable "+variable, err, "Set it in the environment or in .env")
+	}
+
+	checkRethinkDB(report)
+	checkStorage(report)
+	checkAmqp(report)
+
+	for _, result := range results {
+		if result.err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func checkRethinkDB(report func(string, error, string)) {
+	connectOpts, err := database.ConnectOpts()
+	report("RethinkDB configuration", err, "Check the RETHINKDB_TLS_* files")
+	if err != nil {
+		return
+	}
+	session, err := r.Connect(connectOpts)
+	report("RethinkDB connection", err, "Check RETHINKDB_HOST/RETHINKDB_PORT or RETHINKDB_ADDRESSES and credentials")
+	if err != nil {
+		return
+	}
+	defer session.Close()
+
+	tables, err := listTables(session)
+	report("RethinkDB database "+connectOpts.Database, err, "Create the database named in DB_NAME")
+	if err != nil {
+		return
+	}
+	for _, table := range tableNames {
+		err = nil
+		if !containsString(tables, table) {
+			err = fmt.Errorf("table does not exist")
+		}
+		report("RethinkDB table "+table, err, "The server creates it on start; check the RethinkDB user may create tables")
+		if err != nil {
+			continue
+		}
+		indexes, ok := secondaryIndexes[table]
+		if !ok {
+			continue
+		}
+		existing, err := listIndexes(session, table)
+		if err != nil {
+			report("RethinkDB indexes on "+table, err, "Check the RethinkDB user may read the table")
+			continue
+		}
+		for _, index := range indexes {
+			err = nil
+			if !containsString(existing, index) {
+				err = fmt.Errorf("index does not exist")
+			}
+			report("RethinkDB index "+table+"."+index, err, "The server creates it on start; check the RethinkDB user may create indexes")
+		}
+	}
+}
+
+func checkStorage(report func(string, error, string)) {
+	storageConfig := storage.ConfigFromEnv("S3")
+	s3bucket, err := storageConfig.Bucket()
+	report("S3 configuration", err, "Check S3_BUCKET_NAME, S3_PROVIDER, S3_REGION and S3_ENDPOINT")
+	if err != nil {
+		return
+	}
+	_, err = s3bucket.List("", "", "", 1)
+	report("S3 bucket "+storageConfig.BucketName+" is readable", err, "Check the bucket exists and the AWS keys may list it")
+}
+
+func checkAmqp(report func(string, error, string)) {
+	conn, err := amqp.Dial(queue.Url())
+	report("RabbitMQ connection", err, "Check AMQP_URL")
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// Passive declarations fail instead of creating anything, and a failure
+	// closes the channel, so every check gets its own
+	passive := func(declare func(channel *amqp.Channel) error) error {
+		channel, err := conn.Channel()
+		if err != nil {
+			return err
+		}
+		defer channel.Close()
+		return declare(channel)
+	}
+	checkExchange := func(name string, kind string, hint string) {
+		err := passive(func(channel *amqp.Channel) error {
+			return channel.ExchangeDeclarePassive(name, kind, true, false, false, false, nil)
+		})
+		report("RabbitMQ exchange "+name, err, hint)
+	}
+	checkQueue := func(name string, hint string) {
+		err := passive(func(channel *amqp.Channel) error {
+			_, err := channel.QueueDeclarePassive(name, true, false, false, false, nil)
+			return err
+		})
+		report("RabbitMQ queue "+name, err, hint)
+	}
+
+	checkExchange(queue.ExchangeName, "direct", "The server declares it on start; check the vhost permissions")
+	// Expired affinity tasks are dead lettered to the shared task queue, so
+	// it is needed either way
+	checkQueue(queue.TaskQueueName, "Start a worker once to declare it")
+	for _, format := range queue.TaskFormats {
+		checkQueue(queue.FormatQueueName(format), "The server declares it on start; check the vhost permissions")
+	}
+	checkQueue(queue.DeadLetterQueueName, "Start a worker once to declare it")
+	checkExchange(queue.DelayExchangeName, "fanout", "Start a worker once to declare it")
+	checkQueue(queue.DelayQueueName, "Start a worker once to declare it")
+	if queue.AffinityEnabled() {
+		checkExchange(queue.AffinityExchangeName, "x-consistent-hash", "The server declares it on start; check the rabbitmq_consistent_hash_exchange plugin is enabled")
+	}
+}
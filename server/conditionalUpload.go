@@ -0,0 +1,70 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+
+	r "github.com/dancannon/gorethink"
+)
+
+var sha256Hex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// HashETag is the entity tag uploads are identified by
+func HashETag(sha256 string) string {
+	return fmt.Sprintf(`"sha256:%s"`, sha256)
+}
+
+// ifNoneMatchHashes extracts the SHA-256 hashes from an If-None-Match
+// header. Both "sha256:<hex>" and bare hex entity tags are accepted.
+func ifNoneMatchHashes(header string) []string {
+	var hashes []string
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		tag = strings.TrimPrefix(strings.Trim(tag, `"`), "sha256:")
+		tag = strings.ToLower(tag)
+		if sha256Hex.MatchString(tag) {
+			hashes = append(hashes, tag)
+		}
+	}
+	return hashes
+}
+
+// FindImageBySha256 returns r.ErrEmptyResult when none of the owner's images
+// has the hash
+func FindImageBySha256(session *r.Session, sha256 string, ownerId string) (ImageEntry, error) {
+	var imageEntry ImageEntry
+	cursor, err := r.Table("images").GetAllByIndex("sha256", sha256).Filter(
+		r.Row.Field("ownerId").Default("").Eq(ownerId),
+	).Limit(1).Run(session)
+	if err != nil {
+		return imageEntry, err
+	}
+	defer cursor.Close()
+	err = cursor.One(&imageEntry)
+	return imageEntry, err
+}
+
+// ExistingUpload answers uploads whose If-None-Match names the hash of an
+// image that is already stored with 304 and the existing image's location,
+// before any of the body is read. It returns false when the upload should
+// go ahead.
+func ExistingUpload(session *r.Session, writer http.ResponseWriter, req *http.Request) bool {
+	for _, hash := range ifNoneMatchHashes(req.Header.Get("If-None-Match")) {
+		imageEntry, err := FindImageBySha256(session, hash, RequestTenant(req))
+		if err == r.ErrEmptyResult {
+			continue
+		}
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return true
+		}
+		writer.Header().Set("ETag", HashETag(imageEntry.Sha256))
+		writer.Header().Set("Location", apiPath(req, "/image/"+imageEntry.Id))
+		writer.Header().Set("X-Image-Id", imageEntry.Id)
+		writer.WriteHeader(http.StatusNotModified)
+		return true
+	}
+	return false
+}
@@ -0,0 +1,99 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/thejsj/veenco/safehttp"
+	"github.com/thejsj/veenco/storage"
+)
+
+// openSource starts reading the image's bytes, passing a Range header on
+// when the client sent one
+func openSource(s3bucket *s3.Bucket, imageEntry ImageEntry, byteRange string) (*http.Response, error) {
+	headers := map[string][]string{}
+	if byteRange != "" {
+		headers["Range"] = []string{byteRange}
+	}
+	if imageEntry.SourceUrl == "" {
+		return s3bucket.GetResponseWithHeaders(imageEntry.S3Filename, headers)
+	}
+	if foreignBucket, key, ok := storage.ForeignObject(s3bucket, imageEntry.SourceUrl); ok {
+		return foreignBucket.GetResponseWithHeaders(key, headers)
+	}
+
+	req, err := http.NewRequest("GET", imageEntry.SourceUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header = headers
+	res, err := safehttp.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent {
+		res.Body.Close()
+		return nil, fmt.Errorf("Fetching %s returned %s", imageEntry.SourceUrl, res.Status)
+	}
+	return res, nil
+}
+
+// ContentGetHandler streams the original file through the server so the
+// bucket can stay private. `?download=1` asks the browser to save the file
+// instead of showing it, and `?filename=` overrides the name it is saved as.
+func ContentGetHandler(session *r.Session, s3bucket *s3.Bucket) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		log.Printf("GET ContentGetHandler")
+		imageEntry, ok := FindImageEntry(session, writer, req, params.ByName("id"))
+		if !ok {
+			return
+		}
+
+		res, err := openSource(s3bucket, imageEntry, req.Header.Get("Range"))
+		if err != nil {
+			if imageEntry.SourceUrl == "" {
+				RecordS3Error("get")
+			}
+			http.Error(writer, "Error reading image: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer res.Body.Close()
+
+		contentType := imageEntry.ContentType
+		if contentType == "" {
+			contentType = res.Header.Get("Content-Type")
+		}
+		disposition := "inline"
+		if download, _ := strconv.ParseBool(req.URL.Query().Get("download")); download {
+			disposition = "attachment"
+		}
+		filename := imageEntry.OriginalFileName
+		if override := req.URL.Query().Get("filename"); override != "" {
+			filename = NormalizeFilename(override)
+		}
+
+		writer.Header().Set("Content-Type", contentType)
+		writer.Header().Set("Content-Disposition", ContentDisposition(disposition, filename))
+		writer.Header().Set("Accept-Ranges", "bytes")
+		for _, header := range []string{"Content-Length", "Content-Range", "Last-Modified"} {
+			if value := res.Header.Get(header); value != "" {
+				writer.Header().Set(header, value)
+			}
+		}
+		if imageEntry.Sha256 != "" && res.StatusCode == http.StatusOK {
+			writer.Header().Set("ETag", HashETag(imageEntry.Sha256))
+		}
+		writer.WriteHeader(res.StatusCode)
+		_, err = io.Copy(writer, res.Body)
+		if err != nil {
+			// Headers are already sent, so this can only be logged
+			log.Printf("Error streaming image %s: %s", imageEntry.Id, err)
+		}
+	}
+}
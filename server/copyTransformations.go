@@ -0,0 +1,163 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/julienschmidt/httprouter"
+	"github.com/thejsj/veenco/config"
+	"github.com/thejsj/veenco/errcode"
+	"github.com/thejsj/veenco/queue"
+)
+
+// recordedSubmissions rebuilds the submissions that created an image's jobs.
+// Every submission has one step that starts from the original image; the
+// others start from an earlier step's output, given by inputJob or, for
+// jobs from before pipelines, by the job whose nextJob they are.
+func recordedSubmissions(jobs []map[string]interface{}) []TransformationJobCollection {
+	sort.SliceStable(jobs, func(i, j int) bool {
+		return jobTime(jobs[i]).Before(jobTime(jobs[j]))
+	})
+	input := map[string]string{}
+	for _, job := range jobs {
+		if next := jobString(job, "nextJob"); next != "" {
+			input[next] = jobString(job, "id")
+		}
+	}
+	children := map[string][]map[string]interface{}{}
+	var roots []map[string]interface{}
+	for _, job := range jobs {
+		inputJob := jobString(job, "inputJob")
+		if inputJob == "" {
+			inputJob = input[jobString(job, "id")]
+		}
+		if inputJob == "" {
+			roots = append(roots, job)
+		} else {
+			children[inputJob] = append(children[inputJob], job)
+		}
+	}
+
+	var submissions []TransformationJobCollection
+	for _, root := range roots {
+		submission := TransformationJobCollection{Preset: jobString(root, "preset")}
+		names := map[string]string{}
+		var visit func(job map[string]interface{}, inputName string)
+		visit = func(job map[string]interface{}, inputName string) {
+			step := TransformationJob{
+				JobType: jobString(job, "jobType"),
+				Data:    map[string]interface{}{},
+				Name:    jobString(job, "stepName"),
+				Input:   inputName,
+			}
+			for _, field := range []string{"width", "quality", "ops"} {
+				if value, ok := job[field]; ok {
+					step.Data[field] = value
+				}
+			}
+			id := jobString(job, "id")
+			// Unnamed steps get a name when later steps start from them
+			if step.Name == "" && len(children[id]) > 0 {
+				step.Name = fmt.Sprintf("step-%d", len(submission.Transformations)+1)
+			}
+			names[id] = step.Name
+			submission.Transformations = append(submission.Transformations, step)
+			for _, child := range children[id] {
+				visit(child, names[id])
+			}
+		}
+		visit(root, "")
+		submissions = append(submissions, submission)
+	}
+	return submissions
+}
+
+// CopyTransformationsErrorResponse is the error of a copy that failed
+// partway, along with the jobs it had already queued
+type CopyTransformationsErrorResponse struct {
+	ErrorResponse
+	Queued map[string][]interface{} `json:"queued"`
+}
+
+// writeCopyTransformationsError answers like writeTransformationError,
+// listing the jobs that were queued before err so clients don't copy them
+// again
+func writeCopyTransformationsError(writer http.ResponseWriter, err error, queued map[string][]interface{}) {
+	if errors.Is(err, queue.ErrBlocked) {
+		retryAfter := config.Duration("PUBLISH_RETRY_AFTER", 30*time.Second)
+		writer.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)))
+	}
+	code := errcode.Of(err)
+	jsonResponse, _ := json.Marshal(CopyTransformationsErrorResponse{
+		ErrorResponse: ErrorResponse{Code: code, Error: err.Error()},
+		Queued:        queued,
+	})
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("X-Content-Type-Options", "nosniff")
+	writer.WriteHeader(StatusOf(code))
+	writer.Write(jsonResponse)
+}
+
+// CopyTransformationsPostHandler replays the transformations recorded for
+// the image given as `from` on this one, one submission per submission
+// that created them. The source's expiry and callback aren't copied.
+func CopyTransformationsPostHandler(session *r.Session, publisher *queue.Publisher) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		log.Printf("POST CopyTransformationsPostHandler")
+		imageEntry, ok := FindImageEntryToChange(session, writer, req, params.ByName("id"))
+		if !ok {
+			return
+		}
+		from := req.URL.Query().Get("from")
+		if from == "" {
+			WriteError(writer, http.StatusBadRequest, errcode.InvalidRequest, "`from` must give the image to copy transformations from")
+			return
+		}
+		sourceEntry, ok := FindImageEntry(session, writer, req, from)
+		if !ok {
+			return
+		}
+
+		var jobs []map[string]interface{}
+		err := chainRecords(r.Table("jobs").GetAllByIndex("imageId", sourceEntry.Id).Filter(r.Row.Field("status").Default(JobStatusPending).Ne(JobStatusCancelled)), session, &jobs)
+		if handleError(writer, err, "") {
+			return
+		}
+		submissions := recordedSubmissions(jobs)
+		if len(submissions) == 0 {
+			WriteError(writer, http.StatusBadRequest, errcode.InvalidRequest, fmt.Sprintf("Image `%s` has no transformations to copy", from))
+			return
+		}
+
+		response := map[string][]interface{}{}
+		for _, submission := range submissions {
+			queued, err := queueTransformations(session, publisher, req, imageEntry, submission, time.Time{}, "")
+			if err != nil && len(response) > 0 {
+				writeCopyTransformationsError(writer, err, response)
+				return
+			}
+			if err != nil {
+				writeTransformationError(writer, err)
+				return
+			}
+			for key, jobs := range queued {
+				response[key] = append(response[key], jobs...)
+			}
+		}
+		log.Printf("Copied %d jobs from %s to %s", len(jobs), sourceEntry.Id, imageEntry.Id)
+
+		jsonResponse, err := json.Marshal(response)
+		if handleError(writer, err, "Error Marshalling JSON") {
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(jsonResponse)
+	}
+}
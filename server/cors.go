@@ -0,0 +1,75 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/thejsj/veenco/config"
+)
+
+var (
+	defaultCorsMethods = []string{"GET", "HEAD", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"}
+	// X-Admin-Token is left out so browsers can't send the admin token;
+	// add it to CORS_ALLOWED_HEADERS for a trusted admin UI
+	defaultCorsHeaders = []string{
+		"Content-Type", "If-None-Match", "Range",
+		"X-Api-Key", "X-Request-ID", "X-Filename", "X-Uploader-Id", "Idempotency-Key",
+		"Tus-Resumable", "Upload-Length", "Upload-Offset", "Upload-Metadata",
+	}
+	// Response headers clients need to read, on top of the ones browsers
+	// always expose
+	defaultCorsExposedHeaders = []string{
+		"ETag", "Link", "Location", "Retry-After", "X-Image-Id", "X-Total-Count", "Content-Disposition", "Idempotent-Replayed", "X-Deduplicated",
+		"Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size", "Upload-Length", "Upload-Offset",
+	}
+)
+
+func corsList(name string, fallback []string) string {
+	list := config.List(name)
+	if len(list) == 0 {
+		list = fallback
+	}
+	return strings.Join(list, ", ")
+}
+
+// corsOriginAllowed checks the origin against CORS_ALLOWED_ORIGINS, where
+// `*` allows any origin
+func corsOriginAllowed(origin string) bool {
+	for _, allowed := range config.List("CORS_ALLOWED_ORIGINS") {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Cors lets browsers on the origins in CORS_ALLOWED_ORIGINS call the API.
+// Preflight requests are answered here for every route, so they never reach
+// the router or need an API key. CORS_ALLOWED_METHODS, CORS_ALLOWED_HEADERS,
+// CORS_EXPOSED_HEADERS and CORS_MAX_AGE override the defaults. Nothing
+// changes while no origin is allowed.
+func Cors(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		origin := req.Header.Get("Origin")
+		writer.Header().Add("Vary", "Origin")
+		if origin == "" || !corsOriginAllowed(origin) {
+			handler.ServeHTTP(writer, req)
+			return
+		}
+
+		writer.Header().Set("Access-Control-Allow-Origin", origin)
+		preflight := req.Method == "OPTIONS" && req.Header.Get("Access-Control-Request-Method") != ""
+		if !preflight {
+			writer.Header().Set("Access-Control-Expose-Headers", corsList("CORS_EXPOSED_HEADERS", defaultCorsExposedHeaders))
+			handler.ServeHTTP(writer, req)
+			return
+		}
+
+		writer.Header().Add("Vary", "Access-Control-Request-Method")
+		writer.Header().Add("Vary", "Access-Control-Request-Headers")
+		writer.Header().Set("Access-Control-Allow-Methods", corsList("CORS_ALLOWED_METHODS", defaultCorsMethods))
+		writer.Header().Set("Access-Control-Allow-Headers", corsList("CORS_ALLOWED_HEADERS", defaultCorsHeaders))
+		writer.Header().Set("Access-Control-Max-Age", config.String("CORS_MAX_AGE", "600"))
+		writer.WriteHeader(http.StatusNoContent)
+	})
+}
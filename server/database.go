@@ -0,0 +1,180 @@
+package server
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/thejsj/veenco/chaos"
+	"github.com/thejsj/veenco/errcode"
+	"github.com/thejsj/veenco/ids"
+)
+
+// GetImageEntry fetches a single image, returning r.ErrEmptyResult when no
+// image with that id exists
+func GetImageEntry(session *r.Session, id string) (ImageEntry, error) {
+	var imageEntry ImageEntry
+	if err := chaos.DBError(); err != nil {
+		return imageEntry, err
+	}
+	cursor, err := r.Table("images").Get(id).Run(session)
+	if err != nil {
+		return imageEntry, err
+	}
+	defer cursor.Close()
+	err = cursor.One(&imageEntry)
+	return imageEntry, err
+}
+
+// LookupImageEntry accepts either an image's id or its short slug. Slugs
+// from before ULID ids existed can look like one, so a miss on the id falls
+// back to the slug. Slugs are unique per owner, so ownerId's image is
+// preferred, then an unowned one, then any other.
+func LookupImageEntry(session *r.Session, idOrSlug string, ownerId string) (ImageEntry, error) {
+	if ids.LooksLikeId(idOrSlug) {
+		imageEntry, err := GetImageEntry(session, idOrSlug)
+		if err != r.ErrEmptyResult {
+			return imageEntry, err
+		}
+	}
+	var imageEntries []ImageEntry
+	cursor, err := r.Table("images").GetAllByIndex("slug", idOrSlug).Run(session)
+	if err != nil {
+		return ImageEntry{}, err
+	}
+	defer cursor.Close()
+	err = cursor.All(&imageEntries)
+	if err != nil {
+		return ImageEntry{}, err
+	}
+	for _, preferred := range []string{ownerId, ""} {
+		for _, imageEntry := range imageEntries {
+			if imageEntry.OwnerId == preferred {
+				return imageEntry, nil
+			}
+		}
+	}
+	if len(imageEntries) > 0 {
+		return imageEntries[0], nil
+	}
+	return ImageEntry{}, r.ErrEmptyResult
+}
+
+// FindImageEntry looks up an image for a handler, writing a 404 or 500 and
+// returning false when it can't be loaded. Other tenants' images are
+// reported as missing so their ids don't leak.
+func FindImageEntry(session *r.Session, writer http.ResponseWriter, req *http.Request, idOrSlug string) (ImageEntry, bool) {
+	imageEntry, err := LookupImageEntry(session, idOrSlug, RequestTenant(req))
+	if err == nil && !CanAccess(req, imageEntry.OwnerId) {
+		err = r.ErrEmptyResult
+	}
+	if err == r.ErrEmptyResult {
+		WriteError(writer, http.StatusNotFound, errcode.NotFound, fmt.Sprintf("No image with id or slug `%s` could be found", idOrSlug))
+		return imageEntry, false
+	}
+	if err != nil {
+		WriteError(writer, http.StatusInternalServerError, errcode.StorageUnavailable, err.Error())
+		return imageEntry, false
+	}
+	return imageEntry, true
+}
+
+// FindImageEntryToChange is FindImageEntry for handlers that change the
+// image or create jobs for it, answering 403 for images without an owner
+func FindImageEntryToChange(session *r.Session, writer http.ResponseWriter, req *http.Request, idOrSlug string) (ImageEntry, bool) {
+	imageEntry, ok := FindImageEntry(session, writer, req, idOrSlug)
+	if ok && !CanChange(req, imageEntry.OwnerId) {
+		WriteError(writer, http.StatusForbidden, errcode.Forbidden, fmt.Sprintf("Image `%s` has no owner and can only be changed once an admin assigns it one", idOrSlug))
+		return imageEntry, false
+	}
+	return imageEntry, ok
+}
+
+// tableNames lists every table the server and worker use
+var tableNames = []string{"images", "jobs", "apiKeys", resumableTableName, "quarantine", "batches", "presets", idempotencyTableName, slugsTableName, settingsTableName}
+
+// secondaryIndexes lists the indexes each table is expected to have
+var secondaryIndexes = map[string][]string{
+	"images":  {"slug", "sha256", "createAt", "chainId", "ownerId"},
+	"jobs":    {"imageId", "chainId", "ownerId", "batchId"},
+	"apiKeys": {"keyHash"},
+}
+
+// listTables returns the tables that exist in the session's database
+func listTables(session *r.Session) ([]string, error) {
+	cursor, err := r.TableList().Run(session)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var tables []string
+	err = cursor.All(&tables)
+	return tables, err
+}
+
+// listIndexes returns the secondary indexes that exist on the table
+func listIndexes(session *r.Session, table string) ([]string, error) {
+	cursor, err := r.Table(table).IndexList().Run(session)
+	if err != nil {
+		return nil, err
+	}
+	defer cursor.Close()
+	var indexes []string
+	err = cursor.All(&indexes)
+	return indexes, err
+}
+
+// SetupIndexes creates any tables and secondary indexes that don't exist
+// yet, so deployments pick up the tables of new features on upgrade
+func SetupIndexes(session *r.Session) error {
+	existingTables, err := listTables(session)
+	if err != nil {
+		return err
+	}
+	for _, table := range tableNames {
+		if containsString(existingTables, table) {
+			continue
+		}
+		log.Printf("Creating table %s", table)
+		err = r.TableCreate(table).Exec(session)
+		if err != nil {
+			// Another server starting at the same time may have created it
+			if tables, listErr := listTables(session); listErr != nil || !containsString(tables, table) {
+				return err
+			}
+		}
+	}
+
+	for table, indexes := range secondaryIndexes {
+		existing, err := listIndexes(session, table)
+		if err != nil {
+			return err
+		}
+
+		for _, index := range indexes {
+			if containsString(existing, index) {
+				continue
+			}
+			log.Printf("Creating index %s on table %s", index, table)
+			err = r.Table(table).IndexCreate(index).Exec(session)
+			if err != nil {
+				return err
+			}
+		}
+		err = r.Table(table).IndexWait().Exec(session)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
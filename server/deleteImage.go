@@ -0,0 +1,62 @@
+package server
+
+import (
+	"log"
+	"net/http"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mitchellh/goamz/s3"
+)
+
+// ImageDeleteHandler removes an image, its stored object and job outputs and
+// cancels any of its jobs. Images under legal hold are refused with 409.
+func ImageDeleteHandler(session *r.Session, s3bucket *s3.Bucket) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		log.Printf("DELETE ImageDeleteHandler")
+		imageEntry, ok := FindImageEntryToChange(session, writer, req, params.ByName("id"))
+		if !ok {
+			return
+		}
+		if imageEntry.LegalHold {
+			http.Error(writer, "Image is under legal hold and can't be deleted", http.StatusConflict)
+			return
+		}
+
+		err := r.Table("jobs").Filter(map[string]interface{}{"imageId": imageEntry.Id}).Update(map[string]interface{}{
+			"status": JobStatusCancelled,
+		}).Exec(session)
+		if err != nil {
+			http.Error(writer, "Error cancelling jobs: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		err = deleteJobOutputs(session, s3bucket, imageEntry.Id)
+		if err == nil {
+			err = deleteCaptions(s3bucket, imageEntry)
+		}
+		if err == nil {
+			err = deleteRenders(s3bucket, imageEntry.Id)
+		}
+		if err != nil {
+			http.Error(writer, "Error deleting job outputs, captions and renders from S3 bucket: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// Externally registered images don't own their bytes
+		if imageEntry.S3Filename != "" {
+			err = s3bucket.Del(imageEntry.S3Filename)
+			if err != nil {
+				RecordS3Error("delete")
+				http.Error(writer, "Error deleting object from S3 bucket: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		err = r.Table("images").Get(imageEntry.Id).Delete().Exec(session)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Deleted image %s", imageEntry.Id)
+		writer.WriteHeader(http.StatusNoContent)
+	}
+}
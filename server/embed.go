@@ -0,0 +1,111 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/julienschmidt/httprouter"
+)
+
+// ImageDimensions reads the width and height from the image header, returning
+// zeros for formats that can't be decoded
+func ImageDimensions(buffer []byte) (int, int) {
+	config, _, err := image.DecodeConfig(bytes.NewReader(buffer))
+	if err != nil {
+		return 0, 0
+	}
+	return config.Width, config.Height
+}
+
+// OEmbedResponse is an oEmbed 1.0 "photo" response
+type OEmbedResponse struct {
+	Type         string `json:"type"`
+	Version      string `json:"version"`
+	Title        string `json:"title,omitempty"`
+	ProviderName string `json:"provider_name"`
+	Url          string `json:"url"`
+	Width        int    `json:"width"`
+	Height       int    `json:"height"`
+}
+
+var embedTemplate = template.Must(template.New("embed").Parse(
+	`<picture><source srcset="{{.Url}}" type="{{.ContentType}}"><img src="{{.Url}}" alt="{{.Alt}}"` +
+		`{{if .Width}} width="{{.Width}}" height="{{.Height}}"{{end}} loading="lazy" style="max-width:100%;height:auto"></picture>`,
+))
+
+// OEmbedGetHandler resolves `url` query parameters of the form
+// .../image/:id into an oEmbed photo response
+func OEmbedGetHandler(session *r.Session) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		log.Printf("GET OEmbedGetHandler")
+		query := req.URL.Query()
+		if format := query.Get("format"); format != "" && format != "json" {
+			http.Error(writer, fmt.Sprintf("Format `%s` is not supported", format), http.StatusNotImplemented)
+			return
+		}
+
+		resourceUrl, err := url.Parse(query.Get("url"))
+		if err != nil {
+			http.Error(writer, "`url` is not a valid URL", http.StatusBadRequest)
+			return
+		}
+		segments := strings.Split(strings.Trim(resourceUrl.Path, "/"), "/")
+		if len(segments) < 2 || segments[len(segments)-2] != "image" {
+			http.Error(writer, "`url` does not point to an image", http.StatusNotFound)
+			return
+		}
+
+		imageEntry, ok := FindImageEntry(session, writer, req, segments[len(segments)-1])
+		if !ok {
+			return
+		}
+		jsonResponse, err := json.Marshal(OEmbedResponse{
+			Type:         "photo",
+			Version:      "1.0",
+			Title:        imageEntry.OriginalFileName,
+			ProviderName: "enco",
+			Url:          contentUrl(req, imageEntry),
+			Width:        imageEntry.Width,
+			Height:       imageEntry.Height,
+		})
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(jsonResponse)
+	}
+}
+
+// EmbedGetHandler returns an HTML snippet that can be pasted into a page
+func EmbedGetHandler(session *r.Session) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		log.Printf("GET EmbedGetHandler")
+		imageEntry, ok := FindImageEntry(session, writer, req, params.ByName("id"))
+		if !ok {
+			return
+		}
+		writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+		err := embedTemplate.Execute(writer, map[string]interface{}{
+			"Url":         contentUrl(req, imageEntry),
+			"ContentType": imageEntry.ContentType,
+			"Alt":         imageEntry.OriginalFileName,
+			"Width":       imageEntry.Width,
+			"Height":      imageEntry.Height,
+		})
+		if err != nil {
+			log.Printf("Error rendering embed snippet: %s", err)
+		}
+	}
+}
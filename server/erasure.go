@@ -0,0 +1,168 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mitchellh/goamz/s3"
+)
+
+// ErasureRequest identifies a data subject by uploader id and/or IP. When
+// DeleteContent is set the matching images are removed entirely instead of
+// just having their uploader details stripped. Images under legal hold are
+// skipped either way and returned as `legalHold`. Quarantined uploads from
+// the subject are treated the same way.
+type ErasureRequest struct {
+	UploaderId    string `json:"uploaderId"`
+	UploaderIp    string `json:"uploaderIp"`
+	DeleteContent bool   `json:"deleteContent"`
+}
+
+func ErasurePostHandler(session *r.Session, s3bucket *s3.Bucket) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		log.Printf("POST ErasurePostHandler")
+
+		var erasure ErasureRequest
+		err := json.NewDecoder(req.Body).Decode(&erasure)
+		if err != nil {
+			http.Error(writer, "Error unmarshalling erasure request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		filter := map[string]interface{}{}
+		if erasure.UploaderId != "" {
+			filter["uploaderId"] = erasure.UploaderId
+		}
+		if erasure.UploaderIp != "" {
+			filter["uploaderIp"] = erasure.UploaderIp
+		}
+		if len(filter) == 0 {
+			http.Error(writer, "`uploaderId` or `uploaderIp` is required", http.StatusBadRequest)
+			return
+		}
+
+		cursor, err := r.Table("images").Filter(filter).Run(session)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var images []ImageEntry
+		err = cursor.All(&images)
+		cursor.Close()
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Images under legal hold are left exactly as they are and listed
+		// apart, so they can be erased once the hold is lifted
+		held := []string{}
+		erased := 0
+		for _, image := range images {
+			if image.LegalHold {
+				log.Printf("Not erasing image %s: image is under legal hold", image.Id)
+				held = append(held, image.Id)
+				continue
+			}
+			if erasure.DeleteContent {
+				err = eraseImage(session, s3bucket, image)
+			} else {
+				err = r.Table("images").Get(image.Id).Replace(
+					r.Row.Without("uploaderId", "uploaderIp", "uploaderUserAgent"),
+				).Exec(session)
+			}
+			if err != nil {
+				http.Error(writer, "Error erasing image "+image.Id+": "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			erased++
+		}
+
+		quarantined, err := eraseQuarantined(session, s3bucket, filter, erasure.DeleteContent)
+		if err != nil {
+			http.Error(writer, "Error erasing quarantined uploads: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		log.Printf("Erased uploader details from %v images and %v quarantined uploads, %v under legal hold", erased, quarantined, len(held))
+		jsonResponse, err := json.Marshal(map[string]interface{}{
+			"erased":         erased,
+			"quarantined":    quarantined,
+			"contentDeleted": erasure.DeleteContent,
+			"legalHold":      held,
+		})
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(jsonResponse)
+	}
+}
+
+// eraseQuarantined strips the uploader details from the quarantined uploads
+// matching the filter, or deletes them along with their objects, so a later
+// release can't bring the details back. It returns how many were erased.
+func eraseQuarantined(session *r.Session, s3bucket *s3.Bucket, filter map[string]interface{}, deleteContent bool) (int, error) {
+	cursor, err := r.Table("quarantine").Filter(map[string]interface{}{"image": filter}).Run(session)
+	if err != nil {
+		return 0, err
+	}
+	var entries []QuarantineEntry
+	err = cursor.All(&entries)
+	cursor.Close()
+	if err != nil {
+		return 0, err
+	}
+	for _, entry := range entries {
+		if deleteContent {
+			if entry.Image.S3Filename != "" {
+				err = s3bucket.Del(entry.Image.S3Filename)
+				if err != nil {
+					return 0, err
+				}
+			}
+			err = r.Table("quarantine").Get(entry.Id).Delete().Exec(session)
+		} else {
+			err = r.Table("quarantine").Get(entry.Id).Replace(
+				r.Row.Without(map[string]interface{}{
+					"image": []string{"uploaderId", "uploaderIp", "uploaderUserAgent"},
+				}),
+			).Exec(session)
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(entries), nil
+}
+
+// eraseImage deletes the stored object along with the image entry and jobs
+func eraseImage(session *r.Session, s3bucket *s3.Bucket, image ImageEntry) error {
+	err := deleteJobOutputs(session, s3bucket, image.Id)
+	if err != nil {
+		return err
+	}
+	err = deleteCaptions(s3bucket, image)
+	if err != nil {
+		return err
+	}
+	err = deleteRenders(s3bucket, image.Id)
+	if err != nil {
+		return err
+	}
+	if image.S3Filename != "" {
+		err = s3bucket.Del(image.S3Filename)
+		if err != nil {
+			return err
+		}
+	}
+	err = r.Table("jobs").Filter(map[string]interface{}{"imageId": image.Id}).Delete().Exec(session)
+	if err != nil {
+		return err
+	}
+	return r.Table("images").Get(image.Id).Delete().Exec(session)
+}
@@ -0,0 +1,154 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/thejsj/veenco/errcode"
+)
+
+// ErrorResponse is the JSON body of a failed request
+type ErrorResponse struct {
+	Code  errcode.Code `json:"code"`
+	Error string       `json:"error"`
+}
+
+// WriteError answers with a JSON error carrying a code from errcode
+func WriteError(writer http.ResponseWriter, status int, code errcode.Code, message string) {
+	jsonResponse, _ := json.Marshal(ErrorResponse{Code: code, Error: message})
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Header().Set("X-Content-Type-Options", "nosniff")
+	writer.WriteHeader(status)
+	writer.Write(jsonResponse)
+}
+
+// StatusOf is the status an error with this code is answered with when the
+// handler doesn't pick a more specific one
+func StatusOf(code errcode.Code) int {
+	switch code {
+	case errcode.InvalidRequest, errcode.PipelineTooLarge:
+		return http.StatusBadRequest
+	case errcode.Unauthorized:
+		return http.StatusUnauthorized
+	case errcode.Forbidden:
+		return http.StatusForbidden
+	case errcode.NotFound:
+		return http.StatusNotFound
+	case errcode.Conflict:
+		return http.StatusConflict
+	case errcode.PayloadTooLarge:
+		return http.StatusRequestEntityTooLarge
+	case errcode.UnsupportedFormat:
+		return http.StatusUnsupportedMediaType
+	case errcode.InvalidImage:
+		return http.StatusUnprocessableEntity
+	case errcode.QuotaExceeded, errcode.RateLimited:
+		return http.StatusTooManyRequests
+	case errcode.UploadTimeout:
+		return http.StatusRequestTimeout
+	case errcode.SourceUnavailable:
+		return http.StatusBadGateway
+	case errcode.ReadOnly, errcode.QueueUnavailable:
+		return http.StatusServiceUnavailable
+	case errcode.NotImplemented:
+		return http.StatusNotImplemented
+	}
+	return http.StatusInternalServerError
+}
+
+// codeOfStatus picks a code for an error response written without one
+func codeOfStatus(status int) errcode.Code {
+	switch status {
+	case http.StatusUnauthorized:
+		return errcode.Unauthorized
+	case http.StatusForbidden:
+		return errcode.Forbidden
+	case http.StatusNotFound:
+		return errcode.NotFound
+	case http.StatusConflict, http.StatusPreconditionFailed:
+		return errcode.Conflict
+	case http.StatusRequestEntityTooLarge:
+		return errcode.PayloadTooLarge
+	case http.StatusUnsupportedMediaType:
+		return errcode.UnsupportedFormat
+	case http.StatusUnprocessableEntity:
+		return errcode.InvalidImage
+	case http.StatusTooManyRequests:
+		return errcode.RateLimited
+	case http.StatusRequestTimeout:
+		return errcode.UploadTimeout
+	case http.StatusBadGateway:
+		return errcode.SourceUnavailable
+	case http.StatusNotImplemented:
+		return errcode.NotImplemented
+	}
+	if status < 500 {
+		return errcode.InvalidRequest
+	}
+	return errcode.Internal
+}
+
+// WriteErrorOf answers with the code attached to err and its status.
+// Missing documents are reported as NOT_FOUND and errors without a code as
+// INTERNAL. The message, when given, is put in front of the error's.
+func WriteErrorOf(writer http.ResponseWriter, err error, message string) {
+	code := errcode.Of(err)
+	if err == r.ErrEmptyResult {
+		code = errcode.NotFound
+	}
+	if message != "" {
+		message = fmt.Sprintf("%s : %s", message, err.Error())
+	} else {
+		message = err.Error()
+	}
+	WriteError(writer, StatusOf(code), code, message)
+}
+
+// errorEnvelopeWriter holds back plain text error responses, such as the
+// ones written by http.Error or the router, so they can be sent as JSON
+type errorEnvelopeWriter struct {
+	http.ResponseWriter
+	status  int
+	message bytes.Buffer
+}
+
+func (writer *errorEnvelopeWriter) WriteHeader(status int) {
+	if status >= 400 && strings.HasPrefix(writer.Header().Get("Content-Type"), "text/plain") {
+		writer.status = status
+		return
+	}
+	writer.ResponseWriter.WriteHeader(status)
+}
+
+func (writer *errorEnvelopeWriter) Write(data []byte) (int, error) {
+	if writer.status != 0 {
+		return writer.message.Write(data)
+	}
+	return writer.ResponseWriter.Write(data)
+}
+
+func (writer *errorEnvelopeWriter) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
+
+func (writer *errorEnvelopeWriter) Flush() {
+	if flusher, ok := writer.ResponseWriter.(http.Flusher); ok && writer.status == 0 {
+		flusher.Flush()
+	}
+}
+
+// ErrorEnvelope makes every failed request answer with an ErrorResponse.
+// Handlers that don't call WriteError get a code picked from their status.
+func ErrorEnvelope(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		envelopeWriter := &errorEnvelopeWriter{ResponseWriter: writer}
+		handler.ServeHTTP(envelopeWriter, req)
+		if envelopeWriter.status != 0 {
+			WriteError(writer, envelopeWriter.status, codeOfStatus(envelopeWriter.status), strings.TrimSpace(envelopeWriter.message.String()))
+		}
+	})
+}
@@ -0,0 +1,109 @@
+package server
+
+import (
+	"encoding/xml"
+	"log"
+	"net/http"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/julienschmidt/httprouter"
+	"github.com/thejsj/veenco/config"
+)
+
+const feedLength = 50
+
+type AtomLink struct {
+	Rel    string `xml:"rel,attr,omitempty"`
+	Href   string `xml:"href,attr"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length int    `xml:"length,attr,omitempty"`
+}
+
+type AtomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type AtomEntry struct {
+	Id      string     `xml:"id"`
+	Title   string     `xml:"title"`
+	Updated string     `xml:"updated"`
+	Links   []AtomLink `xml:"link"`
+}
+
+type AtomFeed struct {
+	XMLName xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	Id      string      `xml:"id"`
+	Title   string      `xml:"title"`
+	Updated string      `xml:"updated"`
+	Author  AtomAuthor  `xml:"author"`
+	Links   []AtomLink  `xml:"link"`
+	Entries []AtomEntry `xml:"entry"`
+}
+
+// feedEntryId keeps the urn:uuid: ids of entries from before ULIDs
+func feedEntryId(id string) string {
+	if len(id) == 36 {
+		return "urn:uuid:" + id
+	}
+	return "urn:ulid:" + id
+}
+
+// FeedGetHandler serves an Atom feed of the most recent uploads with an
+// enclosure link pointing at each original
+func FeedGetHandler(session *r.Session) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		log.Printf("GET FeedGetHandler")
+		query := r.Table("images").OrderBy(r.Desc("createAt"))
+		if filter := TenantFilter(req); filter != nil {
+			query = query.Filter(filter)
+		}
+		cursor, err := query.Limit(feedLength).Run(session)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var images []ImageEntry
+		err = cursor.All(&images)
+		cursor.Close()
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		selfUrl := requestScheme(req) + "://" + req.Host + req.URL.Path
+		feed := AtomFeed{
+			Id:      selfUrl,
+			Title:   "Recent uploads",
+			Updated: time.Now().UTC().Format(time.RFC3339),
+			// Atom needs an author for entries that don't name their own
+			Author: AtomAuthor{Name: config.String("FEED_AUTHOR", "enco")},
+			Links:  []AtomLink{{Rel: "self", Href: selfUrl}},
+		}
+		if len(images) > 0 {
+			feed.Updated = images[0].CreatedAt.UTC().Format(time.RFC3339)
+		}
+		for _, image := range images {
+			feed.Entries = append(feed.Entries, AtomEntry{
+				Id:      feedEntryId(image.Id),
+				Title:   image.OriginalFileName,
+				Updated: image.CreatedAt.UTC().Format(time.RFC3339),
+				Links: []AtomLink{{
+					Rel:    "enclosure",
+					Href:   contentUrl(req, image),
+					Type:   image.ContentType,
+					Length: image.Size,
+				}},
+			})
+		}
+
+		xmlResponse, err := xml.Marshal(feed)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/atom+xml")
+		writer.Write([]byte(xml.Header))
+		writer.Write(xmlResponse)
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"path"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// Filenames are cut to this many bytes, the limit of most filesystems
+const maxFilenameBytes = 255
+
+// NormalizeFilename puts client supplied filenames into NFC so visually
+// identical names made from combining characters compare equal. Any
+// directories the client sent are dropped, with either separator, and
+// names are cut to maxFilenameBytes, keeping the extension.
+func NormalizeFilename(filename string) string {
+	filename = strings.TrimSpace(filename)
+	if index := strings.LastIndexAny(filename, `/\`); index >= 0 {
+		filename = strings.TrimSpace(filename[index+1:])
+	}
+	filename = norm.NFC.String(filename)
+	if len(filename) <= maxFilenameBytes {
+		return filename
+	}
+	extension := path.Ext(filename)
+	if len(extension) > maxFilenameBytes/2 {
+		extension = ""
+	}
+	base := filename[:len(filename)-len(extension)]
+	cut := maxFilenameBytes - len(extension)
+	for cut > 0 && !utf8.RuneStart(base[cut]) {
+		cut--
+	}
+	return base[:cut] + extension
+}
+
+// KeyExtension returns the extension used in S3 keys. It is folded with NFKC
+// (so full-width `.ＪＰＧ` becomes `.jpg`) and lowercased, and extensions
+// that still contain anything but ASCII letters and digits are dropped.
+func KeyExtension(filename string) string {
+	extension := strings.ToLower(norm.NFKC.String(path.Ext(filename)))
+	if len(extension) < 2 {
+		return ""
+	}
+	for _, character := range extension[1:] {
+		if character > unicode.MaxASCII || !(unicode.IsLetter(character) || unicode.IsDigit(character)) {
+			return ""
+		}
+	}
+	return extension
+}
+
+// ContentDisposition builds a header value carrying both an ASCII fallback
+// filename and the full UTF-8 name encoded as per RFC 5987
+func ContentDisposition(disposition string, filename string) string {
+	filename = NormalizeFilename(filename)
+	if filename == "" {
+		return disposition
+	}
+	return fmt.Sprintf(`%s; filename="%s"; filename*=UTF-8''%s`, disposition, asciiFilename(filename), rfc5987Encode(filename))
+}
+
+func asciiFilename(filename string) string {
+	var fallback strings.Builder
+	for _, character := range norm.NFKD.String(filename) {
+		switch {
+		case character == '"' || character == '\\':
+			fallback.WriteRune('_')
+		case unicode.Is(unicode.Mn, character):
+			// Drop combining marks so é falls back to e
+		case character < 0x20 || character > 0x7e:
+			fallback.WriteRune('_')
+		default:
+			fallback.WriteRune(character)
+		}
+	}
+	return fallback.String()
+}
+
+func rfc5987Encode(value string) string {
+	// PathEscape leaves a few sub-delims RFC 5987 doesn't allow
+	escaped := url.PathEscape(value)
+	replacer := strings.NewReplacer("'", "%27", "(", "%28", ")", "%29", "*", "%2A", ",", "%2C", ";", "%3B", "=", "%3D", "@", "%40", ":", "%3A", "/", "%2F")
+	return replacer.Replace(escaped)
+}
@@ -0,0 +1,62 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestNormalizeFilename(t *testing.T) {
+	for filename, expected := range map[string]string{
+		"  cafe\u0301.jpg ":        "caf\u00e9.jpg",
+		"../../etc/passwd":         "passwd",
+		`C:\Users\me\photo.png`:    "photo.png",
+		"albums/2020/ summer.jpeg": "summer.jpeg",
+		"trailing/":                "",
+	} {
+		if normalized := NormalizeFilename(filename); normalized != expected {
+			t.Errorf("Expected %q to become %q, got %q", filename, expected, normalized)
+		}
+	}
+}
+
+func TestNormalizeFilenameCutsLongNames(t *testing.T) {
+	normalized := NormalizeFilename(strings.Repeat("é", 200) + ".jpeg")
+	if len(normalized) > maxFilenameBytes || !utf8.ValidString(normalized) || !strings.HasSuffix(normalized, "é.jpeg") {
+		t.Errorf("Expected a valid name of at most %d bytes ending in `.jpeg`, got %q (%d bytes)", maxFilenameBytes, normalized, len(normalized))
+	}
+	normalized = NormalizeFilename(strings.Repeat("a", 300))
+	if normalized != strings.Repeat("a", maxFilenameBytes) {
+		t.Errorf("Expected a name without an extension to be cut to %d bytes, got %d", maxFilenameBytes, len(normalized))
+	}
+}
+
+func TestKeyExtension(t *testing.T) {
+	for filename, expected := range map[string]string{
+		"photo.JPG":      ".jpg",
+		"photo.ＪＰＧ":      ".jpg",
+		"photo.jp g":     "",
+		"photo.é":        "",
+		"photo":          "",
+		"archive.tar.gz": ".gz",
+	} {
+		if extension := KeyExtension(filename); extension != expected {
+			t.Errorf("Expected the extension of %q to be %q, got %q", filename, expected, extension)
+		}
+	}
+}
+
+func TestContentDisposition(t *testing.T) {
+	for filename, expected := range map[string]string{
+		"":                   `inline`,
+		"café.jpg":           `inline; filename="cafe.jpg"; filename*=UTF-8''caf%C3%A9.jpg`,
+		`say "cheese".png`:   `inline; filename="say _cheese_.png"; filename*=UTF-8''say%20%22cheese%22.png`,
+		"a\r\nSet-Cookie: x": `inline; filename="a__Set-Cookie: x"; filename*=UTF-8''a%0D%0ASet-Cookie%3A%20x`,
+		"写真.jpg":             `inline; filename="__.jpg"; filename*=UTF-8''%E5%86%99%E7%9C%9F.jpg`,
+		"dir/name.jpg":       `inline; filename="name.jpg"; filename*=UTF-8''name.jpg`,
+	} {
+		if header := ContentDisposition("inline", filename); header != expected {
+			t.Errorf("Expected %q to give %s, got %s", filename, expected, header)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+)
+
+// IndexFilters turns the `contentType`, `originalFileName`, `createdAfter`
+// and `createdBefore` query params into filters for the image index.
+// originalFileName matches any part of the name, ignoring case, and the
+// dates take RFC 3339 timestamps or plain YYYY-MM-DD days.
+func IndexFilters(query url.Values) ([]interface{}, error) {
+	var filters []interface{}
+	if contentType := query.Get("contentType"); contentType != "" {
+		filters = append(filters, map[string]interface{}{"contentType": contentType})
+	}
+	if name := query.Get("originalFileName"); name != "" {
+		filters = append(filters, r.Row.Field("originalFileName").Default("").Match("(?i)"+regexp.QuoteMeta(name)))
+	}
+	if value := query.Get("createdAfter"); value != "" {
+		after, err := parseFilterTime(value)
+		if err != nil {
+			return nil, fmt.Errorf("`createdAfter` %s", err)
+		}
+		filters = append(filters, r.Row.Field("createAt").Ge(after))
+	}
+	if value := query.Get("createdBefore"); value != "" {
+		before, err := parseFilterTime(value)
+		if err != nil {
+			return nil, fmt.Errorf("`createdBefore` %s", err)
+		}
+		filters = append(filters, r.Row.Field("createAt").Lt(before))
+	}
+	return filters, nil
+}
+
+func parseFilterTime(value string) (time.Time, error) {
+	if parsed, err := time.Parse(time.RFC3339, value); err == nil {
+		return parsed, nil
+	}
+	parsed, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return parsed, fmt.Errorf("must be an RFC 3339 timestamp or a YYYY-MM-DD date")
+	}
+	return parsed, nil
+}
@@ -0,0 +1,418 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/thejsj/veenco/config"
+)
+
+// A small GraphQL implementation covering what the UI needs: a single query
+// operation with fields, aliases, arguments and variables. Fragments,
+// directives, mutations and introspection aren't supported.
+
+// graphqlMaxDepth bounds how deeply selections and values nest, from
+// GRAPHQL_MAX_DEPTH (6 by default). Every level of a selection can fan out
+// to a list of records, so depth is what makes a query expensive.
+func graphqlMaxDepth() int {
+	return config.Int("GRAPHQL_MAX_DEPTH", 6)
+}
+
+// graphqlMaxFields bounds how many fields a query selects in total, from
+// GRAPHQL_MAX_FIELDS (200 by default)
+func graphqlMaxFields() int {
+	return config.Int("GRAPHQL_MAX_FIELDS", 200)
+}
+
+// graphqlSelection is one field of a selection set
+type graphqlSelection struct {
+	Alias      string
+	Name       string
+	Arguments  map[string]interface{}
+	Selections []graphqlSelection
+}
+
+type graphqlToken struct {
+	kind     string // "name", "number", "string", "eof" or the punctuator itself
+	text     string
+	position int
+}
+
+func graphqlTokenize(query string) ([]graphqlToken, error) {
+	var tokens []graphqlToken
+	for position := 0; position < len(query); {
+		character := query[position]
+		switch {
+		case strings.ContainsRune(" \t\r\n,", rune(character)):
+			position++
+		case character == '#':
+			for position < len(query) && query[position] != '\n' {
+				position++
+			}
+		case strings.HasPrefix(query[position:], "..."):
+			tokens = append(tokens, graphqlToken{kind: "...", text: "...", position: position})
+			position += 3
+		case strings.ContainsRune("{}()[]:$!=@", rune(character)):
+			tokens = append(tokens, graphqlToken{kind: string(character), text: string(character), position: position})
+			position++
+		case character == '_' || (character|0x20 >= 'a' && character|0x20 <= 'z'):
+			start := position
+			for position < len(query) && (query[position] == '_' || (query[position]|0x20 >= 'a' && query[position]|0x20 <= 'z') || (query[position] >= '0' && query[position] <= '9')) {
+				position++
+			}
+			tokens = append(tokens, graphqlToken{kind: "name", text: query[start:position], position: start})
+		case character == '-' || (character >= '0' && character <= '9'):
+			start := position
+			position++
+			for position < len(query) && strings.ContainsRune("0123456789.eE+-", rune(query[position])) {
+				position++
+			}
+			tokens = append(tokens, graphqlToken{kind: "number", text: query[start:position], position: start})
+		case character == '"':
+			start := position
+			position++
+			for position < len(query) && query[position] != '"' {
+				if query[position] == '\\' {
+					position++
+				}
+				position++
+			}
+			if position >= len(query) {
+				return nil, fmt.Errorf("Unterminated string at position %d", start)
+			}
+			position++
+			tokens = append(tokens, graphqlToken{kind: "string", text: query[start:position], position: start})
+		default:
+			return nil, fmt.Errorf("Unexpected character %q at position %d", character, position)
+		}
+	}
+	return append(tokens, graphqlToken{kind: "eof", position: len(query)}), nil
+}
+
+type graphqlParser struct {
+	tokens    []graphqlToken
+	next      int
+	variables map[string]interface{}
+	// How deeply the parser is nested and how many fields it has read,
+	// against their limits
+	depth     int
+	maxDepth  int
+	fields    int
+	maxFields int
+}
+
+// nest enters a selection set, list or object, failing past maxDepth.
+// Callers leave it with `defer parser.unnest()`.
+func (parser *graphqlParser) nest(position int) error {
+	parser.depth++
+	if parser.depth > parser.maxDepth {
+		return fmt.Errorf("The query nests deeper than %d levels at position %d", parser.maxDepth, position)
+	}
+	return nil
+}
+
+func (parser *graphqlParser) unnest() {
+	parser.depth--
+}
+
+func (parser *graphqlParser) peek() graphqlToken {
+	return parser.tokens[parser.next]
+}
+
+func (parser *graphqlParser) accept(kind string) bool {
+	if parser.peek().kind != kind {
+		return false
+	}
+	parser.next++
+	return true
+}
+
+func (parser *graphqlParser) expect(kind string) (graphqlToken, error) {
+	token := parser.peek()
+	if token.kind != kind {
+		found := token.text
+		if token.kind == "eof" {
+			found = "the end of the query"
+		}
+		return token, fmt.Errorf("Expected %s at position %d, found %s", kind, token.position, found)
+	}
+	parser.next++
+	return token, nil
+}
+
+// ParseGraphQL parses a query document, substituting variables as it goes,
+// and returns the operation's top-level selections
+func ParseGraphQL(query string, variables map[string]interface{}) ([]graphqlSelection, error) {
+	tokens, err := graphqlTokenize(query)
+	if err != nil {
+		return nil, err
+	}
+	if variables == nil {
+		variables = map[string]interface{}{}
+	}
+	parser := &graphqlParser{tokens: tokens, variables: variables, maxDepth: graphqlMaxDepth(), maxFields: graphqlMaxFields()}
+	if token := parser.peek(); token.kind == "name" {
+		if token.text != "query" {
+			return nil, fmt.Errorf("Only queries are supported, found `%s`", token.text)
+		}
+		parser.next++
+		parser.accept("name")
+		if parser.accept("(") {
+			err = parser.variableDefinitions()
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	selections, err := parser.selectionSet()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = parser.expect("eof"); err != nil {
+		return nil, fmt.Errorf("Only one operation per request is supported: %s", err)
+	}
+	return selections, nil
+}
+
+// variableDefinitions reads `$name: Type = default` entries up to the
+// closing parenthesis. Types aren't checked; defaults fill in variables the
+// request didn't send.
+func (parser *graphqlParser) variableDefinitions() error {
+	for !parser.accept(")") {
+		if _, err := parser.expect("$"); err != nil {
+			return err
+		}
+		name, err := parser.expect("name")
+		if err != nil {
+			return err
+		}
+		if _, err = parser.expect(":"); err != nil {
+			return err
+		}
+		for parser.accept("[") {
+		}
+		if _, err = parser.expect("name"); err != nil {
+			return err
+		}
+		for parser.accept("!") || parser.accept("]") {
+		}
+		if parser.accept("=") {
+			value, err := parser.value()
+			if err != nil {
+				return err
+			}
+			if _, ok := parser.variables[name.text]; !ok {
+				parser.variables[name.text] = value
+			}
+		}
+	}
+	return nil
+}
+
+func (parser *graphqlParser) selectionSet() ([]graphqlSelection, error) {
+	open, err := parser.expect("{")
+	if err != nil {
+		return nil, err
+	}
+	if err = parser.nest(open.position); err != nil {
+		return nil, err
+	}
+	defer parser.unnest()
+	var selections []graphqlSelection
+	for !parser.accept("}") {
+		if token := parser.peek(); token.kind == "..." || token.kind == "@" {
+			return nil, fmt.Errorf("Fragments and directives aren't supported (position %d)", token.position)
+		}
+		name, err := parser.expect("name")
+		if err != nil {
+			return nil, err
+		}
+		parser.fields++
+		if parser.fields > parser.maxFields {
+			return nil, fmt.Errorf("The query selects more than %d fields", parser.maxFields)
+		}
+		selection := graphqlSelection{Alias: name.text, Name: name.text, Arguments: map[string]interface{}{}}
+		if parser.accept(":") {
+			name, err = parser.expect("name")
+			if err != nil {
+				return nil, err
+			}
+			selection.Name = name.text
+		}
+		if parser.accept("(") {
+			for !parser.accept(")") {
+				argument, err := parser.expect("name")
+				if err != nil {
+					return nil, err
+				}
+				if _, err = parser.expect(":"); err != nil {
+					return nil, err
+				}
+				selection.Arguments[argument.text], err = parser.value()
+				if err != nil {
+					return nil, err
+				}
+			}
+		}
+		if parser.peek().kind == "{" {
+			selection.Selections, err = parser.selectionSet()
+			if err != nil {
+				return nil, err
+			}
+		}
+		selections = append(selections, selection)
+	}
+	if len(selections) == 0 {
+		return nil, fmt.Errorf("Empty selection set at position %d", parser.tokens[parser.next-1].position)
+	}
+	return selections, nil
+}
+
+// value reads a literal, list, object or variable. Numbers become float64
+// like they do when decoding JSON variables, so resolvers see one type.
+func (parser *graphqlParser) value() (interface{}, error) {
+	token := parser.peek()
+	if token.kind == "eof" {
+		return nil, fmt.Errorf("Expected a value at position %d", token.position)
+	}
+	parser.next++
+	if token.kind == "[" || token.kind == "{" {
+		if err := parser.nest(token.position); err != nil {
+			return nil, err
+		}
+		defer parser.unnest()
+	}
+	switch token.kind {
+	case "$":
+		name, err := parser.expect("name")
+		if err != nil {
+			return nil, err
+		}
+		return parser.variables[name.text], nil
+	case "number", "string":
+		var value interface{}
+		if err := json.Unmarshal([]byte(token.text), &value); err != nil {
+			return nil, fmt.Errorf("Invalid %s at position %d", token.kind, token.position)
+		}
+		return value, nil
+	case "name":
+		switch token.text {
+		case "true":
+			return true, nil
+		case "false":
+			return false, nil
+		case "null":
+			return nil, nil
+		}
+		// Enum values are passed on as strings
+		return token.text, nil
+	case "[":
+		list := []interface{}{}
+		for !parser.accept("]") {
+			value, err := parser.value()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+		return list, nil
+	case "{":
+		object := map[string]interface{}{}
+		for !parser.accept("}") {
+			name, err := parser.expect("name")
+			if err != nil {
+				return nil, err
+			}
+			if _, err = parser.expect(":"); err != nil {
+				return nil, err
+			}
+			object[name.text], err = parser.value()
+			if err != nil {
+				return nil, err
+			}
+		}
+		return object, nil
+	}
+	return nil, fmt.Errorf("Expected a value at position %d", token.position)
+}
+
+// graphqlType is an object type. Scalars are read straight from the source
+// record; fields need a resolver and return objects of their Type.
+type graphqlType struct {
+	Name    string
+	Scalars []string
+	Fields  map[string]graphqlField
+}
+
+type graphqlField struct {
+	Type *graphqlType
+	// Returns a map[string]interface{}, a slice of them, or nil
+	Resolve func(source map[string]interface{}, arguments map[string]interface{}) (interface{}, error)
+}
+
+type GraphQLError struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// executeGraphQL resolves the selections against source, recording errors
+// and leaving the failed fields null
+func executeGraphQL(objectType *graphqlType, source map[string]interface{}, selections []graphqlSelection, path []interface{}, errors *[]GraphQLError) map[string]interface{} {
+	result := map[string]interface{}{}
+	for _, selection := range selections {
+		fieldPath := append(append([]interface{}{}, path...), selection.Alias)
+		if selection.Name == "__typename" {
+			result[selection.Alias] = objectType.Name
+			continue
+		}
+		field, isObject := objectType.Fields[selection.Name]
+		if !isObject {
+			if !containsString(objectType.Scalars, selection.Name) {
+				*errors = append(*errors, GraphQLError{Message: fmt.Sprintf("%s has no field `%s`", objectType.Name, selection.Name), Path: fieldPath})
+				continue
+			}
+			if selection.Selections != nil {
+				*errors = append(*errors, GraphQLError{Message: fmt.Sprintf("`%s` is a scalar and takes no selection set", selection.Name), Path: fieldPath})
+			}
+			result[selection.Alias] = source[selection.Name]
+			continue
+		}
+		if selection.Selections == nil {
+			*errors = append(*errors, GraphQLError{Message: fmt.Sprintf("`%s` needs a selection set", selection.Name), Path: fieldPath})
+			continue
+		}
+
+		value, err := field.Resolve(source, selection.Arguments)
+		if err != nil {
+			*errors = append(*errors, GraphQLError{Message: err.Error(), Path: fieldPath})
+			result[selection.Alias] = nil
+			continue
+		}
+		result[selection.Alias] = resolveGraphQLValue(field.Type, value, selection.Selections, fieldPath, errors)
+	}
+	return result
+}
+
+func resolveGraphQLValue(objectType *graphqlType, value interface{}, selections []graphqlSelection, path []interface{}, errors *[]GraphQLError) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		if value == nil {
+			return nil
+		}
+		return executeGraphQL(objectType, value, selections, path, errors)
+	case []map[string]interface{}:
+		list := make([]interface{}, len(value))
+		for i, item := range value {
+			list[i] = executeGraphQL(objectType, item, selections, append(path, i), errors)
+		}
+		return list
+	case [][]map[string]interface{}:
+		list := make([]interface{}, len(value))
+		for i, item := range value {
+			list[i] = resolveGraphQLValue(objectType, item, selections, append(path, i), errors)
+		}
+		return list
+	}
+	return nil
+}
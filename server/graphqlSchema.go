@@ -0,0 +1,255 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/thejsj/veenco/errcode"
+)
+
+type GraphQLRequest struct {
+	Query     string                 `json:"query"`
+	Variables map[string]interface{} `json:"variables"`
+}
+
+type GraphQLResponse struct {
+	Data   interface{}    `json:"data"`
+	Errors []GraphQLError `json:"errors,omitempty"`
+}
+
+// scalarNames lists the keys records of these types are encoded with
+func scalarNames(types ...reflect.Type) []string {
+	builder := &schemaBuilder{components: map[string]interface{}{}}
+	var names []string
+	for _, t := range types {
+		for name := range builder.object(t)["properties"].(map[string]interface{}) {
+			if !containsString(names, name) {
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+func stringArgument(arguments map[string]interface{}, name string) (string, error) {
+	value, ok := arguments[name].(string)
+	if !ok || value == "" {
+		return "", fmt.Errorf("`%s` must be a string", name)
+	}
+	return value, nil
+}
+
+func intArgument(arguments map[string]interface{}, name string, fallback int) (int, error) {
+	value, ok := arguments[name]
+	if !ok || value == nil {
+		return fallback, nil
+	}
+	number, ok := value.(float64)
+	if !ok || number != float64(int(number)) {
+		return 0, fmt.Errorf("`%s` must be an integer", name)
+	}
+	return int(number), nil
+}
+
+// graphqlSchema builds the query type for a request, so resolvers see the
+// caller's tenant. Images and jobs are returned as stored: images with
+// their JSON field names and a signed `url`, jobs with their database ones.
+func graphqlSchema(session *r.Session, s3bucket *s3.Bucket, req *http.Request) *graphqlType {
+	imageType := &graphqlType{Name: "Image", Scalars: append(scalarNames(reflect.TypeOf(ImageEntry{})), "url")}
+	jobType := &graphqlType{Name: "Job", Scalars: scalarNames(reflect.TypeOf(ImageResizeToWidthPxJob{}))}
+	outputType := &graphqlType{Name: "Output", Scalars: []string{"jobId", "jobType", "key", "url"}}
+	chainType := &graphqlType{Name: "Chain", Scalars: []string{"id"}}
+
+	imageRecord := func(imageEntry ImageEntry) (map[string]interface{}, error) {
+		var record map[string]interface{}
+		encoded, err := json.Marshal(imageEntry)
+		if err == nil {
+			err = json.Unmarshal(encoded, &record)
+		}
+		if record != nil {
+			record["url"] = imageEntry.Url(s3bucket)
+		}
+		return record, err
+	}
+	images := func(query r.Term) ([]map[string]interface{}, error) {
+		var imageEntries []ImageEntry
+		err := chainRecords(query, session, &imageEntries)
+		records := []map[string]interface{}{}
+		for _, imageEntry := range imageEntries {
+			if err != nil || !CanAccess(req, imageEntry.OwnerId) {
+				continue
+			}
+			var record map[string]interface{}
+			record, err = imageRecord(imageEntry)
+			records = append(records, record)
+		}
+		return records, err
+	}
+	image := func(idOrSlug string) (interface{}, error) {
+		imageEntry, err := LookupImageEntry(session, idOrSlug, RequestTenant(req))
+		if err == r.ErrEmptyResult || (err == nil && !CanAccess(req, imageEntry.OwnerId)) {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		return imageRecord(imageEntry)
+	}
+	jobs := func(query r.Term) ([]map[string]interface{}, error) {
+		var found []map[string]interface{}
+		err := chainRecords(query, session, &found)
+		records := []map[string]interface{}{}
+		for _, job := range found {
+			if ownerId, _ := job["ownerId"].(string); CanAccess(req, ownerId) {
+				defaultJobStatus(job)
+				records = append(records, job)
+			}
+		}
+		return records, err
+	}
+	job := func(id string) (interface{}, error) {
+		if id == "" {
+			return nil, nil
+		}
+		found, err := jobs(r.Table("jobs").GetAll(id))
+		if err != nil || len(found) == 0 {
+			return nil, err
+		}
+		return found[0], nil
+	}
+	imageJobs := func(source map[string]interface{}) ([]map[string]interface{}, error) {
+		id, _ := source["id"].(string)
+		return jobs(r.Table("jobs").GetAllByIndex("imageId", id))
+	}
+
+	imageType.Fields = map[string]graphqlField{
+		"jobs": {Type: jobType, Resolve: func(source map[string]interface{}, _ map[string]interface{}) (interface{}, error) {
+			return imageJobs(source)
+		}},
+		// Each chain lists its jobs in the order they run
+		"jobChains": {Type: jobType, Resolve: func(source map[string]interface{}, _ map[string]interface{}) (interface{}, error) {
+			found, err := imageJobs(source)
+			return JobChains(found), err
+		}},
+		"outputs": {Type: outputType, Resolve: func(source map[string]interface{}, _ map[string]interface{}) (interface{}, error) {
+			found, err := imageJobs(source)
+			outputs := []map[string]interface{}{}
+			for _, job := range found {
+				if key := jobString(job, "outputKey"); key != "" {
+					outputs = append(outputs, map[string]interface{}{
+						"jobId":   job["id"],
+						"jobType": job["jobType"],
+						"key":     key,
+						"url":     SignedUrl(s3bucket, key, signedUrlTTL()),
+					})
+				}
+			}
+			return outputs, err
+		}},
+	}
+	jobType.Fields = map[string]graphqlField{
+		"image": {Type: imageType, Resolve: func(source map[string]interface{}, _ map[string]interface{}) (interface{}, error) {
+			return image(jobString(source, "imageId"))
+		}},
+		"next": {Type: jobType, Resolve: func(source map[string]interface{}, _ map[string]interface{}) (interface{}, error) {
+			return job(jobString(source, "nextJob"))
+		}},
+	}
+	chainType.Fields = map[string]graphqlField{
+		"images": {Type: imageType, Resolve: func(source map[string]interface{}, _ map[string]interface{}) (interface{}, error) {
+			return images(r.Table("images").GetAllByIndex("chainId", source["id"]))
+		}},
+		"jobs": {Type: jobType, Resolve: func(source map[string]interface{}, _ map[string]interface{}) (interface{}, error) {
+			return jobs(r.Table("jobs").GetAllByIndex("chainId", source["id"]).OrderBy("createdAt"))
+		}},
+	}
+
+	return &graphqlType{Name: "Query", Fields: map[string]graphqlField{
+		"image": {Type: imageType, Resolve: func(_ map[string]interface{}, arguments map[string]interface{}) (interface{}, error) {
+			id, err := stringArgument(arguments, "id")
+			if err != nil {
+				return nil, err
+			}
+			return image(id)
+		}},
+		"images": {Type: imageType, Resolve: func(_ map[string]interface{}, arguments map[string]interface{}) (interface{}, error) {
+			page := Page{}
+			var err error
+			page.Limit, err = intArgument(arguments, "limit", defaultPageLimit)
+			if err != nil || page.Limit < 1 || page.Limit > maxPageLimit {
+				return nil, fmt.Errorf("`limit` must be between 1 and %v", maxPageLimit)
+			}
+			page.Offset, err = intArgument(arguments, "offset", 0)
+			if err != nil || page.Offset < 0 {
+				return nil, fmt.Errorf("`offset` must be a positive number")
+			}
+			query := page.OrderedImages()
+			if filter := TenantFilter(req); filter != nil {
+				query = query.Filter(filter)
+			}
+			return images(page.Slice(query))
+		}},
+		"job": {Type: jobType, Resolve: func(_ map[string]interface{}, arguments map[string]interface{}) (interface{}, error) {
+			id, err := stringArgument(arguments, "id")
+			if err != nil {
+				return nil, err
+			}
+			return job(id)
+		}},
+		"chain": {Type: chainType, Resolve: func(_ map[string]interface{}, arguments map[string]interface{}) (interface{}, error) {
+			id, err := stringArgument(arguments, "id")
+			if err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{"id": id}, nil
+		}},
+	}}
+}
+
+// GraphQLHandler answers queries over images, their outputs and job chains,
+// taken from a JSON body on POST or the `query` parameter on GET
+func GraphQLHandler(session *r.Session, s3bucket *s3.Bucket) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		log.Printf("%s GraphQLHandler", req.Method)
+		var graphqlRequest GraphQLRequest
+		if req.Method == http.MethodGet {
+			graphqlRequest.Query = req.URL.Query().Get("query")
+			if variables := req.URL.Query().Get("variables"); variables != "" {
+				if err := json.Unmarshal([]byte(variables), &graphqlRequest.Variables); err != nil {
+					WriteError(writer, http.StatusBadRequest, errcode.InvalidRequest, "`variables` must be a JSON object")
+					return
+				}
+			}
+		} else if err := json.NewDecoder(req.Body).Decode(&graphqlRequest); err != nil {
+			WriteError(writer, http.StatusBadRequest, errcode.InvalidRequest, "Error unmarshalling GraphQL request: "+err.Error())
+			return
+		}
+
+		response := GraphQLResponse{}
+		selections, err := ParseGraphQL(graphqlRequest.Query, graphqlRequest.Variables)
+		if err != nil {
+			response.Errors = []GraphQLError{{Message: err.Error()}}
+		} else {
+			response.Data = executeGraphQL(graphqlSchema(session, s3bucket, req), nil, selections, nil, &response.Errors)
+		}
+
+		jsonResponse, err := json.Marshal(response)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		if response.Data == nil {
+			writer.WriteHeader(http.StatusBadRequest)
+		}
+		writer.Write(jsonResponse)
+	}
+}
@@ -0,0 +1,119 @@
+package server
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestGraphQLTokenize(t *testing.T) {
+	tokens, err := graphqlTokenize(`query($id: ID!) { image(id: $id, n: -1.5e2) { url } } # done`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var kinds []string
+	for _, token := range tokens {
+		kinds = append(kinds, token.kind)
+	}
+	expected := []string{"name", "(", "$", "name", ":", "name", "!", ")", "{", "name", "(", "name", ":", "$", "name", "name", ":", "number", ")", "{", "name", "}", "}", "eof"}
+	if !reflect.DeepEqual(kinds, expected) {
+		t.Errorf("Expected %v, got %v", expected, kinds)
+	}
+
+	tokens, err = graphqlTokenize(`"a \"quoted\" string"`)
+	if err != nil || tokens[0].text != `"a \"quoted\" string"` {
+		t.Errorf("Expected the escaped quotes to stay in the string, got %v (%v)", tokens, err)
+	}
+	for _, query := range []string{`"unterminated`, `{ image % }`} {
+		if _, err := graphqlTokenize(query); err == nil {
+			t.Errorf("Expected %q to fail", query)
+		}
+	}
+}
+
+func TestParseGraphQL(t *testing.T) {
+	selections, err := ParseGraphQL(`query Images($limit: Int = 5, $tags: [String!]) {
+		first: images(limit: $limit, where: {tags: $tags, public: true}) { id }
+		image(id: "abc") { jobs { id } }
+	}`, map[string]interface{}{"tags": []interface{}{"a"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selections) != 2 {
+		t.Fatalf("Expected 2 selections, got %v", selections)
+	}
+	images := selections[0]
+	if images.Alias != "first" || images.Name != "images" {
+		t.Errorf("Expected the alias `first` for `images`, got %v", images)
+	}
+	expected := map[string]interface{}{
+		"limit": float64(5),
+		"where": map[string]interface{}{"tags": []interface{}{"a"}, "public": true},
+	}
+	if !reflect.DeepEqual(images.Arguments, expected) {
+		t.Errorf("Expected arguments %v, got %v", expected, images.Arguments)
+	}
+	if jobs := selections[1].Selections; len(jobs) != 1 || jobs[0].Name != "jobs" || len(jobs[0].Selections) != 1 {
+		t.Errorf("Expected image { jobs { id } }, got %v", selections[1])
+	}
+}
+
+func TestParseGraphQLRejects(t *testing.T) {
+	for query, message := range map[string]string{
+		`mutation { deleteImage(id: "a") { id } }`:    "Only queries",
+		`{ image(id: "a") { ...fields } }`:            "Fragments",
+		`{ image(id: "a") { id } } { images { id } }`: "one operation",
+		`{ }`:                    "Empty selection set",
+		`{ image(id: ) { id } }`: "Expected a value",
+		`{ a { b { c { d { e { f { g } } } } } } }`: "deeper than 6",
+		`{ image(id: [[[[[[["a"]]]]]]]) { id } }`:   "deeper than 6",
+		"{ " + strings.Repeat("id ", 201) + "}":     "more than 200 fields",
+	} {
+		_, err := ParseGraphQL(query, nil)
+		if err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("Expected %q to fail with %q, got %v", query, message, err)
+		}
+	}
+}
+
+func TestExecuteGraphQL(t *testing.T) {
+	jobType := &graphqlType{Name: "Job", Scalars: []string{"id", "status"}}
+	imageType := &graphqlType{Name: "Image", Scalars: []string{"id"}}
+	imageType.Fields = map[string]graphqlField{
+		"jobs": {Type: jobType, Resolve: func(source map[string]interface{}, _ map[string]interface{}) (interface{}, error) {
+			return []map[string]interface{}{{"id": source["id"].(string) + "-1", "status": "done"}}, nil
+		}},
+		"broken": {Type: jobType, Resolve: func(map[string]interface{}, map[string]interface{}) (interface{}, error) {
+			return nil, errors.New("Database unavailable")
+		}},
+	}
+	queryType := &graphqlType{Name: "Query", Fields: map[string]graphqlField{
+		"image": {Type: imageType, Resolve: func(_ map[string]interface{}, arguments map[string]interface{}) (interface{}, error) {
+			return map[string]interface{}{"id": arguments["id"]}, nil
+		}},
+	}}
+
+	selections, err := ParseGraphQL(`{ image(id: "a") { __typename id jobs { status } broken { id } missing } }`, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var graphqlErrors []GraphQLError
+	data := executeGraphQL(queryType, nil, selections, nil, &graphqlErrors)
+	expected := map[string]interface{}{"image": map[string]interface{}{
+		"__typename": "Image",
+		"id":         "a",
+		"jobs":       []interface{}{map[string]interface{}{"status": "done"}},
+		"broken":     nil,
+	}}
+	if !reflect.DeepEqual(data, expected) {
+		t.Errorf("Expected %v, got %v", expected, data)
+	}
+	expectedErrors := []GraphQLError{
+		{Message: "Database unavailable", Path: []interface{}{"image", "broken"}},
+		{Message: "Image has no field `missing`", Path: []interface{}{"image", "missing"}},
+	}
+	if !reflect.DeepEqual(graphqlErrors, expectedErrors) {
+		t.Errorf("Expected errors %v, got %v", expectedErrors, graphqlErrors)
+	}
+}
@@ -0,0 +1,25 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/thejsj/veenco/config"
+)
+
+func HealthzHandler() func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		jsonResponse, err := json.Marshal(map[string]interface{}{
+			"status":        "ok",
+			"configVersion": config.Version(),
+			"readOnly":      ReadOnly(),
+		})
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(jsonResponse)
+	}
+}
@@ -0,0 +1,255 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/julienschmidt/httprouter"
+	"github.com/thejsj/veenco/config"
+	"github.com/thejsj/veenco/errcode"
+)
+
+const idempotencyTableName = "idempotencyKeys"
+
+// Response headers replayed along with the body of a stored response
+var idempotentHeaders = []string{"Content-Type", "Location", "ETag", "X-Image-Id", "Upload-Offset", "Tus-Resumable"}
+
+// IdempotencyRecord is the stored outcome of a request sent with an
+// Idempotency-Key. Status is 0 while the first request is still running.
+type IdempotencyRecord struct {
+	Id          string            `gorethink:"id" json:"id"`
+	Fingerprint string            `gorethink:"fingerprint,omitempty" json:"fingerprint,omitempty"`
+	Status      int               `gorethink:"status" json:"status"`
+	Header      map[string]string `gorethink:"header,omitempty" json:"header,omitempty"`
+	Body        string            `gorethink:"body" json:"body"`
+	CreatedAt   time.Time         `gorethink:"createdAt" json:"createdAt"`
+	ExpiresAt   time.Time         `gorethink:"expiresAt" json:"expiresAt"`
+}
+
+// idempotencyKeyTTL is how long a key's response is kept, from
+// IDEMPOTENCY_KEY_TTL
+func idempotencyKeyTTL() time.Duration {
+	return config.Duration("IDEMPOTENCY_KEY_TTL", 24*time.Hour)
+}
+
+// idempotencyPendingTimeout is how long a retry waits on a first request
+// before assuming it died without storing a response, from
+// IDEMPOTENCY_PENDING_TIMEOUT
+func idempotencyPendingTimeout() time.Duration {
+	return config.Duration("IDEMPOTENCY_PENDING_TIMEOUT", 10*time.Minute)
+}
+
+// idempotencyRecordId scopes a key to the tenant and route it was sent to,
+// so the same key can't replay another tenant's response or another
+// endpoint's
+func idempotencyRecordId(req *http.Request, key string) string {
+	path := strings.TrimSuffix(unversionedPath(req.URL.Path), "/")
+	hash := sha256.Sum256([]byte(RequestTenant(req) + "\n" + req.Method + "\n" + path + "\n" + key))
+	return hex.EncodeToString(hash[:])
+}
+
+// idempotencyFingerprintBytes bounds how much of a body is hashed into its
+// fingerprint, from IDEMPOTENCY_FINGERPRINT_BYTES (512MB by default, the
+// same as uploads)
+func idempotencyFingerprintBytes() int64 {
+	return int64(config.Int("IDEMPOTENCY_FINGERPRINT_BYTES", 512<<20))
+}
+
+// fingerprintBody hashes the method, path and body of a request as the
+// handler reads it, so a key reused for a different request can be told
+// apart without holding the body in memory
+type fingerprintBody struct {
+	io.ReadCloser
+	hash      hash.Hash
+	remaining int64
+}
+
+func newFingerprintBody(req *http.Request) *fingerprintBody {
+	body := &fingerprintBody{ReadCloser: req.Body, hash: sha256.New(), remaining: idempotencyFingerprintBytes()}
+	body.hash.Write([]byte(req.Method + "\n" + unversionedPath(req.URL.Path) + "?" + req.URL.RawQuery + "\n"))
+	return body
+}
+
+func (body *fingerprintBody) Read(buffer []byte) (int, error) {
+	n, err := body.ReadCloser.Read(buffer)
+	hashed := int64(n)
+	if hashed > body.remaining {
+		hashed = body.remaining
+	}
+	body.hash.Write(buffer[:hashed])
+	body.remaining -= hashed
+	return n, err
+}
+
+// fingerprint reads whatever the handler left of the body and returns the
+// hash of the whole request
+func (body *fingerprintBody) fingerprint() string {
+	io.Copy(ioutil.Discard, io.LimitReader(body, body.remaining))
+	return hex.EncodeToString(body.hash.Sum(nil))
+}
+
+type idempotencyContextKey struct{}
+
+// idempotencyProgress tracks whether a request has changed something that
+// a retry mustn't do again
+type idempotencyProgress struct {
+	committed bool
+}
+
+// markIdempotentCommitted records that the request has had an effect, such
+// as queueing a task, so its response is kept even when it fails later on
+func markIdempotentCommitted(req *http.Request) {
+	if progress, ok := req.Context().Value(idempotencyContextKey{}).(*idempotencyProgress); ok {
+		progress.committed = true
+	}
+}
+
+// claimIdempotencyKey stores a pending record for the key. It returns the
+// existing record instead when the key was already used and hasn't
+// expired.
+func claimIdempotencyKey(session *r.Session, id string) (*IdempotencyRecord, error) {
+	now := time.Now()
+	for {
+		response, err := r.Table(idempotencyTableName).Insert(IdempotencyRecord{
+			Id:        id,
+			CreatedAt: now,
+			ExpiresAt: now.Add(idempotencyKeyTTL()),
+		}).RunWrite(session)
+		// A key that is already stored is reported as a write error
+		if err != nil && response.Errors == 0 {
+			return nil, err
+		}
+		if response.Inserted == 1 {
+			return nil, nil
+		}
+
+		var existing IdempotencyRecord
+		cursor, err := r.Table(idempotencyTableName).Get(id).Run(session)
+		if err == nil {
+			err = cursor.One(&existing)
+			cursor.Close()
+		}
+		if err == r.ErrEmptyResult {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		abandoned := existing.Status == 0 && now.Sub(existing.CreatedAt) > idempotencyPendingTimeout()
+		if existing.ExpiresAt.After(now) && !abandoned {
+			return &existing, nil
+		}
+		// Expired and abandoned keys are treated as never used
+		err = r.Table(idempotencyTableName).Get(id).Delete().Exec(session)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// replayIdempotentResponse answers with a stored response
+func replayIdempotentResponse(writer http.ResponseWriter, record *IdempotencyRecord) {
+	for name, value := range record.Header {
+		writer.Header().Set(name, value)
+	}
+	writer.Header().Set("Idempotent-Replayed", "true")
+	writer.WriteHeader(record.Status)
+	writer.Write([]byte(record.Body))
+}
+
+// Idempotent lets clients retry a POST safely by sending the same
+// Idempotency-Key header. The first request with a key runs as usual and
+// its response is stored for IDEMPOTENCY_KEY_TTL (24h by default); retries
+// get that response back instead of creating another image or job chain.
+// A retry that arrives while the first request is still running gets a
+// 409, and one with a different method, path or body than the first gets a
+// 422. Server errors aren't stored, so the request can be retried for real,
+// unless the request already queued work before failing; then its partial
+// result is kept so a retry doesn't queue it twice.
+func Idempotent(session *r.Session, handle httprouter.Handle) httprouter.Handle {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		key := req.Header.Get("Idempotency-Key")
+		if key == "" {
+			handle(writer, req, params)
+			return
+		}
+		if len(key) > 255 {
+			WriteError(writer, http.StatusBadRequest, errcode.InvalidRequest, "`Idempotency-Key` can be at most 255 characters")
+			return
+		}
+
+		id := idempotencyRecordId(req, key)
+		existing, err := claimIdempotencyKey(session, id)
+		if err != nil {
+			WriteError(writer, http.StatusInternalServerError, errcode.StorageUnavailable, "Error storing idempotency key: "+err.Error())
+			return
+		}
+		if existing != nil && existing.Status == 0 {
+			WriteError(writer, http.StatusConflict, errcode.Conflict, "A request with this `Idempotency-Key` is still being processed")
+			return
+		}
+		body := newFingerprintBody(req)
+		if existing != nil {
+			if existing.Fingerprint != "" && existing.Fingerprint != body.fingerprint() {
+				WriteError(writer, http.StatusUnprocessableEntity, errcode.InvalidRequest, "This `Idempotency-Key` was already used for a different request")
+				return
+			}
+			replayIdempotentResponse(writer, existing)
+			return
+		}
+
+		req.Body = body
+		progress := &idempotencyProgress{}
+		req = req.WithContext(context.WithValue(req.Context(), idempotencyContextKey{}, progress))
+		capturingWriter := &capturingResponseWriter{ResponseWriter: writer, status: http.StatusOK}
+		handle(capturingWriter, req, params)
+
+		if capturingWriter.status >= 500 && !progress.committed {
+			err = r.Table(idempotencyTableName).Get(id).Delete().Exec(session)
+		} else {
+			header := map[string]string{}
+			for _, name := range idempotentHeaders {
+				if value := capturingWriter.Header().Get(name); value != "" {
+					header[name] = value
+				}
+			}
+			err = r.Table(idempotencyTableName).Get(id).Update(map[string]interface{}{
+				"fingerprint": body.fingerprint(),
+				"status":      capturingWriter.status,
+				"header":      header,
+				"body":        capturingWriter.body.String(),
+			}).Exec(session)
+		}
+		if err != nil {
+			log.Printf("Error storing response for idempotency key: %s", err)
+		}
+	}
+}
+
+// SweepIdempotencyKeys deletes expired keys every IDEMPOTENCY_SWEEP_INTERVAL
+// (an hour by default). Lookups ignore expired keys either way; this only
+// keeps the table from growing.
+func SweepIdempotencyKeys(session *r.Session) {
+	for range time.Tick(config.Duration("IDEMPOTENCY_SWEEP_INTERVAL", time.Hour)) {
+		if ReadOnly() {
+			continue
+		}
+		response, err := r.Table(idempotencyTableName).Filter(r.Row.Field("expiresAt").Lt(time.Now())).Delete().RunWrite(session)
+		if err != nil {
+			log.Printf("Error deleting expired idempotency keys: %s", err)
+			continue
+		}
+		if response.Deleted > 0 {
+			log.Printf("Deleted %d expired idempotency keys", response.Deleted)
+		}
+	}
+}
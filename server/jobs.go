@@ -0,0 +1,318 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/thejsj/veenco/config"
+)
+
+// ImageJobsGetHandler lists an image's jobs grouped into their NextJob
+// chains, each chain in the order its steps run
+func ImageJobsGetHandler(session *r.Session) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		log.Printf("GET ImageJobsGetHandler")
+		imageEntry, ok := FindImageEntry(session, writer, req, params.ByName("id"))
+		if !ok {
+			return
+		}
+
+		cursor, err := r.Table("jobs").GetAllByIndex("imageId", imageEntry.Id).Run(session)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var jobs []map[string]interface{}
+		err = cursor.All(&jobs)
+		cursor.Close()
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for _, job := range jobs {
+			defaultJobStatus(job)
+		}
+
+		jsonResponse, err := json.Marshal(map[string]interface{}{
+			"imageId": imageEntry.Id,
+			"chains":  JobChains(jobs),
+		})
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(jsonResponse)
+	}
+}
+
+// JobGetHandler returns a single job with its parameters, state, timeline
+// and, once the worker has finished it, the key of its output
+func JobGetHandler(session *r.Session) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		log.Printf("GET JobGetHandler")
+		id := params.ByName("id")
+		var job map[string]interface{}
+		cursor, err := r.Table("jobs").Get(id).Run(session)
+		if err == nil {
+			err = cursor.One(&job)
+			cursor.Close()
+		}
+		if err == nil && !CanAccess(req, jobString(job, "ownerId")) {
+			err = r.ErrEmptyResult
+		}
+		if err == r.ErrEmptyResult {
+			http.Error(writer, fmt.Sprintf("No job with id `%s` could be found", id), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defaultJobStatus(job)
+		annotateJobEvents(job)
+
+		jsonResponse, err := json.Marshal(job)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(jsonResponse)
+	}
+}
+
+type JobStatusRequest struct {
+	Ids []string `json:"ids"`
+}
+
+// JobEvent is an entry of a job's timeline. The server records the first
+// two events, the worker the rest: consumed, downloading (skipped when the
+// worker already has the image), converting, uploading, then done, failed
+// or expired.
+type JobEvent struct {
+	Event  string    `gorethink:"event" json:"event"`
+	At     time.Time `gorethink:"at" json:"at"`
+	Detail string    `gorethink:"detail,omitempty" json:"detail,omitempty"`
+	// Added by GET /job/:id, not stored
+	SincePreviousMs int64 `gorethink:"-" json:"sincePreviousMs,omitempty"`
+}
+
+const (
+	JobEventCreated   = "created"
+	JobEventPublished = "published"
+	JobEventFailed    = "failed"
+)
+
+// maxJobEvents bounds a job's timeline, from JOB_MAX_EVENTS (50 by
+// default). Retries add events on every attempt, so only the latest are
+// kept.
+func maxJobEvents() int {
+	return config.Int("JOB_MAX_EVENTS", 50)
+}
+
+// recordJobEvent adds an event to the timeline of each job. The timeline is
+// informational, so failures are only logged.
+func recordJobEvent(session *r.Session, jobIds []string, event string, detail string) {
+	recordJobEventAt(session, jobIds, event, detail, time.Now())
+}
+
+// recordJobEventAt is recordJobEvent for an event that happened at a given
+// time, such as a publish recorded once the broker confirmed it
+func recordJobEventAt(session *r.Session, jobIds []string, event string, detail string, at time.Time) {
+	entry := JobEvent{Event: event, At: at, Detail: detail}
+	args := make([]interface{}, len(jobIds))
+	for i, id := range jobIds {
+		args[i] = id
+	}
+	err := r.Table("jobs").GetAll(args...).Update(map[string]interface{}{
+		"events": r.Row.Field("events").Default([]interface{}{}).Append(entry).Slice(-maxJobEvents()),
+	}).Exec(session)
+	if err != nil {
+		log.Printf("Error recording %s event: %s", event, err)
+	}
+}
+
+// annotateJobEvents sorts the events of a job read from the database by
+// time, as the server and worker append them concurrently, and adds the time
+// since the previous event to each, so slow stages stand out
+func annotateJobEvents(job map[string]interface{}) {
+	events, _ := job["events"].([]interface{})
+	eventTime := func(event interface{}) time.Time {
+		entry, _ := event.(map[string]interface{})
+		at, _ := entry["at"].(time.Time)
+		return at
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return eventTime(events[i]).Before(eventTime(events[j]))
+	})
+	var previous time.Time
+	for _, event := range events {
+		entry, ok := event.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		at, ok := entry["at"].(time.Time)
+		if !ok {
+			continue
+		}
+		if !previous.IsZero() {
+			entry["sincePreviousMs"] = int64(at.Sub(previous) / time.Millisecond)
+		}
+		previous = at
+	}
+}
+
+// Fields of each job returned by JobStatusPostHandler
+var jobStatusFields = []interface{}{"id", "imageId", "status", "error", "errorCode", "outputKey", "startedAt", "completedAt", "ownerId"}
+
+// JobStatusPostHandler returns the state of up to JOB_STATUS_MAX_IDS (100 by
+// default) jobs at once, in the order they were asked for. Ids that don't
+// exist, or belong to another tenant, are listed under `notFound`.
+func JobStatusPostHandler(session *r.Session) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		log.Printf("POST JobStatusPostHandler")
+		var statusRequest JobStatusRequest
+		err := json.NewDecoder(req.Body).Decode(&statusRequest)
+		if err != nil {
+			http.Error(writer, "Error unmarshalling job status request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		maxIds := config.Int("JOB_STATUS_MAX_IDS", 100)
+		if len(statusRequest.Ids) == 0 || len(statusRequest.Ids) > maxIds {
+			http.Error(writer, fmt.Sprintf("`ids` must list between 1 and %d job ids", maxIds), http.StatusBadRequest)
+			return
+		}
+
+		ids := make([]interface{}, len(statusRequest.Ids))
+		for i, id := range statusRequest.Ids {
+			ids[i] = id
+		}
+		cursor, err := r.Table("jobs").GetAll(ids...).Pluck(jobStatusFields...).Run(session)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var found []map[string]interface{}
+		err = cursor.All(&found)
+		cursor.Close()
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		byId := map[string]map[string]interface{}{}
+		for _, job := range found {
+			if CanAccess(req, jobString(job, "ownerId")) {
+				byId[jobString(job, "id")] = job
+			}
+		}
+
+		jobs := []map[string]interface{}{}
+		notFound := []string{}
+		for _, id := range statusRequest.Ids {
+			job, ok := byId[id]
+			if !ok {
+				notFound = append(notFound, id)
+				continue
+			}
+			defaultJobStatus(job)
+			jobs = append(jobs, job)
+		}
+		jsonResponse, err := json.Marshal(map[string]interface{}{
+			"jobs":     jobs,
+			"notFound": notFound,
+		})
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(jsonResponse)
+	}
+}
+
+// deleteJobOutputs removes the objects the worker uploaded for an image's jobs
+func deleteJobOutputs(session *r.Session, s3bucket *s3.Bucket, imageId string) error {
+	cursor, err := r.Table("jobs").GetAllByIndex("imageId", imageId).HasFields("outputKey").Run(session)
+	if err != nil {
+		return err
+	}
+	var jobs []Job
+	err = cursor.All(&jobs)
+	cursor.Close()
+	if err != nil {
+		return err
+	}
+	for _, job := range jobs {
+		err = s3bucket.Del(job.OutputKey)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Jobs from before job states were tracked have no status
+func defaultJobStatus(job map[string]interface{}) {
+	if _, ok := job["status"]; !ok {
+		job["status"] = JobStatusPending
+	}
+}
+
+// JobChains follows nextJob links from every job nothing points to. Chains
+// are ordered by their first job's creation time.
+func JobChains(jobs []map[string]interface{}) [][]map[string]interface{} {
+	byId := map[string]map[string]interface{}{}
+	isNext := map[string]bool{}
+	for _, job := range jobs {
+		byId[jobString(job, "id")] = job
+		if next := jobString(job, "nextJob"); next != "" {
+			isNext[next] = true
+		}
+	}
+
+	var heads []map[string]interface{}
+	for _, job := range jobs {
+		if !isNext[jobString(job, "id")] {
+			heads = append(heads, job)
+		}
+	}
+	sort.SliceStable(heads, func(i, j int) bool {
+		return jobTime(heads[i]).Before(jobTime(heads[j]))
+	})
+
+	chains := [][]map[string]interface{}{}
+	visited := map[string]bool{}
+	for _, head := range heads {
+		var chain []map[string]interface{}
+		for job := head; job != nil && !visited[jobString(job, "id")]; job = byId[jobString(job, "nextJob")] {
+			visited[jobString(job, "id")] = true
+			chain = append(chain, job)
+		}
+		chains = append(chains, chain)
+	}
+	// Anything left is part of a cycle; list it rather than drop it
+	for _, job := range jobs {
+		if !visited[jobString(job, "id")] {
+			chains = append(chains, []map[string]interface{}{job})
+		}
+	}
+	return chains
+}
+
+func jobTime(job map[string]interface{}) time.Time {
+	value, _ := job["createdAt"].(time.Time)
+	return value
+}
+
+func jobString(job map[string]interface{}, field string) string {
+	value, _ := job[field].(string)
+	return value
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/julienschmidt/httprouter"
+)
+
+type LegalHoldRequest struct {
+	Reason string `json:"reason"`
+}
+
+func LegalHoldPutHandler(session *r.Session) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		var holdRequest LegalHoldRequest
+		if req.ContentLength != 0 {
+			err := json.NewDecoder(req.Body).Decode(&holdRequest)
+			if err != nil {
+				http.Error(writer, "Error unmarshalling legal hold request: "+err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		setLegalHold(session, writer, req, params.ByName("id"), func(image r.Term) r.Term {
+			return image.Update(map[string]interface{}{
+				"legalHold":       true,
+				"legalHoldReason": holdRequest.Reason,
+				"legalHoldAt":     time.Now(),
+			})
+		})
+	}
+}
+
+func LegalHoldDeleteHandler(session *r.Session) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		setLegalHold(session, writer, req, params.ByName("id"), func(image r.Term) r.Term {
+			return image.Replace(r.Row.Without("legalHold", "legalHoldReason", "legalHoldAt"))
+		})
+	}
+}
+
+func setLegalHold(session *r.Session, writer http.ResponseWriter, req *http.Request, id string, update func(image r.Term) r.Term) {
+	imageEntry, ok := FindImageEntry(session, writer, req, id)
+	if !ok {
+		return
+	}
+
+	err := update(r.Table("images").Get(imageEntry.Id)).Exec(session)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	imageEntry, err = GetImageEntry(session, imageEntry.Id)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Legal hold on image %s set to %v", imageEntry.Id, imageEntry.LegalHold)
+	jsonResponse, err := json.Marshal(map[string]interface{}{
+		"id":              imageEntry.Id,
+		"legalHold":       imageEntry.LegalHold,
+		"legalHoldReason": imageEntry.LegalHoldReason,
+	})
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(jsonResponse)
+}
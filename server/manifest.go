@@ -0,0 +1,159 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mitchellh/goamz/s3"
+)
+
+// ManifestObject describes a single stored object belonging to an image
+type ManifestObject struct {
+	Key    string `json:"key,omitempty"`
+	Url    string `json:"url,omitempty"`
+	Size   int    `json:"size"`
+	Sha256 string `json:"sha256"`
+}
+
+type Manifest struct {
+	ImageId     string           `json:"imageId"`
+	GeneratedAt time.Time        `json:"generatedAt"`
+	Objects     []ManifestObject `json:"objects"`
+}
+
+// SignedManifest carries an Ed25519 signature over the JSON encoding of
+// Manifest, verifiable with the key served by GET /manifest/key. The
+// signature covers `manifest` exactly as it appears in the response.
+type SignedManifest struct {
+	Manifest  Manifest `json:"manifest"`
+	Algorithm string   `json:"algorithm"`
+	Signature string   `json:"signature"`
+}
+
+// signedManifestBody is how a SignedManifest is written, with the manifest
+// kept as the bytes that were signed so re-encoding can't change them
+type signedManifestBody struct {
+	Manifest  json.RawMessage `json:"manifest"`
+	Algorithm string          `json:"algorithm"`
+	Signature string          `json:"signature"`
+}
+
+// signManifest encodes and signs manifest, returning the response body
+// holding those same bytes
+func signManifest(privateKey ed25519.PrivateKey, manifest Manifest) ([]byte, error) {
+	manifestJson, err := json.Marshal(manifest)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(signedManifestBody{
+		Manifest:  manifestJson,
+		Algorithm: "ed25519",
+		Signature: base64.StdEncoding.EncodeToString(ed25519.Sign(privateKey, manifestJson)),
+	})
+}
+
+func Sha256Hex(buffer []byte) string {
+	sum := sha256.Sum256(buffer)
+	return hex.EncodeToString(sum[:])
+}
+
+// manifestSigningKey reads the base64 encoded Ed25519 seed from
+// MANIFEST_SIGNING_KEY
+func manifestSigningKey() (ed25519.PrivateKey, error) {
+	encodedSeed := os.Getenv("MANIFEST_SIGNING_KEY")
+	if encodedSeed == "" {
+		return nil, errors.New("MANIFEST_SIGNING_KEY is not set")
+	}
+	seed, err := base64.StdEncoding.DecodeString(encodedSeed)
+	if err != nil {
+		return nil, fmt.Errorf("Error decoding MANIFEST_SIGNING_KEY: %s", err)
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("MANIFEST_SIGNING_KEY must be a %v byte seed", ed25519.SeedSize)
+	}
+	return ed25519.NewKeyFromSeed(seed), nil
+}
+
+func ManifestGetHandler(session *r.Session, s3bucket *s3.Bucket) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		log.Printf("GET ManifestGetHandler")
+		privateKey, err := manifestSigningKey()
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+
+		imageEntry, ok := FindImageEntry(session, writer, req, params.ByName("id"))
+		if !ok {
+			return
+		}
+
+		// Images uploaded before hashes were recorded get backfilled here
+		if imageEntry.Sha256 == "" {
+			log.Printf("Backfilling hash for image %s", imageEntry.Id)
+			buffer, err := ReadSource(s3bucket, imageEntry)
+			if err != nil {
+				http.Error(writer, "Error reading image: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			imageEntry.Size = len(buffer)
+			imageEntry.Sha256 = Sha256Hex(buffer)
+			err = r.Table("images").Get(imageEntry.Id).Update(map[string]interface{}{
+				"size":   imageEntry.Size,
+				"sha256": imageEntry.Sha256,
+			}).Exec(session)
+			if err != nil {
+				http.Error(writer, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		manifest := Manifest{
+			ImageId:     imageEntry.Id,
+			GeneratedAt: time.Now().UTC(),
+			Objects: []ManifestObject{
+				{Key: imageEntry.S3Filename, Url: imageEntry.SourceUrl, Size: imageEntry.Size, Sha256: imageEntry.Sha256},
+			},
+		}
+		jsonResponse, err := signManifest(privateKey, manifest)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(jsonResponse)
+	}
+}
+
+// ManifestKeyGetHandler serves the public half of the manifest signing key
+func ManifestKeyGetHandler() func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		privateKey, err := manifestSigningKey()
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		publicKey := privateKey.Public().(ed25519.PublicKey)
+		jsonResponse, err := json.Marshal(map[string]string{
+			"algorithm": "ed25519",
+			"publicKey": base64.StdEncoding.EncodeToString(publicKey),
+		})
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(jsonResponse)
+	}
+}
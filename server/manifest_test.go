@@ -0,0 +1,36 @@
+package server
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestSignManifestSignsTheWrittenBytes(t *testing.T) {
+	privateKey := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	manifest := Manifest{
+		ImageId:     "a",
+		GeneratedAt: time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC),
+		Objects:     []ManifestObject{{Key: "a.jpg", Url: "https://example.com/?a=1&b=<2>", Size: 3, Sha256: "abc"}},
+	}
+	body, err := signManifest(privateKey, manifest)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var response signedManifestBody
+	err = json.Unmarshal(body, &response)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(response.Signature)
+	if err != nil {
+		t.Fatal(err)
+	}
+	publicKey := privateKey.Public().(ed25519.PublicKey)
+	if response.Algorithm != "ed25519" || !ed25519.Verify(publicKey, response.Manifest, signature) {
+		t.Errorf("Expected the signature to verify against the manifest in %s", body)
+	}
+}
@@ -0,0 +1,128 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/julienschmidt/httprouter"
+	"github.com/thejsj/veenco/config"
+)
+
+const defaultMaxMetadataBytes = 16 << 10
+
+// maxMetadataBytes is read from MAX_METADATA_BYTES
+func maxMetadataBytes() int {
+	max := config.Int("MAX_METADATA_BYTES", defaultMaxMetadataBytes)
+	if max <= 0 {
+		return defaultMaxMetadataBytes
+	}
+	return max
+}
+
+// ParseMetadata decodes a client supplied metadata object, enforcing the
+// size limit on its encoded form
+func ParseMetadata(raw []byte) (map[string]interface{}, error) {
+	if len(raw) > maxMetadataBytes() {
+		return nil, fmt.Errorf("Metadata can't be larger than %v bytes", maxMetadataBytes())
+	}
+	var metadata map[string]interface{}
+	err := json.Unmarshal(raw, &metadata)
+	if err != nil {
+		return nil, fmt.Errorf("Metadata must be a JSON object: %s", err)
+	}
+	return metadata, nil
+}
+
+// mergePatchTerm turns an RFC 7396 JSON merge patch into the argument of a
+// ReQL merge, which merges nested objects and replaces everything else the
+// same way. A null in the patch removes the key, which r.Literal() does.
+func mergePatchTerm(patch map[string]interface{}) map[string]interface{} {
+	term := map[string]interface{}{}
+	for key, value := range patch {
+		switch value := value.(type) {
+		case nil:
+			term[key] = r.Literal()
+		case map[string]interface{}:
+			term[key] = mergePatchTerm(value)
+		default:
+			term[key] = value
+		}
+	}
+	return term
+}
+
+// MetadataFilter turns `metadata.<key>=<value>` query parameters into a
+// filter on the images table
+func MetadataFilter(query url.Values) map[string]interface{} {
+	metadata := map[string]interface{}{}
+	for param, values := range query {
+		if strings.HasPrefix(param, "metadata.") && len(values) > 0 {
+			metadata[strings.TrimPrefix(param, "metadata.")] = values[0]
+		}
+	}
+	if len(metadata) == 0 {
+		return nil
+	}
+	return map[string]interface{}{"metadata": metadata}
+}
+
+func MetadataPatchHandler(session *r.Session) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		log.Printf("PATCH MetadataPatchHandler")
+		imageEntry, ok := FindImageEntryToChange(session, writer, req, params.ByName("id"))
+		if !ok {
+			return
+		}
+
+		body, err := ioutil.ReadAll(http.MaxBytesReader(writer, req.Body, int64(maxMetadataBytes())))
+		if err != nil {
+			http.Error(writer, "Error reading body of request: "+err.Error(), http.StatusRequestEntityTooLarge)
+			return
+		}
+		patch, err := ParseMetadata(body)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// The patch is merged by the database in a single update, so
+		// concurrent patches of different keys don't undo each other
+		tooLarge := fmt.Sprintf("Metadata can't be larger than %v bytes", maxMetadataBytes())
+		merged := r.Row.Field("metadata").Default(map[string]interface{}{}).Merge(mergePatchTerm(patch))
+		response, err := r.Table("images").Get(imageEntry.Id).Update(r.Branch(
+			merged.ToJSON().Count().Gt(maxMetadataBytes()),
+			r.Error(tooLarge),
+			map[string]interface{}{"metadata": merged},
+		), r.UpdateOpts{ReturnChanges: "always"}).RunWrite(session)
+		if err != nil && strings.Contains(err.Error(), tooLarge) {
+			http.Error(writer, tooLarge, http.StatusBadRequest)
+			return
+		}
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		metadata := map[string]interface{}{}
+		if len(response.Changes) > 0 {
+			newValue, _ := response.Changes[0].NewValue.(map[string]interface{})
+			if stored, ok := newValue["metadata"].(map[string]interface{}); ok {
+				metadata = stored
+			}
+		}
+		encoded, err := json.Marshal(metadata)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(encoded)
+	}
+}
@@ -0,0 +1,221 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/thejsj/veenco/queue"
+)
+
+// Histogram buckets, in seconds for latencies and bytes for uploads
+var (
+	latencyBuckets    = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+	uploadSizeBuckets = []float64{10 << 10, 100 << 10, 1 << 20, 10 << 20, 100 << 20, 1 << 30}
+)
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// metricFamily is a counter or histogram along with its values, keyed by
+// their rendered labels
+type metricFamily struct {
+	name       string
+	help       string
+	buckets    []float64
+	counters   map[string]float64
+	histograms map[string]*histogram
+}
+
+type metricsRegistry struct {
+	mutex    sync.Mutex
+	families []*metricFamily
+}
+
+var metrics = &metricsRegistry{}
+
+func (registry *metricsRegistry) counter(name string, help string) *metricFamily {
+	family := &metricFamily{name: name, help: help, counters: map[string]float64{}}
+	registry.families = append(registry.families, family)
+	return family
+}
+
+func (registry *metricsRegistry) histogram(name string, help string, buckets []float64) *metricFamily {
+	family := &metricFamily{name: name, help: help, buckets: buckets, histograms: map[string]*histogram{}}
+	registry.families = append(registry.families, family)
+	return family
+}
+
+var (
+	requestsTotal   = metrics.counter("enco_http_requests_total", "HTTP requests by route, method and status")
+	requestDuration = metrics.histogram("enco_http_request_duration_seconds", "HTTP request latency by route", latencyBuckets)
+	uploadSize      = metrics.histogram("enco_upload_size_bytes", "Size of stored uploads", uploadSizeBuckets)
+	s3ErrorsTotal   = metrics.counter("enco_s3_errors_total", "Failed S3 requests by operation")
+	publishesTotal  = metrics.counter("enco_queue_publish_total", "Tasks published to the queue by result")
+)
+
+// labels renders label pairs, e.g. labels("route", "/", "method", "GET")
+func labels(pairs ...string) string {
+	var rendered []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		rendered = append(rendered, pairs[i]+"="+strconv.Quote(pairs[i+1]))
+	}
+	return strings.Join(rendered, ",")
+}
+
+func (family *metricFamily) inc(labels string) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	family.counters[labels]++
+}
+
+func (family *metricFamily) observe(labels string, value float64) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+	observed, ok := family.histograms[labels]
+	if !ok {
+		observed = &histogram{counts: make([]uint64, len(family.buckets))}
+		family.histograms[labels] = observed
+	}
+	for i, bound := range family.buckets {
+		if value <= bound {
+			observed.counts[i]++
+		}
+	}
+	observed.sum += value
+	observed.count++
+}
+
+func withLabel(existing string, label string) string {
+	if existing == "" {
+		return label
+	}
+	return existing + "," + label
+}
+
+func braces(labels string) string {
+	if labels == "" {
+		return ""
+	}
+	return "{" + labels + "}"
+}
+
+// render writes the registry in the Prometheus text format
+func (registry *metricsRegistry) render() string {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+	var out strings.Builder
+	for _, family := range registry.families {
+		if family.histograms == nil {
+			fmt.Fprintf(&out, "# HELP %s %s\n# TYPE %s counter\n", family.name, family.help, family.name)
+			for _, key := range sortedKeys(family.counters) {
+				fmt.Fprintf(&out, "%s%s %v\n", family.name, braces(key), family.counters[key])
+			}
+			continue
+		}
+		fmt.Fprintf(&out, "# HELP %s %s\n# TYPE %s histogram\n", family.name, family.help, family.name)
+		for _, key := range sortedKeys(family.histograms) {
+			observed := family.histograms[key]
+			for i, bound := range family.buckets {
+				le := labels("le", strconv.FormatFloat(bound, 'g', -1, 64))
+				fmt.Fprintf(&out, "%s_bucket%s %d\n", family.name, braces(withLabel(key, le)), observed.counts[i])
+			}
+			fmt.Fprintf(&out, "%s_bucket%s %d\n", family.name, braces(withLabel(key, labels("le", "+Inf"))), observed.count)
+			fmt.Fprintf(&out, "%s_sum%s %v\n", family.name, braces(key), observed.sum)
+			fmt.Fprintf(&out, "%s_count%s %d\n", family.name, braces(key), observed.count)
+		}
+	}
+	return out.String()
+}
+
+func sortedKeys[V any](values map[string]V) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// routePattern turns a request path back into the route it matched, e.g.
+// /image/:id/jobs, so ids don't end up as label values
+func routePattern(router *httprouter.Router, req *http.Request) string {
+	handle, params, _ := router.Lookup(req.Method, req.URL.Path)
+	if handle == nil {
+		return "unmatched"
+	}
+	segments := strings.Split(req.URL.Path, "/")
+	next := 0
+	for i, segment := range segments {
+		if next < len(params) && segment == params[next].Value {
+			segments[i] = ":" + params[next].Key
+			next++
+		}
+	}
+	return strings.Join(segments, "/")
+}
+
+type requestStartKey struct{}
+
+// RequestStart is when Instrumented started handling the request, or zero
+// outside of it
+func RequestStart(req *http.Request) time.Time {
+	start, _ := req.Context().Value(requestStartKey{}).(time.Time)
+	return start
+}
+
+// Instrumented counts every request and its latency by route
+func Instrumented(router *httprouter.Router, handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		req = req.WithContext(context.WithValue(req.Context(), requestStartKey{}, start))
+		recordingWriter := &statusRecordingWriter{ResponseWriter: writer, status: http.StatusOK}
+		handler.ServeHTTP(recordingWriter, req)
+		route := routePattern(router, req)
+		requestsTotal.inc(labels("route", route, "method", req.Method, "status", strconv.Itoa(recordingWriter.status)))
+		requestDuration.observe(labels("route", route), time.Since(start).Seconds())
+	})
+}
+
+// RecordS3Error counts a failed request to the bucket
+func RecordS3Error(operation string) {
+	s3ErrorsTotal.inc(labels("operation", operation))
+}
+
+// RecordPublish counts a task published to the queue, by why it failed
+func RecordPublish(err error) {
+	result := "ok"
+	switch {
+	case err == nil:
+	case errors.Is(err, queue.ErrBlocked):
+		result = "blocked"
+	case errors.Is(err, queue.ErrUnroutable):
+		result = "unroutable"
+	case errors.Is(err, queue.ErrNacked):
+		result = "nacked"
+	case errors.Is(err, queue.ErrConfirmTimeout):
+		result = "timeout"
+	default:
+		result = "error"
+	}
+	publishesTotal.inc(labels("result", result))
+}
+
+// MetricsGetHandler serves the metrics for Prometheus to scrape
+func MetricsGetHandler() func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		writer.Write([]byte(metrics.render()))
+		writeSLOMetrics(writer, time.Now())
+	}
+}
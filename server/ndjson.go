@@ -0,0 +1,39 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	r "github.com/dancannon/gorethink"
+)
+
+// Rows are flushed to the client in batches of this size
+const ndjsonFlushInterval = 100
+
+// StreamNDJSON writes every row of the cursor as its own line of JSON while
+// the cursor is being read, so large tables never sit in memory at once
+func StreamNDJSON(writer http.ResponseWriter, cursor *r.Cursor) {
+	writer.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, canFlush := writer.(http.Flusher)
+	encoder := json.NewEncoder(writer)
+
+	var row interface{}
+	count := 0
+	for cursor.Next(&row) {
+		err := encoder.Encode(row)
+		if err != nil {
+			log.Printf("Error writing NDJSON row: %s", err)
+			return
+		}
+		row = nil
+		count++
+		if canFlush && count%ndjsonFlushInterval == 0 {
+			flusher.Flush()
+		}
+	}
+	// Headers are already sent, so a cursor error can only be logged
+	if cursor.Err() != nil {
+		log.Printf("Error reading cursor while streaming NDJSON: %s", cursor.Err())
+	}
+}
@@ -0,0 +1,269 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// apiRoute describes one route for the OpenAPI document. Request and
+// Response are zero values of the types the handler decodes and encodes;
+// nil means the body isn't JSON or there isn't one.
+type apiRoute struct {
+	Method   string
+	Path     string
+	Summary  string
+	Request  interface{}
+	Response interface{}
+	Admin    bool
+	// Served at the root rather than under APIVersion
+	Unversioned bool
+}
+
+// multipartUpload stands for the form POST /image accepts
+type multipartUpload struct{}
+
+// apiRoutes mirrors the router in Serve, with paths as given to the
+// versioned router, and has to be kept in step with it
+var apiRoutes = []apiRoute{
+	{Method: "GET", Path: "/", Summary: "List images", Response: []ImageEntry{}},
+	{Method: "GET", Path: "/healthz", Summary: "Check the server is up", Unversioned: true},
+	{Method: "GET", Path: "/metrics", Summary: "Prometheus metrics", Unversioned: true},
+	{Method: "GET", Path: "/capabilities", Summary: "Job types, formats and limits this deployment supports", Response: Capabilities{}},
+	{Method: "GET", Path: "/openapi.json", Summary: "This document", Unversioned: true},
+	{Method: "GET", Path: "/image/:id", Summary: "Get an image by id or slug", Response: ImageResponse{}},
+	{Method: "DELETE", Path: "/image/:id", Summary: "Delete an image"},
+	{Method: "PATCH", Path: "/image/:id", Summary: "Update an image", Request: ImagePatch{}, Response: ImageEntry{}},
+	{Method: "GET", Path: "/image/:id/jobs", Summary: "List an image's jobs", Response: map[string][]Job{}},
+	{Method: "GET", Path: "/image/:id/content", Summary: "Download an image's bytes"},
+	{Method: "GET", Path: "/image/:id/url", Summary: "Get a signed URL for an image", Response: SignedUrlResponse{}},
+	{Method: "GET", Path: "/image/:id/render", Summary: "Resize and convert an image on request, e.g. `?w=300&h=200&fit=crop&format=webp` or `?ops=resize:w=300;format:webp`"},
+	{Method: "GET", Path: "/image/:id/preview", Summary: "Render the `ops` query parameter on a downscaled copy"},
+	{Method: "PUT", Path: "/image/:id/captions/:language", Summary: "Store a caption track", Response: Caption{}},
+	{Method: "DELETE", Path: "/image/:id/captions/:language", Summary: "Delete a caption track"},
+	{Method: "GET", Path: "/job/:id", Summary: "Get a job", Response: Job{}},
+	{Method: "POST", Path: "/jobs/status", Summary: "Get the status of many jobs", Request: JobStatusRequest{}, Response: map[string]interface{}{}},
+	{Method: "GET", Path: "/graphql", Summary: "GraphQL query over images, outputs and job chains, in the `query` parameter", Response: GraphQLResponse{}},
+	{Method: "POST", Path: "/graphql", Summary: "GraphQL query over images, outputs and job chains", Request: GraphQLRequest{}, Response: GraphQLResponse{}},
+	{Method: "POST", Path: "/image", Summary: "Upload images, or register one by URL with a JSON body", Request: multipartUpload{}, Response: []UploadResult{}},
+	{Method: "PUT", Path: "/image", Summary: "Upload an image as the raw body", Response: map[string]string{}},
+	{Method: "POST", Path: "/uploads", Summary: "Start a resumable upload", Response: ResumableUpload{}},
+	{Method: "HEAD", Path: "/uploads/:id", Summary: "Get a resumable upload's offset"},
+	{Method: "PATCH", Path: "/uploads/:id", Summary: "Append a chunk to a resumable upload"},
+	{Method: "DELETE", Path: "/uploads/:id", Summary: "Abandon a resumable upload"},
+	{Method: "POST", Path: "/image/:id/transformation", Summary: "Queue transformations of an image", Request: TransformationJobCollection{}, Response: map[string][]Job{}},
+	{Method: "GET", Path: "/presets", Summary: "List transformation presets", Response: []Preset{}},
+	{Method: "GET", Path: "/presets/:name", Summary: "Get a transformation preset", Response: Preset{}},
+	{Method: "PUT", Path: "/presets/:name", Summary: "Create or replace a transformation preset", Request: Preset{}, Response: Preset{}, Admin: true},
+	{Method: "DELETE", Path: "/presets/:name", Summary: "Delete a transformation preset", Admin: true},
+	{Method: "POST", Path: "/image/:id/copy-transformations", Summary: "Queue the transformations recorded for the image given as `from`", Response: map[string][]Job{}},
+	{Method: "POST", Path: "/transformation/batch", Summary: "Queue the same transformations for many images", Request: BatchTransformationRequest{}, Response: BatchTransformationResponse{}},
+	{Method: "GET", Path: "/transformation/batch/:id", Summary: "Get the combined status of a batch's jobs", Response: BatchStatus{}},
+	{Method: "POST", Path: "/erasure", Summary: "Erase an uploader's details", Request: ErasureRequest{}, Admin: true},
+	{Method: "GET", Path: "/feed.atom", Summary: "Atom feed of recent images"},
+	{Method: "GET", Path: "/oembed", Summary: "oEmbed for an image URL", Response: OEmbedResponse{}},
+	{Method: "PATCH", Path: "/image/:id/metadata", Summary: "Merge into an image's metadata", Request: map[string]interface{}{}, Response: ImageEntry{}},
+	{Method: "GET", Path: "/image/:id/embed", Summary: "HTML page embedding an image"},
+	{Method: "GET", Path: "/image/:id/manifest", Summary: "Signed manifest of an image and its derivatives", Response: SignedManifest{}},
+	{Method: "GET", Path: "/manifest/key", Summary: "Public key manifests are signed with"},
+	{Method: "GET", Path: "/quarantine", Summary: "List quarantined uploads", Response: []QuarantineListing{}, Admin: true},
+	{Method: "POST", Path: "/quarantine/:id/release", Summary: "Release a quarantined upload", Response: ImageEntry{}, Admin: true},
+	{Method: "DELETE", Path: "/quarantine/:id", Summary: "Delete a quarantined upload", Admin: true},
+	{Method: "GET", Path: "/admin/slo", Summary: "SLO status", Response: SLOStatus{}, Admin: true},
+	{Method: "PUT", Path: "/admin/replay-capture", Summary: "Start or stop capturing requests", Request: ReplayCaptureRequest{}, Admin: true},
+	{Method: "PUT", Path: "/admin/read-only", Summary: "Enter or leave read-only mode", Request: ReadOnlyRequest{}, Admin: true},
+	{Method: "GET", Path: "/admin/images/:id", Summary: "An image with the details of its upload request", Response: ImageUploadResponse{}, Admin: true},
+	{Method: "GET", Path: "/admin/chains/:id", Summary: "Images and jobs sharing a chain id", Response: map[string]interface{}{}, Admin: true},
+	{Method: "GET", Path: "/admin/api-keys", Summary: "List API keys", Response: []ApiKey{}, Admin: true},
+	{Method: "POST", Path: "/admin/api-keys", Summary: "Create an API key", Request: ApiKeyRequest{}, Response: ApiKeyResponse{}, Admin: true},
+	{Method: "DELETE", Path: "/admin/api-keys/:id", Summary: "Revoke an API key", Admin: true},
+	{Method: "PUT", Path: "/image/:id/hold", Summary: "Put an image under legal hold", Request: LegalHoldRequest{}, Admin: true},
+	{Method: "DELETE", Path: "/image/:id/hold", Summary: "Release an image's legal hold", Admin: true},
+	{Method: "PUT", Path: "/image/:id/owner", Summary: "Assign an image and its jobs to a tenant", Request: ImageOwnerRequest{}, Admin: true},
+}
+
+var routeParameterPattern = regexp.MustCompile(`:(\w+)`)
+
+// schemaBuilder turns Go types into JSON schemas, collecting named structs
+// under components so they are described once
+type schemaBuilder struct {
+	components map[string]interface{}
+}
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// fieldName is the key a field is encoded under. Types without json tags
+// are returned as stored, so their gorethink names apply.
+func fieldName(field reflect.StructField) (string, bool) {
+	for _, tag := range []string{"json", "gorethink"} {
+		name := strings.Split(field.Tag.Get(tag), ",")[0]
+		if name == "-" {
+			return "", false
+		}
+		if name != "" {
+			return name, true
+		}
+	}
+	return field.Name, true
+}
+
+func (builder *schemaBuilder) schema(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t.Kind() == reflect.Ptr:
+		return builder.schema(t.Elem())
+	case t.Kind() == reflect.Struct:
+		if _, ok := builder.components[t.Name()]; !ok {
+			// Claimed first so self-referencing types terminate
+			builder.components[t.Name()] = nil
+			builder.components[t.Name()] = builder.object(t)
+		}
+		return map[string]interface{}{"$ref": "#/components/schemas/" + t.Name()}
+	case t.Kind() == reflect.Slice && t.Elem().Kind() == reflect.Uint8:
+		return map[string]interface{}{"type": "string", "format": "byte"}
+	case t.Kind() == reflect.Slice || t.Kind() == reflect.Array:
+		return map[string]interface{}{"type": "array", "items": builder.schema(t.Elem())}
+	case t.Kind() == reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": builder.schema(t.Elem())}
+	case t.Kind() == reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case t.Kind() == reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	}
+	return map[string]interface{}{}
+}
+
+// object describes a struct's exported fields, flattening embedded ones the
+// way encoding/json does
+func (builder *schemaBuilder) object(t reflect.Type) map[string]interface{} {
+	properties := map[string]interface{}{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct && field.Tag.Get("json") == "" {
+			embedded := builder.object(field.Type)["properties"].(map[string]interface{})
+			for name, property := range embedded {
+				properties[name] = property
+			}
+			continue
+		}
+		if field.PkgPath != "" {
+			continue
+		}
+		if name, ok := fieldName(field); ok {
+			properties[name] = builder.schema(field.Type)
+		}
+	}
+	return map[string]interface{}{"type": "object", "properties": properties}
+}
+
+func jsonContent(schema map[string]interface{}) map[string]interface{} {
+	return map[string]interface{}{"application/json": map[string]interface{}{"schema": schema}}
+}
+
+// OpenAPIDocument describes every route in apiRoutes as OpenAPI 3
+func OpenAPIDocument() map[string]interface{} {
+	builder := &schemaBuilder{components: map[string]interface{}{}}
+	errorResponse := map[string]interface{}{
+		"description": "Error",
+		"content":     jsonContent(builder.schema(reflect.TypeOf(ErrorResponse{}))),
+	}
+	paths := map[string]map[string]interface{}{}
+	for _, route := range apiRoutes {
+		path := routeParameterPattern.ReplaceAllString(route.Path, "{$1}")
+		if !route.Unversioned {
+			path = "/" + APIVersion + path
+		}
+		var parameters []interface{}
+		for _, match := range routeParameterPattern.FindAllStringSubmatch(route.Path, -1) {
+			parameters = append(parameters, map[string]interface{}{
+				"name": match[1], "in": "path", "required": true,
+				"schema": map[string]interface{}{"type": "string"},
+			})
+		}
+
+		success := map[string]interface{}{"description": "OK"}
+		if route.Response != nil {
+			success["content"] = jsonContent(builder.schema(reflect.TypeOf(route.Response)))
+		}
+		operation := map[string]interface{}{
+			"summary":   route.Summary,
+			"responses": map[string]interface{}{"200": success, "default": errorResponse},
+		}
+		if parameters != nil {
+			operation["parameters"] = parameters
+		}
+		switch route.Request.(type) {
+		case nil:
+		case multipartUpload:
+			operation["requestBody"] = map[string]interface{}{
+				"content": map[string]interface{}{
+					"multipart/form-data": map[string]interface{}{
+						"schema": map[string]interface{}{
+							"type": "object",
+							"properties": map[string]interface{}{
+								"file":             map[string]interface{}{"type": "string", "format": "binary", "description": "Any field name, unless UPLOAD_FIELD_NAMES limits them"},
+								slugRequestedField: map[string]interface{}{"type": "string"},
+								"metadata":         map[string]interface{}{"type": "string", "description": "JSON object"},
+								"thumbnail":        map[string]interface{}{"type": "boolean", "description": "Return a tiny data URI thumbnail"},
+							},
+						},
+					},
+					"application/json": map[string]interface{}{
+						"schema": builder.schema(reflect.TypeOf(ExternalImageRequest{})),
+					},
+				},
+			}
+		default:
+			operation["requestBody"] = map[string]interface{}{
+				"content": jsonContent(builder.schema(reflect.TypeOf(route.Request))),
+			}
+		}
+		if route.Admin {
+			operation["security"] = []interface{}{map[string]interface{}{"adminToken": []string{}}}
+		}
+		if paths[path] == nil {
+			paths[path] = map[string]interface{}{}
+		}
+		paths[path][strings.ToLower(route.Method)] = operation
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info":    map[string]interface{}{"title": "enco", "version": APIVersion},
+		"paths":   paths,
+		"security": []interface{}{
+			map[string]interface{}{"apiKey": []string{}},
+			map[string]interface{}{},
+		},
+		"components": map[string]interface{}{
+			"schemas": builder.components,
+			"securitySchemes": map[string]interface{}{
+				"apiKey":     map[string]interface{}{"type": "apiKey", "in": "header", "name": "X-Api-Key"},
+				"adminToken": map[string]interface{}{"type": "apiKey", "in": "header", "name": "X-Admin-Token"},
+			},
+		},
+	}
+}
+
+// OpenAPIGetHandler serves the OpenAPI document
+func OpenAPIGetHandler() func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		jsonResponse, err := json.Marshal(OpenAPIDocument())
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(jsonResponse)
+	}
+}
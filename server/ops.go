@@ -0,0 +1,85 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/thejsj/veenco/config"
+	"github.com/thejsj/veenco/worker/image-converter"
+)
+
+// maxTransformationPx bounds the sizes an ops string can ask for, from
+// TRANSFORMATION_MAX_PX (16384 by default)
+func maxTransformationPx() uint {
+	return uint(config.Int("TRANSFORMATION_MAX_PX", 16384))
+}
+
+// transformationsFromOps turns an ops string such as
+// `resize:w=800;format:webp,q=80` into a single operations job, so its
+// steps share one output. Width-only resizes go the same way: a
+// resizeToWidthPx job is run by Converter.Resize, which doesn't take a
+// width.
+func transformationsFromOps(ops string) ([]TransformationJob, error) {
+	operations, err := imageConverter.ParseOperations(ops, maxTransformationPx())
+	if err != nil {
+		return nil, err
+	}
+	return []TransformationJob{{
+		JobType: JobTypeOperations,
+		Data:    map[string]interface{}{"ops": joinOperations(operations)},
+	}}, nil
+}
+
+func joinOperations(operations []imageConverter.Operation) string {
+	var steps []string
+	for _, operation := range operations {
+		steps = append(steps, operation.String())
+	}
+	return strings.Join(steps, ";")
+}
+
+// checkJobOps parses the ops of an operations job and writes them back the
+// canonical way, with `q` clamped to the quality policy
+func checkJobOps(ops string, policy QualityPolicy) (string, []imageConverter.Operation, error) {
+	operations, err := imageConverter.ParseOperations(ops, maxTransformationPx())
+	if err != nil {
+		return "", nil, err
+	}
+	for _, operation := range operations {
+		if quality, ok := operation.Named["q"]; ok {
+			q, _ := strconv.ParseFloat(quality, 64)
+			operation.Named["q"] = strconv.FormatFloat(policy.Clamp(q), 'f', -1, 64)
+		}
+	}
+	return joinOperations(operations), operations, nil
+}
+
+// estimateOpsWidth is the widest an operations job's output can get: the
+// largest resize, or the original's width when nothing resizes it
+func estimateOpsWidth(imageEntry ImageEntry, operations []imageConverter.Operation) float64 {
+	width := float64(imageEntry.Width)
+	if width == 0 {
+		width = float64(maxTransformationPx())
+	}
+	resized := 0.0
+	for _, operation := range operations {
+		if operation.Name != "resize" {
+			continue
+		}
+		if w, _ := strconv.ParseFloat(operation.Named["w"], 64); w > resized {
+			resized = w
+		}
+		if h, _ := strconv.ParseFloat(operation.Named["h"], 64); h > 0 && operation.Named["w"] == "" {
+			if imageEntry.Width > 0 && imageEntry.Height > 0 {
+				h = h * float64(imageEntry.Width) / float64(imageEntry.Height)
+			}
+			if h > resized {
+				resized = h
+			}
+		}
+	}
+	if resized > 0 {
+		return resized
+	}
+	return width
+}
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTransformationsFromOps(t *testing.T) {
+	for ops, canonical := range map[string]string{
+		"resize:w=800":              "resize:w=800",
+		"resize:w=800;resize:w=400": "resize:w=800;resize:w=400",
+		"resize:w=800;format:webp":  "resize:w=800;format:webp",
+		"resize:h=200,fit=crop":     "resize:fit=crop,h=200",
+		"crop:1:1":                  "crop:1:1",
+		";resize:w=10,h=10;":        "resize:h=10,w=10",
+	} {
+		transformations, err := transformationsFromOps(ops)
+		expected := []TransformationJob{{JobType: JobTypeOperations, Data: map[string]interface{}{"ops": canonical}}}
+		if err != nil || !reflect.DeepEqual(transformations, expected) {
+			t.Errorf("Expected %q to become %v, got %v (%v)", ops, expected, transformations, err)
+		}
+	}
+}
+
+func TestCheckJobOpsClampsQuality(t *testing.T) {
+	ops, _, err := checkJobOps("format:jpeg,q=100", QualityPolicy{Min: 10, Max: 90})
+	if err != nil || ops != "format:jpeg,q=90" {
+		t.Errorf("Expected q to be clamped to 90, got %q (%v)", ops, err)
+	}
+}
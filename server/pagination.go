@@ -0,0 +1,87 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	r "github.com/dancannon/gorethink"
+)
+
+const (
+	defaultPageLimit = 50
+	maxPageLimit     = 500
+)
+
+// Page is a window into the images table, newest first unless Ascending
+type Page struct {
+	Limit     int
+	Offset    int
+	Ascending bool
+}
+
+// ParsePage reads `limit`, `offset` and `sort` (`createdAt` or `-createdAt`)
+// from the query string. A defaultLimit of 0 means no limit unless one is
+// asked for.
+func ParsePage(query url.Values, defaultLimit int) (Page, error) {
+	page := Page{Limit: defaultLimit}
+	var err error
+	if value := query.Get("limit"); value != "" {
+		page.Limit, err = strconv.Atoi(value)
+		if err != nil || page.Limit < 1 || page.Limit > maxPageLimit {
+			return page, fmt.Errorf("`limit` must be between 1 and %v", maxPageLimit)
+		}
+	}
+	if value := query.Get("offset"); value != "" {
+		page.Offset, err = strconv.Atoi(value)
+		if err != nil || page.Offset < 0 {
+			return page, errors.New("`offset` must be a positive number")
+		}
+	}
+	switch query.Get("sort") {
+	case "", "-createdAt":
+	case "createdAt":
+		page.Ascending = true
+	default:
+		return page, errors.New("`sort` must be `createdAt` or `-createdAt`")
+	}
+	return page, nil
+}
+
+// OrderedImages is the images table sorted for the page. It must come before
+// any filter since it uses the createAt index.
+func (page Page) OrderedImages() r.Term {
+	index := r.Desc("createAt")
+	if page.Ascending {
+		index = r.Asc("createAt")
+	}
+	return r.Table("images").OrderBy(r.OrderByOpts{Index: index})
+}
+
+// Slice applies the offset and limit to an ordered query
+func (page Page) Slice(query r.Term) r.Term {
+	if page.Offset > 0 {
+		query = query.Skip(page.Offset)
+	}
+	if page.Limit > 0 {
+		query = query.Limit(page.Limit)
+	}
+	return query
+}
+
+// WriteHeaders sets X-Total-Count and, when there are more rows, a Link to
+// the next page
+func (page Page) WriteHeaders(writer http.ResponseWriter, req *http.Request, total int) {
+	writer.Header().Set("X-Total-Count", strconv.Itoa(total))
+	if page.Limit == 0 || page.Offset+page.Limit >= total {
+		return
+	}
+	next := *req.URL
+	query := next.Query()
+	query.Set("offset", strconv.Itoa(page.Offset+page.Limit))
+	query.Set("limit", strconv.Itoa(page.Limit))
+	next.RawQuery = query.Encode()
+	writer.Header().Set("Link", fmt.Sprintf("<%s>; rel=\"next\"", next.RequestURI()))
+}
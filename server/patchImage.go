@@ -0,0 +1,119 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mitchellh/goamz/s3"
+)
+
+const (
+	maxTags              = 50
+	maxTagLength         = 64
+	maxDescriptionLength = 4096
+)
+
+// ImagePatch lists the fields that can change after upload. Fields left out
+// of the request body are not touched.
+type ImagePatch struct {
+	OriginalFileName *string   `json:"originalFileName"`
+	Tags             *[]string `json:"tags"`
+	Description      *string   `json:"description"`
+}
+
+// Changes validates the patch and returns the fields to update
+func (patch ImagePatch) Changes() (map[string]interface{}, error) {
+	changes := map[string]interface{}{}
+	if patch.OriginalFileName != nil {
+		originalFileName := NormalizeFilename(strings.TrimSpace(*patch.OriginalFileName))
+		if originalFileName == "" {
+			return nil, fmt.Errorf("`originalFileName` can't be empty")
+		}
+		changes["originalFileName"] = originalFileName
+	}
+	if patch.Tags != nil {
+		tags, err := normalizeTags(*patch.Tags)
+		if err != nil {
+			return nil, err
+		}
+		changes["tags"] = tags
+	}
+	if patch.Description != nil {
+		if utf8.RuneCountInString(*patch.Description) > maxDescriptionLength {
+			return nil, fmt.Errorf("`description` can't be longer than %v characters", maxDescriptionLength)
+		}
+		changes["description"] = *patch.Description
+	}
+	return changes, nil
+}
+
+// normalizeTags trims the tags and drops empty and repeated ones
+func normalizeTags(tags []string) ([]string, error) {
+	normalized := []string{}
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag == "" || containsString(normalized, tag) {
+			continue
+		}
+		if utf8.RuneCountInString(tag) > maxTagLength {
+			return nil, fmt.Errorf("Tags can't be longer than %v characters", maxTagLength)
+		}
+		normalized = append(normalized, tag)
+	}
+	if len(normalized) > maxTags {
+		return nil, fmt.Errorf("An image can't have more than %v tags", maxTags)
+	}
+	return normalized, nil
+}
+
+func ImagePatchHandler(session *r.Session, s3bucket *s3.Bucket) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		log.Printf("PATCH ImagePatchHandler")
+		imageEntry, ok := FindImageEntryToChange(session, writer, req, params.ByName("id"))
+		if !ok {
+			return
+		}
+
+		var patch ImagePatch
+		err := json.NewDecoder(req.Body).Decode(&patch)
+		if err != nil {
+			http.Error(writer, "Error unmarshalling image patch: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		changes, err := patch.Changes()
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if len(changes) > 0 {
+			err = r.Table("images").Get(imageEntry.Id).Update(changes).Exec(session)
+			if err != nil {
+				http.Error(writer, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			imageEntry, err = GetImageEntry(session, imageEntry.Id)
+			if err != nil {
+				http.Error(writer, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+
+		jsonResponse, err := json.Marshal(ImageResponse{
+			ImageEntry: imageEntry,
+			Url:        imageEntry.Url(s3bucket),
+		})
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(jsonResponse)
+	}
+}
@@ -0,0 +1,102 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+)
+
+// pipelineJob returns the Job embedded in a pointer to one of the job type
+// structs, such as *ImageResizeToWidthPxJob
+func pipelineJob(job interface{}) *Job {
+	return reflect.ValueOf(job).Elem().FieldByName("Job").Addr().Interface().(*Job)
+}
+
+// pipelineSteps resolves step names while a submission is parsed. A step
+// starts from the output of the step named by its `input`, or from the
+// previous step's when it has none, so steps can branch off a shared
+// intermediate result instead of forming a single line.
+type pipelineSteps struct {
+	named    map[string]string
+	previous string
+}
+
+func newPipelineSteps() *pipelineSteps {
+	return &pipelineSteps{named: map[string]string{}}
+}
+
+// link sets the job's InputJob and records its name. Inputs can only name
+// earlier steps, which keeps the pipeline free of cycles.
+func (steps *pipelineSteps) link(job *Job, step TransformationJob) error {
+	if step.Name != "" {
+		if _, ok := steps.named[step.Name]; ok {
+			return fmt.Errorf("More than one step is named `%s`", step.Name)
+		}
+	}
+	job.InputJob = steps.previous
+	if step.Input != "" {
+		inputJob, ok := steps.named[step.Input]
+		if !ok {
+			return fmt.Errorf("`input` must name an earlier valid step, got `%s`", step.Input)
+		}
+		job.InputJob = inputJob
+	}
+	if step.Name != "" {
+		job.StepName = step.Name
+		steps.named[step.Name] = job.Id
+	}
+	steps.previous = job.Id
+	return nil
+}
+
+// TaskStep is a job as the worker runs it: from the original when InputJob
+// is empty, otherwise from the output of the step with that job id
+type TaskStep struct {
+	JobId    string  `json:"jobId"`
+	InputJob string  `json:"inputJob,omitempty"`
+	Quality  float64 `json:"quality,omitempty"`
+	Ops      string  `json:"ops,omitempty"`
+}
+
+// pipelineTaskSteps lists the jobs in the order they were submitted, which
+// always puts a step after the one it starts from
+func pipelineTaskSteps(jobs []*Job) []TaskStep {
+	steps := []TaskStep{}
+	for _, job := range jobs {
+		steps = append(steps, TaskStep{JobId: job.Id, InputJob: job.InputJob, Quality: job.Quality, Ops: job.Ops})
+	}
+	return steps
+}
+
+// pipelineBranches returns every path from an original-image step to a step
+// whose output nothing else uses, in the order the steps run
+func pipelineBranches(jobs []*Job) [][]*Job {
+	byId := map[string]*Job{}
+	usedAsInput := map[string]bool{}
+	for _, job := range jobs {
+		byId[job.Id] = job
+		usedAsInput[job.InputJob] = true
+	}
+	var branches [][]*Job
+	for _, job := range jobs {
+		if usedAsInput[job.Id] {
+			continue
+		}
+		var branch []*Job
+		for step := job; step != nil; step = byId[step.InputJob] {
+			branch = append([]*Job{step}, branch...)
+		}
+		branches = append(branches, branch)
+	}
+	return branches
+}
+
+// pipelineDepth is the number of steps in the longest branch
+func pipelineDepth(jobs []*Job) int {
+	depth := 0
+	for _, branch := range pipelineBranches(jobs) {
+		if len(branch) > depth {
+			depth = len(branch)
+		}
+	}
+	return depth
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+
+	"github.com/thejsj/veenco/config"
+)
+
+// PipelineLimits bound the size of a single transformation request. Every
+// job of a request runs as one NextJob chain, so depth is the number of
+// valid jobs; MaxJobs also counts invalid ones. Zero means no limit.
+type PipelineLimits struct {
+	MaxJobs  int `gorethink:"maxJobs,omitempty" json:"maxJobs,omitempty"`
+	MaxDepth int `gorethink:"maxDepth,omitempty" json:"maxDepth,omitempty"`
+	// Estimated from each job's output dimensions, see estimateOutputBytes
+	MaxOutputBytes int `gorethink:"maxOutputBytes,omitempty" json:"maxOutputBytes,omitempty"`
+}
+
+// Uncompressed RGB, so the estimate errs on the large side
+const estimatedBytesPerPixel = 3
+
+// DefaultPipelineLimits are read from PIPELINE_MAX_JOBS, PIPELINE_MAX_DEPTH
+// and PIPELINE_MAX_OUTPUT_BYTES, defaulting to 20 jobs, 10 steps and 1GiB
+func DefaultPipelineLimits() PipelineLimits {
+	return PipelineLimits{
+		MaxJobs:        config.Int("PIPELINE_MAX_JOBS", 20),
+		MaxDepth:       config.Int("PIPELINE_MAX_DEPTH", 10),
+		MaxOutputBytes: config.Int("PIPELINE_MAX_OUTPUT_BYTES", 1<<30),
+	}
+}
+
+// RequestPipelineLimits are the defaults with any limits set on the
+// caller's API key taking their place
+func RequestPipelineLimits(req *http.Request) PipelineLimits {
+	limits := DefaultPipelineLimits()
+	apiKey, ok := RequestApiKey(req)
+	if !ok || apiKey.Limits == nil {
+		return limits
+	}
+	if apiKey.Limits.MaxJobs > 0 {
+		limits.MaxJobs = apiKey.Limits.MaxJobs
+	}
+	if apiKey.Limits.MaxDepth > 0 {
+		limits.MaxDepth = apiKey.Limits.MaxDepth
+	}
+	if apiKey.Limits.MaxOutputBytes > 0 {
+		limits.MaxOutputBytes = apiKey.Limits.MaxOutputBytes
+	}
+	return limits
+}
+
+// Check returns why a request is over the limits, or an empty string
+func (limits PipelineLimits) Check(jobs int, depth int, outputBytes int) string {
+	if limits.MaxJobs > 0 && jobs > limits.MaxJobs {
+		return fmt.Sprintf("A request can have at most %d transformations, got %d", limits.MaxJobs, jobs)
+	}
+	if limits.MaxDepth > 0 && depth > limits.MaxDepth {
+		return fmt.Sprintf("A chain can have at most %d steps, got %d", limits.MaxDepth, depth)
+	}
+	if limits.MaxOutputBytes > 0 && outputBytes > limits.MaxOutputBytes {
+		return fmt.Sprintf("The transformations would produce an estimated %d bytes, over the limit of %d", outputBytes, limits.MaxOutputBytes)
+	}
+	return ""
+}
+
+// checkResizeWidth rejects widths estimateOutputBytes and the worker can't
+// handle, which also keeps the estimate from overflowing
+func checkResizeWidth(width float64) error {
+	maxPx := float64(maxTransformationPx())
+	if !(width >= 1 && width <= maxPx) {
+		return fmt.Errorf("`width` must be between 1 and %d", int(maxPx))
+	}
+	return nil
+}
+
+// estimateOutputBytes sizes a resize to width. Images of unknown dimensions
+// are assumed to be square. Estimates too large for an int are capped.
+func estimateOutputBytes(imageEntry ImageEntry, width float64) int {
+	height := width
+	if imageEntry.Width > 0 && imageEntry.Height > 0 {
+		height = width * float64(imageEntry.Height) / float64(imageEntry.Width)
+	}
+	estimate := width * height * estimatedBytesPerPixel
+	if estimate >= math.MaxInt {
+		return math.MaxInt
+	}
+	return int(estimate)
+}
+
+// addOutputBytes sums estimates without overflowing
+func addOutputBytes(total int, estimate int) int {
+	if total > math.MaxInt-estimate {
+		return math.MaxInt
+	}
+	return total + estimate
+}
@@ -0,0 +1,189 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/julienschmidt/httprouter"
+	"github.com/thejsj/veenco/errcode"
+)
+
+var presetNamePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{0,63}$`)
+
+// Preset is a named set of transformations that submissions can refer to
+// with `preset` instead of repeating them. The name is the primary key.
+type Preset struct {
+	Name            string              `gorethink:"id" json:"name"`
+	Description     string              `gorethink:"description,omitempty" json:"description,omitempty"`
+	Transformations []TransformationJob `gorethink:"transformations,omitempty" json:"transformations,omitempty"`
+	// Alternative to Transformations, in the `ops` syntax
+	Ops       string    `gorethink:"ops,omitempty" json:"ops,omitempty"`
+	CreatedAt time.Time `gorethink:"createdAt" json:"createdAt"`
+	UpdatedAt time.Time `gorethink:"updatedAt" json:"updatedAt"`
+}
+
+// steps returns the preset's transformations followed by its ops
+func (preset Preset) steps() ([]TransformationJob, error) {
+	steps := append([]TransformationJob{}, preset.Transformations...)
+	if preset.Ops != "" {
+		transformations, err := transformationsFromOps(preset.Ops)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid `ops`: %s", err)
+		}
+		steps = append(steps, transformations...)
+	}
+	return steps, nil
+}
+
+// validate checks what can be checked without an image: the job types, the
+// ops and the step names
+func (preset Preset) validate() error {
+	steps, err := preset.steps()
+	if err != nil {
+		return err
+	}
+	if len(steps) == 0 {
+		return fmt.Errorf("A preset needs `transformations` or `ops`")
+	}
+	pipeline := newPipelineSteps()
+	for i, step := range steps {
+		switch step.JobType {
+		case JobTypeResizeToWidthPx:
+		case JobTypeOperations:
+			ops, _ := step.Data["ops"].(string)
+			if _, _, err = checkJobOps(ops, CurrentQualityPolicy()); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("Unknown `jobType` `%s`", step.JobType)
+		}
+		if err = pipeline.link(&Job{Id: fmt.Sprint(i)}, step); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// GetPreset returns r.ErrEmptyResult when there is no preset with the name
+func GetPreset(session *r.Session, name string) (Preset, error) {
+	var preset Preset
+	cursor, err := r.Table("presets").Get(name).Run(session)
+	if err != nil {
+		return preset, err
+	}
+	defer cursor.Close()
+	err = cursor.One(&preset)
+	return preset, err
+}
+
+// presetTransformations looks up the preset a submission names
+func presetTransformations(session *r.Session, name string) ([]TransformationJob, error) {
+	preset, err := GetPreset(session, name)
+	if err == r.ErrEmptyResult {
+		return nil, errcode.Wrap(errcode.InvalidRequest, fmt.Errorf("No preset named `%s` could be found", name))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return preset.steps()
+}
+
+func writePreset(writer http.ResponseWriter, status int, preset interface{}) {
+	jsonResponse, err := json.Marshal(preset)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(status)
+	writer.Write(jsonResponse)
+}
+
+// PresetIndexHandler lists every preset by name
+func PresetIndexHandler(session *r.Session) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		log.Printf("GET PresetIndexHandler")
+		presets := []Preset{}
+		err := chainRecords(r.Table("presets").OrderBy("id"), session, &presets)
+		if handleError(writer, err, "") {
+			return
+		}
+		writePreset(writer, http.StatusOK, presets)
+	}
+}
+
+func PresetGetHandler(session *r.Session) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		log.Printf("GET PresetGetHandler")
+		preset, err := GetPreset(session, params.ByName("name"))
+		if err == r.ErrEmptyResult {
+			WriteError(writer, http.StatusNotFound, errcode.NotFound, fmt.Sprintf("No preset named `%s` could be found", params.ByName("name")))
+			return
+		}
+		if handleError(writer, err, "") {
+			return
+		}
+		writePreset(writer, http.StatusOK, preset)
+	}
+}
+
+// PresetPutHandler creates or replaces a preset. Jobs already submitted
+// with it keep the transformations they were given.
+func PresetPutHandler(session *r.Session) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		log.Printf("PUT PresetPutHandler")
+		var preset Preset
+		err := json.NewDecoder(req.Body).Decode(&preset)
+		if err != nil {
+			WriteError(writer, http.StatusBadRequest, errcode.InvalidRequest, "Error unmarshalling preset: "+err.Error())
+			return
+		}
+		preset.Name = params.ByName("name")
+		if !presetNamePattern.MatchString(preset.Name) {
+			WriteError(writer, http.StatusBadRequest, errcode.InvalidRequest, "Preset names must be lowercase letters, digits, `-` and `_`, up to 64 characters")
+			return
+		}
+		if err = preset.validate(); err != nil {
+			WriteError(writer, http.StatusBadRequest, errcode.InvalidRequest, err.Error())
+			return
+		}
+
+		status := http.StatusOK
+		preset.UpdatedAt = time.Now()
+		existing, err := GetPreset(session, preset.Name)
+		if err == r.ErrEmptyResult {
+			status = http.StatusCreated
+			preset.CreatedAt = preset.UpdatedAt
+		} else if handleError(writer, err, "") {
+			return
+		} else {
+			preset.CreatedAt = existing.CreatedAt
+		}
+		err = r.Table("presets").Insert(preset, r.InsertOpts{Conflict: "replace"}).Exec(session)
+		if handleError(writer, err, "Error storing preset") {
+			return
+		}
+		log.Printf("Stored preset %s", preset.Name)
+		writePreset(writer, status, preset)
+	}
+}
+
+func PresetDeleteHandler(session *r.Session) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		log.Printf("DELETE PresetDeleteHandler")
+		response, err := r.Table("presets").Get(params.ByName("name")).Delete().RunWrite(session)
+		if handleError(writer, err, "") {
+			return
+		}
+		if response.Deleted == 0 {
+			WriteError(writer, http.StatusNotFound, errcode.NotFound, fmt.Sprintf("No preset named `%s` could be found", params.ByName("name")))
+			return
+		}
+		writer.WriteHeader(http.StatusNoContent)
+	}
+}
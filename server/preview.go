@@ -0,0 +1,69 @@
+package server
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/thejsj/veenco/config"
+	"github.com/thejsj/veenco/errcode"
+	"github.com/thejsj/veenco/worker/image-converter"
+)
+
+// PreviewGetHandler applies the `ops` query parameter to a copy of the image
+// scaled down to PREVIEW_PROXY_PX (512 by default) and returns the result
+// without storing anything, so UIs can show the effect of a transformation
+// before submitting it. Resizes are kept within the proxy's size too.
+func PreviewGetHandler(session *r.Session, s3bucket *s3.Bucket) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		log.Printf("GET PreviewGetHandler")
+		imageEntry, ok := FindImageEntry(session, writer, req, params.ByName("id"))
+		if !ok {
+			return
+		}
+		operations, err := imageConverter.ParseOperations(req.URL.Query().Get("ops"), maxTransformationPx())
+		if err != nil {
+			WriteError(writer, http.StatusBadRequest, errcode.InvalidRequest, "Invalid `ops`: "+err.Error())
+			return
+		}
+		if !strings.HasPrefix(imageEntry.ContentType, "image/") {
+			WriteError(writer, http.StatusUnsupportedMediaType, errcode.UnsupportedFormat, "Previews are only available for images")
+			return
+		}
+
+		source, err := ReadSource(s3bucket, imageEntry)
+		if err != nil {
+			code := errcode.StorageUnavailable
+			if imageEntry.SourceUrl != "" {
+				code = errcode.SourceUnavailable
+			}
+			WriteError(writer, http.StatusBadGateway, code, "Error reading image: "+err.Error())
+			return
+		}
+		preview, contentType, err := imageConverter.Preview(source, uint(config.Int("PREVIEW_PROXY_PX", 512)), operations)
+		if err != nil {
+			writePreviewError(writer, err, "Error rendering preview: ")
+			return
+		}
+
+		writer.Header().Set("Content-Type", contentType)
+		writer.Header().Set("Cache-Control", "private, max-age=300")
+		writer.Write(preview)
+	}
+}
+
+// writePreviewError answers for a failed imageConverter.Preview, telling
+// builds without ImageMagick and oversized images apart from bad ones
+func writePreviewError(writer http.ResponseWriter, err error, prefix string) {
+	switch err {
+	case imageConverter.ErrPreviewUnavailable:
+		WriteError(writer, http.StatusNotImplemented, errcode.NotImplemented, err.Error())
+	case imageConverter.ErrSourceTooLarge:
+		WriteError(writer, http.StatusRequestEntityTooLarge, errcode.PayloadTooLarge, prefix+err.Error())
+	default:
+		WriteError(writer, http.StatusUnprocessableEntity, errcode.InvalidImage, prefix+err.Error())
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/thejsj/veenco/config"
+)
+
+// VideoProbe is what ffprobe found in a video upload
+type VideoProbe struct {
+	DurationSeconds float64 `gorethink:"durationSeconds,omitempty" json:"durationSeconds,omitempty"`
+	VideoCodec      string  `gorethink:"videoCodec,omitempty" json:"videoCodec,omitempty"`
+	AudioCodec      string  `gorethink:"audioCodec,omitempty" json:"audioCodec,omitempty"`
+	Width           int     `gorethink:"width,omitempty" json:"width,omitempty"`
+	Height          int     `gorethink:"height,omitempty" json:"height,omitempty"`
+	FrameRate       float64 `gorethink:"frameRate,omitempty" json:"frameRate,omitempty"`
+	BitRate         int     `gorethink:"bitRate,omitempty" json:"bitRate,omitempty"`
+}
+
+type ffprobeOutput struct {
+	Streams []struct {
+		CodecType  string `json:"codec_type"`
+		CodecName  string `json:"codec_name"`
+		Width      int    `json:"width"`
+		Height     int    `json:"height"`
+		RFrameRate string `json:"r_frame_rate"`
+	} `json:"streams"`
+	Format struct {
+		Duration string `json:"duration"`
+		BitRate  string `json:"bit_rate"`
+	} `json:"format"`
+}
+
+// ProbeVideo runs ffprobe (FFPROBE_PATH, defaulting to `ffprobe` on the
+// PATH) over the video, giving up after FFPROBE_TIMEOUT
+func ProbeVideo(buffer []byte) (*VideoProbe, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), config.Duration("FFPROBE_TIMEOUT", 30*time.Second))
+	defer cancel()
+	cmd := exec.CommandContext(ctx, config.String("FFPROBE_PATH", "ffprobe"),
+		"-v", "error", "-print_format", "json", "-show_format", "-show_streams", "-")
+	cmd.Stdin = bytes.NewReader(buffer)
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, err
+	}
+
+	var probed ffprobeOutput
+	err = json.Unmarshal(output, &probed)
+	if err != nil {
+		return nil, err
+	}
+	probe := &VideoProbe{}
+	probe.DurationSeconds, _ = strconv.ParseFloat(probed.Format.Duration, 64)
+	probe.BitRate, _ = strconv.Atoi(probed.Format.BitRate)
+	for _, stream := range probed.Streams {
+		switch {
+		case stream.CodecType == "video" && probe.VideoCodec == "":
+			probe.VideoCodec = stream.CodecName
+			probe.Width = stream.Width
+			probe.Height = stream.Height
+			probe.FrameRate = parseFrameRate(stream.RFrameRate)
+		case stream.CodecType == "audio" && probe.AudioCodec == "":
+			probe.AudioCodec = stream.CodecName
+		}
+	}
+	return probe, nil
+}
+
+// parseFrameRate reads ffprobe's fractional rates such as `30000/1001`
+func parseFrameRate(rate string) float64 {
+	parts := strings.SplitN(rate, "/", 2)
+	numerator, err := strconv.ParseFloat(parts[0], 64)
+	if err != nil {
+		return 0
+	}
+	if len(parts) == 1 {
+		return numerator
+	}
+	denominator, err := strconv.ParseFloat(parts[1], 64)
+	if err != nil || denominator == 0 {
+		return 0
+	}
+	return numerator / denominator
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/thejsj/veenco/config"
+	"github.com/thejsj/veenco/errcode"
+	"github.com/thejsj/veenco/queue"
+)
+
+// writeTransformationError answers a transformation request that couldn't
+// be queued. Flow control gets a Retry-After of PUBLISH_RETRY_AFTER (30s by
+// default) so clients back off until the broker recovers.
+func writeTransformationError(writer http.ResponseWriter, err error) {
+	if errors.Is(err, queue.ErrBlocked) {
+		retryAfter := config.Duration("PUBLISH_RETRY_AFTER", 30*time.Second)
+		writer.Header().Set("Retry-After", strconv.Itoa(int(retryAfter/time.Second)))
+	}
+	WriteErrorOf(writer, err, "")
+}
+
+// failUnqueuedJobs marks the jobs of a pipeline whose task couldn't be
+// queued as failed, so they don't wait as pending forever
+func failUnqueuedJobs(session *r.Session, pipeline []*Job, publishErr error) {
+	var jobIds []interface{}
+	for _, job := range pipeline {
+		jobIds = append(jobIds, job.Id)
+	}
+	message := "Error queueing transformation: " + publishErr.Error()
+	err := r.Table("jobs").GetAll(jobIds...).Update(map[string]interface{}{
+		"status":      JobStatusFailed,
+		"error":       message,
+		"errorCode":   errcode.QueueUnavailable,
+		"completedAt": time.Now(),
+		"events":      r.Row.Field("events").Default([]interface{}{}).Append(JobEvent{Event: JobEventFailed, At: time.Now(), Detail: message}),
+	}).Exec(session)
+	if err != nil {
+		log.Printf("Error marking unqueued jobs as failed: %s", err)
+	}
+}
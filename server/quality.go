@@ -0,0 +1,62 @@
+package server
+
+import (
+	"math"
+	"net/http"
+
+	"github.com/thejsj/veenco/config"
+)
+
+// QualityPolicy bounds the output quality clients may ask for, so a request
+// can't force maximum-quality derivatives on the whole storage budget
+type QualityPolicy struct {
+	Min float64 `gorethink:"min,omitempty" json:"min,omitempty"`
+	Max float64 `gorethink:"max,omitempty" json:"max,omitempty"`
+}
+
+// CurrentQualityPolicy is read from QUALITY_MIN and QUALITY_MAX, defaulting
+// to 1 and 95
+func CurrentQualityPolicy() QualityPolicy {
+	return QualityPolicy{
+		Min: config.Float("QUALITY_MIN", 1),
+		Max: config.Float("QUALITY_MAX", 95),
+	}
+}
+
+// RequestQualityPolicy is the current policy with any bounds set on the
+// caller's API key taking their place
+func RequestQualityPolicy(req *http.Request) QualityPolicy {
+	policy := CurrentQualityPolicy()
+	apiKey, ok := RequestApiKey(req)
+	if !ok || apiKey.Quality == nil {
+		return policy
+	}
+	if apiKey.Quality.Min > 0 {
+		policy.Min = apiKey.Quality.Min
+	}
+	if apiKey.Quality.Max > 0 {
+		policy.Max = apiKey.Quality.Max
+	}
+	return policy
+}
+
+// Check returns why bounds given for an API key can't be used, or an empty
+// string
+func (policy QualityPolicy) Check() string {
+	if policy.Min < 0 || policy.Min > 100 || policy.Max < 0 || policy.Max > 100 {
+		return "`quality` bounds must be between 1 and 100"
+	}
+	if policy.Min > 0 && policy.Max > 0 && policy.Min > policy.Max {
+		return "`quality.min` can't be above `quality.max`"
+	}
+	return ""
+}
+
+// Clamp brings a requested quality inside the policy. 0 means the client
+// didn't ask for one and is left for the worker's default.
+func (policy QualityPolicy) Clamp(quality float64) float64 {
+	if quality == 0 {
+		return 0
+	}
+	return math.Round(math.Max(policy.Min, math.Min(policy.Max, quality)))
+}
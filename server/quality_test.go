@@ -0,0 +1,41 @@
+package server
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestQualityPolicy(t *testing.T) {
+	req := httptest.NewRequest("POST", "/image/a/transformations", nil)
+	if policy := RequestQualityPolicy(req); policy != (QualityPolicy{Min: 1, Max: 95}) {
+		t.Errorf("Expected the default policy without a key, got %v", policy)
+	}
+
+	apiKey := ApiKey{Id: "key", Quality: &QualityPolicy{Max: 70}}
+	req = req.WithContext(context.WithValue(req.Context(), apiKeyContextKey{}, apiKey))
+	policy := RequestQualityPolicy(req)
+	if policy != (QualityPolicy{Min: 1, Max: 70}) {
+		t.Errorf("Expected the key's maximum to replace the default, got %v", policy)
+	}
+	if quality := policy.Clamp(100); quality != 70 {
+		t.Errorf("Expected quality 100 to be clamped to 70, got %v", quality)
+	}
+	if quality := policy.Clamp(0); quality != 0 {
+		t.Errorf("Expected no quality to stay unset, got %v", quality)
+	}
+}
+
+func TestQualityPolicyCheck(t *testing.T) {
+	for policy, valid := range map[QualityPolicy]bool{
+		{Min: 10, Max: 90}: true,
+		{Max: 50}:          true,
+		{Min: 90, Max: 10}: false,
+		{Max: 101}:         false,
+		{Min: -1}:          false,
+	} {
+		if reason := policy.Check(); (reason == "") != valid {
+			t.Errorf("Expected %v to be valid: %v, got %q", policy, valid, reason)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/thejsj/veenco/errcode"
+	"github.com/thejsj/veenco/ids"
+)
+
+// QuarantineEntry keeps track of an upload that was received and stored but
+// could not become an image. Image holds the entry that would have been
+// inserted, pointing at the raw object.
+type QuarantineEntry struct {
+	Id            string     `gorethink:"id" json:"id"`
+	Reason        string     `gorethink:"reason" json:"reason"`
+	QuarantinedAt time.Time  `gorethink:"quarantinedAt" json:"quarantinedAt"`
+	Image         ImageEntry `gorethink:"image" json:"image"`
+}
+
+// Content types whose dimensions must be readable for the upload to pass
+var decodableContentTypes = []string{"image/jpeg", "image/png", "image/gif"}
+
+// ValidateUpload returns the reason an upload should be quarantined, or an
+// empty string when it is fine
+func ValidateUpload(imageEntry ImageEntry) string {
+	if imageEntry.Size == 0 {
+		return "Upload is empty"
+	}
+	contentType := strings.ToLower(strings.TrimSpace(strings.Split(imageEntry.ContentType, ";")[0]))
+	if containsString(decodableContentTypes, contentType) && imageEntry.Width == 0 {
+		return fmt.Sprintf("Content does not decode as %s", contentType)
+	}
+	return ""
+}
+
+// Quarantine records the failed upload, returning a 422 result with the
+// quarantine id
+func Quarantine(session *r.Session, imageEntry ImageEntry, code errcode.Code, reason string) UploadResult {
+	log.Printf("Quarantining upload %s: %s", imageEntry.S3Filename, reason)
+	result := UploadResult{FileName: imageEntry.OriginalFileName, Error: reason, Code: code}
+	entry := QuarantineEntry{
+		Id:            ids.New(),
+		Reason:        reason,
+		QuarantinedAt: time.Now(),
+		Image:         imageEntry,
+	}
+	err := r.Table("quarantine").Insert(entry).Exec(session)
+	if err != nil {
+		log.Printf("Error quarantining upload %s: %s", imageEntry.S3Filename, err)
+		result.Status = http.StatusInternalServerError
+		result.Code = errcode.StorageUnavailable
+		return result
+	}
+	result.Status = http.StatusUnprocessableEntity
+	result.QuarantineId = entry.Id
+	return result
+}
+
+// QuarantineUploader is who sent a quarantined upload. ImageEntry never
+// renders these fields, so the admin listing adds them explicitly.
+type QuarantineUploader struct {
+	Id        string `json:"id,omitempty"`
+	Ip        string `json:"ip,omitempty"`
+	UserAgent string `json:"userAgent,omitempty"`
+}
+
+// QuarantineListing is a quarantined upload as the admin listing shows it
+type QuarantineListing struct {
+	QuarantineEntry
+	Uploader *QuarantineUploader `json:"uploader,omitempty"`
+}
+
+func QuarantineIndexHandler(session *r.Session) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		cursor, err := r.Table("quarantine").OrderBy(r.Desc("quarantinedAt")).Run(session)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		entries := []QuarantineEntry{}
+		err = cursor.All(&entries)
+		cursor.Close()
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		listing := make([]QuarantineListing, len(entries))
+		for i, entry := range entries {
+			listing[i].QuarantineEntry = entry
+			uploader := QuarantineUploader{
+				Id:        entry.Image.UploaderId,
+				Ip:        entry.Image.UploaderIp,
+				UserAgent: entry.Image.UploaderUserAgent,
+			}
+			if uploader != (QuarantineUploader{}) {
+				listing[i].Uploader = &uploader
+			}
+		}
+		jsonResponse, err := json.Marshal(listing)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(jsonResponse)
+	}
+}
+
+// QuarantineReleaseHandler turns the quarantined upload into a regular image.
+// The image is copied from the stored entry in the same query, so uploader
+// details erased since the entry was read are not brought back.
+func QuarantineReleaseHandler(session *r.Session) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		entry, ok := findQuarantineEntry(session, writer, params.ByName("id"))
+		if !ok {
+			return
+		}
+		// The slug was given up when the upload was quarantined
+		if entry.Image.Slug != "" {
+			reserved, err := reserveSlug(session, entry.Image.Slug, entry.Image.OwnerId)
+			if err != nil {
+				http.Error(writer, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if !reserved {
+				WriteError(writer, http.StatusConflict, errcode.Conflict, fmt.Sprintf("Slug `%s` has been taken since the upload was quarantined", entry.Image.Slug))
+				return
+			}
+		}
+		err := r.Table("images").Insert(r.Table("quarantine").Get(entry.Id).Field("image")).Exec(session)
+		if err != nil {
+			releaseSlug(session, entry.Image.Slug, entry.Image.OwnerId)
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		err = r.Table("quarantine").Get(entry.Id).Delete().Exec(session)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Released quarantined upload %s as image %s", entry.Id, entry.Image.Id)
+
+		jsonResponse, err := json.Marshal(entry.Image)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(jsonResponse)
+	}
+}
+
+// QuarantineDeleteHandler removes the quarantined upload and its object
+func QuarantineDeleteHandler(session *r.Session, s3bucket *s3.Bucket) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		entry, ok := findQuarantineEntry(session, writer, params.ByName("id"))
+		if !ok {
+			return
+		}
+		err := s3bucket.Del(entry.Image.S3Filename)
+		if err != nil {
+			http.Error(writer, "Error deleting object from S3 bucket: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		err = r.Table("quarantine").Get(entry.Id).Delete().Exec(session)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Deleted quarantined upload %s", entry.Id)
+		writer.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func findQuarantineEntry(session *r.Session, writer http.ResponseWriter, id string) (QuarantineEntry, bool) {
+	var entry QuarantineEntry
+	cursor, err := r.Table("quarantine").Get(id).Run(session)
+	if err == nil {
+		err = cursor.One(&entry)
+		cursor.Close()
+	}
+	if err == r.ErrEmptyResult {
+		http.Error(writer, fmt.Sprintf("No quarantined upload with id `%s` could be found", id), http.StatusNotFound)
+		return entry, false
+	}
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return entry, false
+	}
+	return entry, true
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/thejsj/veenco/config"
+	"github.com/thejsj/veenco/errcode"
+	"golang.org/x/time/rate"
+)
+
+var requestLimiters = newLimiterCache()
+
+// limiterCache keeps a token bucket per client. Buckets that have filled
+// back up are dropped every minute, since a new one would start out the
+// same, so clients that go away don't keep their buckets forever.
+type limiterCache struct {
+	mutex     sync.Mutex
+	limiters  map[string]*rate.Limiter
+	lastSweep time.Time
+}
+
+func newLimiterCache() *limiterCache {
+	return &limiterCache{limiters: map[string]*rate.Limiter{}, lastSweep: time.Now()}
+}
+
+// get returns the client's bucket, picking up configuration reloads
+func (cache *limiterCache) get(clientKey string, limit rate.Limit, burst int) *rate.Limiter {
+	cache.mutex.Lock()
+	defer cache.mutex.Unlock()
+	now := time.Now()
+	if now.Sub(cache.lastSweep) > time.Minute {
+		for key, limiter := range cache.limiters {
+			if limiter.TokensAt(now) >= float64(limiter.Burst()) {
+				delete(cache.limiters, key)
+			}
+		}
+		cache.lastSweep = now
+	}
+	limiter, ok := cache.limiters[clientKey]
+	if !ok {
+		limiter = rate.NewLimiter(limit, burst)
+		cache.limiters[clientKey] = limiter
+	} else if limiter.Limit() != limit || limiter.Burst() != burst {
+		limiter.SetLimit(limit)
+		limiter.SetBurst(burst)
+	}
+	return limiter
+}
+
+// requestLimiter returns the token bucket for a client, or nil when the
+// `<prefix>_PER_MINUTE` limit isn't set. `<prefix>_BURST` defaults to the
+// per-minute limit.
+func requestLimiter(prefix string, clientKey string) *rate.Limiter {
+	perMinute := config.Int(prefix+"_PER_MINUTE", 0)
+	if perMinute <= 0 {
+		return nil
+	}
+	limit := rate.Limit(float64(perMinute) / 60)
+	burst := config.Int(prefix+"_BURST", perMinute)
+	return requestLimiters.get(clientKey, limit, burst)
+}
+
+// RateLimited answers with 429 once a client has used up its requests to
+// the scope. Every client is limited by IP with RATE_LIMIT_IP_PER_MINUTE,
+// and callers with an API key also by key with RATE_LIMIT_KEY_PER_MINUTE.
+// Each scope has its own buckets, so uploads don't use up transformations.
+func RateLimited(scope string, handle httprouter.Handle) httprouter.Handle {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		limiters := []*rate.Limiter{requestLimiter("RATE_LIMIT_IP", scope+" ip "+ClientIp(req))}
+		if apiKey, ok := RequestApiKey(req); ok {
+			limiters = append(limiters, requestLimiter("RATE_LIMIT_KEY", scope+" key "+apiKey.Id))
+		}
+
+		now := time.Now()
+		var reservations []*rate.Reservation
+		var wait time.Duration
+		for _, limiter := range limiters {
+			if limiter == nil {
+				continue
+			}
+			reservation := limiter.ReserveN(now, 1)
+			reservations = append(reservations, reservation)
+			if !reservation.OK() {
+				wait = time.Minute
+			} else if delay := reservation.DelayFrom(now); delay > wait {
+				wait = delay
+			}
+		}
+		if wait > 0 {
+			// Only requests that go ahead use up tokens
+			for _, reservation := range reservations {
+				reservation.CancelAt(now)
+			}
+			writer.Header().Set("Retry-After", fmt.Sprint(math.Ceil(wait.Seconds())))
+			WriteError(writer, http.StatusTooManyRequests, errcode.RateLimited, fmt.Sprintf("Too many %s requests, retry in %s", scope, wait.Round(time.Second)))
+			return
+		}
+		handle(writer, req, params)
+	}
+}
@@ -0,0 +1,55 @@
+package server
+
+import (
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mitchellh/goamz/s3"
+)
+
+// ImagePutHandler takes the file as the raw request body, e.g.
+//
+//	curl -T photo.jpg -H 'Content-Type: image/jpeg' -H 'X-Filename: photo.jpg' .../image
+//
+// X-Filename may be percent-encoded for non-ASCII names. The slug and
+// metadata can be passed as query parameters.
+func ImagePutHandler(session *r.Session, s3bucket *s3.Bucket) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		log.Printf("PUT ImagePutHandler")
+		if ExistingUpload(session, writer, req) {
+			return
+		}
+		if !LimitUploadBody(writer, req) {
+			return
+		}
+		GuardUploadBody(writer, req)
+		ThrottleUploadBody(req)
+
+		contentType := req.Header.Get("Content-Type")
+		if contentType == "" {
+			http.Error(writer, "`Content-Type` header is required", http.StatusBadRequest)
+			return
+		}
+		originalFileName := req.Header.Get("X-Filename")
+		if decoded, err := url.PathUnescape(originalFileName); err == nil {
+			originalFileName = decoded
+		}
+
+		buffer, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			WriteUploadReadError(writer, err)
+			return
+		}
+		storeUpload(session, s3bucket, writer, req, Upload{
+			Buffer:           buffer,
+			OriginalFileName: originalFileName,
+			ContentType:      contentType,
+			Slug:             req.URL.Query().Get(slugRequestedField),
+			Metadata:         req.URL.Query().Get("metadata"),
+		})
+	}
+}
@@ -0,0 +1,127 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/julienschmidt/httprouter"
+	"github.com/thejsj/veenco/config"
+	"github.com/thejsj/veenco/errcode"
+)
+
+// readOnlySwitch is 1 while an admin has switched read-only mode on. The
+// switch is stored in the settings table so every replica picks it up.
+var readOnlySwitch int32
+
+const settingsTableName = "settings"
+
+// ReadOnlySetting is the settings row holding the admin's switch
+type ReadOnlySetting struct {
+	Id        string    `gorethink:"id"`
+	Enabled   bool      `gorethink:"enabled"`
+	UpdatedAt time.Time `gorethink:"updatedAt"`
+}
+
+const readOnlySettingId = "readOnly"
+
+// ReadOnly reports whether writes are refused, either because READ_ONLY is
+// set or an admin switched it on. An admin can't override READ_ONLY=true.
+func ReadOnly() bool {
+	return atomic.LoadInt32(&readOnlySwitch) == 1 || config.Bool("READ_ONLY", false)
+}
+
+// loadReadOnly picks up the switch as last stored by any replica
+func loadReadOnly(session *r.Session) error {
+	var setting ReadOnlySetting
+	cursor, err := r.Table(settingsTableName).Get(readOnlySettingId).Run(session)
+	if err == nil {
+		err = cursor.One(&setting)
+		cursor.Close()
+	}
+	if err != nil && err != r.ErrEmptyResult {
+		return err
+	}
+	var enabled int32
+	if setting.Enabled {
+		enabled = 1
+	}
+	atomic.StoreInt32(&readOnlySwitch, enabled)
+	return nil
+}
+
+// WatchReadOnly reloads the switch every READ_ONLY_POLL_INTERVAL (5s by
+// default), keeping the last known state when the database can't be reached
+func WatchReadOnly(session *r.Session) {
+	for range time.Tick(config.Duration("READ_ONLY_POLL_INTERVAL", 5*time.Second)) {
+		err := loadReadOnly(session)
+		if err != nil {
+			log.Printf("Error loading the read-only switch: %s", err)
+		}
+	}
+}
+
+// Routes that only read despite their method, and the switch itself so
+// read-only mode can be turned off again
+var readOnlySafePaths = []string{"/jobs/status", "/graphql", "/admin/read-only"}
+
+// ReadOnlyGuard answers every request that could change something with 503
+// while in read-only mode.
+func ReadOnlyGuard(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET", "HEAD", "OPTIONS":
+			handler.ServeHTTP(writer, req)
+			return
+		}
+		path := unversionedPath(req.URL.Path)
+		if !ReadOnly() || containsString(readOnlySafePaths, path) {
+			handler.ServeHTTP(writer, req)
+			return
+		}
+		writer.Header().Set("Retry-After", config.String("READ_ONLY_RETRY_AFTER", "300"))
+		WriteError(writer, http.StatusServiceUnavailable, errcode.ReadOnly, config.String("READ_ONLY_MESSAGE", "The service is in read-only mode for maintenance"))
+	})
+}
+
+type ReadOnlyRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+// ReadOnlyPutHandler switches read-only mode on or off for every replica
+func ReadOnlyPutHandler(session *r.Session) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		var readOnlyRequest ReadOnlyRequest
+		err := json.NewDecoder(req.Body).Decode(&readOnlyRequest)
+		if err != nil {
+			http.Error(writer, "Error unmarshalling read-only request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = r.Table(settingsTableName).Insert(ReadOnlySetting{
+			Id:        readOnlySettingId,
+			Enabled:   readOnlyRequest.Enabled,
+			UpdatedAt: time.Now(),
+		}, r.InsertOpts{Conflict: "replace"}).Exec(session)
+		if err != nil {
+			WriteErrorOf(writer, errcode.Wrap(errcode.StorageUnavailable, err), "Error storing the read-only switch")
+			return
+		}
+		var enabled int32
+		if readOnlyRequest.Enabled {
+			enabled = 1
+		}
+		atomic.StoreInt32(&readOnlySwitch, enabled)
+		log.Printf("Read-only mode enabled: %v", readOnlyRequest.Enabled)
+
+		jsonResponse, err := json.Marshal(ReadOnlyRequest{Enabled: ReadOnly()})
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(jsonResponse)
+	}
+}
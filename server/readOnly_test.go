@@ -0,0 +1,36 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadOnlyGuard(t *testing.T) {
+	t.Setenv("READ_ONLY", "true")
+	guard := ReadOnlyGuard(http.HandlerFunc(func(writer http.ResponseWriter, req *http.Request) {
+		writer.WriteHeader(http.StatusNoContent)
+	}))
+	for request, expected := range map[[2]string]int{
+		{"GET", "/image/a"}:                     http.StatusNoContent,
+		{"GET", "/quarantine"}:                  http.StatusNoContent,
+		{"POST", "/v1/graphql"}:                 http.StatusNoContent,
+		{"PUT", "/admin/read-only"}:             http.StatusNoContent,
+		{"PUT", "/v1/admin/read-only"}:          http.StatusNoContent,
+		{"POST", "/quarantine/a/release"}:       http.StatusServiceUnavailable,
+		{"DELETE", "/v1/quarantine/a"}:          http.StatusServiceUnavailable,
+		{"PUT", "/v1/image/a/hold"}:             http.StatusServiceUnavailable,
+		{"PUT", "/image/a/owner"}:               http.StatusServiceUnavailable,
+		{"POST", "/admin/api-keys"}:             http.StatusServiceUnavailable,
+		{"POST", "/image"}:                      http.StatusServiceUnavailable,
+		{"DELETE", "/image/a"}:                  http.StatusServiceUnavailable,
+		{"PATCH", "/image/a/metadata"}:          http.StatusServiceUnavailable,
+		{"POST", "/image/hold/transformations"}: http.StatusServiceUnavailable,
+	} {
+		recorder := httptest.NewRecorder()
+		guard.ServeHTTP(recorder, httptest.NewRequest(request[0], request[1], nil))
+		if recorder.Code != expected {
+			t.Errorf("Expected %s %s to answer %d, got %d", request[0], request[1], expected, recorder.Code)
+		}
+	}
+}
@@ -0,0 +1,298 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/thejsj/veenco/config"
+	"github.com/thejsj/veenco/errcode"
+	"github.com/thejsj/veenco/worker/image-converter"
+)
+
+// Renders are kept under this prefix, one folder per image
+const renderKeyPrefix = "renders/"
+
+// `fit` and `format` are copied into an ops string, so they can't carry
+// separators of their own
+var renderWordPattern = regexp.MustCompile(`^[a-z]+$`)
+
+var (
+	renderSlotsOnce sync.Once
+	renderSlots     chan struct{}
+)
+
+// acquireRenderSlot waits for one of the RENDER_CONCURRENCY (4 by default)
+// renders allowed at once, returning false if the client gave up first
+func acquireRenderSlot(req *http.Request) bool {
+	renderSlotsOnce.Do(func() {
+		renderSlots = make(chan struct{}, config.Int("RENDER_CONCURRENCY", 4))
+	})
+	select {
+	case renderSlots <- struct{}{}:
+		return true
+	case <-req.Context().Done():
+		return false
+	}
+}
+
+func releaseRenderSlot() {
+	<-renderSlots
+}
+
+// renderMaxPx bounds the size of a render, from RENDER_MAX_PX (4096 by
+// default)
+func renderMaxPx() uint {
+	return uint(config.Int("RENDER_MAX_PX", 4096))
+}
+
+// renderSizes are the widths and heights renders are made at, from
+// RENDER_SIZES. Requested sizes are rounded up to the next one, so the
+// number of cached renders per image stays bounded however many sizes
+// clients ask for.
+func renderSizes() []uint {
+	names := config.List("RENDER_SIZES")
+	if len(names) == 0 {
+		names = strings.Split("16,32,48,64,96,128,160,240,320,480,640,800,960,1080,1280,1600,1920,2048,2560,3200,3840,4096", ",")
+	}
+	var sizes []uint
+	for _, name := range names {
+		size, err := strconv.ParseUint(strings.TrimSpace(name), 10, 32)
+		if err == nil && size > 0 {
+			sizes = append(sizes, uint(size))
+		}
+	}
+	sort.Slice(sizes, func(i, j int) bool { return sizes[i] < sizes[j] })
+	return sizes
+}
+
+// snapRenderSize rounds px up to the next render size, or down to maxPx
+func snapRenderSize(px uint, sizes []uint, maxPx uint) uint {
+	for _, size := range sizes {
+		if size >= px && size <= maxPx {
+			return size
+		}
+	}
+	return maxPx
+}
+
+// renderOps turns the query of a render URL into an ops string, either
+// from `ops` or from `w`, `h`, `fit`, `format` and `q`. Resize sizes are
+// snapped to renderSizes and steps are always written the same way, so
+// equal renders share a cache key.
+func renderOps(query map[string][]string) (string, error) {
+	get := func(name string) string {
+		if values := query[name]; len(values) > 0 {
+			return values[0]
+		}
+		return ""
+	}
+	ops := get("ops")
+	if ops != "" {
+		for _, name := range []string{"w", "h", "fit", "format", "q"} {
+			if get(name) != "" {
+				return "", fmt.Errorf("`%s` can't be given along with `ops`", name)
+			}
+		}
+	} else {
+		var err error
+		ops, err = renderQueryOps(get)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	maxPx := renderMaxPx()
+	operations, err := imageConverter.ParseOperations(ops, maxPx)
+	if err != nil {
+		return "", err
+	}
+	sizes := renderSizes()
+	var steps []string
+	for _, operation := range operations {
+		if operation.Name == "resize" {
+			for _, name := range []string{"w", "h"} {
+				if value, ok := operation.Named[name]; ok {
+					px, _ := strconv.ParseUint(value, 10, 32)
+					operation.Named[name] = strconv.FormatUint(uint64(snapRenderSize(uint(px), sizes, maxPx)), 10)
+				}
+			}
+		}
+		steps = append(steps, operation.String())
+	}
+	return strings.Join(steps, ";"), nil
+}
+
+// renderQueryOps builds an ops string from the separate render parameters
+func renderQueryOps(get func(name string) string) (string, error) {
+	maxPx := uint64(renderMaxPx())
+	var steps []string
+	var size []string
+	for _, name := range []string{"w", "h"} {
+		value := get(name)
+		if value == "" {
+			continue
+		}
+		px, err := strconv.ParseUint(value, 10, 32)
+		if err != nil || px == 0 || px > maxPx {
+			return "", fmt.Errorf("`%s` must be a number of pixels between 1 and %d", name, maxPx)
+		}
+		size = append(size, fmt.Sprintf("%s=%d", name, px))
+	}
+	fit := get("fit")
+	if fit == "" {
+		fit = "clip"
+	}
+	format := get("format")
+	for name, value := range map[string]string{"fit": fit, "format": format} {
+		if value != "" && !renderWordPattern.MatchString(value) {
+			return "", fmt.Errorf("Invalid `%s` `%s`", name, value)
+		}
+	}
+	if len(size) > 0 {
+		steps = append(steps, "resize:"+strings.Join(size, ",")+",fit="+fit)
+	}
+
+	if format != "" {
+		step := "format:" + format
+		if quality := get("q"); quality != "" {
+			q, err := strconv.ParseUint(quality, 10, 32)
+			if err != nil {
+				return "", fmt.Errorf("`q` must be a number between 1 and 100")
+			}
+			step += fmt.Sprintf(",q=%d", q)
+		}
+		steps = append(steps, step)
+	} else if get("q") != "" {
+		return "", fmt.Errorf("`q` can only be given along with `format`")
+	}
+	if len(steps) == 0 {
+		return "", fmt.Errorf("A render needs `ops`, `w`, `h` or `format`")
+	}
+	return strings.Join(steps, ";"), nil
+}
+
+// renderKey is where the render of an image with these ops is cached. The
+// original's hash is part of it, so replacing the original bypasses
+// renders of the old bytes.
+func renderKey(imageEntry ImageEntry, ops string) string {
+	hash := sha256.Sum256([]byte(imageEntry.Sha256 + "\n" + imageEntry.SourceUrl + "\n" + ops))
+	return renderKeyPrefix + imageEntry.Id + "/" + hex.EncodeToString(hash[:16])
+}
+
+// deleteRenders removes every cached render of an image
+func deleteRenders(s3bucket *s3.Bucket, imageId string) error {
+	marker := ""
+	for {
+		list, err := s3bucket.List(renderKeyPrefix+imageId+"/", "", marker, 1000)
+		if err != nil {
+			return err
+		}
+		for _, key := range list.Contents {
+			err = s3bucket.Del(key.Key)
+			if err != nil {
+				return err
+			}
+			marker = key.Key
+		}
+		if !list.IsTruncated {
+			return nil
+		}
+	}
+}
+
+// setRenderCacheHeaders lets browsers and proxies keep a render as
+// RENDER_CACHE_CONTROL says, private for a day by default since images may
+// belong to a tenant. Errors aren't cached.
+func setRenderCacheHeaders(writer http.ResponseWriter, etag string) {
+	writer.Header().Set("ETag", etag)
+	writer.Header().Set("Cache-Control", config.String("RENDER_CACHE_CONTROL", "private, max-age=86400"))
+}
+
+// RenderGetHandler resizes and converts an image on request, e.g.
+// `?w=300&h=200&fit=crop&format=webp` or `?ops=resize:w=300;format:webp`, so
+// pages can put the URL straight in an <img> tag. `fit` is clip (the
+// default, fit within `w` and `h`), crop (fill them, cutting off the edges)
+// or scale (stretch to them). Sizes are rounded up to RENDER_SIZES and
+// renders are cached in the bucket, so only the first request for a size
+// waits on ImageMagick.
+func RenderGetHandler(session *r.Session, s3bucket *s3.Bucket) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		log.Printf("GET RenderGetHandler")
+		imageEntry, ok := FindImageEntry(session, writer, req, params.ByName("id"))
+		if !ok {
+			return
+		}
+		ops, err := renderOps(req.URL.Query())
+		if err != nil {
+			WriteError(writer, http.StatusBadRequest, errcode.InvalidRequest, "Invalid render: "+err.Error())
+			return
+		}
+		if !strings.HasPrefix(imageEntry.ContentType, "image/") {
+			WriteError(writer, http.StatusUnsupportedMediaType, errcode.UnsupportedFormat, "Renders are only available for images")
+			return
+		}
+
+		key := renderKey(imageEntry, ops)
+		etag := `"` + strings.TrimPrefix(key, renderKeyPrefix+imageEntry.Id+"/") + `"`
+		if req.Header.Get("If-None-Match") == etag {
+			setRenderCacheHeaders(writer, etag)
+			writer.WriteHeader(http.StatusNotModified)
+			return
+		}
+
+		// Any error reading the cached render is treated as a miss
+		if res, err := s3bucket.GetResponse(key); err == nil {
+			defer res.Body.Close()
+			writer.Header().Set("Content-Type", res.Header.Get("Content-Type"))
+			setRenderCacheHeaders(writer, etag)
+			writer.Header().Set("X-Render-Cache", "hit")
+			_, err = io.Copy(writer, res.Body)
+			if err != nil {
+				log.Printf("Error streaming render %s: %s", key, err)
+			}
+			return
+		}
+
+		if !acquireRenderSlot(req) {
+			return
+		}
+		defer releaseRenderSlot()
+		source, err := ReadSource(s3bucket, imageEntry)
+		if err != nil {
+			code := errcode.StorageUnavailable
+			if imageEntry.SourceUrl != "" {
+				code = errcode.SourceUnavailable
+			}
+			WriteError(writer, http.StatusBadGateway, code, "Error reading image: "+err.Error())
+			return
+		}
+		operations, _ := imageConverter.ParseOperations(ops, renderMaxPx())
+		rendered, contentType, err := imageConverter.Preview(source, 0, operations)
+		if err != nil {
+			writePreviewError(writer, err, "Error rendering image: ")
+			return
+		}
+		err = s3bucket.Put(key, rendered, contentType, s3.Private)
+		if err != nil {
+			RecordS3Error("put")
+			log.Printf("Error caching render %s: %s", key, err)
+		}
+
+		writer.Header().Set("Content-Type", contentType)
+		setRenderCacheHeaders(writer, etag)
+		writer.Header().Set("X-Render-Cache", "miss")
+		writer.Write(rendered)
+	}
+}
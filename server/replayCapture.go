@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/thejsj/veenco/config"
+	"github.com/thejsj/veenco/replay"
+)
+
+// replayCapturing is 1 while requests are being recorded
+var replayCapturing int32
+
+type capturingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (writer *capturingResponseWriter) WriteHeader(status int) {
+	writer.status = status
+	writer.ResponseWriter.WriteHeader(status)
+}
+
+func (writer *capturingResponseWriter) Write(data []byte) (int, error) {
+	writer.body.Write(data)
+	return writer.ResponseWriter.Write(data)
+}
+
+func (writer *capturingResponseWriter) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
+
+// Captured records the request and its outcome to the replay log while
+// capture is switched on
+func Captured(handle httprouter.Handle) httprouter.Handle {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		if atomic.LoadInt32(&replayCapturing) == 0 {
+			handle(writer, req, params)
+			return
+		}
+
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			http.Error(writer, "Error reading body of request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+		capturingWriter := &capturingResponseWriter{ResponseWriter: writer, status: http.StatusOK}
+		handle(capturingWriter, req, params)
+
+		err = replay.Append(config.String("REPLAY_LOG", "replay.log"), replay.Record{
+			RecordedAt: time.Now(),
+			Method:     req.Method,
+			Path:       req.URL.RequestURI(),
+			Header:     replay.SanitizeHeader(req.Header),
+			Body:       string(body),
+			Status:     capturingWriter.status,
+			Response:   capturingWriter.body.String(),
+		})
+		if err != nil {
+			log.Printf("Error writing replay log: %s", err)
+		}
+	}
+}
+
+type ReplayCaptureRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+// ReplayCapturePutHandler switches request capture on or off
+func ReplayCapturePutHandler() func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		var captureRequest ReplayCaptureRequest
+		err := json.NewDecoder(req.Body).Decode(&captureRequest)
+		if err != nil {
+			http.Error(writer, "Error unmarshalling replay capture request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		var capturing int32
+		if captureRequest.Enabled {
+			capturing = 1
+		}
+		atomic.StoreInt32(&replayCapturing, capturing)
+		log.Printf("Replay capture enabled: %v", captureRequest.Enabled)
+
+		jsonResponse, err := json.Marshal(captureRequest)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(jsonResponse)
+	}
+}
@@ -0,0 +1,548 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/thejsj/veenco/config"
+	"github.com/thejsj/veenco/errcode"
+	"github.com/thejsj/veenco/ids"
+)
+
+// Resumable uploads follow the tus 1.0 core protocol with the creation and
+// termination extensions. Each PATCH becomes one part of an S3 multipart
+// upload, so every chunk except the last must be at least 5MiB, S3's
+// minimum part size. A chunk that fails part way is not stored and the
+// client resumes from the last offset.
+const (
+	tusVersion         = "1.0.0"
+	minResumableChunk  = 5 << 20
+	defaultMaxChunk    = 64 << 20
+	offsetOctetStream  = "application/offset+octet-stream"
+	resumableTableName = "uploads"
+)
+
+// ResumableUpload tracks an upload in progress. HashState is the marshalled
+// SHA-256 state after Offset bytes, so the hash doesn't need the whole file
+// at once.
+type ResumableUpload struct {
+	Id         string     `gorethink:"id"`
+	S3Filename string     `gorethink:"s3Filename"`
+	MultiId    string     `gorethink:"multiId"`
+	Length     int64      `gorethink:"length"`
+	Offset     int64      `gorethink:"offset"`
+	Parts      []s3.Part  `gorethink:"parts"`
+	HashState  []byte     `gorethink:"hashState"`
+	Width      int        `gorethink:"width"`
+	Height     int        `gorethink:"height"`
+	CreatedAt  time.Time  `gorethink:"createdAt"`
+	UpdatedAt  time.Time  `gorethink:"updatedAt"`
+	Image      ImageEntry `gorethink:"image"`
+	// Set while a request is uploading a part or completing the upload
+	ClaimId   string    `gorethink:"claimId"`
+	ClaimedAt time.Time `gorethink:"claimedAt"`
+	// Set once the S3 object has been assembled
+	Completed bool `gorethink:"completed"`
+}
+
+func maxResumableChunk() int64 {
+	return int64(config.Int("UPLOAD_CHUNK_MAX_BYTES", defaultMaxChunk))
+}
+
+// S3 allows at most 10000 parts per object
+func maxResumableSize() int64 {
+	return maxResumableChunk() * 10000
+}
+
+// tusMetadata decodes an Upload-Metadata header: comma separated keys, each
+// followed by a base64 value
+func tusMetadata(header string) map[string]string {
+	metadata := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		fields := strings.Fields(pair)
+		if len(fields) == 0 {
+			continue
+		}
+		value := ""
+		if len(fields) > 1 {
+			decoded, err := base64.StdEncoding.DecodeString(fields[1])
+			if err != nil {
+				continue
+			}
+			value = string(decoded)
+		}
+		metadata[fields[0]] = value
+	}
+	return metadata
+}
+
+func writeTusHeaders(writer http.ResponseWriter) {
+	writer.Header().Set("Tus-Resumable", tusVersion)
+	writer.Header().Set("Cache-Control", "no-store")
+}
+
+// ResumableOptionsHandler advertises what the upload endpoint supports
+func ResumableOptionsHandler() func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		writer.Header().Set("Tus-Resumable", tusVersion)
+		writer.Header().Set("Tus-Version", tusVersion)
+		writer.Header().Set("Tus-Extension", "creation,termination")
+		writer.Header().Set("Tus-Max-Size", strconv.FormatInt(maxResumableSize(), 10))
+		writer.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// ResumablePostHandler starts an upload of Upload-Length bytes. The file
+// name, content type, slug and metadata come from Upload-Metadata as
+// `filename`, `filetype`, `slug` and `metadata`.
+func ResumablePostHandler(session *r.Session, s3bucket *s3.Bucket) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		log.Printf("POST ResumablePostHandler")
+		writeTusHeaders(writer)
+		length, err := strconv.ParseInt(req.Header.Get("Upload-Length"), 10, 64)
+		if err != nil || length <= 0 {
+			http.Error(writer, "`Upload-Length` must be a positive number of bytes", http.StatusBadRequest)
+			return
+		}
+		if length > maxResumableSize() {
+			http.Error(writer, "Upload is larger than the maximum size", http.StatusRequestEntityTooLarge)
+			return
+		}
+
+		uploadMetadata := tusMetadata(req.Header.Get("Upload-Metadata"))
+		var metadata map[string]interface{}
+		if uploadMetadata["metadata"] != "" {
+			metadata, err = ParseMetadata([]byte(uploadMetadata["metadata"]))
+			if err != nil {
+				http.Error(writer, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+		slug, err := AvailableSlug(session, uploadMetadata["slug"], RequestTenant(req))
+		if err != nil {
+			WriteErrorOf(writer, err, "")
+			return
+		}
+
+		imageId := ids.New()
+		originalFileName := NormalizeFilename(uploadMetadata["filename"])
+		contentType := uploadMetadata["filetype"]
+		s3UploadFilename := imageId + KeyExtension(originalFileName)
+		multi, err := s3bucket.InitMulti(s3UploadFilename, contentType, s3.Private)
+		if err != nil {
+			releaseSlug(session, slug, RequestTenant(req))
+			RecordS3Error("initMulti")
+			http.Error(writer, "Error starting S3 multipart upload: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		hashState, _ := sha256.New().(encoding.BinaryMarshaler).MarshalBinary()
+
+		upload := ResumableUpload{
+			Id:         ids.New(),
+			S3Filename: s3UploadFilename,
+			MultiId:    multi.UploadId,
+			Length:     length,
+			Parts:      []s3.Part{},
+			HashState:  hashState,
+			CreatedAt:  time.Now(),
+			UpdatedAt:  time.Now(),
+			Image: ImageEntry{
+				Id:               imageId,
+				Slug:             slug,
+				S3Filename:       s3UploadFilename,
+				OriginalFileName: originalFileName,
+				ContentType:      contentType,
+				Size:             int(length),
+				ChainId:          RequestChainId(req),
+				OwnerId:          RequestTenant(req),
+				Metadata:         metadata,
+			},
+		}
+		// Completed by the chunks: the type is sniffed from the first and
+		// the duration measured at the last
+		upload.Image.recordUploadRequest(req, nil)
+		err = r.Table(resumableTableName).Insert(upload).Exec(session)
+		if err != nil {
+			multi.Abort()
+			releaseSlug(session, slug, RequestTenant(req))
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writer.Header().Set("Location", apiPath(req, "/uploads/"+upload.Id))
+		writer.Header().Set("Upload-Offset", "0")
+		writer.WriteHeader(http.StatusCreated)
+	}
+}
+
+// ResumableHeadHandler tells the client where to resume
+func ResumableHeadHandler(session *r.Session) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		writeTusHeaders(writer)
+		upload, ok := findResumableUpload(session, writer, req, params.ByName("id"))
+		if !ok {
+			return
+		}
+		writer.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+		writer.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+		writer.WriteHeader(http.StatusOK)
+	}
+}
+
+// ResumablePatchHandler stores the next chunk as an S3 part. Once the last
+// byte arrives the object is assembled and the image is recorded. If that
+// fails the client can retry it with an empty PATCH at the final offset.
+func ResumablePatchHandler(session *r.Session, s3bucket *s3.Bucket) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		log.Printf("PATCH ResumablePatchHandler")
+		writeTusHeaders(writer)
+		if req.Header.Get("Content-Type") != offsetOctetStream {
+			http.Error(writer, "`Content-Type` must be "+offsetOctetStream, http.StatusUnsupportedMediaType)
+			return
+		}
+		upload, ok := findResumableUpload(session, writer, req, params.ByName("id"))
+		if !ok {
+			return
+		}
+		offset, err := strconv.ParseInt(req.Header.Get("Upload-Offset"), 10, 64)
+		if err != nil || offset != upload.Offset {
+			http.Error(writer, fmt.Sprintf("`Upload-Offset` must be %v", upload.Offset), http.StatusConflict)
+			return
+		}
+
+		GuardUploadBody(writer, req)
+		ThrottleUploadBody(req)
+		chunk, err := ioutil.ReadAll(http.MaxBytesReader(writer, req.Body, maxResumableChunk()))
+		if err != nil {
+			WriteUploadReadError(writer, err)
+			return
+		}
+		newOffset := offset + int64(len(chunk))
+		if newOffset > upload.Length {
+			http.Error(writer, "Chunk goes past `Upload-Length`", http.StatusBadRequest)
+			return
+		}
+		if newOffset < upload.Length && len(chunk) < minResumableChunk {
+			http.Error(writer, fmt.Sprintf("Every chunk but the last must be at least %v bytes", minResumableChunk), http.StatusBadRequest)
+			return
+		}
+		if len(chunk) == 0 && newOffset < upload.Length {
+			writer.Header().Set("Upload-Offset", strconv.FormatInt(offset, 10))
+			writer.WriteHeader(http.StatusNoContent)
+			return
+		}
+
+		hash, err := resumableHash(upload.HashState)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		hash.Write(chunk)
+		hashState, _ := hash.(encoding.BinaryMarshaler).MarshalBinary()
+
+		// The part number comes from the offset, so only one request may
+		// upload it
+		claimId, err := claimResumableUpload(session, upload.Id, offset)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if claimId == "" {
+			http.Error(writer, "The upload is being changed by another request", http.StatusConflict)
+			return
+		}
+		defer releaseResumableClaim(session, upload.Id, claimId)
+
+		multi := &s3.Multi{Bucket: s3bucket, Key: upload.S3Filename, UploadId: upload.MultiId}
+		if len(chunk) > 0 {
+			part, err := multi.PutPart(len(upload.Parts)+1, bytes.NewReader(chunk))
+			if err != nil {
+				RecordS3Error("putPart")
+				http.Error(writer, "Error uploading part to S3 bucket: "+err.Error(), http.StatusInternalServerError)
+				return
+			}
+			upload.Parts = append(upload.Parts, part)
+
+			changes := map[string]interface{}{
+				"offset":    newOffset,
+				"parts":     upload.Parts,
+				"hashState": hashState,
+				"updatedAt": time.Now(),
+			}
+			// Only the first chunk has the header the dimensions are read from
+			if offset == 0 {
+				upload.Width, upload.Height = ImageDimensions(chunk)
+				upload.Image.DetectedContentType = detectContentType(chunk)
+				changes["width"], changes["height"] = upload.Width, upload.Height
+				changes["image"] = map[string]interface{}{"detectedContentType": upload.Image.DetectedContentType}
+			}
+			res, err := r.Table(resumableTableName).Get(upload.Id).Update(r.Branch(
+				r.Row.Field("claimId").Default("").Eq(claimId), changes, nil,
+			)).RunWrite(session)
+			if err != nil {
+				http.Error(writer, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if res.Replaced == 0 {
+				http.Error(writer, "The upload was changed by another request", http.StatusConflict)
+				return
+			}
+		}
+
+		if newOffset == upload.Length {
+			if !completeResumableUpload(session, writer, multi, upload, hex.EncodeToString(hash.Sum(nil))) {
+				return
+			}
+		}
+		writer.Header().Set("Upload-Offset", strconv.FormatInt(newOffset, 10))
+		writer.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func resumableHash(state []byte) (hash.Hash, error) {
+	digest := sha256.New()
+	err := digest.(encoding.BinaryUnmarshaler).UnmarshalBinary(state)
+	return digest, err
+}
+
+// resumableClaimTimeout is how long a claim holds before another request
+// may take over the upload, from UPLOAD_CLAIM_TIMEOUT (10 minutes by
+// default). It only matters when a server dies while holding one.
+func resumableClaimTimeout() time.Duration {
+	return config.Duration("UPLOAD_CLAIM_TIMEOUT", 10*time.Minute)
+}
+
+// claimResumableUpload marks the upload as being changed by one request,
+// as long as it is still at offset. It returns an empty id if another
+// request got there first.
+func claimResumableUpload(session *r.Session, id string, offset int64) (string, error) {
+	claimId := ids.New()
+	now := time.Now()
+	res, err := r.Table(resumableTableName).Get(id).Update(r.Branch(
+		r.Row.Field("offset").Eq(offset).And(r.Row.Field("claimId").Default("").Eq("").Or(
+			r.Row.Field("claimedAt").Lt(now.Add(-resumableClaimTimeout())),
+		)),
+		map[string]interface{}{"claimId": claimId, "claimedAt": now},
+		nil,
+	)).RunWrite(session)
+	if err != nil || res.Replaced == 0 {
+		return "", err
+	}
+	return claimId, nil
+}
+
+// releaseResumableClaim lets the next request change the upload, unless
+// the claim has already been taken over
+func releaseResumableClaim(session *r.Session, id string, claimId string) {
+	err := r.Table(resumableTableName).Get(id).Update(r.Branch(
+		r.Row.Field("claimId").Default("").Eq(claimId), map[string]interface{}{"claimId": ""}, nil,
+	)).Exec(session)
+	if err != nil {
+		log.Printf("Error releasing upload %s: %s", id, err)
+	}
+}
+
+// completeResumableUpload assembles the object and turns the upload into an
+// image, or hands back the existing one when it is a copy, writing an error
+// response and returning false if it can't. The upload is kept until the
+// image is recorded so a failed completion can be retried.
+func completeResumableUpload(session *r.Session, writer http.ResponseWriter, multi *s3.Multi, upload ResumableUpload, sha256Hex string) bool {
+	if !upload.Completed {
+		if upload.Image.Slug == "" && uploadDeduplication() {
+			existing, err := FindImageBySha256(session, sha256Hex, upload.Image.OwnerId)
+			if err == nil {
+				return completeDuplicateUpload(session, writer, multi, upload, existing)
+			}
+			if err != r.ErrEmptyResult {
+				log.Printf("Error looking for copies of upload %s: %s", upload.Id, err)
+			}
+		}
+
+		err := multi.Complete(upload.Parts)
+		if err != nil {
+			RecordS3Error("completeMulti")
+			http.Error(writer, "Error completing S3 multipart upload: "+err.Error(), http.StatusInternalServerError)
+			return false
+		}
+		// The multipart upload is gone now, so a retry must not complete it
+		// again
+		err = r.Table(resumableTableName).Get(upload.Id).Update(map[string]interface{}{"completed": true}).Exec(session)
+		if err != nil {
+			log.Printf("Error marking upload %s as completed: %s", upload.Id, err)
+		}
+	}
+
+	newImage := upload.Image
+	newImage.CreatedAt = time.Now()
+	newImage.Sha256 = sha256Hex
+	newImage.Width = upload.Width
+	newImage.Height = upload.Height
+	newImage.UploadDurationMs = int64(time.Since(upload.CreatedAt) / time.Millisecond)
+	if reason := ValidateUpload(newImage); reason != "" {
+		result := Quarantine(session, newImage, errcode.InvalidImage, reason)
+		if result.Status == http.StatusUnprocessableEntity {
+			releaseSlug(session, newImage.Slug, newImage.OwnerId)
+			deleteResumableUpload(session, upload.Id)
+		}
+		WriteError(writer, result.Status, result.Code, result.Error)
+		return false
+	}
+	// Replacing keeps a retry from failing on an insert that did go through
+	err := r.Table("images").Insert(newImage, r.InsertOpts{Conflict: "replace"}).Exec(session)
+	if err != nil {
+		WriteError(writer, http.StatusServiceUnavailable, errcode.StorageUnavailable, "Error inserting image entry into database : "+err.Error())
+		return false
+	}
+
+	deleteResumableUpload(session, upload.Id)
+	log.Printf("Finished resumable upload %s as image %s", upload.Id, newImage.Id)
+	uploadSize.observe("", float64(upload.Length))
+	writer.Header().Set("X-Image-Id", newImage.Id)
+	writer.Header().Set("ETag", HashETag(newImage.Sha256))
+	return true
+}
+
+func deleteResumableUpload(session *r.Session, id string) {
+	err := r.Table(resumableTableName).Get(id).Delete().Exec(session)
+	if err != nil {
+		log.Printf("Error removing finished upload %s: %s", id, err)
+	}
+}
+
+// completeDuplicateUpload finishes an upload whose bytes match an existing
+// image by dropping the stored parts and pointing the client at that image
+func completeDuplicateUpload(session *r.Session, writer http.ResponseWriter, multi *s3.Multi, upload ResumableUpload, existing ImageEntry) bool {
+	err := multi.Abort()
+	if err != nil {
+		RecordS3Error("abortMulti")
+		log.Printf("Error aborting duplicate upload %s: %s", upload.Id, err)
+	}
+	releaseSlug(session, upload.Image.Slug, upload.Image.OwnerId)
+	deleteResumableUpload(session, upload.Id)
+	log.Printf("Resumable upload %s is a copy of image %s", upload.Id, existing.Id)
+	writer.Header().Set("X-Image-Id", existing.Id)
+	writer.Header().Set("X-Deduplicated", "true")
+	writer.Header().Set("ETag", HashETag(existing.Sha256))
+	return true
+}
+
+// ResumableDeleteHandler abandons an upload and its stored parts
+func ResumableDeleteHandler(session *r.Session, s3bucket *s3.Bucket) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		log.Printf("DELETE ResumableDeleteHandler")
+		writeTusHeaders(writer)
+		upload, ok := findResumableUpload(session, writer, req, params.ByName("id"))
+		if !ok {
+			return
+		}
+		multi := &s3.Multi{Bucket: s3bucket, Key: upload.S3Filename, UploadId: upload.MultiId}
+		err := multi.Abort()
+		if err != nil {
+			http.Error(writer, "Error aborting S3 multipart upload: "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		err = r.Table(resumableTableName).Get(upload.Id).Delete().Exec(session)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		releaseSlug(session, upload.Image.Slug, upload.Image.OwnerId)
+		writer.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// SweepResumableUploads aborts uploads that haven't received a chunk for
+// UPLOAD_EXPIRY (a day by default) every UPLOAD_SWEEP_INTERVAL (an hour by
+// default), so abandoned parts don't stay in the bucket
+func SweepResumableUploads(session *r.Session, s3bucket *s3.Bucket) {
+	for range time.Tick(config.Duration("UPLOAD_SWEEP_INTERVAL", time.Hour)) {
+		if ReadOnly() {
+			continue
+		}
+		cutoff := time.Now().Add(-config.Duration("UPLOAD_EXPIRY", 24*time.Hour))
+		cursor, err := r.Table(resumableTableName).Filter(
+			r.Row.Field("updatedAt").Default(r.Row.Field("createdAt")).Lt(cutoff).And(
+				r.Row.Field("claimId").Default("").Eq("").Or(
+					r.Row.Field("claimedAt").Lt(time.Now().Add(-resumableClaimTimeout())),
+				),
+			),
+		).Run(session)
+		var uploads []ResumableUpload
+		if err == nil {
+			err = cursor.All(&uploads)
+			cursor.Close()
+		}
+		if err != nil {
+			log.Printf("Error listing expired uploads: %s", err)
+			continue
+		}
+		for _, upload := range uploads {
+			if err := expireResumableUpload(session, s3bucket, upload); err != nil {
+				log.Printf("Error expiring upload %s: %s", upload.Id, err)
+			}
+		}
+		if len(uploads) > 0 {
+			log.Printf("Expired %d abandoned uploads", len(uploads))
+		}
+	}
+}
+
+// expireResumableUpload drops the stored parts, or the assembled object if
+// the image was never recorded, and then the upload itself
+func expireResumableUpload(session *r.Session, s3bucket *s3.Bucket, upload ResumableUpload) error {
+	var err error
+	if upload.Completed {
+		err = s3bucket.Del(upload.S3Filename)
+	} else {
+		multi := &s3.Multi{Bucket: s3bucket, Key: upload.S3Filename, UploadId: upload.MultiId}
+		err = multi.Abort()
+		if s3err, ok := err.(*s3.Error); ok && s3err.Code == "NoSuchUpload" {
+			err = nil
+		}
+	}
+	if err != nil {
+		RecordS3Error("abortMulti")
+		return err
+	}
+	err = r.Table(resumableTableName).Get(upload.Id).Delete().Exec(session)
+	if err == nil {
+		releaseSlug(session, upload.Image.Slug, upload.Image.OwnerId)
+	}
+	return err
+}
+
+func findResumableUpload(session *r.Session, writer http.ResponseWriter, req *http.Request, id string) (ResumableUpload, bool) {
+	var upload ResumableUpload
+	cursor, err := r.Table(resumableTableName).Get(id).Run(session)
+	if err == nil {
+		err = cursor.One(&upload)
+		cursor.Close()
+	}
+	// Uploads without an owner still only belong to whoever started them
+	if err == nil && !validAdminToken(req) && upload.Image.OwnerId != RequestTenant(req) {
+		err = r.ErrEmptyResult
+	}
+	if err == r.ErrEmptyResult {
+		http.Error(writer, fmt.Sprintf("No upload with id `%s` could be found", id), http.StatusNotFound)
+		return upload, false
+	}
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return upload, false
+	}
+	return upload, true
+}
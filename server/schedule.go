@@ -0,0 +1,51 @@
+package server
+
+import (
+	"log"
+	"sync"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/thejsj/veenco/database"
+	"github.com/thejsj/veenco/storage"
+)
+
+// runPeriodicTasks runs the sweeps that keep tables and the bucket from
+// growing, returning only if they all stop. The sweeps skip their runs while
+// in read-only mode.
+func runPeriodicTasks(session *r.Session, s3bucket *s3.Bucket) {
+	var tasks sync.WaitGroup
+	for _, task := range []func(){
+		func() { SweepIdempotencyKeys(session) },
+		func() { SweepResumableUploads(session, s3bucket) },
+	} {
+		tasks.Add(1)
+		go func(task func()) {
+			defer tasks.Done()
+			task()
+		}(task)
+	}
+	tasks.Wait()
+}
+
+// Schedule connects to RethinkDB and S3 and runs only the periodic tasks,
+// so they can be run once per deployment by `enco schedule` while the API
+// replicas set SERVE_SCHEDULE=false
+func Schedule() {
+	log.Printf("Starting scheduler...")
+
+	session, err := database.Connect()
+	failOnError(err, "Failed to connect to RethinkDB")
+	err = SetupIndexes(session)
+	failOnError(err, "Failed to set up database tables and indexes")
+
+	storageConfig := storage.ConfigFromEnv("S3")
+	s3bucket, err := storageConfig.Bucket()
+	failOnError(err, "Failed to configure S3 bucket")
+
+	err = loadReadOnly(session)
+	failOnError(err, "Failed to load the read-only switch")
+	go WatchReadOnly(session)
+
+	runPeriodicTasks(session, s3bucket)
+}
@@ -0,0 +1,695 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/thejsj/veenco/config"
+	"github.com/thejsj/veenco/database"
+	"github.com/thejsj/veenco/errcode"
+	"github.com/thejsj/veenco/ids"
+	"github.com/thejsj/veenco/queue"
+	"github.com/thejsj/veenco/storage"
+	"github.com/thejsj/veenco/worker/image-converter"
+)
+
+var session *r.Session
+
+type ImageEntry struct {
+	Id               string    `gorethink:"id" json:"id"`
+	Slug             string    `gorethink:"slug,omitempty" json:"slug,omitempty"`
+	S3Filename       string    `gorethink:"s3Filename" json:"s3Filename"`
+	OriginalFileName string    `gorethink:"originalFileName,omitempty" json:"originalFileName,omitempty"`
+	ContentType      string    `gorethink:"contentType,omitempty" json:"contentType,omitempty"`
+	CreatedAt        time.Time `gorethink:"createAt,omitempty" json:"createAt,omitempty"`
+	Size             int       `gorethink:"size,omitempty" json:"size,omitempty"`
+	Sha256           string    `gorethink:"sha256,omitempty" json:"sha256,omitempty"`
+	Width            int       `gorethink:"width,omitempty" json:"width,omitempty"`
+	Height           int       `gorethink:"height,omitempty" json:"height,omitempty"`
+	// Shared with the image's jobs and their outputs, see RequestChainId
+	ChainId string `gorethink:"chainId,omitempty" json:"chainId,omitempty"`
+	// Tenant of the API key that created the image, see RequestTenant
+	OwnerId string `gorethink:"ownerId,omitempty" json:"ownerId,omitempty"`
+
+	// Editable with PATCH /image/:id
+	Tags        []string `gorethink:"tags,omitempty" json:"tags,omitempty"`
+	Description string   `gorethink:"description,omitempty" json:"description,omitempty"`
+
+	// Subtitle tracks for videos
+	Captions []Caption `gorethink:"captions,omitempty" json:"captions,omitempty"`
+	// Stream details of video uploads
+	Video *VideoProbe `gorethink:"video,omitempty" json:"video,omitempty"`
+
+	// Set instead of S3Filename for images registered without copying them
+	SourceUrl string `gorethink:"sourceUrl,omitempty" json:"sourceUrl,omitempty"`
+
+	// Arbitrary client supplied JSON object
+	Metadata map[string]interface{} `gorethink:"metadata,omitempty" json:"metadata,omitempty"`
+
+	// Details of the upload request, only shown by GET /admin/images/:id.
+	// The uploader's are removed by the erasure endpoint.
+	UploaderId          string `gorethink:"uploaderId,omitempty" json:"-"`
+	UploaderIp          string `gorethink:"uploaderIp,omitempty" json:"-"`
+	UploaderUserAgent   string `gorethink:"uploaderUserAgent,omitempty" json:"-"`
+	DeclaredContentType string `gorethink:"declaredContentType,omitempty" json:"-"`
+	DetectedContentType string `gorethink:"detectedContentType,omitempty" json:"-"`
+	UploadDurationMs    int64  `gorethink:"uploadDurationMs,omitempty" json:"-"`
+
+	// Images under legal hold can't be deleted until the hold is released
+	LegalHold       bool      `gorethink:"legalHold,omitempty" json:"legalHold,omitempty"`
+	LegalHoldReason string    `gorethink:"legalHoldReason,omitempty" json:"legalHoldReason,omitempty"`
+	LegalHoldAt     time.Time `gorethink:"legalHoldAt,omitempty" json:"legalHoldAt,omitempty"`
+}
+
+// Transformation
+type TransformationJob struct {
+	JobType string                 `json:"jobType"`
+	Data    map[string]interface{} `json:"data"`
+	// Optional name later steps can give as their input
+	Name string `json:"name"`
+	// Name of an earlier step whose output this one starts from, instead of
+	// the previous step's
+	Input string `json:"input"`
+}
+
+type TransformationJobCollection struct {
+	Transformations []TransformationJob `json:"transformations"`
+	// Optional duration, e.g. "10m", after which the jobs are no longer
+	// worth running
+	ExpiresIn string `json:"expiresIn"`
+	// Optional URL the worker POSTs each job's outcome to
+	CallbackUrl string `json:"callbackUrl"`
+	// Optional ops string, e.g. `resize:w=800;format:webp,q=80`, appended
+	// to the transformations. Also accepted as the `ops` query parameter.
+	Ops string `json:"ops"`
+	// Optional name of a preset whose transformations run before the
+	// others. Also accepted as the `preset` query parameter.
+	Preset string `json:"preset"`
+}
+
+// Jobs
+
+type Job struct {
+	Id        string    `gorethink:"id"`
+	ImageId   string    `gorethink:"imageId"`
+	JobType   string    `gorethink:"jobType,omitempty"`
+	NextJob   string    `gorethink:"nextJob,omitempty"`
+	Status    string    `gorethink:"status,omitempty"`
+	CreatedAt time.Time `gorethink:"createdAt,omitempty"`
+	// Requested output quality, already clamped to the quality policy
+	Quality float64 `gorethink:"quality,omitempty"`
+	// The canonical ops string of an operations job
+	Ops string `gorethink:"ops,omitempty"`
+	// Workers skip the job once this has passed
+	ExpiresAt time.Time `gorethink:"expiresAt,omitempty"`
+	// Told about the job's outcome
+	CallbackUrl string `gorethink:"callbackUrl,omitempty"`
+	// The image's chain id and owner
+	ChainId string `gorethink:"chainId,omitempty"`
+	OwnerId string `gorethink:"ownerId,omitempty"`
+	// The step's name, if it was given one, and the job whose output it
+	// starts from, empty for the original image
+	StepName string `gorethink:"stepName,omitempty"`
+	InputJob string `gorethink:"inputJob,omitempty"`
+	// Set when the job was submitted as part of a batch, or from a preset
+	BatchId string `gorethink:"batchId,omitempty"`
+	Preset  string `gorethink:"preset,omitempty"`
+	// What happened to the job so far, oldest first
+	Events []JobEvent `gorethink:"events,omitempty"`
+
+	// Set by the worker as it runs the job
+	StartedAt   time.Time `gorethink:"startedAt,omitempty"`
+	CompletedAt time.Time `gorethink:"completedAt,omitempty"`
+	Error       string    `gorethink:"error,omitempty"`
+	ErrorCode   string    `gorethink:"errorCode,omitempty"`
+	OutputKey   string    `gorethink:"outputKey,omitempty"`
+	// The backend, library version and normalized parameters that produced
+	// the output
+	Conversion map[string]interface{} `gorethink:"conversion,omitempty"`
+}
+
+// Job states. The worker writes running, completed and failed.
+const (
+	JobStatusPending   = "pending"
+	JobStatusRunning   = "running"
+	JobStatusCompleted = "completed"
+	JobStatusFailed    = "failed"
+	JobStatusExpired   = "expired"
+	// Jobs for a deleted image are kept but marked so they are never run
+	JobStatusCancelled = "cancelled"
+)
+
+// Job types accepted by the transformation endpoint
+const (
+	JobTypeResizeToWidthPx = "resizeToWidthPx"
+	// Runs the steps of an ops string, e.g. `resize:h=200,fit=crop`, with
+	// a single output
+	JobTypeOperations = "operations"
+)
+
+type ImageResizeToWidthPxJob struct {
+	Job
+	Width float64 `gorethink:"width"`
+}
+
+// ImageOperationsJob keeps its ops in Job, so they travel with the task
+type ImageOperationsJob struct {
+	Job
+}
+
+type ImageResizeToHeightPxJob struct {
+	Height float64
+}
+
+type ImageResizeByPercentageJob struct {
+	Percentage float64
+}
+
+type ImageCropByPercentageJob struct {
+	Top    int
+	Right  int
+	Bottom int
+	Left   int
+}
+
+func failOnError(err error, msg string) {
+	if err != nil {
+		log.Fatalf("%s: %s", msg, err)
+		panic(fmt.Sprintf("%s: %s", msg, err))
+	}
+}
+
+func IndexHandler(session *r.Session) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		log.Printf("Get IndexHandler")
+		// Streaming clients get every row unless they ask for a page
+		streaming := strings.Contains(req.Header.Get("Accept"), "application/x-ndjson")
+		defaultLimit := defaultPageLimit
+		if streaming {
+			defaultLimit = 0
+		}
+		page, err := ParsePage(req.URL.Query(), defaultLimit)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		filters, err := IndexFilters(req.URL.Query())
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if filter := MetadataFilter(req.URL.Query()); filter != nil {
+			filters = append(filters, filter)
+		}
+		if filter := TenantFilter(req); filter != nil {
+			filters = append(filters, filter)
+		}
+		query := page.OrderedImages()
+		for _, filter := range filters {
+			query = query.Filter(filter)
+		}
+		countCursor, err := query.Count().Run(session)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		var total int
+		err = countCursor.One(&total)
+		countCursor.Close()
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		res, err := page.Slice(query).Run(session)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer res.Close()
+		page.WriteHeaders(writer, req, total)
+
+		if streaming {
+			StreamNDJSON(writer, res)
+			return
+		}
+
+		var rows []interface{}
+		rResponseErr := res.All(&rows)
+		if rResponseErr != nil {
+			http.Error(writer, rResponseErr.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		jsonResponse, jsonMarshalErr := json.Marshal(rows)
+		if jsonMarshalErr != nil {
+			http.Error(writer, jsonMarshalErr.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(jsonResponse)
+	}
+}
+
+// ImageResponse is an image entry along with the URL of its object
+type ImageResponse struct {
+	ImageEntry
+	Url string `json:"url"`
+}
+
+func ImageGetHandler(session *r.Session, s3bucket *s3.Bucket) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		log.Printf("GET ImageGetHandler")
+		imageEntry, ok := FindImageEntry(session, writer, req, params.ByName("id"))
+		if !ok {
+			return
+		}
+
+		jsonResponse, err := json.Marshal(ImageResponse{
+			ImageEntry: imageEntry,
+			Url:        imageEntry.Url(s3bucket),
+		})
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(jsonResponse)
+	}
+}
+
+// handleError writes err, prefixed with message, and reports whether there
+// was one so the handler can stop
+func handleError(writer http.ResponseWriter, err error, message string) bool {
+	if err == nil {
+		return false
+	}
+	WriteErrorOf(writer, err, message)
+	return true
+}
+
+func ImagePostHandler(session *r.Session, s3bucket *s3.Bucket) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		log.Printf("POST ImagePostHandler")
+		log.Printf("Content type", req.Header.Get("Content-Type"))
+		if mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type")); mediaType == "application/json" {
+			registerExternalImage(session, s3bucket, writer, req)
+			return
+		}
+		if ExistingUpload(session, writer, req) {
+			return
+		}
+		if !LimitUploadBody(writer, req) {
+			return
+		}
+		GuardUploadBody(writer, req)
+		ThrottleUploadBody(req)
+
+		err := req.ParseMultipartForm(uploadMemoryBytes())
+		if err != nil && UploadReadStatus(err) != http.StatusBadRequest {
+			WriteUploadReadError(writer, err)
+			return
+		}
+		files, rejected := formFiles(req)
+		if len(rejected) > 0 {
+			WriteError(writer, http.StatusBadRequest, errcode.InvalidRequest, fmt.Sprintf("Files can't be uploaded in the `%s` field, use one of: %s", rejected[0], strings.Join(config.List("UPLOAD_FIELD_NAMES"), ", ")))
+			return
+		}
+		var fileHeaders []*multipart.FileHeader
+		for _, fieldFiles := range files {
+			fileHeaders = append(fileHeaders, fieldFiles...)
+		}
+		if len(fileHeaders) == 0 {
+			http.Error(writer, "At least one file is required, e.g. in the `fileUpload` field", http.StatusBadRequest)
+			return
+		}
+		if len(fileHeaders) > 1 {
+			storeUploads(session, s3bucket, writer, req, files)
+			return
+		}
+
+		upload, err := readFormFile(fileHeaders[0])
+		if err != nil {
+			http.Error(writer, "Error reading file : "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		upload.Slug = req.FormValue(slugRequestedField)
+		upload.Metadata = req.FormValue("metadata")
+		writeUploadResult(writer, saveUpload(session, s3bucket, req, upload))
+	}
+}
+
+// prepare checks the options of a submission, puts its preset's steps in
+// front of the transformations and its `ops` after them, returning when the
+// jobs expire
+func (jobCollection *TransformationJobCollection) prepare(session *r.Session, req *http.Request) (time.Time, error) {
+	var expiresAt time.Time
+	if jobCollection.ExpiresIn != "" {
+		expiresIn, err := time.ParseDuration(jobCollection.ExpiresIn)
+		if err != nil || expiresIn <= 0 {
+			return expiresAt, errcode.Wrap(errcode.InvalidRequest, fmt.Errorf("`expiresIn` must be a positive duration such as `10m`"))
+		}
+		expiresAt = time.Now().Add(expiresIn)
+	}
+	if jobCollection.CallbackUrl != "" && !validHttpUrl(jobCollection.CallbackUrl) {
+		return expiresAt, errcode.Wrap(errcode.InvalidRequest, fmt.Errorf("`callbackUrl` must be an http(s) URL"))
+	}
+	// Receivers couldn't tell our callbacks from forged ones
+	if jobCollection.CallbackUrl != "" && config.String("WEBHOOK_SECRET", "") == "" {
+		return expiresAt, errcode.Wrap(errcode.NotImplemented, fmt.Errorf("`callbackUrl` can't be used until WEBHOOK_SECRET is set"))
+	}
+	if preset := req.URL.Query().Get("preset"); preset != "" {
+		jobCollection.Preset = preset
+	}
+	if jobCollection.Preset != "" {
+		transformations, err := presetTransformations(session, jobCollection.Preset)
+		if err != nil {
+			return expiresAt, err
+		}
+		jobCollection.Transformations = append(transformations, jobCollection.Transformations...)
+	}
+	if ops := req.URL.Query().Get("ops"); ops != "" {
+		jobCollection.Ops = ops
+	}
+	if jobCollection.Ops != "" {
+		transformations, err := transformationsFromOps(jobCollection.Ops)
+		if err != nil {
+			return expiresAt, errcode.Wrap(errcode.InvalidRequest, fmt.Errorf("Invalid `ops`: %s", err))
+		}
+		jobCollection.Transformations = append(jobCollection.Transformations, transformations...)
+		jobCollection.Ops = ""
+	}
+	return expiresAt, nil
+}
+
+// queueTransformations stores the submission's jobs for the image and
+// queues a conversion for each branch of the pipeline. It returns the
+// response body listing the jobs, with the invalid ones apart.
+func queueTransformations(session *r.Session, publisher *queue.Publisher, req *http.Request, imageEntry ImageEntry, jobCollection TransformationJobCollection, expiresAt time.Time, batchId string) (map[string][]interface{}, error) {
+	chainId := chainIdFor(req, imageEntry)
+
+	// Parse all jobs in job collection
+	var validJobs []interface{}
+	var invalidJobs []interface{}
+	var outputBytes int
+	steps := newPipelineSteps()
+	qualityPolicy := RequestQualityPolicy(req)
+	for _, job := range jobCollection.Transformations {
+		newJob := Job{
+			Id:          ids.New(),
+			ImageId:     imageEntry.Id,
+			JobType:     job.JobType,
+			Status:      JobStatusPending,
+			CreatedAt:   time.Now(),
+			ExpiresAt:   expiresAt,
+			CallbackUrl: jobCollection.CallbackUrl,
+			ChainId:     chainId,
+			OwnerId:     imageEntry.OwnerId,
+			BatchId:     batchId,
+			Preset:      jobCollection.Preset,
+		}
+		newJob.Events = []JobEvent{{Event: JobEventCreated, At: newJob.CreatedAt}}
+		// Keep a pointer so NextJob can be set below and the job's
+		// parameters are stored along with it
+		var validJob interface{}
+		var estimate int
+		var err error
+		switch job.JobType {
+		case JobTypeResizeToWidthPx:
+			resizeJob := &ImageResizeToWidthPxJob{Job: newJob}
+			err = FillStruct(job.Data, resizeJob)
+			resizeJob.Job.Quality = qualityPolicy.Clamp(resizeJob.Job.Quality)
+			if err == nil {
+				err = checkResizeWidth(resizeJob.Width)
+			}
+			validJob, estimate = resizeJob, estimateOutputBytes(imageEntry, resizeJob.Width)
+		case JobTypeOperations:
+			operationsJob := &ImageOperationsJob{Job: newJob}
+			err = FillStruct(job.Data, operationsJob)
+			var operations []imageConverter.Operation
+			if err == nil {
+				operationsJob.Job.Ops, operations, err = checkJobOps(operationsJob.Job.Ops, qualityPolicy)
+			}
+			validJob, estimate = operationsJob, estimateOutputBytes(imageEntry, estimateOpsWidth(imageEntry, operations))
+		default:
+			err = fmt.Errorf("Unknown `jobType` `%s`", job.JobType)
+		}
+		if err == nil {
+			err = steps.link(pipelineJob(validJob), job)
+		}
+		if err != nil {
+			invalidJobs = append(invalidJobs, job.Data)
+		} else {
+			validJobs = append(validJobs, validJob)
+			outputBytes = addOutputBytes(outputBytes, estimate)
+		}
+	}
+
+	var pipeline []*Job
+	for _, job := range validJobs {
+		pipeline = append(pipeline, pipelineJob(job))
+	}
+	limits := RequestPipelineLimits(req)
+	if reason := limits.Check(len(jobCollection.Transformations), pipelineDepth(pipeline), outputBytes); reason != "" {
+		return nil, errcode.Wrap(errcode.PipelineTooLarge, errors.New(reason))
+	}
+
+	// Return error if there are any invalid jobs
+	var response map[string][]interface{}
+	if len(invalidJobs) > 0 {
+		response = map[string][]interface{}{
+			"invalidJobs": invalidJobs,
+			"validJobs":   validJobs,
+		}
+	} else {
+		response = map[string][]interface{}{
+			"jobs": validJobs,
+		}
+	}
+
+	// Steps that follow the one before them are also linked through
+	// NextJob; branches start new chains
+	for i := 0; i+1 < len(pipeline); i++ {
+		if pipeline[i+1].InputJob == pipeline[i].Id {
+			pipeline[i].NextJob = pipeline[i+1].Id
+		}
+	}
+
+	// Add jobs to the db
+	for _, job := range validJobs {
+		reqlErr := r.Table("jobs").Insert(job).Exec(session)
+		if reqlErr != nil {
+			return nil, fmt.Errorf("Error inserting image entry into database : %s", reqlErr)
+		}
+	}
+
+	if len(pipeline) == 0 {
+		return response, nil
+	}
+	// The whole pipeline is one task, so every step runs once and later
+	// steps can start from the output of the ones before them
+	var jobIds []string
+	for _, job := range pipeline {
+		jobIds = append(jobIds, job.Id)
+	}
+	name := imageEntry.S3Filename
+	if name == "" {
+		name = imageEntry.Id + KeyExtension(imageEntry.OriginalFileName)
+	}
+	payload, _ := json.Marshal(map[string]interface{}{
+		"name":        name,
+		"sourceUrl":   imageEntry.SourceUrl,
+		"imageId":     imageEntry.Id,
+		"sha256":      imageEntry.Sha256,
+		"jobIds":      jobIds,
+		"steps":       pipelineTaskSteps(pipeline),
+		"expiresAt":   expiresAt,
+		"callbackUrl": jobCollection.CallbackUrl,
+		"chainId":     chainId,
+	})
+	format := strings.TrimPrefix(imageEntry.ContentType, "image/")
+	// Taken before publishing, as a worker can record its first event before
+	// the broker confirms the task
+	publishedAt := time.Now()
+	err := publisher.PublishTask(imageEntry.Id, format, payload, queue.WorkerVersion)
+	RecordPublish(err)
+	if err != nil {
+		failUnqueuedJobs(session, pipeline, err)
+		return nil, errcode.Wrap(errcode.QueueUnavailable, fmt.Errorf("Error queueing transformation: %w", err))
+	}
+	markIdempotentCommitted(req)
+	recordJobEventAt(session, jobIds, JobEventPublished, "", publishedAt)
+	return response, nil
+}
+
+func TransformationPostHandler(session *r.Session, s3bucket *s3.Bucket, publisher *queue.Publisher) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+
+		log.Printf("Querying for document: %s", params.ByName("id"))
+		imageEntry, ok := FindImageEntryToChange(session, writer, req, params.ByName("id"))
+		if !ok {
+			return
+		}
+
+		// Parse jobs in body
+		body, ioErr := ioutil.ReadAll(req.Body)
+		if handleError(writer, errcode.Wrap(errcode.InvalidRequest, ioErr), "Error reading body of request") {
+			return
+		}
+		var jobCollection TransformationJobCollection
+		if len(body) > 0 {
+			// The body may be left out when `ops` is in the query
+			jsonUnmarshalErr := json.Unmarshal(body, &jobCollection)
+			if handleError(writer, errcode.Wrap(errcode.InvalidRequest, jsonUnmarshalErr), "Error unmarshalling body into job collection") {
+				return
+			}
+		}
+		expiresAt, err := jobCollection.prepare(session, req)
+		if handleError(writer, err, "") {
+			return
+		}
+		response, err := queueTransformations(session, publisher, req, imageEntry, jobCollection, expiresAt, "")
+		if err != nil {
+			writeTransformationError(writer, err)
+			return
+		}
+
+		log.Printf("Parsing document into JSON response")
+		jsonResponse, jsonMarshalErr := json.Marshal(response)
+		if handleError(writer, jsonMarshalErr, "Error Marshalling JSON") {
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write([]byte(jsonResponse))
+	}
+}
+
+// Serve connects to RethinkDB, S3 and RabbitMQ and runs the HTTP API until
+// it fails
+func Serve() {
+	log.Printf("Starting server...")
+
+	session, err := database.Connect()
+	failOnError(err, "Failed to connect to RethinkDB")
+	err = SetupIndexes(session)
+	failOnError(err, "Failed to set up database tables and indexes")
+
+	// Connect to S3
+	storageConfig := storage.ConfigFromEnv("S3")
+	log.Printf("Accessing Bucket: %s", storageConfig.BucketName)
+	s3bucket, err := storageConfig.Bucket()
+	failOnError(err, "Failed to configure S3 bucket")
+	// Objects are only handed out through signed URLs or the content endpoint
+	err = storageConfig.EnsureBucket(s3bucket, s3.Private)
+	failOnError(err, "Failed to create the bucket or make it private")
+
+	// Connect to RabbitMQ
+	conn, rabbitMQChannel, err := queue.Dial()
+	failOnError(err, "Failed to connect to RabbitMQ")
+	defer conn.Close()
+
+	err = queue.DeclareExchange(rabbitMQChannel)
+	failOnError(err, "Failed to declare an exchange")
+	if queue.AffinityEnabled() {
+		err = queue.DeclareAffinityExchange(rabbitMQChannel)
+		failOnError(err, "Failed to declare the affinity exchange")
+	}
+	err = queue.DeclareFormatQueues(rabbitMQChannel)
+	failOnError(err, "Failed to declare the format queues")
+	publisher, err := queue.NewPublisher(conn, rabbitMQChannel)
+	failOnError(err, "Failed to put the RabbitMQ channel in confirm mode")
+
+	log.Printf("Tracking %d SLO targets", len(SLOTargets()))
+	err = loadReadOnly(session)
+	failOnError(err, "Failed to load the read-only switch")
+	go WatchReadOnly(session)
+	if config.Bool("SERVE_SCHEDULE", true) {
+		go runPeriodicTasks(session, s3bucket)
+	}
+
+	log.Printf("Binding Router...")
+	router := httprouter.New()
+	// Routes are served under /v1 and, until API_UNPREFIXED_ROUTES is turned
+	// off, at their original paths too
+	v1 := versionedRouter{router: router, version: APIVersion, unprefixed: config.Bool("API_UNPREFIXED_ROUTES", true)}
+	v1.GET("/", Timed("index", IndexHandler(session)))
+	router.GET("/healthz", HealthzHandler())
+	router.GET("/metrics", MetricsGetHandler())
+	v1.GET("/capabilities", CapabilitiesGetHandler(session))
+	router.GET("/openapi.json", OpenAPIGetHandler())
+	v1.GET("/image/:id", ImageGetHandler(session, s3bucket))
+	v1.DELETE("/image/:id", ImageDeleteHandler(session, s3bucket))
+	v1.PATCH("/image/:id", ImagePatchHandler(session, s3bucket))
+	v1.GET("/image/:id/jobs", ImageJobsGetHandler(session))
+	v1.GET("/image/:id/content", ContentGetHandler(session, s3bucket))
+	v1.GET("/image/:id/url", SignedUrlGetHandler(session, s3bucket))
+	v1.GET("/image/:id/render", Timed("render", RateLimited("render", RenderGetHandler(session, s3bucket))))
+	v1.GET("/image/:id/preview", RateLimited("preview", PreviewGetHandler(session, s3bucket)))
+	v1.PUT("/image/:id/captions/:language", CaptionsPutHandler(session, s3bucket))
+	v1.DELETE("/image/:id/captions/:language", CaptionsDeleteHandler(session, s3bucket))
+	v1.GET("/job/:id", JobGetHandler(session))
+	v1.POST("/jobs/status", JobStatusPostHandler(session))
+	v1.GET("/graphql", RateLimited("graphql", GraphQLHandler(session, s3bucket)))
+	v1.POST("/graphql", RateLimited("graphql", GraphQLHandler(session, s3bucket)))
+	v1.POST("/image", Timed("upload", RateLimited("upload", Idempotent(session, ImagePostHandler(session, s3bucket)))))
+	v1.POST("/image/", Timed("upload", RateLimited("upload", Idempotent(session, ImagePostHandler(session, s3bucket)))))
+	v1.PUT("/image", Timed("upload", RateLimited("upload", Idempotent(session, ImagePutHandler(session, s3bucket)))))
+	v1.OPTIONS("/uploads", ResumableOptionsHandler())
+	v1.POST("/uploads", RateLimited("upload", Idempotent(session, ResumablePostHandler(session, s3bucket))))
+	v1.HEAD("/uploads/:id", ResumableHeadHandler(session))
+	v1.PATCH("/uploads/:id", Timed("upload", ResumablePatchHandler(session, s3bucket)))
+	v1.DELETE("/uploads/:id", ResumableDeleteHandler(session, s3bucket))
+	v1.POST("/image/:id/transformation", Timed("transformation", RateLimited("transformation", Captured(Idempotent(session, TransformationPostHandler(session, s3bucket, publisher))))))
+	v1.POST("/image/:id/transformation/", Timed("transformation", RateLimited("transformation", Captured(Idempotent(session, TransformationPostHandler(session, s3bucket, publisher))))))
+	v1.POST("/image/:id/copy-transformations", Timed("transformation", RateLimited("transformation", Idempotent(session, CopyTransformationsPostHandler(session, publisher)))))
+	v1.POST("/transformation/batch", Timed("transformation", RateLimited("transformation", Idempotent(session, BatchTransformationPostHandler(session, publisher)))))
+	v1.GET("/transformation/batch/:id", BatchGetHandler(session))
+	v1.GET("/presets", PresetIndexHandler(session))
+	v1.GET("/presets/:name", PresetGetHandler(session))
+	v1.PUT("/presets/:name", AdminOnly(PresetPutHandler(session)))
+	v1.DELETE("/presets/:name", AdminOnly(PresetDeleteHandler(session)))
+	v1.POST("/erasure", AdminOnly(ErasurePostHandler(session, s3bucket)))
+	v1.GET("/feed.atom", FeedGetHandler(session))
+	v1.GET("/oembed", OEmbedGetHandler(session))
+	v1.PATCH("/image/:id/metadata", MetadataPatchHandler(session))
+	v1.GET("/image/:id/embed", EmbedGetHandler(session))
+	v1.GET("/image/:id/manifest", ManifestGetHandler(session, s3bucket))
+	v1.GET("/manifest/key", ManifestKeyGetHandler())
+	v1.GET("/quarantine", AdminOnly(QuarantineIndexHandler(session)))
+	v1.POST("/quarantine/:id/release", AdminOnly(QuarantineReleaseHandler(session)))
+	v1.DELETE("/quarantine/:id", AdminOnly(QuarantineDeleteHandler(session, s3bucket)))
+	v1.GET("/admin/slo", AdminOnly(SLOGetHandler()))
+	v1.PUT("/admin/replay-capture", AdminOnly(ReplayCapturePutHandler()))
+	v1.PUT("/admin/read-only", AdminOnly(ReadOnlyPutHandler(session)))
+	v1.GET("/admin/chains/:id", AdminOnly(ChainGetHandler(session)))
+	v1.GET("/admin/images/:id", AdminOnly(ImageUploadGetHandler(session)))
+	v1.GET("/admin/api-keys", AdminOnly(ApiKeyIndexHandler(session)))
+	v1.POST("/admin/api-keys", AdminOnly(ApiKeyPostHandler(session)))
+	v1.DELETE("/admin/api-keys/:id", AdminOnly(ApiKeyDeleteHandler(session)))
+	v1.PUT("/image/:id/hold", AdminOnly(LegalHoldPutHandler(session)))
+	v1.DELETE("/image/:id/hold", AdminOnly(LegalHoldDeleteHandler(session)))
+	v1.PUT("/image/:id/owner", AdminOnly(ImageOwnerPutHandler(session)))
+
+	log.Printf("HTTP Server listening on port: %s", os.Getenv("HTTP_PORT"))
+	httpServer := &http.Server{
+		Addr:    ":" + os.Getenv("HTTP_PORT"),
+		Handler: Instrumented(router, ErrorEnvelope(Cors(ReadOnlyGuard(RequireApiKey(session, router))))),
+		// Keeps clients from holding connections open by trickling headers
+		ReadHeaderTimeout: config.Duration("HTTP_READ_HEADER_TIMEOUT", 10*time.Second),
+	}
+	log.Fatal(httpServer.ListenAndServe())
+}
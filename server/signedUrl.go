@@ -0,0 +1,65 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/julienschmidt/httprouter"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/thejsj/veenco/config"
+)
+
+// signedUrlTTL is how long URLs in responses stay valid, from SIGNED_URL_TTL
+func signedUrlTTL() time.Duration {
+	return config.Duration("SIGNED_URL_TTL", time.Hour)
+}
+
+// SignedUrl returns a URL for a private object that stops working after ttl
+func SignedUrl(s3bucket *s3.Bucket, key string, ttl time.Duration) string {
+	return s3bucket.SignedURL(key, time.Now().Add(ttl))
+}
+
+type SignedUrlResponse struct {
+	Url       string    `json:"url"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// SignedUrlGetHandler hands out a URL for the original that expires after
+// `ttl` (a duration such as `15m`), capped at SIGNED_URL_MAX_TTL
+func SignedUrlGetHandler(session *r.Session, s3bucket *s3.Bucket) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		log.Printf("GET SignedUrlGetHandler")
+		imageEntry, ok := FindImageEntry(session, writer, req, params.ByName("id"))
+		if !ok {
+			return
+		}
+
+		ttl := signedUrlTTL()
+		if value := req.URL.Query().Get("ttl"); value != "" {
+			parsed, err := time.ParseDuration(value)
+			if err != nil || parsed <= 0 {
+				http.Error(writer, "`ttl` must be a positive duration such as `15m`", http.StatusBadRequest)
+				return
+			}
+			ttl = parsed
+		}
+		if maxTTL := config.Duration("SIGNED_URL_MAX_TTL", 24*time.Hour); ttl > maxTTL {
+			ttl = maxTTL
+		}
+
+		jsonResponse, err := json.Marshal(SignedUrlResponse{
+			Url:       imageEntry.signedUrl(s3bucket, ttl),
+			ExpiresAt: time.Now().Add(ttl).UTC(),
+		})
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Header().Set("Cache-Control", "no-store")
+		writer.Write(jsonResponse)
+	}
+}
@@ -0,0 +1,244 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/thejsj/veenco/config"
+)
+
+// Requests are counted in one minute buckets covering the longest window
+const sloBuckets = 60
+
+var sloWindows = map[string]int{"5m": 5, "1h": 60}
+
+// SLOTarget says that Objective (e.g. 0.95) of the requests to a route
+// should succeed in less than Latency
+type SLOTarget struct {
+	Route     string        `json:"route"`
+	Latency   time.Duration `json:"-"`
+	Objective float64       `json:"objective"`
+}
+
+type sloBucket struct {
+	minute int64
+	total  int
+	good   int
+}
+
+type sloTracker struct {
+	mutex   sync.Mutex
+	buckets map[string]*[sloBuckets]sloBucket
+}
+
+var slos = &sloTracker{buckets: map[string]*[sloBuckets]sloBucket{}}
+
+var (
+	sloTargetsMutex   sync.Mutex
+	sloTargetsVersion int64
+	sloTargets        map[string]SLOTarget
+)
+
+// SLOTargets are the targets in SLO_TARGETS. They are parsed when first
+// needed, which Serve does at startup, and again only after the
+// configuration is reloaded, so requests don't pay for it and invalid
+// entries are logged once.
+func SLOTargets() map[string]SLOTarget {
+	sloTargetsMutex.Lock()
+	defer sloTargetsMutex.Unlock()
+	if version := config.Version(); sloTargetsVersion != version {
+		sloTargets = parseSLOTargets(config.List("SLO_TARGETS"))
+		sloTargetsVersion = version
+	}
+	return sloTargets
+}
+
+// parseSLOTargets parses route:latency:objective entries such as
+// upload:2s:0.95
+func parseSLOTargets(entries []string) map[string]SLOTarget {
+	targets := map[string]SLOTarget{}
+	for _, entry := range entries {
+		parts := strings.Split(entry, ":")
+		if len(parts) != 3 {
+			log.Printf("Ignoring SLO target `%s`: expected route:latency:objective", entry)
+			continue
+		}
+		latency, err := time.ParseDuration(parts[1])
+		if err != nil {
+			log.Printf("Ignoring SLO target `%s`: %s", entry, err)
+			continue
+		}
+		objective, err := strconv.ParseFloat(parts[2], 64)
+		if err != nil || objective <= 0 || objective >= 1 {
+			log.Printf("Ignoring SLO target `%s`: objective must be between 0 and 1", entry)
+			continue
+		}
+		targets[parts[0]] = SLOTarget{Route: parts[0], Latency: latency, Objective: objective}
+	}
+	return targets
+}
+
+func (tracker *sloTracker) record(route string, now time.Time, good bool) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	buckets, ok := tracker.buckets[route]
+	if !ok {
+		buckets = &[sloBuckets]sloBucket{}
+		tracker.buckets[route] = buckets
+	}
+	minute := now.Unix() / 60
+	bucket := &buckets[minute%sloBuckets]
+	if bucket.minute != minute {
+		*bucket = sloBucket{minute: minute}
+	}
+	bucket.total++
+	if good {
+		bucket.good++
+	}
+}
+
+// window sums the buckets of the last `minutes` minutes
+func (tracker *sloTracker) window(route string, now time.Time, minutes int) (total int, good int) {
+	tracker.mutex.Lock()
+	defer tracker.mutex.Unlock()
+	buckets, ok := tracker.buckets[route]
+	if !ok {
+		return 0, 0
+	}
+	currentMinute := now.Unix() / 60
+	for _, bucket := range buckets {
+		if bucket.minute > currentMinute-int64(minutes) {
+			total += bucket.total
+			good += bucket.good
+		}
+	}
+	return total, good
+}
+
+type statusRecordingWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (writer *statusRecordingWriter) WriteHeader(status int) {
+	writer.status = status
+	writer.ResponseWriter.WriteHeader(status)
+}
+
+// Unwrap lets http.ResponseController reach the connection, e.g. to set
+// upload read deadlines
+func (writer *statusRecordingWriter) Unwrap() http.ResponseWriter {
+	return writer.ResponseWriter
+}
+
+// Flush keeps streaming responses working through the wrapper
+func (writer *statusRecordingWriter) Flush() {
+	if flusher, ok := writer.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Timed counts a request as good for the route's SLO when it didn't fail
+// with a 5xx and finished within the route's latency target
+func Timed(route string, handle httprouter.Handle) httprouter.Handle {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		target, ok := SLOTargets()[route]
+		if !ok {
+			handle(writer, req, params)
+			return
+		}
+		start := time.Now()
+		recordingWriter := &statusRecordingWriter{ResponseWriter: writer, status: http.StatusOK}
+		handle(recordingWriter, req, params)
+		good := recordingWriter.status < 500 && time.Since(start) <= target.Latency
+		slos.record(route, time.Now(), good)
+	}
+}
+
+type SLOWindowStatus struct {
+	Total    int     `json:"total"`
+	Good     int     `json:"good"`
+	BurnRate float64 `json:"burnRate"`
+}
+
+type SLOStatus struct {
+	SLOTarget
+	LatencyTarget string                     `json:"latency"`
+	Windows       map[string]SLOWindowStatus `json:"windows"`
+}
+
+// SLOStatuses computes burn rates: how fast the error budget (1 - objective)
+// is being spent, where 1 means exactly on budget
+func SLOStatuses(now time.Time) []SLOStatus {
+	var statuses []SLOStatus
+	for route, target := range SLOTargets() {
+		status := SLOStatus{
+			SLOTarget:     target,
+			LatencyTarget: target.Latency.String(),
+			Windows:       map[string]SLOWindowStatus{},
+		}
+		for name, minutes := range sloWindows {
+			total, good := slos.window(route, now, minutes)
+			windowStatus := SLOWindowStatus{Total: total, Good: good}
+			if total > 0 {
+				badFraction := float64(total-good) / float64(total)
+				windowStatus.BurnRate = badFraction / (1 - target.Objective)
+			}
+			status.Windows[name] = windowStatus
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// writeSLOMetrics writes each target's objective and, per window, its
+// request counts and burn rate in the Prometheus text format
+func writeSLOMetrics(out io.Writer, now time.Time) {
+	statuses := SLOStatuses(now)
+	if len(statuses) == 0 {
+		return
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Route < statuses[j].Route })
+	windows := sortedKeys(sloWindows)
+	fmt.Fprintf(out, "# HELP enco_slo_objective Fraction of requests that should meet the route's latency target\n# TYPE enco_slo_objective gauge\n")
+	for _, status := range statuses {
+		fmt.Fprintf(out, "enco_slo_objective{%s} %v\n", labels("route", status.Route, "latency", status.LatencyTarget), status.Objective)
+	}
+	for _, gauge := range []struct {
+		name  string
+		help  string
+		value func(SLOWindowStatus) float64
+	}{
+		{"enco_slo_requests", "Requests counted towards the SLO in the window", func(window SLOWindowStatus) float64 { return float64(window.Total) }},
+		{"enco_slo_good_requests", "Requests that met the SLO in the window", func(window SLOWindowStatus) float64 { return float64(window.Good) }},
+		{"enco_slo_burn_rate", "How fast the error budget is spent in the window, 1 being on budget", func(window SLOWindowStatus) float64 { return window.BurnRate }},
+	} {
+		fmt.Fprintf(out, "# HELP %s %s\n# TYPE %s gauge\n", gauge.name, gauge.help, gauge.name)
+		for _, status := range statuses {
+			for _, window := range windows {
+				fmt.Fprintf(out, "%s{%s} %v\n", gauge.name, labels("route", status.Route, "window", window), gauge.value(status.Windows[window]))
+			}
+		}
+	}
+}
+
+func SLOGetHandler() func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		jsonResponse, err := json.Marshal(SLOStatuses(time.Now()))
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(jsonResponse)
+	}
+}
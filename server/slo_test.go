@@ -0,0 +1,48 @@
+package server
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/thejsj/veenco/config"
+)
+
+func TestParseSLOTargets(t *testing.T) {
+	targets := parseSLOTargets([]string{"upload:2s:0.95", "render:fast:0.9", "index:1s:1", "jobs"})
+	if len(targets) != 1 || targets["upload"] != (SLOTarget{Route: "upload", Latency: 2 * time.Second, Objective: 0.95}) {
+		t.Errorf("Expected only the upload target to parse, got %v", targets)
+	}
+}
+
+func TestWriteSLOMetrics(t *testing.T) {
+	sloTargetsMutex.Lock()
+	previousTargets, previousVersion := sloTargets, sloTargetsVersion
+	sloTargets, sloTargetsVersion = parseSLOTargets([]string{"slo-test:1s:0.9"}), config.Version()
+	sloTargetsMutex.Unlock()
+	defer func() {
+		sloTargetsMutex.Lock()
+		sloTargets, sloTargetsVersion = previousTargets, previousVersion
+		sloTargetsMutex.Unlock()
+	}()
+
+	now := time.Now()
+	for i := 0; i < 8; i++ {
+		slos.record("slo-test", now, true)
+	}
+	slos.record("slo-test", now, false)
+	slos.record("slo-test", now, false)
+
+	var out strings.Builder
+	writeSLOMetrics(&out, now)
+	for _, line := range []string{
+		`enco_slo_objective{route="slo-test",latency="1s"} 0.9`,
+		`enco_slo_requests{route="slo-test",window="5m"} 10`,
+		`enco_slo_good_requests{route="slo-test",window="1h"} 8`,
+		`enco_slo_burn_rate{route="slo-test",window="5m"} 2`,
+	} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("Expected the metrics to contain %s, got\n%s", line, out.String())
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package server
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"log"
+	"math/big"
+	"regexp"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/thejsj/veenco/config"
+	"github.com/thejsj/veenco/errcode"
+	"github.com/thejsj/veenco/ids"
+)
+
+const (
+	slugAlphabet       = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+	slugLength         = 10
+	slugGenerateTries  = 5
+	slugRequestedField = "slug"
+)
+
+var validSlug = regexp.MustCompile(`^[A-Za-z0-9_-]{3,64}$`)
+
+var ErrSlugTaken = errors.New("Slug is already in use")
+
+// Reservations in the slugs table are keyed by owner and slug, so only one
+// request can claim a slug however many race for it
+const slugsTableName = "slugs"
+
+// slugReservationTimeout is UPLOAD_EXPIRY, after which even a resumable
+// upload is abandoned. A reservation whose image doesn't exist by then was
+// left by a failed upload or a deleted image and can be claimed again.
+func slugReservationTimeout() time.Duration {
+	return config.Duration("UPLOAD_EXPIRY", 24*time.Hour)
+}
+
+// SlugReservation claims a slug for an owner's image
+type SlugReservation struct {
+	Id         string    `gorethink:"id" json:"id"`
+	OwnerId    string    `gorethink:"ownerId" json:"ownerId"`
+	Slug       string    `gorethink:"slug" json:"slug"`
+	ReservedAt time.Time `gorethink:"reservedAt" json:"reservedAt"`
+}
+
+// NewSlug returns a random base62 string short enough to share in URLs
+func NewSlug() (string, error) {
+	slug := make([]byte, slugLength)
+	max := big.NewInt(int64(len(slugAlphabet)))
+	for i := range slug {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		slug[i] = slugAlphabet[n.Int64()]
+	}
+	return string(slug), nil
+}
+
+// ValidateSlug checks a client provided slug. Slugs that look like ids are
+// rejected since they would shadow image ids.
+func ValidateSlug(slug string) error {
+	if !validSlug.MatchString(slug) {
+		return fmt.Errorf("`%s` must be 3 to 64 letters, digits, dashes or underscores", slugRequestedField)
+	}
+	if ids.LooksLikeId(slug) {
+		return fmt.Errorf("`%s` can't look like an image id", slugRequestedField)
+	}
+	return nil
+}
+
+// AvailableSlug reserves the requested slug if ownerId hasn't used it, or a
+// newly generated one when no slug was requested. Slugs are unique per
+// owner, so taken slugs don't reveal other tenants' images; unowned images'
+// slugs are visible to everyone and count as taken. Errors carry
+// INVALID_REQUEST for bad slugs and CONFLICT (wrapping ErrSlugTaken) for
+// taken ones; anything else is the database failing.
+func AvailableSlug(session *r.Session, requested string, ownerId string) (string, error) {
+	if requested != "" {
+		err := ValidateSlug(requested)
+		if err != nil {
+			return "", errcode.Wrap(errcode.InvalidRequest, err)
+		}
+		reserved, err := reserveSlug(session, requested, ownerId)
+		if err != nil {
+			return "", err
+		}
+		if !reserved {
+			return "", errcode.Wrap(errcode.Conflict, ErrSlugTaken)
+		}
+		return requested, nil
+	}
+
+	for i := 0; i < slugGenerateTries; i++ {
+		slug, err := NewSlug()
+		if err != nil {
+			return "", err
+		}
+		reserved, err := reserveSlug(session, slug, ownerId)
+		if err != nil {
+			return "", err
+		}
+		if reserved {
+			return slug, nil
+		}
+	}
+	return "", errors.New("Could not generate a unique slug")
+}
+
+// reserveSlug claims slug for ownerId, returning false if an image already
+// uses it or another request reserved it first
+func reserveSlug(session *r.Session, slug string, ownerId string) (bool, error) {
+	// Images from before reservations, and unowned ones, only show up here
+	taken, err := slugTaken(session, slug, ownerId)
+	if err != nil || taken {
+		return false, err
+	}
+
+	now := time.Now()
+	reservation := SlugReservation{Id: slugReservationId(slug, ownerId), OwnerId: ownerId, Slug: slug, ReservedAt: now}
+	response, err := r.Table(slugsTableName).Insert(reservation).RunWrite(session)
+	if response.Inserted == 1 {
+		return true, nil
+	}
+	if response.Errors == 0 {
+		return false, err
+	}
+	// The key is taken, which the image lookup above already found not to
+	// be in use unless the reservation is for an upload still under way
+	response, err = r.Table(slugsTableName).Get(reservation.Id).Update(func(row r.Term) interface{} {
+		return r.Branch(
+			row.Field("reservedAt").Lt(now.Add(-slugReservationTimeout())),
+			map[string]interface{}{"reservedAt": now},
+			map[string]interface{}{},
+		)
+	}).RunWrite(session)
+	if err != nil {
+		return false, err
+	}
+	return response.Replaced == 1, nil
+}
+
+// releaseSlug gives up a reservation for an image that won't be recorded,
+// so the slug can be used again straight away. A reservation that can't be
+// released is only logged; it can be claimed again once it times out.
+func releaseSlug(session *r.Session, slug string, ownerId string) {
+	if slug == "" {
+		return
+	}
+	err := r.Table(slugsTableName).Get(slugReservationId(slug, ownerId)).Delete().Exec(session)
+	if err != nil {
+		log.Printf("Error releasing slug %s: %s", slug, err)
+	}
+}
+
+func slugReservationId(slug string, ownerId string) string {
+	return ownerId + "/" + slug
+}
+
+func slugTaken(session *r.Session, slug string, ownerId string) (bool, error) {
+	imageEntry, err := LookupImageEntry(session, slug, ownerId)
+	if err == r.ErrEmptyResult {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return imageEntry.OwnerId == ownerId || imageEntry.OwnerId == "", nil
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/thejsj/veenco/ids"
+	"github.com/thejsj/veenco/safehttp"
+	"github.com/thejsj/veenco/storage"
+)
+
+// ExternalImageRequest registers an image whose bytes stay where they are.
+// Url is an http(s) URL or an `s3://bucket/key` reference to a bucket listed
+// in FOREIGN_BUCKETS.
+type ExternalImageRequest struct {
+	Url              string                 `json:"url"`
+	OriginalFileName string                 `json:"originalFileName"`
+	ContentType      string                 `json:"contentType"`
+	Slug             string                 `json:"slug"`
+	Metadata         map[string]interface{} `json:"metadata"`
+}
+
+// Url is where clients can fetch the image's bytes. Objects in buckets are
+// private, so these are signed and expire after SIGNED_URL_TTL.
+func (imageEntry ImageEntry) Url(s3bucket *s3.Bucket) string {
+	return imageEntry.signedUrl(s3bucket, signedUrlTTL())
+}
+
+func (imageEntry ImageEntry) signedUrl(s3bucket *s3.Bucket, ttl time.Duration) string {
+	if imageEntry.SourceUrl == "" {
+		return SignedUrl(s3bucket, imageEntry.S3Filename, ttl)
+	}
+	if foreignBucket, key, ok := storage.ForeignObject(s3bucket, imageEntry.SourceUrl); ok {
+		return SignedUrl(foreignBucket, key, ttl)
+	}
+	return imageEntry.SourceUrl
+}
+
+// ReadSource fetches the image's bytes from wherever they are stored
+func ReadSource(s3bucket *s3.Bucket, imageEntry ImageEntry) ([]byte, error) {
+	if imageEntry.SourceUrl == "" {
+		return s3bucket.Get(imageEntry.S3Filename)
+	}
+	if foreignBucket, key, ok := storage.ForeignObject(s3bucket, imageEntry.SourceUrl); ok {
+		return foreignBucket.Get(key)
+	}
+	res, err := safehttp.Get(imageEntry.SourceUrl)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Fetching %s returned %s", imageEntry.SourceUrl, res.Status)
+	}
+	return ioutil.ReadAll(res.Body)
+}
+
+// validSourceUrl accepts http(s) URLs and references to buckets in
+// FOREIGN_BUCKETS. References into our own bucket must name the original of
+// an image the caller's tenant owns, so they can't read other tenants'
+// objects.
+func validSourceUrl(session *r.Session, s3bucket *s3.Bucket, req *http.Request, sourceUrl string) bool {
+	foreignBucket, key, ok := storage.ForeignObject(s3bucket, sourceUrl)
+	if !ok {
+		return validHttpUrl(sourceUrl)
+	}
+	if foreignBucket.Name != s3bucket.Name {
+		return true
+	}
+	imageEntry, err := GetImageEntry(session, strings.TrimSuffix(key, path.Ext(key)))
+	return err == nil && imageEntry.S3Filename == key && imageEntry.OwnerId == RequestTenant(req)
+}
+
+func validHttpUrl(rawUrl string) bool {
+	parsed, err := url.Parse(rawUrl)
+	return err == nil && (parsed.Scheme == "http" || parsed.Scheme == "https") && parsed.Host != ""
+}
+
+// registerExternalImage handles JSON bodies sent to POST /image. Nothing is
+// copied into the bucket; the worker fetches the source when transforming.
+func registerExternalImage(session *r.Session, s3bucket *s3.Bucket, writer http.ResponseWriter, req *http.Request) {
+	var external ExternalImageRequest
+	err := json.NewDecoder(req.Body).Decode(&external)
+	if err != nil {
+		http.Error(writer, "Error unmarshalling external image: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !validSourceUrl(session, s3bucket, req, external.Url) {
+		http.Error(writer, "`url` must be an http(s) URL or an s3://bucket/key reference to an allowed bucket", http.StatusBadRequest)
+		return
+	}
+
+	if external.Metadata != nil {
+		encoded, _ := json.Marshal(external.Metadata)
+		external.Metadata, err = ParseMetadata(encoded)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	slug, err := AvailableSlug(session, external.Slug, RequestTenant(req))
+	if err != nil {
+		WriteErrorOf(writer, err, "")
+		return
+	}
+
+	originalFileName := external.OriginalFileName
+	if originalFileName == "" {
+		originalFileName = path.Base(external.Url)
+	}
+	originalFileName = NormalizeFilename(originalFileName)
+	contentType := external.ContentType
+	if contentType == "" {
+		contentType = mime.TypeByExtension(KeyExtension(originalFileName))
+	}
+
+	newImage := ImageEntry{
+		Id:               ids.New(),
+		Slug:             slug,
+		SourceUrl:        external.Url,
+		OriginalFileName: originalFileName,
+		ContentType:      contentType,
+		CreatedAt:        time.Now(),
+		ChainId:          RequestChainId(req),
+		OwnerId:          RequestTenant(req),
+		Metadata:         external.Metadata,
+	}
+	newImage.recordUploadRequest(req, nil)
+	err = r.Table("images").Insert(newImage).Exec(session)
+	if err != nil {
+		releaseSlug(session, slug, newImage.OwnerId)
+		http.Error(writer, "Error inserting image entry into database : "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	log.Printf("Registered external image %s from %s", newImage.Id, newImage.SourceUrl)
+
+	jsonResponse, err := json.Marshal(ImageResponse{
+		ImageEntry: newImage,
+		Url:        newImage.Url(s3bucket),
+	})
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.WriteHeader(http.StatusCreated)
+	writer.Write(jsonResponse)
+}
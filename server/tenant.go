@@ -0,0 +1,92 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/julienschmidt/httprouter"
+	"github.com/thejsj/veenco/errcode"
+)
+
+// RequestTenant is the tenant of the caller's API key. Anonymous callers
+// have the empty tenant, which owns everything uploaded without a key.
+func RequestTenant(req *http.Request) string {
+	apiKey, ok := RequestApiKey(req)
+	if !ok {
+		return ""
+	}
+	return apiKey.Tenant()
+}
+
+// CanAccess reports whether the caller may see a record owned by ownerId.
+// Records without an owner, from before tenancy or uploaded without a key,
+// stay visible to everyone. The admin token can access every tenant's
+// records.
+func CanAccess(req *http.Request, ownerId string) bool {
+	return ownerId == "" || CanChange(req, ownerId)
+}
+
+// CanChange reports whether the caller may change or delete a record owned
+// by ownerId. Records without an owner are read-only until an admin assigns
+// them to a tenant with PUT /image/:id/owner.
+func CanChange(req *http.Request, ownerId string) bool {
+	return validAdminToken(req) || (ownerId != "" && ownerId == RequestTenant(req))
+}
+
+// TenantFilter limits a query on images or jobs to the caller's tenant. It
+// is nil for admins.
+func TenantFilter(req *http.Request) interface{} {
+	if validAdminToken(req) {
+		return nil
+	}
+	return r.Row.Field("ownerId").Default("").Eq(RequestTenant(req))
+}
+
+type ImageOwnerRequest struct {
+	OwnerId string `json:"ownerId"`
+}
+
+// ImageOwnerPutHandler assigns an image, along with its jobs, to a tenant.
+// It is how images from before tenancy are handed to the tenant they belong
+// to, after which that tenant can change them again.
+func ImageOwnerPutHandler(session *r.Session) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		log.Printf("PUT ImageOwnerPutHandler")
+		var ownerRequest ImageOwnerRequest
+		err := json.NewDecoder(req.Body).Decode(&ownerRequest)
+		if err != nil || ownerRequest.OwnerId == "" {
+			WriteError(writer, http.StatusBadRequest, errcode.InvalidRequest, "`ownerId` must name the tenant to assign the image to")
+			return
+		}
+		imageEntry, ok := FindImageEntry(session, writer, req, params.ByName("id"))
+		if !ok {
+			return
+		}
+		if imageEntry.Slug != "" && imageEntry.OwnerId != ownerRequest.OwnerId {
+			existing, err := LookupImageEntry(session, imageEntry.Slug, ownerRequest.OwnerId)
+			if err == nil && existing.OwnerId == ownerRequest.OwnerId {
+				WriteError(writer, http.StatusConflict, errcode.Conflict, fmt.Sprintf("The tenant already has an image with slug `%s`", imageEntry.Slug))
+				return
+			}
+			if err != nil && err != r.ErrEmptyResult {
+				WriteError(writer, http.StatusInternalServerError, errcode.StorageUnavailable, err.Error())
+				return
+			}
+		}
+
+		owner := map[string]interface{}{"ownerId": ownerRequest.OwnerId}
+		err = r.Table("images").Get(imageEntry.Id).Update(owner).Exec(session)
+		if err == nil {
+			err = r.Table("jobs").GetAllByIndex("imageId", imageEntry.Id).Update(owner).Exec(session)
+		}
+		if err != nil {
+			WriteError(writer, http.StatusInternalServerError, errcode.StorageUnavailable, err.Error())
+			return
+		}
+		log.Printf("Assigned image %s from tenant `%s` to `%s`", imageEntry.Id, imageEntry.OwnerId, ownerRequest.OwnerId)
+		writer.WriteHeader(http.StatusNoContent)
+	}
+}
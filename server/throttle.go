@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+
+	"github.com/thejsj/veenco/config"
+	"golang.org/x/time/rate"
+)
+
+// Smallest burst allowed, so a limiter never has to wait for each byte
+const minThrottleBurst = 32 << 10
+
+var uploadLimiters = newLimiterCache()
+
+// uploadLimiter returns the limiter shared by every upload from the same
+// client, or nil when UPLOAD_BYTES_PER_SECOND isn't set
+func uploadLimiter(clientKey string) *rate.Limiter {
+	bytesPerSecond := config.Int("UPLOAD_BYTES_PER_SECOND", 0)
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	burst := bytesPerSecond
+	if burst < minThrottleBurst {
+		burst = minThrottleBurst
+	}
+	return uploadLimiters.get(clientKey, rate.Limit(bytesPerSecond), burst)
+}
+
+type throttledReader struct {
+	ctx     context.Context
+	reader  io.ReadCloser
+	limiter *rate.Limiter
+}
+
+func (throttled *throttledReader) Read(buffer []byte) (int, error) {
+	if len(buffer) > throttled.limiter.Burst() {
+		buffer = buffer[:throttled.limiter.Burst()]
+	}
+	n, err := throttled.reader.Read(buffer)
+	if n > 0 {
+		waitErr := throttled.limiter.WaitN(throttled.ctx, n)
+		if waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+func (throttled *throttledReader) Close() error {
+	return throttled.reader.Close()
+}
+
+// ThrottleUploadBody limits how fast the request body is read, sharing one
+// token bucket between all concurrent uploads from the same client. Clients
+// are told apart by API key, or by IP when they have none.
+func ThrottleUploadBody(req *http.Request) {
+	clientKey := ClientIp(req)
+	if apiKey, ok := RequestApiKey(req); ok {
+		clientKey = "key " + apiKey.Id
+	}
+	limiter := uploadLimiter(clientKey)
+	if limiter == nil {
+		return
+	}
+	req.Body = &throttledReader{ctx: req.Context(), reader: req.Body, limiter: limiter}
+}
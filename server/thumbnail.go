@@ -0,0 +1,53 @@
+package server
+
+import (
+	"encoding/base64"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/thejsj/veenco/config"
+	"github.com/thejsj/veenco/worker/image-converter"
+)
+
+// wantsInlineThumbnail reports whether an upload asked for `thumbnail=true`,
+// in the query string or as a form field
+func wantsInlineThumbnail(req *http.Request) bool {
+	wanted, _ := strconv.ParseBool(req.FormValue("thumbnail"))
+	return wanted
+}
+
+// inlineThumbnailMaxSourcePixels bounds the uploads an inline thumbnail is
+// rendered for, from INLINE_THUMBNAIL_MAX_SOURCE_PIXELS (25 megapixels by
+// default). It is tighter than PREVIEW_MAX_SOURCE_PIXELS since the upload
+// request waits on it.
+func inlineThumbnailMaxSourcePixels() uint64 {
+	return uint64(config.Int("INLINE_THUMBNAIL_MAX_SOURCE_PIXELS", 25000000))
+}
+
+// InlineThumbnail scales an uploaded image to fit within
+// INLINE_THUMBNAIL_PX (64 by default) and returns it as a data URI, so UIs
+// can show something before any job has run. It is rendered while the
+// upload request waits, so it is kept tiny: images whose header gives more
+// than inlineThumbnailMaxSourcePixels are skipped before anything is
+// decoded, and the render takes a render slot and runs under Preview's
+// ImageMagick resource limits.
+func InlineThumbnail(req *http.Request, buffer []byte, contentType string, width int, height int) (string, error) {
+	if !strings.HasPrefix(contentType, "image/") {
+		return "", nil
+	}
+	if pixels := uint64(width) * uint64(height); pixels > inlineThumbnailMaxSourcePixels() {
+		log.Printf("Skipping inline thumbnail of a %dx%d image", width, height)
+		return "", nil
+	}
+	if !acquireRenderSlot(req) {
+		return "", req.Context().Err()
+	}
+	defer releaseRenderSlot()
+	thumbnail, thumbnailType, err := imageConverter.Preview(buffer, uint(config.Int("INLINE_THUMBNAIL_PX", 64)), nil)
+	if err != nil {
+		return "", err
+	}
+	return "data:" + thumbnailType + ";base64," + base64.StdEncoding.EncodeToString(thumbnail), nil
+}
@@ -0,0 +1,304 @@
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/thejsj/veenco/chaos"
+	"github.com/thejsj/veenco/config"
+	"github.com/thejsj/veenco/errcode"
+	"github.com/thejsj/veenco/ids"
+)
+
+// Upload is a single file received by one of the upload handlers
+type Upload struct {
+	Buffer           []byte
+	OriginalFileName string
+	ContentType      string
+	// Requested slug and raw JSON metadata, both optional
+	Slug     string
+	Metadata string
+}
+
+// UploadResult is the outcome of storing one file. Image is the response for
+// a stored file; failed ones have an Error and, when the bytes were kept for
+// review, a QuarantineId.
+type UploadResult struct {
+	// Field is the form field the file was sent in
+	Field        string            `json:"field,omitempty"`
+	FileName     string            `json:"fileName"`
+	Status       int               `json:"status"`
+	Image        map[string]string `json:"image,omitempty"`
+	QuarantineId string            `json:"quarantineId,omitempty"`
+	Error        string            `json:"error,omitempty"`
+	Code         errcode.Code      `json:"code,omitempty"`
+	Sha256       string            `json:"-"`
+}
+
+// uploadFieldAllowed checks a form field name against UPLOAD_FIELD_NAMES.
+// Files are accepted under any name while it isn't set.
+func uploadFieldAllowed(fieldName string) bool {
+	allowed := config.List("UPLOAD_FIELD_NAMES")
+	return len(allowed) == 0 || containsString(allowed, fieldName)
+}
+
+// formFiles returns the files in the multipart form by field name, along
+// with the sorted names of fields that hold files but aren't allowed
+func formFiles(req *http.Request) (map[string][]*multipart.FileHeader, []string) {
+	files := map[string][]*multipart.FileHeader{}
+	var rejected []string
+	if req.MultipartForm == nil {
+		return files, rejected
+	}
+	for fieldName, fileHeaders := range req.MultipartForm.File {
+		if !uploadFieldAllowed(fieldName) {
+			rejected = append(rejected, fieldName)
+			continue
+		}
+		files[fieldName] = fileHeaders
+	}
+	sort.Strings(rejected)
+	return files, rejected
+}
+
+func readFormFile(fileHeader *multipart.FileHeader) (Upload, error) {
+	file, err := fileHeader.Open()
+	if err != nil {
+		return Upload{}, err
+	}
+	defer file.Close()
+	buffer, err := ioutil.ReadAll(file)
+	return Upload{
+		Buffer:           buffer,
+		OriginalFileName: fileHeader.Filename,
+		ContentType:      fileHeader.Header.Get("Content-Type"),
+	}, err
+}
+
+// storeUploads saves each file of a multi-file form on its own and answers
+// with a result per file, ordered by field name and then by position within
+// the field. The form's metadata applies to every file; a slug can only be
+// requested for single uploads.
+func storeUploads(session *r.Session, s3bucket *s3.Bucket, writer http.ResponseWriter, req *http.Request, files map[string][]*multipart.FileHeader) {
+	if req.FormValue(slugRequestedField) != "" {
+		http.Error(writer, "A slug can only be requested when uploading a single file", http.StatusBadRequest)
+		return
+	}
+	var fieldNames []string
+	for fieldName := range files {
+		fieldNames = append(fieldNames, fieldName)
+	}
+	sort.Strings(fieldNames)
+
+	results := []UploadResult{}
+	for _, fieldName := range fieldNames {
+		for _, fileHeader := range files[fieldName] {
+			upload, err := readFormFile(fileHeader)
+			if err != nil {
+				results = append(results, UploadResult{
+					Field:    fieldName,
+					FileName: fileHeader.Filename,
+					Status:   http.StatusBadRequest,
+					Error:    "Error reading file : " + err.Error(),
+					Code:     errcode.InvalidRequest,
+				})
+				continue
+			}
+			upload.Metadata = req.FormValue("metadata")
+			result := saveUpload(session, s3bucket, req, upload)
+			result.Field = fieldName
+			results = append(results, result)
+		}
+	}
+
+	jsonResponse, err := json.Marshal(results)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(jsonResponse)
+}
+
+// writeUploadResult answers a single-file upload
+func writeUploadResult(writer http.ResponseWriter, result UploadResult) {
+	var body interface{} = result.Image
+	switch {
+	case result.QuarantineId != "":
+		body = map[string]string{
+			"quarantineId": result.QuarantineId,
+			"reason":       result.Error,
+			"code":         string(result.Code),
+		}
+	case result.Error != "":
+		WriteError(writer, result.Status, result.Code, result.Error)
+		return
+	}
+
+	jsonResponse, err := json.Marshal(body)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	if result.Sha256 != "" {
+		writer.Header().Set("ETag", HashETag(result.Sha256))
+	}
+	writer.WriteHeader(result.Status)
+	writer.Write(jsonResponse)
+}
+
+// storeUpload saves the file and writes the response
+func storeUpload(session *r.Session, s3bucket *s3.Bucket, writer http.ResponseWriter, req *http.Request, upload Upload) {
+	writeUploadResult(writer, saveUpload(session, s3bucket, req, upload))
+}
+
+// uploadDeduplication reports whether UPLOAD_DEDUPLICATION is on
+func uploadDeduplication() bool {
+	return config.Bool("UPLOAD_DEDUPLICATION", true)
+}
+
+// uploadResultImage is the response body for a stored image
+func uploadResultImage(imageEntry ImageEntry, s3bucket *s3.Bucket) map[string]string {
+	return map[string]string{
+		"id":                imageEntry.Id,
+		"slug":              imageEntry.Slug,
+		"s3-filename":       imageEntry.S3Filename,
+		"original-filename": imageEntry.OriginalFileName,
+		"url":               imageEntry.Url(s3bucket),
+		"content-type":      imageEntry.ContentType,
+		"chain-id":          imageEntry.ChainId,
+	}
+}
+
+// saveUpload puts the file in the bucket and records the image. When the
+// tenant already has an image with the same bytes and no slug was
+// requested, that image is returned, flagged as deduplicated, and nothing
+// is stored.
+func saveUpload(session *r.Session, s3bucket *s3.Bucket, req *http.Request, upload Upload) UploadResult {
+	result := UploadResult{FileName: upload.OriginalFileName}
+	fail := func(status int, code errcode.Code, message string) UploadResult {
+		result.Status = status
+		result.Code = code
+		result.Error = message
+		return result
+	}
+
+	var metadata map[string]interface{}
+	var err error
+	if upload.Metadata != "" {
+		metadata, err = ParseMetadata([]byte(upload.Metadata))
+		if err != nil {
+			return fail(http.StatusBadRequest, errcode.InvalidRequest, err.Error())
+		}
+	}
+
+	buffer := upload.Buffer
+	sha256 := Sha256Hex(buffer)
+	if upload.Slug == "" && uploadDeduplication() {
+		existing, err := FindImageBySha256(session, sha256, RequestTenant(req))
+		if err == nil {
+			log.Printf("Upload %s is a copy of image %s", upload.OriginalFileName, existing.Id)
+			result.Status = http.StatusOK
+			result.Sha256 = existing.Sha256
+			result.Image = uploadResultImage(existing, s3bucket)
+			result.Image["deduplicated"] = "true"
+			return result
+		}
+		if err != r.ErrEmptyResult {
+			log.Printf("Error looking for copies of upload %s: %s", upload.OriginalFileName, err)
+		}
+	}
+
+	// Reserved only once the upload is known to need a new image, and
+	// released again on every path that doesn't record one
+	slug, err := AvailableSlug(session, upload.Slug, RequestTenant(req))
+	if err != nil {
+		return fail(StatusOf(errcode.Of(err)), errcode.Of(err), err.Error())
+	}
+
+	id := ids.New()
+	originalFileName := NormalizeFilename(upload.OriginalFileName)
+	s3UploadFilename := id + KeyExtension(originalFileName)
+
+	contentType := upload.ContentType
+	log.Printf("Content Type: %s / Filename: %s / Size: %v", contentType, originalFileName, binary.Size(buffer))
+	chaos.S3Latency()
+	chainId := RequestChainId(req)
+	s3PutErr := s3bucket.PutHeader(s3UploadFilename, buffer, map[string][]string{
+		"Content-Type":        {contentType},
+		"Content-Disposition": {ContentDisposition("inline", originalFileName)},
+		"X-Amz-Meta-Chain-Id": {chainId},
+	}, s3.Private)
+	if s3PutErr != nil {
+		releaseSlug(session, slug, RequestTenant(req))
+		RecordS3Error("put")
+		return fail(http.StatusInternalServerError, errcode.StorageUnavailable, "Error uploading object to S3 bucket : "+s3PutErr.Error())
+	}
+
+	width, height := ImageDimensions(buffer)
+	newImage := ImageEntry{
+		Id:               id,
+		Slug:             slug,
+		S3Filename:       s3UploadFilename,
+		OriginalFileName: originalFileName,
+		ContentType:      contentType,
+		CreatedAt:        time.Now(),
+		Size:             len(buffer),
+		Sha256:           sha256,
+		Width:            width,
+		Height:           height,
+		ChainId:          chainId,
+		OwnerId:          RequestTenant(req),
+		Metadata:         metadata,
+	}
+	newImage.recordUploadRequest(req, buffer)
+	if strings.HasPrefix(contentType, "video/") {
+		probe, err := ProbeVideo(buffer)
+		if err != nil {
+			log.Printf("Error probing video %s: %s", id, err)
+		} else {
+			newImage.Video = probe
+			newImage.Width, newImage.Height = probe.Width, probe.Height
+		}
+	}
+	// A quarantined upload claims its slug again when it is released
+	if reason := ValidateUpload(newImage); reason != "" {
+		releaseSlug(session, slug, newImage.OwnerId)
+		return Quarantine(session, newImage, errcode.InvalidImage, reason)
+	}
+	reqlErr := chaos.DBError()
+	if reqlErr == nil {
+		reqlErr = r.Table("images").Insert(newImage).Exec(session)
+	}
+	if reqlErr != nil {
+		releaseSlug(session, slug, newImage.OwnerId)
+		return Quarantine(session, newImage, errcode.StorageUnavailable, "Error inserting image entry into database : "+reqlErr.Error())
+	}
+
+	log.Printf("Getting URL for object...")
+	uploadSize.observe("", float64(len(buffer)))
+	result.Status = http.StatusOK
+	result.Sha256 = newImage.Sha256
+	result.Image = uploadResultImage(newImage, s3bucket)
+	if wantsInlineThumbnail(req) {
+		// The upload has succeeded either way, so a failure only leaves the
+		// thumbnail out
+		thumbnail, err := InlineThumbnail(req, buffer, contentType, width, height)
+		if err != nil {
+			log.Printf("Error rendering inline thumbnail for %s: %s", id, err)
+		} else if thumbnail != "" {
+			result.Image["thumbnail"] = thumbnail
+		}
+	}
+	return result
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/thejsj/veenco/config"
+	"github.com/thejsj/veenco/errcode"
+)
+
+// ErrUploadTooSlow is returned by a guarded body once the client has sent
+// data slower than UPLOAD_MIN_BYTES_PER_SECOND for longer than the grace
+// period
+var ErrUploadTooSlow = errors.New("Upload is arriving too slowly")
+
+// guardedReader enforces the upload deadlines. The rate only counts time
+// spent waiting on the client, so server-side throttling doesn't count
+// against it.
+type guardedReader struct {
+	reader     io.ReadCloser
+	controller *http.ResponseController
+	deadline   time.Time
+	stall      time.Duration
+	minRate    int
+	grace      time.Duration
+	read       int64
+	waiting    time.Duration
+}
+
+func (guarded *guardedReader) Read(buffer []byte) (int, error) {
+	// Each read must make progress within the stall window, and none may
+	// go past the deadline for the whole upload
+	readDeadline := time.Now().Add(guarded.stall)
+	if readDeadline.After(guarded.deadline) {
+		readDeadline = guarded.deadline
+	}
+	guarded.controller.SetReadDeadline(readDeadline)
+
+	start := time.Now()
+	n, err := guarded.reader.Read(buffer)
+	guarded.waiting += time.Since(start)
+	guarded.read += int64(n)
+
+	if err == nil && guarded.minRate > 0 && guarded.waiting > guarded.grace {
+		if float64(guarded.read)/guarded.waiting.Seconds() < float64(guarded.minRate) {
+			return n, ErrUploadTooSlow
+		}
+	}
+	return n, err
+}
+
+func (guarded *guardedReader) Close() error {
+	guarded.controller.SetReadDeadline(time.Time{})
+	return guarded.reader.Close()
+}
+
+// GuardUploadBody stops uploads that trickle in, so slow clients can't hold
+// a handler and its multipart temp files forever. The whole body must arrive
+// within UPLOAD_READ_TIMEOUT, no read may stall for longer than
+// UPLOAD_STALL_TIMEOUT, and after UPLOAD_MIN_RATE_GRACE the client must keep
+// up UPLOAD_MIN_BYTES_PER_SECOND.
+func GuardUploadBody(writer http.ResponseWriter, req *http.Request) {
+	controller := http.NewResponseController(writer)
+	deadline := time.Now().Add(config.Duration("UPLOAD_READ_TIMEOUT", 10*time.Minute))
+	err := controller.SetReadDeadline(deadline)
+	if err != nil {
+		log.Printf("Upload read deadlines are not supported: %s", err)
+		return
+	}
+	req.Body = &guardedReader{
+		reader:     req.Body,
+		controller: controller,
+		deadline:   deadline,
+		stall:      config.Duration("UPLOAD_STALL_TIMEOUT", 30*time.Second),
+		minRate:    config.Int("UPLOAD_MIN_BYTES_PER_SECOND", 1024),
+		grace:      config.Duration("UPLOAD_MIN_RATE_GRACE", 10*time.Second),
+	}
+}
+
+// UploadReadStatus is the status to answer with when reading the upload
+// failed: 408 when the client was too slow, 413 when the body was over its
+// limit, 400 otherwise
+func UploadReadStatus(err error) int {
+	var netErr net.Error
+	var maxBytesErr *http.MaxBytesError
+	if errors.Is(err, ErrUploadTooSlow) || (errors.As(err, &netErr) && netErr.Timeout()) {
+		return http.StatusRequestTimeout
+	}
+	if errors.As(err, &maxBytesErr) {
+		return http.StatusRequestEntityTooLarge
+	}
+	return http.StatusBadRequest
+}
+
+// WriteUploadReadError answers with UploadReadStatus and the matching code
+func WriteUploadReadError(writer http.ResponseWriter, err error) {
+	status := UploadReadStatus(err)
+	code := errcode.InvalidRequest
+	switch status {
+	case http.StatusRequestTimeout:
+		code = errcode.UploadTimeout
+	case http.StatusRequestEntityTooLarge:
+		code = errcode.PayloadTooLarge
+	}
+	WriteError(writer, status, code, "Error reading body of request: "+err.Error())
+}
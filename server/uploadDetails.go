@@ -0,0 +1,105 @@
+package server
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/julienschmidt/httprouter"
+	"github.com/thejsj/veenco/config"
+)
+
+// UploadDetails is what was recorded about the request that created an
+// image, for working out where a broken file came from
+type UploadDetails struct {
+	UploaderId          string `json:"uploaderId,omitempty"`
+	UploaderIp          string `json:"uploaderIp,omitempty"`
+	UploaderUserAgent   string `json:"uploaderUserAgent,omitempty"`
+	DeclaredContentType string `json:"declaredContentType,omitempty"`
+	DetectedContentType string `json:"detectedContentType,omitempty"`
+	UploadDurationMs    int64  `json:"uploadDurationMs,omitempty"`
+}
+
+type ImageUploadResponse struct {
+	Image  ImageEntry    `json:"image"`
+	Upload UploadDetails `json:"upload"`
+}
+
+// storedUploaderIp applies UPLOADER_IP_STORAGE to the caller's address:
+// `full` (the default) keeps it, `truncated` keeps the network (a /24 for
+// IPv4, a /48 for IPv6) and `none` drops it
+func storedUploaderIp(req *http.Request) string {
+	ip := ClientIp(req)
+	switch config.String("UPLOADER_IP_STORAGE", "full") {
+	case "none":
+		return ""
+	case "truncated":
+		parsed := net.ParseIP(ip)
+		if parsed == nil {
+			return ""
+		}
+		if ipv4 := parsed.To4(); ipv4 != nil {
+			return ipv4.Mask(net.CIDRMask(24, 32)).String()
+		}
+		return parsed.Mask(net.CIDRMask(48, 128)).String()
+	}
+	return ip
+}
+
+// detectContentType sniffs the type from the first bytes of the file, to
+// compare with the one the client declared
+func detectContentType(buffer []byte) string {
+	if len(buffer) == 0 {
+		return ""
+	}
+	return http.DetectContentType(buffer)
+}
+
+// recordUploadRequest stores the request's details on a new image. The
+// duration counts from when the server started reading the request.
+func (imageEntry *ImageEntry) recordUploadRequest(req *http.Request, buffer []byte) {
+	imageEntry.UploaderId = req.Header.Get("X-Uploader-Id")
+	imageEntry.UploaderIp = storedUploaderIp(req)
+	imageEntry.UploaderUserAgent = req.UserAgent()
+	imageEntry.DeclaredContentType = imageEntry.ContentType
+	imageEntry.DetectedContentType = detectContentType(buffer)
+	if start := RequestStart(req); !start.IsZero() {
+		imageEntry.UploadDurationMs = int64(time.Since(start) / time.Millisecond)
+	}
+}
+
+func (imageEntry ImageEntry) UploadDetails() UploadDetails {
+	return UploadDetails{
+		UploaderId:          imageEntry.UploaderId,
+		UploaderIp:          imageEntry.UploaderIp,
+		UploaderUserAgent:   imageEntry.UploaderUserAgent,
+		DeclaredContentType: imageEntry.DeclaredContentType,
+		DetectedContentType: imageEntry.DetectedContentType,
+		UploadDurationMs:    imageEntry.UploadDurationMs,
+	}
+}
+
+// ImageUploadGetHandler returns an image along with the details of the
+// request that uploaded it, which other endpoints leave out
+func ImageUploadGetHandler(session *r.Session) func(writer http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		log.Printf("GET ImageUploadGetHandler")
+		imageEntry, ok := FindImageEntry(session, writer, req, params.ByName("id"))
+		if !ok {
+			return
+		}
+		jsonResponse, err := json.Marshal(ImageUploadResponse{
+			Image:  imageEntry,
+			Upload: imageEntry.UploadDetails(),
+		})
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writer.Header().Set("Content-Type", "application/json")
+		writer.Write(jsonResponse)
+	}
+}
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/thejsj/veenco/config"
+	"github.com/thejsj/veenco/errcode"
+)
+
+const (
+	defaultMaxUploadBytes    = 512 << 20
+	defaultUploadMemoryBytes = 32 << 20
+)
+
+// maxUploadBytes bounds the body of a single upload request. Resumable
+// uploads are bounded per chunk by UPLOAD_CHUNK_MAX_BYTES instead.
+func maxUploadBytes() int64 {
+	return int64(config.Int("MAX_UPLOAD_BYTES", defaultMaxUploadBytes))
+}
+
+// uploadMemoryBytes is how much of a multipart form is kept in memory
+// before the rest is spooled to temporary files
+func uploadMemoryBytes() int64 {
+	return int64(config.Int("UPLOAD_MEMORY_BYTES", defaultUploadMemoryBytes))
+}
+
+// LimitUploadBody answers with 413 and returns false when the declared
+// Content-Length is over MAX_UPLOAD_BYTES. Otherwise it caps the body so
+// reading past the limit fails with an *http.MaxBytesError.
+func LimitUploadBody(writer http.ResponseWriter, req *http.Request) bool {
+	limit := maxUploadBytes()
+	if req.ContentLength > limit {
+		WriteError(writer, http.StatusRequestEntityTooLarge, errcode.PayloadTooLarge, fmt.Sprintf("Uploads can be at most %d bytes", limit))
+		return false
+	}
+	req.Body = http.MaxBytesReader(writer, req.Body, limit)
+	return true
+}
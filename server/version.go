@@ -0,0 +1,119 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// APIVersion prefixes the routes in Serve. A breaking change, such as a new
+// job schema, ships under the next version with its own handlers while the
+// routes of this one keep their behavior.
+const APIVersion = "v1"
+
+var versionPrefixPattern = regexp.MustCompile(`^/v[0-9]+/`)
+
+// versionedRouter registers routes under /<version>. With unprefixed set
+// they are also served at their old path, for clients from before
+// versioning, with a Deprecation header pointing at the versioned route.
+type versionedRouter struct {
+	router     *httprouter.Router
+	version    string
+	unprefixed bool
+}
+
+func (versioned versionedRouter) Handle(method string, path string, handle httprouter.Handle) {
+	versioned.router.Handle(method, "/"+versioned.version+path, handle)
+	if versioned.unprefixed {
+		versioned.router.Handle(method, path, deprecatedPath(versioned.version, handle))
+	}
+}
+
+func (versioned versionedRouter) GET(path string, handle httprouter.Handle) {
+	versioned.Handle(http.MethodGet, path, handle)
+}
+
+func (versioned versionedRouter) HEAD(path string, handle httprouter.Handle) {
+	versioned.Handle(http.MethodHead, path, handle)
+}
+
+func (versioned versionedRouter) OPTIONS(path string, handle httprouter.Handle) {
+	versioned.Handle(http.MethodOptions, path, handle)
+}
+
+func (versioned versionedRouter) POST(path string, handle httprouter.Handle) {
+	versioned.Handle(http.MethodPost, path, handle)
+}
+
+func (versioned versionedRouter) PUT(path string, handle httprouter.Handle) {
+	versioned.Handle(http.MethodPut, path, handle)
+}
+
+func (versioned versionedRouter) PATCH(path string, handle httprouter.Handle) {
+	versioned.Handle(http.MethodPatch, path, handle)
+}
+
+func (versioned versionedRouter) DELETE(path string, handle httprouter.Handle) {
+	versioned.Handle(http.MethodDelete, path, handle)
+}
+
+func deprecatedPath(version string, handle httprouter.Handle) httprouter.Handle {
+	return func(writer http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		writer.Header().Set("Deprecation", "true")
+		writer.Header().Set("Link", "</"+version+req.URL.Path+">; rel=\"successor-version\"")
+		handle(writer, req, params)
+	}
+}
+
+// unversionedPath strips the version prefix, e.g. /v1/jobs/status becomes
+// /jobs/status
+func unversionedPath(path string) string {
+	if prefix := versionPrefixPattern.FindString(path); prefix != "" {
+		return path[len(prefix)-1:]
+	}
+	return path
+}
+
+// apiPath returns a route's path under the version the request was made
+// with, for Location headers and other links back into the API
+func apiPath(req *http.Request, path string) string {
+	if prefix := versionPrefixPattern.FindString(req.URL.Path); prefix != "" {
+		return prefix[:len(prefix)-1] + path
+	}
+	return path
+}
+
+// requestScheme is the scheme the client used. Behind a TLS terminating
+// proxy that is X-Forwarded-Proto, believed only when the connection comes
+// from one of TRUSTED_PROXIES.
+func requestScheme(req *http.Request) string {
+	if req.TLS != nil {
+		return "https"
+	}
+	remoteIp, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		remoteIp = req.RemoteAddr
+	}
+	if trustedProxy(trustedProxies(), remoteIp) {
+		proto := strings.ToLower(strings.TrimSpace(strings.Split(req.Header.Get("X-Forwarded-Proto"), ",")[0]))
+		if proto == "http" || proto == "https" {
+			return proto
+		}
+	}
+	return "http"
+}
+
+// apiUrl is apiPath as an absolute URL on the host the request was made to,
+// for links that leave the API such as embeds and feeds
+func apiUrl(req *http.Request, path string) string {
+	return requestScheme(req) + "://" + req.Host + apiPath(req, path)
+}
+
+// contentUrl links to an image's original through the content endpoint,
+// which unlike a signed URL doesn't expire
+func contentUrl(req *http.Request, imageEntry ImageEntry) string {
+	return apiUrl(req, "/image/"+imageEntry.Id+"/content")
+}
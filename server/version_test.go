@@ -0,0 +1,37 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestScheme(t *testing.T) {
+	t.Setenv("TRUSTED_PROXIES", "10.0.0.0/8")
+	for _, test := range []struct {
+		remoteAddr string
+		proto      string
+		tls        bool
+		expected   string
+	}{
+		{"192.0.2.1:1234", "", false, "http"},
+		{"192.0.2.1:1234", "", true, "https"},
+		{"192.0.2.1:1234", "https", false, "http"},
+		{"10.0.0.1:1234", "https", false, "https"},
+		{"10.0.0.1:1234", "HTTPS, http", false, "https"},
+		{"10.0.0.1:1234", "gopher", false, "http"},
+	} {
+		req := httptest.NewRequest("GET", "/feed", nil)
+		req.RemoteAddr = test.remoteAddr
+		req.TLS = nil
+		if test.tls {
+			req.TLS = &tls.ConnectionState{}
+		}
+		if test.proto != "" {
+			req.Header.Set("X-Forwarded-Proto", test.proto)
+		}
+		if scheme := requestScheme(req); scheme != test.expected {
+			t.Errorf("Expected %s from %s with X-Forwarded-Proto %q, got %s", test.expected, test.remoteAddr, test.proto, scheme)
+		}
+	}
+}
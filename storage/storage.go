@@ -0,0 +1,195 @@
+package storage
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/mitchellh/goamz/aws"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/thejsj/veenco/config"
+)
+
+const (
+	ProviderAWS        = "aws"
+	ProviderCloudflare = "r2"
+	ProviderBackblaze  = "b2"
+)
+
+// B2 buckets are reached through their region's endpoint. Older accounts
+// may live elsewhere, in which case _REGION has to be set.
+const backblazeDefaultRegion = "us-west-004"
+
+// Config describes how to reach a single bucket. Every bucket is configured
+// through its own set of environment variables sharing a prefix, e.g.
+// S3_BUCKET_NAME, S3_REGION, S3_ENDPOINT, S3_PATH_STYLE and S3_ACCELERATE.
+type Config struct {
+	// One of ProviderAWS, ProviderCloudflare or ProviderBackblaze. Anything
+	// else is treated as a generic S3 compatible service.
+	Provider   string
+	BucketName string
+	AccessKey  string
+	SecretKey  string
+	// Name of an AWS region, ignored when Endpoint is set
+	Region string
+	// Cloudflare account the R2 endpoint is built from
+	AccountId string
+	// Custom S3 compatible endpoint, e.g. http://localhost:9000 for MinIO
+	Endpoint string
+	// Address the bucket as a path on the endpoint instead of a subdomain
+	PathStyle bool
+	// Use the S3 Transfer Acceleration endpoint, only available on AWS
+	Accelerate bool
+}
+
+func ConfigFromEnv(prefix string) Config {
+	config := Config{
+		Provider:   os.Getenv(prefix + "_PROVIDER"),
+		BucketName: os.Getenv(prefix + "_BUCKET_NAME"),
+		AccessKey:  os.Getenv("AWS_ACCESS_KEY"),
+		SecretKey:  os.Getenv("AWS_SECRET_KEY"),
+		Region:     os.Getenv(prefix + "_REGION"),
+		Endpoint:   os.Getenv(prefix + "_ENDPOINT"),
+		AccountId:  os.Getenv(prefix + "_ACCOUNT_ID"),
+		PathStyle:  os.Getenv(prefix+"_PATH_STYLE") != "false",
+		Accelerate: os.Getenv(prefix+"_ACCELERATE") == "true",
+	}
+	if config.Provider == "" {
+		config.Provider = ProviderAWS
+	}
+
+	switch config.Provider {
+	case ProviderCloudflare:
+		// R2 only has a single "auto" region and is addressed per account
+		config.Region = "auto"
+		if config.Endpoint == "" && config.AccountId != "" {
+			config.Endpoint = "https://" + config.AccountId + ".r2.cloudflarestorage.com"
+		}
+	case ProviderBackblaze:
+		if config.Region == "" {
+			config.Region = backblazeDefaultRegion
+		}
+		if config.Endpoint == "" {
+			config.Endpoint = "https://s3." + config.Region + ".backblazeb2.com"
+		}
+	}
+
+	if config.Region == "" {
+		config.Region = aws.USWest2.Name
+	}
+	return config
+}
+
+// BucketACL maps the ACL a bucket is requested with to one the provider
+// accepts. R2 has no ACLs at all and B2 buckets can only be private or
+// public-read.
+func (config Config) BucketACL(acl s3.ACL) s3.ACL {
+	switch config.Provider {
+	case ProviderCloudflare:
+		return s3.Private
+	case ProviderBackblaze:
+		if acl != s3.Private {
+			return s3.PublicRead
+		}
+	}
+	return acl
+}
+
+// EnsureBucket creates the bucket if it doesn't exist and applies acl to
+// it, so a bucket created earlier with another ACL is corrected too
+func (config Config) EnsureBucket(bucket *s3.Bucket, acl s3.ACL) error {
+	acl = config.BucketACL(acl)
+	err := bucket.PutBucket(acl)
+	if s3err, ok := err.(*s3.Error); ok && s3err.Code == "BucketAlreadyOwnedByYou" {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	// R2 buckets are always private and reject ACL requests
+	if config.Provider == ProviderCloudflare {
+		return nil
+	}
+	return bucket.PutBucketACL(acl)
+}
+
+// AwsRegion builds the goamz region used to reach the bucket
+func (config Config) AwsRegion() (aws.Region, error) {
+	if config.Accelerate && config.Provider != ProviderAWS {
+		return aws.Region{}, fmt.Errorf("Transfer Acceleration is not supported by %s", config.Provider)
+	}
+	if config.Provider == ProviderCloudflare && config.Endpoint == "" {
+		return aws.Region{}, fmt.Errorf("R2 needs an account ID or an endpoint")
+	}
+	if config.Endpoint != "" {
+		endpoint, err := url.Parse(config.Endpoint)
+		if err != nil || endpoint.Host == "" {
+			return aws.Region{}, fmt.Errorf("Invalid S3 endpoint: %s", config.Endpoint)
+		}
+		region := aws.Region{
+			Name:       config.Region,
+			S3Endpoint: strings.TrimSuffix(config.Endpoint, "/"),
+		}
+		if !config.PathStyle {
+			region.S3BucketEndpoint = endpoint.Scheme + "://${bucket}." + endpoint.Host
+		}
+		return region, nil
+	}
+
+	region, ok := aws.Regions[config.Region]
+	if !ok {
+		return aws.Region{}, fmt.Errorf("Unknown AWS region: %s", config.Region)
+	}
+	if config.Accelerate {
+		// Transfer Acceleration is only available on virtual hosted buckets
+		region.S3BucketEndpoint = "https://${bucket}.s3-accelerate.amazonaws.com"
+	} else if !config.PathStyle {
+		region.S3BucketEndpoint = strings.Replace(region.S3Endpoint, "://", "://${bucket}.", 1)
+	}
+	return region, nil
+}
+
+// Bucket connects to the bucket described by the config
+func (config Config) Bucket() (*s3.Bucket, error) {
+	if config.BucketName == "" {
+		return nil, fmt.Errorf("No bucket name configured")
+	}
+	region, err := config.AwsRegion()
+	if err != nil {
+		return nil, err
+	}
+	auth := aws.Auth{
+		AccessKey: config.AccessKey,
+		SecretKey: config.SecretKey,
+	}
+	return s3.New(auth, region).Bucket(config.BucketName), nil
+}
+
+// ForeignObject resolves an `s3://bucket/key` reference to that bucket,
+// reached with the same credentials and endpoint as bucket. ok is false for
+// anything that isn't such a reference, and for buckets other than bucket
+// itself that aren't listed in FOREIGN_BUCKETS. References into bucket are
+// resolved too; callers decide whose keys those may name.
+func ForeignObject(bucket *s3.Bucket, reference string) (foreignBucket *s3.Bucket, key string, ok bool) {
+	if !strings.HasPrefix(reference, "s3://") {
+		return nil, "", false
+	}
+	parts := strings.SplitN(strings.TrimPrefix(reference, "s3://"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, "", false
+	}
+	if parts[0] != bucket.Name && !foreignBucketAllowed(parts[0]) {
+		return nil, "", false
+	}
+	return bucket.S3.Bucket(parts[0]), parts[1], true
+}
+
+func foreignBucketAllowed(name string) bool {
+	for _, allowed := range config.List("FOREIGN_BUCKETS") {
+		if allowed == name {
+			return true
+		}
+	}
+	return false
+}
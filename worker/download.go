@@ -0,0 +1,187 @@
+package worker
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/goamz/s3"
+	"github.com/thejsj/veenco/chaos"
+	"github.com/thejsj/veenco/config"
+)
+
+const (
+	// Objects smaller than this are fetched with a single GET
+	rangedDownloadThreshold = 32 << 20
+	rangedDownloadPartSize  = 8 << 20
+	rangedDownloadRetries   = 3
+)
+
+// downloadConcurrency is read from DOWNLOAD_CONCURRENCY, defaulting to 4
+func downloadConcurrency() int {
+	concurrency := config.Int("DOWNLOAD_CONCURRENCY", 4)
+	if concurrency < 1 {
+		return 4
+	}
+	return concurrency
+}
+
+// DownloadFile fetches an object into filename. Large objects are
+// downloaded as parallel ranged GETs, each part retried on its own. The
+// result is checked against expectedSha256 when it is given, and otherwise
+// against the object's ETag when it is a plain MD5.
+func DownloadFile(s3bucket *s3.Bucket, key string, filename string, expectedSha256 string) error {
+	chaos.S3Latency()
+	head, err := s3bucket.Head(key)
+	if err != nil {
+		return fmt.Errorf("Error getting object metadata (%s): %s", key, err)
+	}
+	head.Body.Close()
+	size := head.ContentLength
+	etag := strings.Trim(head.Header.Get("ETag"), "\"")
+
+	file, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if size < rangedDownloadThreshold {
+		reader, err := s3bucket.GetReader(key)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		_, err = io.Copy(file, reader)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = downloadParts(s3bucket, key, file, size)
+		if err != nil {
+			return err
+		}
+	}
+
+	if expectedSha256 != "" {
+		return verifyChecksum(file, sha256.New(), expectedSha256)
+	}
+	return verifyETag(file, etag)
+}
+
+func downloadParts(s3bucket *s3.Bucket, key string, file *os.File, size int64) error {
+	offsets := make(chan int64)
+	errs := make(chan error, 1)
+	var wg sync.WaitGroup
+
+	for i := 0; i < downloadConcurrency(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for offset := range offsets {
+				end := offset + rangedDownloadPartSize - 1
+				if end >= size {
+					end = size - 1
+				}
+				err := downloadPartWithRetries(s3bucket, key, file, offset, end, size)
+				if err != nil {
+					select {
+					case errs <- err:
+					default:
+					}
+				}
+			}
+		}()
+	}
+
+	log.Printf("Downloading %s in %v byte parts", key, rangedDownloadPartSize)
+	for offset := int64(0); offset < size; offset += rangedDownloadPartSize {
+		offsets <- offset
+	}
+	close(offsets)
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		return err
+	default:
+		return nil
+	}
+}
+
+func downloadPartWithRetries(s3bucket *s3.Bucket, key string, file *os.File, start int64, end int64, size int64) (err error) {
+	for attempt := 1; attempt <= rangedDownloadRetries; attempt++ {
+		err = downloadPart(s3bucket, key, file, start, end, size)
+		if err == nil {
+			return nil
+		}
+		log.Printf("Error downloading bytes %v-%v of %s (attempt %v): %s", start, end, key, attempt, err)
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+	return err
+}
+
+// downloadPart writes bytes start to end of the object, which is size bytes
+// long, at the same offset in the file. A response that isn't exactly that
+// range, e.g. the whole object from a server that ignores Range, or a range
+// of an object that changed since its HEAD, is refused.
+func downloadPart(s3bucket *s3.Bucket, key string, file *os.File, start int64, end int64, size int64) error {
+	headers := map[string][]string{
+		"Range": {fmt.Sprintf("bytes=%v-%v", start, end)},
+	}
+	res, err := s3bucket.GetResponseWithHeaders(key, headers)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("Expected 206 Partial Content for a ranged GET, got %s", res.Status)
+	}
+	contentRange := fmt.Sprintf("bytes %v-%v/%v", start, end, size)
+	if res.Header.Get("Content-Range") != contentRange {
+		return fmt.Errorf("Expected Content-Range %q, got %q", contentRange, res.Header.Get("Content-Range"))
+	}
+
+	buffer := make([]byte, end-start+1)
+	_, err = io.ReadFull(res.Body, buffer)
+	if err != nil {
+		return err
+	}
+	_, err = file.WriteAt(buffer, start)
+	return err
+}
+
+// verifyETag compares the file's MD5 against the ETag. ETags of objects
+// uploaded in multiple parts aren't an MD5 of the content and are skipped.
+func verifyETag(file *os.File, etag string) error {
+	if etag == "" || strings.Contains(etag, "-") {
+		return nil
+	}
+	return verifyChecksum(file, md5.New(), etag)
+}
+
+// verifyChecksum compares the file's hex encoded hash against expected
+func verifyChecksum(file *os.File, hash hash.Hash, expected string) error {
+	_, err := file.Seek(0, 0)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return err
+	}
+	checksum := hex.EncodeToString(hash.Sum(nil))
+	if checksum != expected {
+		return fmt.Errorf("Checksum mismatch: expected %s, got %s", expected, checksum)
+	}
+	return nil
+}
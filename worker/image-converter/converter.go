@@ -0,0 +1,119 @@
+package imageConverter
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/thejsj/veenco/config"
+)
+
+// DefaultQuality is used when the job doesn't ask for a quality
+const DefaultQuality = 95
+
+// Converter is a backend that can run conversions. Which backends are
+// compiled in depends on build tags, and which of those work is checked at
+// runtime, so one binary can run on nodes with and without vips. ImageMagick
+// is linked through cgo, so a binary with it won't even start where
+// libMagickWand is missing; nodes without it need a separate build with
+// `-tags noimagick`, which falls back to vips or the Go backend.
+type Converter interface {
+	Name() string
+	// Version fails when the backend can't run on this node
+	Version() (string, error)
+	// Formats the backend can read and write
+	Formats() []string
+	// Resize halves the image's dimensions and writes the result next to
+	// the source, returning the validated output and how it was produced.
+	// A quality of 0 uses DefaultQuality.
+	Resize(fileName string, quality uint) (Result, error)
+}
+
+// Backends are preferred in this order when CONVERTER_BACKEND isn't set
+var converterPreference = []string{"imagick", "vips", "go"}
+
+var converters []Converter
+
+func register(converter Converter) {
+	converters = append(converters, converter)
+	sort.SliceStable(converters, func(i, j int) bool {
+		return preferenceOf(converters[i]) < preferenceOf(converters[j])
+	})
+}
+
+func preferenceOf(converter Converter) int {
+	for i, name := range converterPreference {
+		if name == converter.Name() {
+			return i
+		}
+	}
+	return len(converterPreference)
+}
+
+// Compiled returns every compiled-in backend, most preferred first, whether
+// or not it works on this node
+func Compiled() []Converter {
+	return converters
+}
+
+// Available returns the compiled-in backends that work on this node, most
+// preferred first
+func Available() []Converter {
+	var available []Converter
+	for _, converter := range converters {
+		if _, err := converter.Version(); err == nil {
+			available = append(available, converter)
+		}
+	}
+	return available
+}
+
+// Select returns the backend named by CONVERTER_BACKEND, or the most
+// preferred available one when it isn't set
+func Select() (Converter, error) {
+	available := Available()
+	name := config.String("CONVERTER_BACKEND", "")
+	for _, converter := range available {
+		if name == "" || converter.Name() == name {
+			return converter, nil
+		}
+	}
+	var names []string
+	for _, converter := range available {
+		names = append(names, converter.Name())
+	}
+	if name != "" {
+		return nil, fmt.Errorf("Converter backend `%s` isn't available; available: %s", name, strings.Join(names, ", "))
+	}
+	return nil, fmt.Errorf("No converter backend is available")
+}
+
+func normalizeQuality(quality uint) uint {
+	if quality == 0 || quality > 100 {
+		return DefaultQuality
+	}
+	return quality
+}
+
+// outputFileNameFor names a conversion's output after its source and the
+// time it was made, in the source's directory
+func outputFileNameFor(fileName string) string {
+	fileExtension := filepath.Ext(fileName)
+	name := strings.TrimSuffix(filepath.Base(fileName), fileExtension)
+	return filepath.Join(filepath.Dir(fileName), name+"-"+time.Now().Format(time.RFC850)+fileExtension)
+}
+
+// checkNotEmpty is the part of validating an output every backend shares
+func checkNotEmpty(fileName string) error {
+	info, err := os.Stat(fileName)
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		return fmt.Errorf("%s is empty", fileName)
+	}
+	return nil
+}
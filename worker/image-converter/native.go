@@ -0,0 +1,138 @@
+package imageConverter
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"log"
+	"os"
+	"runtime"
+)
+
+// nativeConverter uses only the standard library, so it is always
+// available, including in static builds for nodes without ImageMagick. It
+// handles fewer formats and uses a simple box filter.
+type nativeConverter struct{}
+
+func init() {
+	register(nativeConverter{})
+}
+
+func (nativeConverter) Name() string {
+	return "go"
+}
+
+func (nativeConverter) Version() (string, error) {
+	return runtime.Version(), nil
+}
+
+func (nativeConverter) Formats() []string {
+	return []string{"jpeg", "png", "gif"}
+}
+
+func (converter nativeConverter) Resize(fileName string, quality uint) (result Result, err error) {
+	quality = normalizeQuality(quality)
+	source, format, err := decodeFile(fileName)
+	if err != nil {
+		return result, err
+	}
+	bounds := source.Bounds()
+	log.Printf("With: %v / Height: %v", bounds.Dx(), bounds.Dy())
+	halved := halve(source)
+
+	outputFileName := outputFileNameFor(fileName)
+	log.Printf("Starting to convert image: %v", outputFileName)
+	output, err := os.Create(outputFileName)
+	if err != nil {
+		return result, err
+	}
+	switch format {
+	case "jpeg":
+		err = jpeg.Encode(output, halved, &jpeg.Options{Quality: int(quality)})
+	case "png":
+		err = png.Encode(output, halved)
+	case "gif":
+		err = gif.Encode(output, halved, nil)
+	}
+	closeErr := output.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = validateNative(outputFileName, halved.Bounds().Dx(), halved.Bounds().Dy(), format)
+	}
+	if err != nil {
+		log.Printf("Converted image failed validation: %v", err)
+		os.Remove(outputFileName)
+		return result, err
+	}
+	log.Printf("Finished converting image: %v", outputFileName)
+	return NewResult(outputFileName, converter, map[string]interface{}{
+		"operation": "resize",
+		"width":     halved.Bounds().Dx(),
+		"height":    halved.Bounds().Dy(),
+		"filter":    "box",
+		"quality":   quality,
+		"format":    format,
+	}), nil
+}
+
+func decodeFile(fileName string) (image.Image, string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, "", err
+	}
+	defer file.Close()
+	return image.Decode(file)
+}
+
+// halve averages each 2x2 block of pixels into one
+func halve(source image.Image) *image.RGBA64 {
+	bounds := source.Bounds()
+	width, height := bounds.Dx()/2, bounds.Dy()/2
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	halved := image.NewRGBA64(image.Rect(0, 0, width, height))
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			var r, g, b, a, count uint32
+			for _, offset := range [][2]int{{0, 0}, {1, 0}, {0, 1}, {1, 1}} {
+				point := image.Pt(bounds.Min.X+2*x+offset[0], bounds.Min.Y+2*y+offset[1])
+				if !point.In(bounds) {
+					continue
+				}
+				pr, pg, pb, pa := source.At(point.X, point.Y).RGBA()
+				r, g, b, a, count = r+pr, g+pg, b+pb, a+pa, count+1
+			}
+			halved.SetRGBA64(x, y, color.RGBA64{uint16(r / count), uint16(g / count), uint16(b / count), uint16(a / count)})
+		}
+	}
+	return halved
+}
+
+// validateNative decodes the whole output, like validate does for
+// ImageMagick, and checks its dimensions and format
+func validateNative(fileName string, width int, height int, format string) error {
+	err := checkNotEmpty(fileName)
+	if err != nil {
+		return err
+	}
+	decoded, decodedFormat, err := decodeFile(fileName)
+	if err != nil {
+		return fmt.Errorf("%s does not decode: %s", fileName, err)
+	}
+	if decoded.Bounds().Dx() != width || decoded.Bounds().Dy() != height {
+		return fmt.Errorf("%s is %vx%v, expected %vx%v", fileName, decoded.Bounds().Dx(), decoded.Bounds().Dy(), width, height)
+	}
+	if decodedFormat != format {
+		return fmt.Errorf("%s is %s, expected %s", fileName, decodedFormat, format)
+	}
+	return nil
+}
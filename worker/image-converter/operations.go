@@ -0,0 +1,285 @@
+package imageConverter
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Operation is one step of an ops string such as
+// `resize:w=800;crop:1:1;format:webp,q=80`: a name, then comma separated
+// arguments that are either positional or `key=value`
+type Operation struct {
+	Name       string
+	Positional []string
+	Named      map[string]string
+	// Offset of the step in the ops string, for error messages
+	Position int
+}
+
+// Formats an operation can convert to
+var outputFormats = []string{"jpeg", "png", "webp", "gif"}
+
+// How a resize given both `w` and `h` treats the image's aspect ratio:
+// scale stretches it to the box, clip fits it within the box and crop fills
+// the box, cutting off what sticks out around the center
+var resizeFits = []string{"scale", "clip", "crop"}
+
+// SyntaxError points at the offending character of an ops string
+type SyntaxError struct {
+	Position int
+	Message  string
+}
+
+func (err *SyntaxError) Error() string {
+	return fmt.Sprintf("at position %d: %s", err.Position, err.Message)
+}
+
+// ParseOperations tokenizes and checks an ops string. Steps are separated
+// by `;`, a step's name by `:` from its arguments and arguments by `,`.
+// Positional arguments may themselves contain `:`, as in `crop:16:9`.
+// Empty steps, such as a leading or doubled `;`, are skipped. Sizes are
+// bounded by maxPx.
+func ParseOperations(ops string, maxPx uint) ([]Operation, error) {
+	tokens, err := tokenize(ops)
+	if err != nil {
+		return nil, err
+	}
+	parser := &opsParser{tokens: tokens}
+	var operations []Operation
+	for !parser.done() {
+		if parser.peek(';') {
+			parser.next++
+			continue
+		}
+		operation, err := parser.step()
+		if err != nil {
+			return nil, err
+		}
+		err = operation.validate(maxPx)
+		if err != nil {
+			return nil, &SyntaxError{Position: operation.Position, Message: err.Error()}
+		}
+		operations = append(operations, operation)
+		if !parser.done() {
+			_, err = parser.expect(';')
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	if len(operations) == 0 {
+		return nil, &SyntaxError{Position: 0, Message: "no operations given"}
+	}
+	return operations, nil
+}
+
+// token is a single punctuation character or a run of word characters
+type token struct {
+	kind     rune // ':', ';', ',', '=' or 'w' for a word
+	text     string
+	position int
+}
+
+func isWordCharacter(character rune) bool {
+	return character == '.' || character == '-' || character == '_' ||
+		(character >= '0' && character <= '9') ||
+		(character >= 'a' && character <= 'z') ||
+		(character >= 'A' && character <= 'Z')
+}
+
+func tokenize(ops string) ([]token, error) {
+	var tokens []token
+	for position := 0; position < len(ops); {
+		character := rune(ops[position])
+		switch {
+		case character == ' ':
+			position++
+		case strings.ContainsRune(":;,=", character):
+			tokens = append(tokens, token{kind: character, text: string(character), position: position})
+			position++
+		case isWordCharacter(character):
+			start := position
+			for position < len(ops) && isWordCharacter(rune(ops[position])) {
+				position++
+			}
+			tokens = append(tokens, token{kind: 'w', text: ops[start:position], position: start})
+		default:
+			return nil, &SyntaxError{Position: position, Message: fmt.Sprintf("unexpected character %q", character)}
+		}
+	}
+	return tokens, nil
+}
+
+type opsParser struct {
+	tokens []token
+	next   int
+}
+
+func (parser *opsParser) done() bool {
+	return parser.next >= len(parser.tokens)
+}
+
+func (parser *opsParser) peek(kind rune) bool {
+	return !parser.done() && parser.tokens[parser.next].kind == kind
+}
+
+func (parser *opsParser) expect(kind rune) (token, error) {
+	if parser.done() {
+		position := 0
+		if len(parser.tokens) > 0 {
+			last := parser.tokens[len(parser.tokens)-1]
+			position = last.position + len(last.text)
+		}
+		return token{}, &SyntaxError{Position: position, Message: "expected " + describeKind(kind) + ", found the end"}
+	}
+	found := parser.tokens[parser.next]
+	if found.kind != kind {
+		return found, &SyntaxError{Position: found.position, Message: fmt.Sprintf("expected %s, found `%s`", describeKind(kind), found.text)}
+	}
+	parser.next++
+	return found, nil
+}
+
+func describeKind(kind rune) string {
+	if kind == 'w' {
+		return "a name or value"
+	}
+	return "`" + string(kind) + "`"
+}
+
+// step parses `name` or `name:arg,arg`
+func (parser *opsParser) step() (Operation, error) {
+	name, err := parser.expect('w')
+	if err != nil {
+		return Operation{}, err
+	}
+	operation := Operation{Name: name.text, Named: map[string]string{}, Position: name.position}
+	if !parser.peek(':') {
+		return operation, nil
+	}
+	parser.next++
+	for {
+		value, err := parser.expect('w')
+		if err != nil {
+			return operation, err
+		}
+		if parser.peek('=') {
+			parser.next++
+			namedValue, err := parser.expect('w')
+			if err != nil {
+				return operation, err
+			}
+			operation.Named[value.text] = namedValue.text
+		} else {
+			positional := value.text
+			for parser.peek(':') {
+				parser.next++
+				part, err := parser.expect('w')
+				if err != nil {
+					return operation, err
+				}
+				positional += ":" + part.text
+			}
+			operation.Positional = append(operation.Positional, positional)
+		}
+		if !parser.peek(',') {
+			return operation, nil
+		}
+		parser.next++
+	}
+}
+
+// String writes the operation back as an ops step, with named arguments
+// sorted so equal operations give equal strings
+func (operation Operation) String() string {
+	arguments := append([]string{}, operation.Positional...)
+	var names []string
+	for name := range operation.Named {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		arguments = append(arguments, name+"="+operation.Named[name])
+	}
+	if len(arguments) == 0 {
+		return operation.Name
+	}
+	return operation.Name + ":" + strings.Join(arguments, ",")
+}
+
+func (operation Operation) uint(name string) (uint, error) {
+	value, ok := operation.Named[name]
+	if !ok {
+		return 0, nil
+	}
+	parsed, err := strconv.ParseUint(value, 10, 32)
+	if err != nil || parsed == 0 {
+		return 0, fmt.Errorf("`%s` must be a positive integer", name)
+	}
+	return uint(parsed), nil
+}
+
+// aspect reads a crop's `x:y` ratio
+func (operation Operation) aspect() (float64, error) {
+	if len(operation.Positional) != 1 {
+		return 0, fmt.Errorf("crop takes an aspect ratio such as `crop:16:9`")
+	}
+	x, y, _ := strings.Cut(operation.Positional[0], ":")
+	width, widthErr := strconv.ParseFloat(x, 64)
+	height, heightErr := strconv.ParseFloat(y, 64)
+	if widthErr != nil || heightErr != nil || width <= 0 || height <= 0 {
+		return 0, fmt.Errorf("crop takes an aspect ratio such as `crop:16:9`")
+	}
+	return width / height, nil
+}
+
+func (operation Operation) validate(maxPx uint) error {
+	switch operation.Name {
+	case "resize":
+		width, err := operation.uint("w")
+		if err != nil {
+			return err
+		}
+		height, err := operation.uint("h")
+		if err != nil {
+			return err
+		}
+		if width == 0 && height == 0 {
+			return fmt.Errorf("resize needs `w` or `h`")
+		}
+		if width > maxPx || height > maxPx {
+			return fmt.Errorf("`w` and `h` can be at most %d", maxPx)
+		}
+		if fit, ok := operation.Named["fit"]; ok && !containsString(resizeFits, fit) {
+			return fmt.Errorf("`fit` must be one of %s", strings.Join(resizeFits, ", "))
+		}
+	case "crop":
+		_, err := operation.aspect()
+		return err
+	case "format":
+		if len(operation.Positional) != 1 || !containsString(outputFormats, operation.Positional[0]) {
+			return fmt.Errorf("format must be one of %s", strings.Join(outputFormats, ", "))
+		}
+		quality, err := operation.uint("q")
+		if err != nil {
+			return err
+		}
+		if quality > 100 {
+			return fmt.Errorf("`q` must be at most 100")
+		}
+	default:
+		return fmt.Errorf("Unknown operation `%s`", operation.Name)
+	}
+	return nil
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
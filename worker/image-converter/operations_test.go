@@ -0,0 +1,81 @@
+package imageConverter
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestTokenize(t *testing.T) {
+	tokens, err := tokenize("resize:w=800, fit=crop;crop:16:9")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var texts []string
+	for _, token := range tokens {
+		texts = append(texts, token.text)
+	}
+	expected := []string{"resize", ":", "w", "=", "800", ",", "fit", "=", "crop", ";", "crop", ":", "16", ":", "9"}
+	if !reflect.DeepEqual(texts, expected) {
+		t.Errorf("Expected %v, got %v", expected, texts)
+	}
+	if tokens[6].position != 14 {
+		t.Errorf("Expected `fit` at position 14, got %d", tokens[6].position)
+	}
+
+	_, err = tokenize("resize:w=80%")
+	syntaxError, ok := err.(*SyntaxError)
+	if !ok || syntaxError.Position != 11 {
+		t.Errorf("Expected a syntax error at position 11, got %v", err)
+	}
+}
+
+func TestParseOperations(t *testing.T) {
+	operations, err := ParseOperations("resize:w=800,fit=crop;crop:16:9;format:webp,q=80", 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var steps []string
+	for _, operation := range operations {
+		steps = append(steps, operation.String())
+	}
+	expected := []string{"resize:fit=crop,w=800", "crop:16:9", "format:webp,q=80"}
+	if !reflect.DeepEqual(steps, expected) {
+		t.Errorf("Expected %v, got %v", expected, steps)
+	}
+	if operations[1].Position != 22 {
+		t.Errorf("Expected the crop at position 22, got %d", operations[1].Position)
+	}
+}
+
+func TestParseOperationsSkipsEmptySteps(t *testing.T) {
+	for _, ops := range []string{";resize:w=10", "resize:w=10;", "resize:w=10;;format:png", " ; resize:w=10"} {
+		operations, err := ParseOperations(ops, 4096)
+		if err != nil || len(operations) == 0 || operations[0].Name != "resize" {
+			t.Errorf("Expected %q to parse, got %v (%v)", ops, operations, err)
+		}
+	}
+	if _, err := ParseOperations(";;", 4096); err == nil {
+		t.Errorf("Expected ops without steps to fail")
+	}
+}
+
+func TestParseOperationsRejects(t *testing.T) {
+	for ops, message := range map[string]string{
+		"":                     "no operations",
+		"blur:5":               "Unknown operation",
+		"resize":               "needs `w` or `h`",
+		"resize:w=5000":        "at most 4096",
+		"resize:w=10,fit=fill": "`fit` must be one of",
+		"crop:16":              "aspect ratio",
+		"format:bmp":           "format must be one of",
+		"format:png,q=101":     "at most 100",
+		"resize:w=":            "expected a name or value, found the end",
+		"resize:w=10 format":   "expected `;`",
+	} {
+		_, err := ParseOperations(ops, 4096)
+		if err == nil || !strings.Contains(err.Error(), message) {
+			t.Errorf("Expected %q to fail with %q, got %v", ops, message, err)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+//go:build !noimagick
+
+package imageConverter
+
+import (
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gographics/imagick/imagick"
+)
+
+// Preview applies the operations to a copy of the image scaled down to fit
+// within proxySize pixels, or to the image itself when proxySize is 0,
+// returning the encoded result and its content type. Nothing is written to
+// disk.
+func Preview(source []byte, proxySize uint, operations []Operation) ([]byte, string, error) {
+	initializeImagick(serverResourceDefaults)
+
+	mw := imagick.NewMagickWand()
+	defer mw.Destroy()
+	// Pinging only reads the header, so huge images are refused before
+	// their pixels are decoded
+	err := mw.PingImageBlob(source)
+	if err != nil {
+		return nil, "", err
+	}
+	if uint64(mw.GetImageWidth())*uint64(mw.GetImageHeight()) > maxSourcePixels() {
+		return nil, "", ErrSourceTooLarge
+	}
+	mw.Clear()
+	err = mw.ReadImageBlob(source)
+	if err != nil {
+		return nil, "", err
+	}
+
+	width := float64(mw.GetImageWidth())
+	height := float64(mw.GetImageHeight())
+	longest := math.Max(width, height)
+	scale := 1.0
+	if proxySize > 0 && longest > float64(proxySize) {
+		scale = float64(proxySize) / longest
+		err = mw.ResizeImage(atLeastOne(width*scale), atLeastOne(height*scale), imagick.FILTER_TRIANGLE, 1)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+
+	for _, operation := range operations {
+		err = operation.apply(mw, scale, proxySize)
+		if err != nil {
+			return nil, "", err
+		}
+	}
+	format := strings.ToLower(mw.GetImageFormat())
+	return mw.GetImageBlob(), "image/" + format, nil
+}
+
+// ApplyOperations runs the operations on an image file at full size and
+// writes the result next to it, for jobs given as an ops string
+func ApplyOperations(fileName string, operations []Operation) (result Result, err error) {
+	converter := imagickConverter{}
+	if _, err = converter.Version(); err != nil {
+		return result, ErrOperationsUnavailable
+	}
+	initializeImagick(nil)
+
+	mw := imagick.NewMagickWand()
+	defer mw.Destroy()
+	err = mw.ReadImage(fileName)
+	if err != nil {
+		return result, err
+	}
+	var steps []string
+	for _, operation := range operations {
+		err = operation.apply(mw, 1, 0)
+		if err != nil {
+			return result, err
+		}
+		steps = append(steps, operation.String())
+	}
+
+	format := mw.GetImageFormat()
+	outputFileName := outputFileNameFor(fileName)
+	outputFileName = strings.TrimSuffix(outputFileName, filepath.Ext(outputFileName)) + "." + strings.ToLower(format)
+	err = mw.WriteImage(outputFileName)
+	if err != nil {
+		return result, err
+	}
+	resources := ResourceStats()
+	width, height := mw.GetImageWidth(), mw.GetImageHeight()
+	err = validate(outputFileName, width, height, format)
+	if err != nil {
+		os.Remove(outputFileName)
+		return result, err
+	}
+	result = NewResult(outputFileName, converter, map[string]interface{}{
+		"operation": "ops",
+		"ops":       strings.Join(steps, ";"),
+		"width":     width,
+		"height":    height,
+		"format":    format,
+	})
+	result.Resources = resources
+	return result, nil
+}
+
+// apply runs the operation on the wand. Pixel sizes are multiplied by scale
+// so a downscaled proxy gets proportionally smaller results, and resizes
+// stay within maxPx when it isn't 0, so a preview never outgrows its proxy.
+func (operation Operation) apply(mw *imagick.MagickWand, scale float64, maxPx uint) error {
+	width := float64(mw.GetImageWidth())
+	height := float64(mw.GetImageHeight())
+	switch operation.Name {
+	case "resize":
+		requestedWidth, _ := operation.uint("w")
+		requestedHeight, _ := operation.uint("h")
+		newWidth, newHeight := float64(requestedWidth)*scale, float64(requestedHeight)*scale
+		if newWidth == 0 {
+			newWidth = width * newHeight / height
+		}
+		if newHeight == 0 {
+			newHeight = height * newWidth / width
+		}
+		if longest := math.Max(newWidth, newHeight); maxPx > 0 && longest > float64(maxPx) {
+			newWidth, newHeight = newWidth*float64(maxPx)/longest, newHeight*float64(maxPx)/longest
+		}
+		switch operation.Named["fit"] {
+		case "clip":
+			ratio := math.Min(newWidth/width, newHeight/height)
+			newWidth, newHeight = width*ratio, height*ratio
+		case "crop":
+			// Cropping to the box's aspect first keeps the image from ever
+			// being larger than either the original or the box
+			aspect := newWidth / newHeight
+			cropWidth, cropHeight := width, width/aspect
+			if cropHeight > height {
+				cropWidth, cropHeight = height*aspect, height
+			}
+			err := mw.CropImage(atLeastOne(cropWidth), atLeastOne(cropHeight), int((width-cropWidth)/2), int((height-cropHeight)/2))
+			if err != nil {
+				return err
+			}
+		}
+		return mw.ResizeImage(atLeastOne(newWidth), atLeastOne(newHeight), imagick.FILTER_TRIANGLE, 1)
+	case "crop":
+		aspect, _ := operation.aspect()
+		newWidth, newHeight := width, width/aspect
+		if newHeight > height {
+			newWidth, newHeight = height*aspect, height
+		}
+		return mw.CropImage(atLeastOne(newWidth), atLeastOne(newHeight), int((width-newWidth)/2), int((height-newHeight)/2))
+	case "format":
+		err := mw.SetImageFormat(operation.Positional[0])
+		if err != nil {
+			return err
+		}
+		if quality, _ := operation.uint("q"); quality > 0 {
+			return mw.SetImageCompressionQuality(quality)
+		}
+	}
+	return nil
+}
+
+func atLeastOne(size float64) uint {
+	if size < 1 {
+		return 1
+	}
+	return uint(size + 0.5)
+}
@@ -0,0 +1,26 @@
+package imageConverter
+
+import (
+	"errors"
+
+	"github.com/thejsj/veenco/config"
+)
+
+var (
+	// ErrPreviewUnavailable is returned by Preview in builds without
+	// ImageMagick
+	ErrPreviewUnavailable = errors.New("Previews aren't available in builds without ImageMagick")
+	// ErrOperationsUnavailable is returned by ApplyOperations where
+	// ImageMagick isn't available
+	ErrOperationsUnavailable = errors.New("Ops jobs need ImageMagick, which isn't available on this worker")
+	// ErrSourceTooLarge is returned by Preview for images with more pixels
+	// than PREVIEW_MAX_SOURCE_PIXELS
+	ErrSourceTooLarge = errors.New("The image has too many pixels to preview")
+)
+
+// maxSourcePixels bounds the images Preview decodes, checked against the
+// header before any pixels are read, from PREVIEW_MAX_SOURCE_PIXELS (100
+// megapixels by default)
+func maxSourcePixels() uint64 {
+	return uint64(config.Int("PREVIEW_MAX_SOURCE_PIXELS", 100000000))
+}
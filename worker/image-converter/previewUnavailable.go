@@ -0,0 +1,13 @@
+//go:build noimagick
+
+package imageConverter
+
+// Preview needs ImageMagick, which builds with the noimagick tag leave out
+func Preview(source []byte, proxySize uint, operations []Operation) ([]byte, string, error) {
+	return nil, "", ErrPreviewUnavailable
+}
+
+// ApplyOperations needs ImageMagick too
+func ApplyOperations(fileName string, operations []Operation) (Result, error) {
+	return Result{}, ErrOperationsUnavailable
+}
@@ -1,18 +1,76 @@
+//go:build !noimagick
+
 package imageConverter
 
 import (
+	"errors"
+	"fmt"
 	"log"
-	"path/filepath"
+	"os"
 	"strings"
-	"time"
+	"sync"
 
 	"github.com/gographics/imagick/imagick"
 )
 
-func Resize(fileName string) (resizeError error) {
-	imagick.Initialize()
-	// Schedule cleanup
-	defer imagick.Terminate()
+// imagickConverter runs conversions in-process through ImageMagick. It
+// needs cgo, so builds for nodes without ImageMagick leave it out with the
+// noimagick tag.
+type imagickConverter struct{}
+
+func init() {
+	register(imagickConverter{})
+}
+
+func (imagickConverter) Name() string {
+	return "imagick"
+}
+
+// The probe runs once, listing the formats ImageMagick has delegates for
+var (
+	probeOnce     sync.Once
+	probedVersion string
+	probedFormats []string
+	probeErr      error
+)
+
+func probeImagick() {
+	probeOnce.Do(func() {
+		initializeImagick(nil)
+		probedVersion, _ = imagick.GetVersion()
+		if probedVersion == "" {
+			probeErr = errors.New("ImageMagick didn't report a version")
+			return
+		}
+		mw := imagick.NewMagickWand()
+		defer mw.Destroy()
+		for _, format := range []string{"jpeg", "png", "gif", "webp", "tiff", "bmp"} {
+			if len(mw.QueryFormats(strings.ToUpper(format))) > 0 {
+				probedFormats = append(probedFormats, format)
+			}
+		}
+		if len(probedFormats) == 0 {
+			probeErr = fmt.Errorf("%s has no delegates for any supported format", probedVersion)
+		}
+	})
+}
+
+// Version fails when ImageMagick doesn't report a version or can't handle
+// any of the formats this backend converts
+func (imagickConverter) Version() (string, error) {
+	probeImagick()
+	return probedVersion, probeErr
+}
+
+// Formats are the ones ImageMagick was built with delegates for
+func (imagickConverter) Formats() []string {
+	probeImagick()
+	return probedFormats
+}
+
+func (converter imagickConverter) Resize(fileName string, quality uint) (result Result, resizeError error) {
+	quality = normalizeQuality(quality)
+	initializeImagick(nil)
 	var err error
 
 	mw := imagick.NewMagickWand()
@@ -21,8 +79,9 @@ func Resize(fileName string) (resizeError error) {
 
 	err = mw.ReadImage(fileName)
 	if err != nil {
-		return err
+		return result, err
 	}
+	format := mw.GetImageFormat()
 
 	// Get original logo size
 	width := mw.GetImageWidth()
@@ -38,21 +97,45 @@ func Resize(fileName string) (resizeError error) {
 	err = mw.ResizeImage(hWidth, hHeight, imagick.FILTER_LANCZOS, 1)
 	if err != nil {
 		log.Printf("Error resizing image: %v", err)
-		return err
+		return result, err
 	}
 
-	// Set the compression quality to 95 (high quality = low compression)
-	err = mw.SetImageCompressionQuality(95)
+	// Higher quality means lower compression
+	err = mw.SetImageCompressionQuality(quality)
 	if err != nil {
 		log.Printf("Error setting compression quaility: %v", err)
-		return err
+		return result, err
+	}
+	outputFileName := outputFileNameFor(fileName)
+
+	log.Printf("Starting to convert image: %v", outputFileName)
+	err = mw.WriteImage(outputFileName)
+	if err != nil {
+		log.Printf("Error writing image: %v", err)
+		return result, err
+	}
+	// Read while the image is still in the pixel cache
+	resources := ResourceStats()
+
+	err = validate(outputFileName, hWidth, hHeight, format)
+	if err != nil {
+		log.Printf("Converted image failed validation: %v", err)
+		os.Remove(outputFileName)
+		return result, err
+	}
+	log.Printf("Finished converting image: %v", outputFileName)
+	for name, stat := range resources {
+		log.Printf("ImageMagick %s: %v of %v", name, stat.Used, stat.Limit)
 	}
-	fileExtension := filepath.Ext(fileName)
-	name := strings.TrimSuffix(fileName, fileExtension)
-	converteImageFileName := name + "-" + string(time.Now().Format(time.RFC850)) + fileExtension
-
-	log.Printf("Starting to convert image: %v", converteImageFileName)
-	mw.WriteImage("images/" + converteImageFileName)
-	log.Printf("Finished converting image: %v", converteImageFileName)
-	return nil
+	result = NewResult(outputFileName, converter, map[string]interface{}{
+		"operation": "resize",
+		"width":     hWidth,
+		"height":    hHeight,
+		"filter":    "lanczos",
+		"blur":      1,
+		"quality":   quality,
+		"format":    format,
+	})
+	result.Resources = resources
+	return result, nil
 }
@@ -0,0 +1,84 @@
+//go:build !noimagick
+
+package imageConverter
+
+import (
+	"log"
+	"sync"
+
+	"github.com/gographics/imagick/imagick"
+	"github.com/thejsj/veenco/config"
+)
+
+// resourceLimits maps each ImageMagick resource to the setting that limits
+// it. Area is in pixels, memory, map and disk are in bytes, thread is a
+// count. Unset or zero leaves ImageMagick's own default in place.
+var resourceLimits = []struct {
+	name     string
+	setting  string
+	resource imagick.ResourceType
+}{
+	{"area", "IMAGICK_AREA_LIMIT", imagick.RESOURCE_AREA},
+	{"memory", "IMAGICK_MEMORY_LIMIT", imagick.RESOURCE_MEMORY},
+	{"map", "IMAGICK_MAP_LIMIT", imagick.RESOURCE_MAP},
+	{"disk", "IMAGICK_DISK_LIMIT", imagick.RESOURCE_DISK},
+	{"thread", "IMAGICK_THREAD_LIMIT", imagick.RESOURCE_THREAD},
+}
+
+// serverResourceDefaults bound previews and renders when nothing is
+// configured, as they decode untrusted images inside the API process. An
+// image over the area limit is cached on disk, and the disk limit then fails
+// it instead of letting it take the server's memory.
+var serverResourceDefaults = map[string]int64{
+	"area":   64 << 20,
+	"memory": 256 << 20,
+	"map":    512 << 20,
+	"disk":   1 << 30,
+}
+
+// ImageMagick is set up once per process and never torn down, as tearing it
+// down in the middle of a concurrent conversion or preview would break it
+var initializeOnce sync.Once
+
+// initializeImagick sets ImageMagick up and applies the resource limits the
+// first time it is called. The first caller's defaults apply to the whole
+// process: the server only previews, with serverResourceDefaults, and the
+// worker only converts, with ImageMagick's own.
+func initializeImagick(defaults map[string]int64) {
+	initializeOnce.Do(func() {
+		imagick.Initialize()
+		ConfigureResources(defaults)
+	})
+}
+
+// ConfigureResources applies the configured limits, falling back to
+// defaults for the ones that aren't set. It must be called after
+// imagick.Initialize, which initializeImagick takes care of.
+func ConfigureResources(defaults map[string]int64) {
+	for _, limit := range resourceLimits {
+		value := int64(config.Int(limit.setting, 0))
+		if value <= 0 {
+			value = defaults[limit.name]
+		}
+		if value <= 0 {
+			continue
+		}
+		err := imagick.SetResourceLimit(limit.resource, value)
+		if err != nil {
+			log.Printf("Error setting ImageMagick %s limit to %v: %v", limit.name, value, err)
+		}
+	}
+}
+
+// ResourceStats reports the pixel cache's current use of each limited
+// resource
+func ResourceStats() map[string]ResourceStat {
+	stats := map[string]ResourceStat{}
+	for _, limit := range resourceLimits {
+		stats[limit.name] = ResourceStat{
+			Used:  imagick.GetResource(limit.resource),
+			Limit: imagick.GetResourceLimit(limit.resource),
+		}
+	}
+	return stats
+}
@@ -0,0 +1,58 @@
+package imageConverter
+
+import (
+	"encoding/json"
+	"io/ioutil"
+)
+
+// Result describes a converted file along with the exact backend, library
+// version and normalized parameters used, so the output can be reproduced
+type Result struct {
+	FileName       string                 `json:"fileName"`
+	Backend        string                 `json:"backend"`
+	BackendVersion string                 `json:"backendVersion"`
+	Parameters     map[string]interface{} `json:"parameters"`
+	Usage          *Usage                 `json:"usage,omitempty"`
+	// ImageMagick's resource use and limits right after writing the output
+	Resources map[string]ResourceStat `json:"resources,omitempty"`
+}
+
+func NewResult(fileName string, converter Converter, parameters map[string]interface{}) Result {
+	version, _ := converter.Version()
+	return Result{
+		FileName:       fileName,
+		Backend:        converter.Name(),
+		BackendVersion: version,
+		Parameters:     parameters,
+	}
+}
+
+// ResourceStat is how much of a resource the pixel cache is using against
+// its limit
+type ResourceStat struct {
+	Used  int64 `json:"used"`
+	Limit int64 `json:"limit"`
+}
+
+// WriteSidecar stores the result as JSON next to the converted file
+func (result Result) WriteSidecar() (string, error) {
+	sidecarFileName := result.FileName + ".json"
+	encoded, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	return sidecarFileName, ioutil.WriteFile(sidecarFileName, encoded, 0644)
+}
+
+// Record is the result as stored on a job record, without the local file
+// name
+func (result Result) Record() (map[string]interface{}, error) {
+	encoded, err := json.Marshal(result)
+	if err != nil {
+		return nil, err
+	}
+	var record map[string]interface{}
+	err = json.Unmarshal(encoded, &record)
+	delete(record, "fileName")
+	return record, err
+}
@@ -0,0 +1,23 @@
+package imageConverter
+
+import "testing"
+
+func TestResultRecord(t *testing.T) {
+	result := Result{
+		FileName:       "/tmp/a.jpg",
+		Backend:        "go",
+		BackendVersion: "1",
+		Parameters:     map[string]interface{}{"quality": 80},
+		Usage:          &Usage{WallTimeMs: 5},
+	}
+	record, err := result.Record()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := record["fileName"]; ok {
+		t.Errorf("Expected the local file name to be left out, got %v", record)
+	}
+	if record["backend"] != "go" || record["backendVersion"] != "1" || record["usage"] == nil {
+		t.Errorf("Expected the backend and usage to be recorded, got %v", record)
+	}
+}
@@ -0,0 +1,41 @@
+package imageConverter
+
+import (
+	"syscall"
+	"time"
+)
+
+// Usage is the resources spent on one conversion. Conversions run in the
+// worker's own process one at a time, so CPU time is the difference in the
+// process's usage around the conversion. MaxRssKb is the process's peak
+// resident set so far: a high-water mark rather than a figure for this job
+// alone, so it only shows a job when that job raised it.
+type Usage struct {
+	WallTimeMs   int64 `json:"wallTimeMs"`
+	UserTimeMs   int64 `json:"userTimeMs"`
+	SystemTimeMs int64 `json:"systemTimeMs"`
+	MaxRssKb     int64 `json:"maxRssKb"`
+}
+
+// MeasureUsage runs the conversion and reports what it used
+func MeasureUsage(convert func() error) (Usage, error) {
+	var before, after syscall.Rusage
+	syscall.Getrusage(syscall.RUSAGE_SELF, &before)
+	start := time.Now()
+
+	err := convert()
+
+	wallTime := time.Since(start)
+	syscall.Getrusage(syscall.RUSAGE_SELF, &after)
+	return Usage{
+		WallTimeMs:   int64(wallTime / time.Millisecond),
+		UserTimeMs:   timevalMs(after.Utime) - timevalMs(before.Utime),
+		SystemTimeMs: timevalMs(after.Stime) - timevalMs(before.Stime),
+		// Linux reports ru_maxrss in kilobytes
+		MaxRssKb: int64(after.Maxrss),
+	}, err
+}
+
+func timevalMs(tv syscall.Timeval) int64 {
+	return tv.Nano() / int64(time.Millisecond)
+}
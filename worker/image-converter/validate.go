@@ -0,0 +1,36 @@
+//go:build !noimagick
+
+package imageConverter
+
+import (
+	"fmt"
+
+	"github.com/gographics/imagick/imagick"
+)
+
+// validate re-opens a converted file and checks that it is non-empty,
+// decodes, and has the expected dimensions and format. ImageMagick must
+// already be initialized.
+func validate(fileName string, width uint, height uint, format string) error {
+	err := checkNotEmpty(fileName)
+	if err != nil {
+		return err
+	}
+
+	mw := imagick.NewMagickWand()
+	defer mw.Destroy()
+
+	// ReadImage decodes the pixel data, catching truncated output that
+	// reading the header alone would miss
+	err = mw.ReadImage(fileName)
+	if err != nil {
+		return fmt.Errorf("%s does not decode: %s", fileName, err)
+	}
+	if mw.GetImageWidth() != width || mw.GetImageHeight() != height {
+		return fmt.Errorf("%s is %vx%v, expected %vx%v", fileName, mw.GetImageWidth(), mw.GetImageHeight(), width, height)
+	}
+	if format != "" && mw.GetImageFormat() != format {
+		return fmt.Errorf("%s is %s, expected %s", fileName, mw.GetImageFormat(), format)
+	}
+	return nil
+}
@@ -0,0 +1,97 @@
+package imageConverter
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// vipsConverter runs the libvips command line tools, which are available on
+// nodes, ARM ones included, where ImageMagick isn't. It is only used when
+// `vips` is on the PATH.
+type vipsConverter struct{}
+
+func init() {
+	register(vipsConverter{})
+}
+
+func (vipsConverter) Name() string {
+	return "vips"
+}
+
+func (vipsConverter) Version() (string, error) {
+	output, err := exec.Command("vips", "--version").Output()
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+func (vipsConverter) Formats() []string {
+	return []string{"jpeg", "png", "gif", "webp", "tiff"}
+}
+
+// vipsHeader reads a field such as `width` from an image's header
+func vipsHeader(fileName string, field string) (string, error) {
+	output, err := exec.Command("vipsheader", "-f", field, fileName).Output()
+	return strings.TrimSpace(string(output)), err
+}
+
+func vipsDimensions(fileName string) (int, int, error) {
+	width, err := vipsHeader(fileName, "width")
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s does not decode: %s", fileName, err)
+	}
+	height, err := vipsHeader(fileName, "height")
+	if err != nil {
+		return 0, 0, fmt.Errorf("%s does not decode: %s", fileName, err)
+	}
+	parsedWidth, _ := strconv.Atoi(width)
+	parsedHeight, _ := strconv.Atoi(height)
+	return parsedWidth, parsedHeight, nil
+}
+
+func (converter vipsConverter) Resize(fileName string, quality uint) (result Result, err error) {
+	quality = normalizeQuality(quality)
+	width, height, err := vipsDimensions(fileName)
+	if err != nil {
+		return result, err
+	}
+	log.Printf("With: %v / Height: %v", width, height)
+
+	outputFileName := outputFileNameFor(fileName)
+	log.Printf("Starting to convert image: %v", outputFileName)
+	// The saver takes its options after the file name; Q only applies to
+	// lossy formats and is ignored by the others
+	output, err := exec.Command("vips", "resize", fileName, fmt.Sprintf("%s[Q=%d]", outputFileName, quality), "0.5").CombinedOutput()
+	if err != nil {
+		os.Remove(outputFileName)
+		return result, fmt.Errorf("vips resize failed: %s: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	var outputWidth, outputHeight int
+	err = checkNotEmpty(outputFileName)
+	if err == nil {
+		outputWidth, outputHeight, err = vipsDimensions(outputFileName)
+		// vips rounds odd dimensions up rather than down
+		if err == nil && (outputWidth-width/2 > 1 || outputHeight-height/2 > 1 || outputWidth < width/2 || outputHeight < height/2) {
+			err = fmt.Errorf("%s is %vx%v, expected %vx%v", outputFileName, outputWidth, outputHeight, width/2, height/2)
+		}
+	}
+	if err != nil {
+		log.Printf("Converted image failed validation: %v", err)
+		os.Remove(outputFileName)
+		return result, err
+	}
+	log.Printf("Finished converting image: %v", outputFileName)
+	return NewResult(outputFileName, converter, map[string]interface{}{
+		"operation": "resize",
+		"width":     outputWidth,
+		"height":    outputHeight,
+		"filter":    "lanczos3",
+		"quality":   quality,
+	}), nil
+}
@@ -0,0 +1,188 @@
+package worker
+
+import (
+	"log"
+	"mime"
+	"os"
+	"path/filepath"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/thejsj/veenco/config"
+)
+
+// Job states, matching the ones the server stores
+const (
+	jobStatusPending   = "pending"
+	jobStatusRunning   = "running"
+	jobStatusCompleted = "completed"
+	jobStatusFailed    = "failed"
+	jobStatusExpired   = "expired"
+	jobStatusCancelled = "cancelled"
+)
+
+// Events recorded on a job's timeline, in the order they normally happen.
+// The server records `created` and `published` before these.
+const (
+	jobEventConsumed    = "consumed"
+	jobEventDownloading = "downloading"
+	jobEventConverting  = "converting"
+	jobEventUploading   = "uploading"
+	jobEventDone        = "done"
+	jobEventFailed      = "failed"
+	jobEventExpired     = "expired"
+	// A failed attempt that will be tried again
+	jobEventRetrying = "retrying"
+)
+
+// Converted files are uploaded under this prefix
+const outputKeyPrefix = "derivatives/"
+
+func jobIdArgs(jobIds []string) []interface{} {
+	args := make([]interface{}, len(jobIds))
+	for i, id := range jobIds {
+		args[i] = id
+	}
+	return args
+}
+
+// updateJobs sets fields on every job the message was queued for
+func updateJobs(session *r.Session, jobIds []string, fields map[string]interface{}) error {
+	if len(jobIds) == 0 {
+		return nil
+	}
+	return r.Table("jobs").GetAll(jobIdArgs(jobIds)...).Update(fields).Exec(session)
+}
+
+// withJobEvent adds an event to the job timeline along with the update's
+// other fields
+func withJobEvent(fields map[string]interface{}, event string, detail string) map[string]interface{} {
+	entry := map[string]interface{}{"event": event, "at": time.Now()}
+	if detail != "" {
+		entry["detail"] = detail
+	}
+	// Only the latest JOB_MAX_EVENTS are kept, like the server does
+	fields["events"] = r.Row.Field("events").Default([]interface{}{}).Append(entry).Slice(-config.Int("JOB_MAX_EVENTS", 50))
+	return fields
+}
+
+// recordJobEvent adds an event to the timeline of every job the message was
+// queued for. The timeline is informational, so failures are only logged.
+func recordJobEvent(session *r.Session, jobIds []string, event string, detail string) {
+	err := updateJobs(session, jobIds, withJobEvent(map[string]interface{}{}, event, detail))
+	if err != nil {
+		log.Printf("Error recording %s event: %v", event, err)
+	}
+}
+
+// jobsCancelled reports whether every job the message was queued for has
+// been cancelled, e.g. because its image was deleted
+func jobsCancelled(session *r.Session, jobIds []string) (bool, error) {
+	if len(jobIds) == 0 {
+		return false, nil
+	}
+	cursor, err := r.Table("jobs").GetAll(jobIdArgs(jobIds)...).Filter(
+		r.Row.Field("status").Default("").Ne(jobStatusCancelled),
+	).Count().Run(session)
+	if err != nil {
+		return false, err
+	}
+	defer cursor.Close()
+	var remaining int
+	err = cursor.One(&remaining)
+	return remaining == 0, err
+}
+
+// completedOutputs returns the output keys of the jobs that already
+// completed, by job id, so a redelivered task doesn't redo them
+func completedOutputs(session *r.Session, jobIds []string) (map[string]string, error) {
+	outputs := map[string]string{}
+	if len(jobIds) == 0 {
+		return outputs, nil
+	}
+	cursor, err := r.Table("jobs").GetAll(jobIdArgs(jobIds)...).Filter(
+		r.Row.Field("status").Default("").Eq(jobStatusCompleted),
+	).Pluck("id", "outputKey").Run(session)
+	if err != nil {
+		return outputs, err
+	}
+	defer cursor.Close()
+	var jobs []struct {
+		Id        string `gorethink:"id"`
+		OutputKey string `gorethink:"outputKey"`
+	}
+	err = cursor.All(&jobs)
+	for _, job := range jobs {
+		if job.OutputKey != "" {
+			outputs[job.Id] = job.OutputKey
+		}
+	}
+	return outputs, err
+}
+
+// uploadOutput stores the converted file under the last job's id and returns
+// its key
+func uploadOutput(s3bucket *s3.Bucket, fileName string, jobIds []string, chainId string) (string, error) {
+	file, err := os.Open(fileName)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return "", err
+	}
+
+	extension := filepath.Ext(fileName)
+	key := outputKeyPrefix + jobIds[len(jobIds)-1] + extension
+	contentType := mime.TypeByExtension(extension)
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	headers := map[string][]string{"Content-Type": {contentType}}
+	if chainId != "" {
+		headers["X-Amz-Meta-Chain-Id"] = []string{chainId}
+	}
+	return key, s3bucket.PutReaderHeader(key, file, info.Size(), headers, s3.Private)
+}
+
+// readOnly reports whether the server is in read-only mode, either from
+// READ_ONLY or the admin's switch in the settings table
+func readOnly(session *r.Session) (bool, error) {
+	if config.Bool("READ_ONLY", false) {
+		return true, nil
+	}
+	cursor, err := r.Table("settings").Get("readOnly").Field("enabled").Default(false).Run(session)
+	if err != nil {
+		return false, err
+	}
+	defer cursor.Close()
+	var enabled bool
+	err = cursor.One(&enabled)
+	return enabled, err
+}
+
+// waitWhileReadOnly holds off the next task until read-only mode ends, so
+// maintenance doesn't race with job records and outputs being written. It
+// checks again every READ_ONLY_POLL_INTERVAL (5s by default).
+func waitWhileReadOnly(session *r.Session) {
+	waiting := false
+	for {
+		enabled, err := readOnly(session)
+		if err != nil {
+			log.Printf("Error checking read-only mode: %v", err)
+		}
+		if !enabled {
+			if waiting {
+				log.Printf("Read-only mode ended, resuming tasks")
+			}
+			return
+		}
+		if !waiting {
+			log.Printf("Read-only mode, waiting before taking the next task")
+			waiting = true
+		}
+		time.Sleep(config.Duration("READ_ONLY_POLL_INTERVAL", 5*time.Second))
+	}
+}
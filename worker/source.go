@@ -0,0 +1,48 @@
+package worker
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/mitchellh/goamz/s3"
+	"github.com/thejsj/veenco/errcode"
+	"github.com/thejsj/veenco/safehttp"
+	"github.com/thejsj/veenco/storage"
+)
+
+// fetchSource downloads the image to fileName. Images registered from
+// elsewhere are fetched from their source URL or foreign bucket on demand;
+// everything else comes from our bucket and is checked against the
+// image's sha256 when it is known.
+func fetchSource(s3bucket *s3.Bucket, key string, sourceUrl string, sha256 string, fileName string) error {
+	if sourceUrl == "" {
+		return errcode.Wrap(errcode.StorageUnavailable, DownloadFile(s3bucket, key, fileName, sha256))
+	}
+	if foreignBucket, foreignKey, ok := storage.ForeignObject(s3bucket, sourceUrl); ok {
+		return errcode.Wrap(errcode.SourceUnavailable, DownloadFile(foreignBucket, foreignKey, fileName, sha256))
+	}
+	return errcode.Wrap(errcode.SourceUnavailable, fetchUrl(sourceUrl, fileName))
+}
+
+func fetchUrl(sourceUrl string, fileName string) error {
+	res, err := safehttp.Get(sourceUrl)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("Fetching %s returned %s", sourceUrl, res.Status)
+	}
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(file, res.Body)
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
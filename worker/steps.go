@@ -0,0 +1,154 @@
+package worker
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/thejsj/veenco/config"
+	"github.com/thejsj/veenco/errcode"
+	"github.com/thejsj/veenco/worker/image-converter"
+)
+
+// TaskStep is one job of a task. It starts from the original when InputJob
+// is empty and from the output of the step with that job id otherwise,
+// which always comes earlier in the task.
+type TaskStep struct {
+	JobId    string `json:"jobId"`
+	InputJob string `json:"inputJob,omitempty"`
+	Quality  uint   `json:"quality,omitempty"`
+	// Set for operations jobs, which run the ops instead of a resize
+	Ops string `json:"ops,omitempty"`
+}
+
+// chainSteps runs the steps in order, handing each the source or the output
+// of its input step, and returns the outputs by job id. It stops at the
+// first step that fails.
+func chainSteps(steps []TaskStep, source string, run func(step TaskStep, input string) (string, error)) (map[string]string, error) {
+	outputs := map[string]string{}
+	for _, step := range steps {
+		input := source
+		if step.InputJob != "" {
+			var ok bool
+			input, ok = outputs[step.InputJob]
+			if !ok {
+				return outputs, errcode.Wrap(errcode.InvalidRequest, fmt.Errorf("Job %s starts from job %s, which isn't an earlier step", step.JobId, step.InputJob))
+			}
+		}
+		output, err := run(step, input)
+		if err != nil {
+			return outputs, err
+		}
+		outputs[step.JobId] = output
+	}
+	return outputs, nil
+}
+
+// runSteps converts the image once per step, uploading each step's output
+// as soon as it is done. Steps that completed on an earlier delivery aren't
+// run again; their uploaded output is downloaded instead when a later step
+// starts from it. When a step fails, it and the steps that haven't run yet
+// fail together.
+func runSteps(job ImageConverationPayloadJob, session *r.Session, s3bucket *s3.Bucket, lastAttempt bool) error {
+	sourceFileName, err := workPath(job.Name)
+	if err == nil {
+		defer useWorkFile(sourceFileName)()
+	}
+	completedKeys, err := completedOutputs(session, job.JobIds)
+	if err != nil {
+		log.Printf("Error loading completed steps: %v", err)
+	}
+	completed := map[string]bool{}
+	var pending []string
+	for _, step := range job.Steps {
+		if _, ok := completedKeys[step.JobId]; ok {
+			completed[step.JobId] = true
+		} else {
+			pending = append(pending, step.JobId)
+		}
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	err = updateJobs(session, pending, map[string]interface{}{
+		"status":    jobStatusRunning,
+		"startedAt": time.Now(),
+	})
+	if err != nil {
+		log.Printf("Error marking jobs as running: %v", err)
+	}
+	inputJobs := map[string]bool{}
+	for _, step := range job.Steps {
+		inputJobs[step.InputJob] = true
+	}
+
+	var outputs map[string]string
+	source, err := fetchWorkFile(job.Name, job.SourceUrl, job.Sha256, s3bucket, func(event string) {
+		recordJobEvent(session, pending, event, "")
+	})
+	if err == nil {
+		outputs, err = chainSteps(job.Steps, source, func(step TaskStep, input string) (string, error) {
+			stepIds := []string{step.JobId}
+			if outputKey, ok := completedKeys[step.JobId]; ok {
+				if !inputJobs[step.JobId] {
+					return "", nil
+				}
+				output, err := workPath(outputKey)
+				if err == nil {
+					err = DownloadFile(s3bucket, outputKey, output, "")
+				}
+				return output, errcode.Wrap(errcode.StorageUnavailable, err)
+			}
+			result, err := convertFile(input, step.Quality, step.Ops, func(event string) {
+				recordJobEvent(session, stepIds, event, "")
+			})
+			if err != nil {
+				return "", err
+			}
+			recordJobEvent(session, stepIds, jobEventUploading, "")
+			outputKey, err := uploadOutput(s3bucket, result.FileName, stepIds, job.ChainId)
+			if err != nil {
+				removeWorkFiles(result.FileName, result.FileName+".json")
+				return "", errcode.Wrap(errcode.StorageUnavailable, err)
+			}
+			err = completeJobs(session, s3bucket, job, stepIds, outputKey, result)
+			if err != nil {
+				log.Printf("Error marking job %s as completed: %v", step.JobId, err)
+			}
+			completed[step.JobId] = true
+			return result.FileName, nil
+		})
+	}
+	// Outputs are only needed by later steps; a retry downloads the ones
+	// that were uploaded and converts the rest again
+	for _, output := range outputs {
+		if output != "" {
+			removeWorkFiles(output, output+".json")
+		}
+	}
+
+	if err != nil {
+		var remaining []string
+		for _, step := range job.Steps {
+			if !completed[step.JobId] {
+				remaining = append(remaining, step.JobId)
+			}
+		}
+		failJobs(session, s3bucket, job, remaining, err, lastAttempt)
+		return err
+	}
+	removeWorkFiles(source)
+	return nil
+}
+
+// applyOps runs an operations job's ops on the file. The server already
+// checked them against the same TRANSFORMATION_MAX_PX.
+func applyOps(fileName string, ops string) (imageConverter.Result, error) {
+	operations, err := imageConverter.ParseOperations(ops, uint(config.Int("TRANSFORMATION_MAX_PX", 16384)))
+	if err != nil {
+		return imageConverter.Result{}, err
+	}
+	return imageConverter.ApplyOperations(fileName, operations)
+}
@@ -0,0 +1,62 @@
+package worker
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestChainStepsStartsFromInputOutput(t *testing.T) {
+	steps := []TaskStep{
+		{JobId: "first"},
+		{JobId: "second", InputJob: "first"},
+		{JobId: "branch"},
+	}
+	inputs := map[string]string{}
+	outputs, err := chainSteps(steps, "original.jpg", func(step TaskStep, input string) (string, error) {
+		inputs[step.JobId] = input
+		return step.JobId + ".jpg", nil
+	})
+	if err != nil {
+		t.Fatalf("chainSteps failed: %v", err)
+	}
+	expected := map[string]string{"first": "original.jpg", "second": "first.jpg", "branch": "original.jpg"}
+	for jobId, input := range expected {
+		if inputs[jobId] != input {
+			t.Errorf("Step %s started from %q, expected %q", jobId, inputs[jobId], input)
+		}
+		if outputs[jobId] != jobId+".jpg" {
+			t.Errorf("Step %s output %q, expected %q", jobId, outputs[jobId], jobId+".jpg")
+		}
+	}
+}
+
+func TestChainStepsStopsAtFailure(t *testing.T) {
+	steps := []TaskStep{
+		{JobId: "first"},
+		{JobId: "second", InputJob: "first"},
+	}
+	var ran []string
+	_, err := chainSteps(steps, "original.jpg", func(step TaskStep, input string) (string, error) {
+		ran = append(ran, step.JobId)
+		return "", errors.New("conversion failed")
+	})
+	if err == nil {
+		t.Fatal("Expected the failure to be returned")
+	}
+	if len(ran) != 1 {
+		t.Errorf("Expected only the first step to run, ran %v", ran)
+	}
+}
+
+func TestChainStepsRejectsLaterInput(t *testing.T) {
+	steps := []TaskStep{
+		{JobId: "first", InputJob: "second"},
+		{JobId: "second"},
+	}
+	_, err := chainSteps(steps, "original.jpg", func(step TaskStep, input string) (string, error) {
+		return step.JobId + ".jpg", nil
+	})
+	if err == nil {
+		t.Fatal("Expected a step starting from a later one to fail")
+	}
+}
@@ -0,0 +1,134 @@
+package worker
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/mitchellh/goamz/s3"
+	"github.com/thejsj/veenco/config"
+	"github.com/thejsj/veenco/errcode"
+	"github.com/thejsj/veenco/safehttp"
+)
+
+const webhookAttempts = 3
+
+type webhookDelivery struct {
+	callbackUrl string
+	payload     WebhookPayload
+}
+
+var (
+	webhookDeliveriesOnce sync.Once
+	webhookDeliveries     chan webhookDelivery
+)
+
+// queueWebhook hands the call to WEBHOOK_CONCURRENCY (4 by default)
+// senders, so slow receivers don't hold up the jobs behind them. Up to
+// WEBHOOK_QUEUE_SIZE (1000 by default) calls wait for a sender; past that
+// they are dropped and logged.
+func queueWebhook(callbackUrl string, payload WebhookPayload) {
+	webhookDeliveriesOnce.Do(func() {
+		webhookDeliveries = make(chan webhookDelivery, config.Int("WEBHOOK_QUEUE_SIZE", 1000))
+		for i := 0; i < config.Int("WEBHOOK_CONCURRENCY", 4); i++ {
+			go func() {
+				for delivery := range webhookDeliveries {
+					err := sendWebhook(delivery.callbackUrl, delivery.payload)
+					if err != nil {
+						log.Printf("Error calling webhook for job %s: %v", delivery.payload.JobId, err)
+					}
+				}
+			}()
+		}
+	})
+	select {
+	case webhookDeliveries <- webhookDelivery{callbackUrl: callbackUrl, payload: payload}:
+	default:
+		log.Printf("Dropping webhook for job %s, too many are waiting to be sent", payload.JobId)
+	}
+}
+
+// WebhookPayload is POSTed to a transformation's callback URL for each of
+// its jobs once they finish
+type WebhookPayload struct {
+	JobId     string       `json:"jobId"`
+	ImageId   string       `json:"imageId"`
+	ChainId   string       `json:"chainId,omitempty"`
+	Status    string       `json:"status"`
+	Error     string       `json:"error,omitempty"`
+	ErrorCode errcode.Code `json:"errorCode,omitempty"`
+	OutputUrl string       `json:"outputUrl,omitempty"`
+	SentAt    time.Time    `json:"sentAt"`
+}
+
+// WebhookSignature is the hex HMAC-SHA256 of the body using WEBHOOK_SECRET,
+// sent as `X-Enco-Signature: sha256=<signature>`
+func WebhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// notifyJobs calls the message's callback URL for each job in the
+// background. Failed calls are retried a few times and then only logged;
+// they never fail the job. Nothing is sent without WEBHOOK_SECRET, since
+// receivers couldn't verify it.
+func notifyJobs(job ImageConverationPayloadJob, s3bucket *s3.Bucket, status string, outputKey string, jobErr error) {
+	if job.CallbackUrl == "" {
+		return
+	}
+	if config.String("WEBHOOK_SECRET", "") == "" {
+		log.Printf("Not calling webhooks for jobs %v, WEBHOOK_SECRET isn't set", job.JobIds)
+		return
+	}
+	payload := WebhookPayload{ImageId: job.ImageId, ChainId: job.ChainId, Status: status}
+	if jobErr != nil {
+		payload.Error = jobErr.Error()
+		payload.ErrorCode = errcode.Of(jobErr)
+	}
+	if outputKey != "" {
+		payload.OutputUrl = s3bucket.SignedURL(outputKey, time.Now().Add(config.Duration("SIGNED_URL_TTL", time.Hour)))
+	}
+	for _, jobId := range job.JobIds {
+		payload.JobId = jobId
+		payload.SentAt = time.Now().UTC()
+		queueWebhook(job.CallbackUrl, payload)
+	}
+}
+
+func sendWebhook(callbackUrl string, payload WebhookPayload) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	secret := config.String("WEBHOOK_SECRET", "")
+
+	for attempt := 1; ; attempt++ {
+		req, err := http.NewRequest("POST", callbackUrl, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Enco-Signature", "sha256="+WebhookSignature(secret, body))
+		// Callback URLs come from callers, so they mustn't reach our network
+		res, err := safehttp.Do(req)
+		if err == nil {
+			res.Body.Close()
+			if res.StatusCode < 300 {
+				return nil
+			}
+			err = fmt.Errorf("Callback returned %s", res.Status)
+		}
+		if attempt == webhookAttempts {
+			return err
+		}
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
@@ -0,0 +1,201 @@
+package worker
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/thejsj/veenco/config"
+	"github.com/thejsj/veenco/worker/image-converter"
+)
+
+// Files removed by removeWorkFiles and the sweep, for the metrics
+var workFilesRemoved int64
+
+// Files running jobs are using, with how many use each. The sweep leaves
+// them alone.
+var (
+	workFilesMutex sync.Mutex
+	workFilesInUse = map[string]int{}
+)
+
+// workDir is where sources are downloaded and outputs written, read from
+// WORKER_WORK_DIR. It defaults to a directory of its own so the sweep never
+// touches anything the worker didn't create.
+func workDir() string {
+	return config.String("WORKER_WORK_DIR", filepath.Join(os.TempDir(), "enco-worker"))
+}
+
+// workPath returns where a source with the given key is stored, creating
+// its directory
+func workPath(key string) (string, error) {
+	path := filepath.Join(workDir(), filepath.Clean("/"+key))
+	return path, os.MkdirAll(filepath.Dir(path), 0755)
+}
+
+// useWorkFile marks the file as in use until the returned function is
+// called. It also counts the file's age from now, so a source that keeps
+// being reused, e.g. with task affinity, is swept by when it was last used
+// rather than when it was downloaded.
+func useWorkFile(fileName string) (release func()) {
+	workFilesMutex.Lock()
+	workFilesInUse[fileName]++
+	workFilesMutex.Unlock()
+	now := time.Now()
+	// Fails when the file hasn't been downloaded yet, which is fine
+	os.Chtimes(fileName, now, now)
+	return func() {
+		workFilesMutex.Lock()
+		defer workFilesMutex.Unlock()
+		workFilesInUse[fileName]--
+		if workFilesInUse[fileName] <= 0 {
+			delete(workFilesInUse, fileName)
+		}
+	}
+}
+
+// removeWorkFiles deletes files once they are no longer needed, logging
+// rather than failing the job when one can't be removed
+func removeWorkFiles(fileNames ...string) {
+	for _, fileName := range fileNames {
+		err := os.Remove(fileName)
+		if err == nil {
+			atomic.AddInt64(&workFilesRemoved, 1)
+		} else if !os.IsNotExist(err) {
+			log.Printf("Error removing %s: %v", fileName, err)
+		}
+	}
+}
+
+// sweepWorkDir removes files unused for longer than maxAge, which are left
+// behind by jobs that failed or by a worker that died mid-job. Files in use
+// are skipped however old they are.
+func sweepWorkDir(maxAge time.Duration) {
+	cutoff := time.Now().Add(-maxAge)
+	var stale []string
+	filepath.Walk(workDir(), func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() && info.ModTime().Before(cutoff) {
+			stale = append(stale, path)
+		}
+		return nil
+	})
+	// Held while removing, so a job can't start using a file in between
+	workFilesMutex.Lock()
+	defer workFilesMutex.Unlock()
+	unused := stale[:0]
+	for _, path := range stale {
+		if workFilesInUse[path] == 0 {
+			unused = append(unused, path)
+		}
+	}
+	stale = unused
+	if len(stale) > 0 {
+		log.Printf("Sweeping %d files older than %v from %s", len(stale), maxAge, workDir())
+		removeWorkFiles(stale...)
+	}
+}
+
+// sweepWorkDirPeriodically runs the sweep every WORKER_SWEEP_INTERVAL (10m
+// by default), removing files older than WORKER_FILE_MAX_AGE (1h)
+func sweepWorkDirPeriodically() {
+	for {
+		sweepWorkDir(config.Duration("WORKER_FILE_MAX_AGE", time.Hour))
+		time.Sleep(config.Duration("WORKER_SWEEP_INTERVAL", 10*time.Minute))
+	}
+}
+
+// workDirUsage totals the size and number of files in the work directory
+func workDirUsage() (bytes int64, files int64) {
+	filepath.Walk(workDir(), func(path string, info os.FileInfo, err error) error {
+		if err == nil && info.Mode().IsRegular() {
+			bytes += info.Size()
+			files++
+		}
+		return nil
+	})
+	return bytes, files
+}
+
+// ImageMagick's pixel cache use right after the latest conversion, and the
+// most each resource has used since the worker started. ImageMagick is torn
+// down between conversions, so its live numbers would always read zero.
+var (
+	wandStatsMutex sync.Mutex
+	wandStatsLast  = map[string]imageConverter.ResourceStat{}
+	wandStatsPeak  = map[string]int64{}
+)
+
+// recordWandStats keeps a conversion's resource use for the metrics. Only
+// ImageMagick reports any.
+func recordWandStats(resources map[string]imageConverter.ResourceStat) {
+	wandStatsMutex.Lock()
+	defer wandStatsMutex.Unlock()
+	for name, stat := range resources {
+		wandStatsLast[name] = stat
+		if stat.Used > wandStatsPeak[name] {
+			wandStatsPeak[name] = stat.Used
+		}
+	}
+}
+
+// writeWandMetrics writes the recorded resource use in the Prometheus text
+// format
+func writeWandMetrics(writer http.ResponseWriter) {
+	wandStatsMutex.Lock()
+	defer wandStatsMutex.Unlock()
+	if len(wandStatsLast) == 0 {
+		return
+	}
+	var names []string
+	for name := range wandStatsLast {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	fmt.Fprintf(writer, "# HELP enco_worker_imagick_resource_used ImageMagick pixel cache use after the latest conversion\n# TYPE enco_worker_imagick_resource_used gauge\n")
+	for _, name := range names {
+		fmt.Fprintf(writer, "enco_worker_imagick_resource_used{resource=%q} %d\n", name, wandStatsLast[name].Used)
+	}
+	fmt.Fprintf(writer, "# HELP enco_worker_imagick_resource_limit ImageMagick resource limit\n# TYPE enco_worker_imagick_resource_limit gauge\n")
+	for _, name := range names {
+		fmt.Fprintf(writer, "enco_worker_imagick_resource_limit{resource=%q} %d\n", name, wandStatsLast[name].Limit)
+	}
+	fmt.Fprintf(writer, "# HELP enco_worker_imagick_resource_peak Most ImageMagick pixel cache use seen after a conversion\n# TYPE enco_worker_imagick_resource_peak gauge\n")
+	for _, name := range names {
+		fmt.Fprintf(writer, "enco_worker_imagick_resource_peak{resource=%q} %d\n", name, wandStatsPeak[name])
+	}
+}
+
+// serveMetrics exposes the work directory's disk use, the converter backend
+// and ImageMagick's resource use in the Prometheus text format on WORKER_METRICS_ADDR, e.g.
+// ":9101", when it is set
+func serveMetrics() {
+	addr := config.String("WORKER_METRICS_ADDR", "")
+	if addr == "" {
+		return
+	}
+	http.HandleFunc("/metrics", func(writer http.ResponseWriter, req *http.Request) {
+		bytes, files := workDirUsage()
+		writer.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprintf(writer, "# HELP enco_worker_disk_usage_bytes Size of the files in the work directory\n# TYPE enco_worker_disk_usage_bytes gauge\nenco_worker_disk_usage_bytes %d\n", bytes)
+		fmt.Fprintf(writer, "# HELP enco_worker_disk_files Files in the work directory\n# TYPE enco_worker_disk_files gauge\nenco_worker_disk_files %d\n", files)
+		var stat syscall.Statfs_t
+		if syscall.Statfs(workDir(), &stat) == nil {
+			fmt.Fprintf(writer, "# HELP enco_worker_disk_free_bytes Space left on the work directory's filesystem\n# TYPE enco_worker_disk_free_bytes gauge\nenco_worker_disk_free_bytes %d\n", stat.Bavail*uint64(stat.Bsize))
+		}
+		if converter != nil {
+			version, _ := converter.Version()
+			fmt.Fprintf(writer, "# HELP enco_worker_converter_info Converter backend in use\n# TYPE enco_worker_converter_info gauge\nenco_worker_converter_info{backend=%q,version=%q} 1\n", converter.Name(), version)
+		}
+		writeWandMetrics(writer)
+		fmt.Fprintf(writer, "# HELP enco_worker_files_removed_total Work files removed after upload or by the sweep\n# TYPE enco_worker_files_removed_total counter\nenco_worker_files_removed_total %d\n", atomic.LoadInt64(&workFilesRemoved))
+	})
+	log.Printf("Serving worker metrics on %s", addr)
+	log.Fatal(http.ListenAndServe(addr, nil))
+}
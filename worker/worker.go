@@ -0,0 +1,403 @@
+package worker
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	r "github.com/dancannon/gorethink"
+	"github.com/mitchellh/goamz/s3"
+	"github.com/streadway/amqp"
+	"github.com/thejsj/veenco/chaos"
+	"github.com/thejsj/veenco/config"
+	"github.com/thejsj/veenco/database"
+	"github.com/thejsj/veenco/errcode"
+	"github.com/thejsj/veenco/queue"
+	"github.com/thejsj/veenco/storage"
+	"github.com/thejsj/veenco/worker/image-converter"
+)
+
+type ImageConverationPayloadJob struct {
+	Name string `json:"name"`
+	// Set for images registered without a copy in the bucket
+	SourceUrl string   `json:"sourceUrl,omitempty"`
+	ImageId   string   `json:"imageId,omitempty"`
+	JobIds    []string `json:"jobIds,omitempty"`
+	// The original's SHA-256, checked once it is downloaded; empty for
+	// images registered without a copy in the bucket
+	Sha256 string `json:"sha256,omitempty"`
+	// Output quality already bounded by the server's policy; 0 for default
+	Quality uint `json:"quality,omitempty"`
+	// Zero when the jobs don't expire
+	ExpiresAt time.Time `json:"expiresAt,omitempty"`
+	// Told about each job once it completes, fails or expires
+	CallbackUrl string `json:"callbackUrl,omitempty"`
+	// The image's chain id, passed on to outputs and webhook calls
+	ChainId string `json:"chainId,omitempty"`
+	// The jobs to run one by one, each with its own output. Tasks from
+	// before pipelines have none and convert once for all of JobIds.
+	Steps []TaskStep `json:"steps,omitempty"`
+}
+
+// converter runs the conversions, picked from the backends available on
+// this node when Work starts
+var converter imageConverter.Converter
+
+var errJobExpired = errcode.Wrap(errcode.JobTimeout, errors.New("The job expired before a worker could run it"))
+
+func failOnError(err error, msg string) {
+	if err != nil {
+		log.Fatalf("%s: %s", msg, err)
+		panic(fmt.Sprintf("%s: %s", msg, err))
+	}
+}
+
+// convertImage downloads the image unless it is already on disk and
+// converts it, telling stage about each step as it starts
+func convertImage(imageFilename string, sourceUrl string, sha256 string, quality uint, s3bucket *s3.Bucket, stage func(event string)) (result imageConverter.Result, err error) {
+	filenameForFile, err := fetchWorkFile(imageFilename, sourceUrl, sha256, s3bucket, stage)
+	if err != nil {
+		return result, err
+	}
+	return convertFile(filenameForFile, quality, "", stage)
+}
+
+// fetchWorkFile downloads the image into the work directory unless it is
+// already there, returning its path
+func fetchWorkFile(imageFilename string, sourceUrl string, sha256 string, s3bucket *s3.Bucket, stage func(event string)) (string, error) {
+	filenameForFile, err := workPath(imageFilename)
+	if err != nil {
+		return "", err
+	}
+
+	// Check if Video is already in HDD
+	if _, err := os.Stat(filenameForFile); os.IsNotExist(err) {
+		log.Printf("File not in memory. Starting Download: %s", filenameForFile)
+		stage(jobEventDownloading)
+		err := fetchSource(s3bucket, imageFilename, sourceUrl, sha256, filenameForFile)
+		if err != nil {
+			os.Remove(filenameForFile)
+			log.Printf("Error getting file (%s). Error: %s", imageFilename, err)
+			return "", err
+		}
+		log.Printf("Done downloading (%s) to: %s", imageFilename, filenameForFile)
+	}
+	return filenameForFile, nil
+}
+
+// convertFile converts a file in the work directory, writing the output and
+// its sidecar next to it
+func convertFile(filenameForFile string, quality uint, ops string, stage func(event string)) (result imageConverter.Result, err error) {
+	stage(jobEventConverting)
+	usage, err := imageConverter.MeasureUsage(func() (err error) {
+		if ops != "" {
+			result, err = applyOps(filenameForFile, ops)
+		} else {
+			result, err = converter.Resize(filenameForFile, quality)
+		}
+		return err
+	})
+	log.Printf("Conversion usage for %v: wall %vms, user %vms, system %vms, max rss %vkB", filenameForFile, usage.WallTimeMs, usage.UserTimeMs, usage.SystemTimeMs, usage.MaxRssKb)
+	if err != nil {
+		log.Printf("Error converting image %v", err)
+		return result, errcode.Wrap(errcode.InvalidImage, err)
+	}
+	result.Usage = &usage
+	recordWandStats(result.Resources)
+	_, err = result.WriteSidecar()
+	if err != nil {
+		log.Printf("Error writing conversion details for %v: %v", result.FileName, err)
+		return result, err
+	}
+	log.Printf("Image converted succesfully: %v (%v with %v %v)", filenameForFile, result.FileName, result.Backend, result.BackendVersion)
+	return result, nil
+}
+
+// maxAttempts is how many times a task is tried before it is dead lettered,
+// from JOB_MAX_ATTEMPTS (3 by default)
+func maxAttempts() int {
+	return config.Int("JOB_MAX_ATTEMPTS", 3)
+}
+
+// runJob converts the image for a message, keeping its job records up to
+// date when the message names them. A failure only fails the jobs and tells
+// their callbacks when it won't be retried.
+func runJob(job ImageConverationPayloadJob, session *r.Session, s3bucket *s3.Bucket, lastAttempt bool) error {
+	sourceFileName, err := workPath(job.Name)
+	if err == nil {
+		defer useWorkFile(sourceFileName)()
+	}
+	err = updateJobs(session, job.JobIds, map[string]interface{}{
+		"status":    jobStatusRunning,
+		"startedAt": time.Now(),
+	})
+	if err != nil {
+		log.Printf("Error marking jobs as running: %v", err)
+	}
+
+	result, err := convertImage(job.Name, job.SourceUrl, job.Sha256, job.Quality, s3bucket, func(event string) {
+		recordJobEvent(session, job.JobIds, event, "")
+	})
+	var outputKey string
+	if err == nil && len(job.JobIds) > 0 {
+		recordJobEvent(session, job.JobIds, jobEventUploading, "")
+		outputKey, err = uploadOutput(s3bucket, result.FileName, job.JobIds, job.ChainId)
+		err = errcode.Wrap(errcode.StorageUnavailable, err)
+		// The output is only needed until it is uploaded; a retry converts
+		// it again. Anything else left behind is removed by the sweep.
+		removeWorkFiles(result.FileName, result.FileName+".json")
+	}
+	if err != nil {
+		failJobs(session, s3bucket, job, job.JobIds, err, lastAttempt)
+		return err
+	}
+
+	if len(job.JobIds) > 0 {
+		// Keep the source around for retries until the jobs are done
+		removeWorkFiles(sourceFileName)
+	}
+	return completeJobs(session, s3bucket, job, job.JobIds, outputKey, result)
+}
+
+// failJobs records a failed attempt at the jobs. They go back to pending
+// when the task will be retried; otherwise they fail and their callbacks
+// are told.
+func failJobs(session *r.Session, s3bucket *s3.Bucket, job ImageConverationPayloadJob, jobIds []string, err error, lastAttempt bool) {
+	if !lastAttempt && errcode.Retryable(errcode.Of(err)) {
+		updateErr := updateJobs(session, jobIds, withJobEvent(map[string]interface{}{
+			"status": jobStatusPending,
+		}, jobEventRetrying, err.Error()))
+		if updateErr != nil {
+			log.Printf("Error marking jobs for retry: %v", updateErr)
+		}
+		return
+	}
+	updateErr := updateJobs(session, jobIds, withJobEvent(map[string]interface{}{
+		"status":      jobStatusFailed,
+		"error":       err.Error(),
+		"errorCode":   errcode.Of(err),
+		"completedAt": time.Now(),
+	}, jobEventFailed, err.Error()))
+	if updateErr != nil {
+		log.Printf("Error marking jobs as failed: %v", updateErr)
+	}
+	job.JobIds = jobIds
+	notifyJobs(job, s3bucket, jobStatusFailed, "", err)
+}
+
+// completeJobs records the jobs' output, along with the backend and
+// parameters that produced it, and tells their callbacks
+func completeJobs(session *r.Session, s3bucket *s3.Bucket, job ImageConverationPayloadJob, jobIds []string, outputKey string, result imageConverter.Result) error {
+	update := map[string]interface{}{
+		"status":      jobStatusCompleted,
+		"outputKey":   outputKey,
+		"completedAt": time.Now(),
+	}
+	conversion, err := result.Record()
+	if err != nil {
+		log.Printf("Error recording conversion details for %v: %v", result.FileName, err)
+	} else {
+		update["conversion"] = conversion
+	}
+	err = updateJobs(session, jobIds, withJobEvent(update, jobEventDone, ""))
+	job.JobIds = jobIds
+	notifyJobs(job, s3bucket, jobStatusCompleted, outputKey, nil)
+	return err
+}
+
+// settleFailedDelivery retries a failed task from the back of the queue, or
+// moves it to the dead letter queue once it can't succeed or has used up its
+// attempts. The delivery is only requeued as is when neither can be
+// published.
+func settleFailedDelivery(ch *amqp.Channel, d amqp.Delivery, err error, lastAttempt bool) {
+	var publishErr error
+	if lastAttempt || !errcode.Retryable(errcode.Of(err)) {
+		publishErr = queue.DeadLetter(ch, d, err.Error())
+	} else {
+		publishErr = queue.Retry(ch, d)
+	}
+	if publishErr != nil {
+		log.Printf("Error republishing failed task, requeueing it: %v", publishErr)
+		d.Nack(false, true)
+		return
+	}
+	d.Ack(false)
+}
+
+// Work consumes conversion jobs from the task queue until the connection
+// fails
+func Work() {
+	storageConfig := storage.ConfigFromEnv("S3")
+	if storageConfig.BucketName == "" {
+		storageConfig.BucketName = "hiphipjorge-video-encoding"
+	}
+	log.Printf("Accessing Bucket: %s", storageConfig.BucketName)
+	s3bucket, err := storageConfig.Bucket()
+	failOnError(err, "Failed to configure S3 bucket")
+
+	for _, compiled := range imageConverter.Compiled() {
+		version, err := compiled.Version()
+		if err != nil {
+			log.Printf("Converter backend unavailable: %s: %v", compiled.Name(), err)
+			continue
+		}
+		log.Printf("Converter backend available: %s %s (%s)", compiled.Name(), version, strings.Join(compiled.Formats(), ", "))
+	}
+	converter, err = imageConverter.Select()
+	failOnError(err, "Failed to select a converter backend")
+	log.Printf("Converting with: %s", converter.Name())
+
+	// Job records are updated as messages are processed
+	session, err := database.Connect()
+	failOnError(err, "Failed to connect to RethinkDB")
+
+	// Connect to RabbitMQ
+	conn, ch, err := queue.Dial()
+	failOnError(err, "Failed to connect to RabbitMQ")
+	defer conn.Close()
+
+	// Besides the shared queue, the worker takes tasks from the queue of
+	// every format its backend reads, and leaves the others to workers that
+	// can convert them
+	var queueNames []string
+	if queue.AffinityEnabled() {
+		affinityQueue, err := queue.DeclareAffinityQueue(ch)
+		failOnError(err, "Failed to declare a queue")
+		// The shared queue also gets the tasks that expired in the queue of
+		// a worker that went away
+		task_queue, err := queue.DeclareTaskQueue(ch)
+		failOnError(err, "Failed to declare a queue")
+		queueNames = append(queueNames, affinityQueue.Name, task_queue.Name)
+	} else {
+		task_queue, err := queue.DeclareTaskQueue(ch)
+		failOnError(err, "Failed to declare a queue")
+		err = queue.DeclareFormatQueues(ch)
+		failOnError(err, "Failed to declare the format queues")
+		queueNames = append(queueNames, task_queue.Name)
+		for _, format := range converter.Formats() {
+			for _, taskFormat := range queue.TaskFormats {
+				if format == taskFormat {
+					queueNames = append(queueNames, queue.FormatQueueName(format))
+				}
+			}
+		}
+	}
+	_, err = queue.DeclareDeadLetterQueue(ch)
+	failOnError(err, "Failed to declare the dead letter queue")
+	_, err = queue.DeclareDelayQueue(ch)
+	failOnError(err, "Failed to declare the delay queue")
+
+	// Global, so the prefetch is shared by the consumers of every queue
+	// and the worker holds one task at a time
+	err = ch.Qos(
+		1,    // prefetch count
+		0,    // prefetch size
+		true, // global
+	)
+	failOnError(err, "Failed to set QoS")
+
+	msgs := make(chan amqp.Delivery)
+	for _, queueName := range queueNames {
+		deliveries, err := ch.Consume(
+			queueName, // queue
+			"",        // consumer
+			false,     // auto-ack
+			false,     // exclusive
+			false,     // no-local
+			false,     // no-wait
+			nil,       // args
+		)
+		failOnError(err, "Failed to register a consumer")
+		log.Printf("Consuming tasks from %s", queueName)
+		go func() {
+			for d := range deliveries {
+				msgs <- d
+			}
+		}()
+	}
+
+	go sweepWorkDirPeriodically()
+	go serveMetrics()
+
+	forever := make(chan bool)
+
+	go func() {
+		for d := range msgs {
+			log.Printf("Received a message: %s", d.Body)
+			waitWhileReadOnly(session)
+			if !queue.CanProcess(d) {
+				// Leave it for an upgraded worker; this isn't a failure of the job.
+				// Delaying it keeps old workers from taking it back right away.
+				log.Printf("Delaying message requiring worker version %v (this is %v)", queue.MinWorkerVersion(d), queue.WorkerVersion)
+				err := queue.Delay(ch, d)
+				if err != nil {
+					log.Printf("Error delaying message, requeueing it: %v", err)
+					d.Nack(false, true)
+					continue
+				}
+				d.Ack(false)
+				continue
+			}
+			if chaos.Redeliver() {
+				d.Nack(false, true)
+				continue
+			}
+
+			var job ImageConverationPayloadJob
+			err := json.Unmarshal([]byte(d.Body), &job)
+			if err != nil {
+				// It can't succeed however often it is tried
+				log.Printf("Error unmarshalling JSON: %s (%s)", err, d.Body)
+				settleFailedDelivery(ch, d, errcode.Wrap(errcode.InvalidRequest, err), true)
+			} else {
+				recordJobEvent(session, job.JobIds, jobEventConsumed, "")
+				cancelled, err := jobsCancelled(session, job.JobIds)
+				if err != nil {
+					log.Printf("Error checking job status: %v", err)
+				}
+				if cancelled {
+					d.Ack(false)
+					log.Printf("Skipping cancelled jobs for image: %v", job.Name)
+					continue
+				}
+				if !job.ExpiresAt.IsZero() && time.Now().After(job.ExpiresAt) {
+					err = updateJobs(session, job.JobIds, withJobEvent(map[string]interface{}{
+						"status":      jobStatusExpired,
+						"error":       errJobExpired.Error(),
+						"errorCode":   errcode.JobTimeout,
+						"completedAt": time.Now(),
+					}, jobEventExpired, ""))
+					if err != nil {
+						log.Printf("Error marking jobs as expired: %v", err)
+					}
+					notifyJobs(job, s3bucket, jobStatusExpired, "", errJobExpired)
+					d.Ack(false)
+					log.Printf("Skipping expired jobs for image: %v", job.Name)
+					continue
+				}
+				log.Printf("Start Converting Image: %v", job.Name)
+				attempt := queue.Attempt(d) + 1
+				lastAttempt := attempt >= maxAttempts()
+				if len(job.Steps) > 0 {
+					err = runSteps(job, session, s3bucket, lastAttempt)
+				} else {
+					err = runJob(job, session, s3bucket, lastAttempt)
+				}
+				if err != nil {
+					log.Printf("Error Converting Image: %v (attempt %d): %v", job.Name, attempt, err)
+					settleFailedDelivery(ch, d, err, lastAttempt)
+					continue
+				}
+				d.Ack(false)
+				log.Printf("Done Converting Image: %v", job.Name)
+			}
+		}
+	}()
+
+	log.Printf(" [*] Waiting for messages. To exit press CTRL+C")
+	<-forever
+}